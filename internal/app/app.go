@@ -1,15 +1,16 @@
 package app
 
 import (
+	"context"
 	"embed"
 	"io/fs"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/filesystem"
-	"github.com/gofiber/fiber/v2/middleware/limiter"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	htmlEngine "github.com/gofiber/template/html/v2"
@@ -19,25 +20,46 @@ import (
 	"matcha/internal/handlers"
 	"matcha/internal/middleware"
 	"matcha/internal/services"
+	"matcha/internal/views"
 )
 
 // NewApp creates and configures a new Fiber application with all middleware and routes
 func NewApp(cfg *config.Config, db *gorm.DB, templateFS embed.FS, staticFS embed.FS) *fiber.App {
 	// Initialize authentication middleware
 	middleware.InitAuth(cfg)
+	handlers.InitPagination(cfg)
 
 	// Initialize services
 	emailService := services.NewEmailService(cfg, db)
+	emailService.UseQueue(services.EmailQueueSize)
 
 	// Initialize handlers
-	dashboardHandler := handlers.NewDashboardHandler(db)
-	usersHandler := handlers.NewUsersHandler(db)
+	dashboardHandler := handlers.NewDashboardHandler(db, cfg)
+	usersHandler := handlers.NewUsersHandler(db, cfg)
 	productsHandler := handlers.NewProductsHandler(db)
 	customersHandler := handlers.NewCustomersHandler(db)
-	licenseKeysHandler := handlers.NewLicenseKeysHandler(db)
-	settingsHandler := handlers.NewSettingsHandler(db)
-	apiHandler := handlers.NewAPIHandler(db)
+	licenseKeysHandler := handlers.NewLicenseKeysHandler(db, emailService, cfg.Location())
+	settingsHandler := handlers.NewSettingsHandler(db, emailService)
+	apiHandler := handlers.NewAPIHandler(db, emailService)
 	webhookHandler := handlers.NewWebhookHandler(db, emailService)
+	ssoHandler := handlers.NewSSOHandler(db, cfg, services.NewOIDCService(cfg))
+	webhookEventsHandler := handlers.NewWebhookEventsHandler(db, webhookHandler.Processor())
+
+	// Retry failed webhook events and deliver queued emails in the background
+	// until the app shuts down
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	workerDone := make(chan struct{})
+	go func() {
+		defer close(workerDone)
+		webhookHandler.Processor().Run(workerCtx, time.Minute)
+	}()
+	// The email queue stops last, since webhook retries may still queue emails
+	emailCtx, stopEmails := context.WithCancel(context.Background())
+	emailDone := make(chan struct{})
+	go func() {
+		defer close(emailDone)
+		emailService.RunQueue(emailCtx)
+	}()
 
 	// Initialize template engine - use filesystem in development, embedded in production
 	var engine *htmlEngine.Engine
@@ -52,24 +74,14 @@ func NewApp(cfg *config.Config, db *gorm.DB, templateFS embed.FS, staticFS embed
 	}
 
 	// Add template functions
-	engine.AddFunc("dict", func(values ...interface{}) map[string]interface{} {
-		dict := make(map[string]interface{})
-		for i := 0; i < len(values); i += 2 {
-			if i+1 < len(values) {
-				key, ok := values[i].(string)
-				if ok {
-					dict[key] = values[i+1]
-				}
-			}
-		}
-		return dict
-	})
+	engine.AddFuncMap(views.Funcs(cfg.Location(), cfg.AdminPath, cfg.IsEnabled))
 
 	engine.Debug(cfg.Debug)
 
 	// Initialize Fiber app
-	app := fiber.New(fiber.Config{
-		Views: engine,
+	app := fiber.New(middleware.TrustProxy(fiber.Config{
+		Views:     engine,
+		BodyLimit: cfg.BodyLimit,
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
 			code := fiber.StatusInternalServerError
 			if e, ok := err.(*fiber.Error); ok {
@@ -93,16 +105,28 @@ func NewApp(cfg *config.Config, db *gorm.DB, templateFS embed.FS, staticFS embed
 				})
 			}
 		},
+	}, cfg))
+
+	// Stop background workers and wait for webhooks still being processed once
+	// in-flight requests have drained
+	app.Hooks().OnShutdown(func() error {
+		stopWorkers()
+		<-workerDone
+		webhookHandler.Processor().Wait()
+		stopEmails()
+		<-emailDone
+		return nil
 	})
 
 	// Middleware
 	app.Use(recover.New())
+	app.Use(middleware.ForwardedClientIP(cfg))
 	app.Use(logger.New())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowHeaders: "Origin, Content-Type, Accept",
-		AllowMethods: "GET, POST, PUT, DELETE, OPTIONS",
-	}))
+	app.Use(middleware.RedirectHTTPS(cfg))
+	app.Use(middleware.CORS(cfg))
+
+	// Bound the database work of each request, see handlers' requestDB
+	app.Use(middleware.QueryTimeout(cfg.DBQueryTimeout))
 
 	// Add database to context
 	app.Use(func(c *fiber.Ctx) error {
@@ -110,6 +134,9 @@ func NewApp(cfg *config.Config, db *gorm.DB, templateFS embed.FS, staticFS embed
 		return c.Next()
 	})
 
+	// One-shot flash messages set before redirects
+	app.Use(middleware.Flash)
+
 	// Method override middleware for HTML forms
 	app.Use(func(c *fiber.Ctx) error {
 		if c.Method() == fiber.MethodPost {
@@ -124,27 +151,21 @@ func NewApp(cfg *config.Config, db *gorm.DB, templateFS embed.FS, staticFS embed
 		return c.Next()
 	})
 
-	// Rate limiting - stricter for API endpoints
-	app.Use("/api/v1/licenses/verify", limiter.New(limiter.Config{
-		Max:        60, // 60 requests per window
-		Expiration: 60, // 1 minute window
-		KeyGenerator: func(c *fiber.Ctx) string {
-			// Rate limit by IP address
-			return c.IP()
-		},
-		LimitReached: func(c *fiber.Ctx) error {
-			return c.Status(429).JSON(fiber.Map{
-				"error":   "Rate limit exceeded",
-				"message": "Too many license verification requests. Please try again later.",
-			})
-		},
-	}))
+	// Rate limit counters live in memory unless a shared store is configured
+	limiterStorage, err := middleware.NewRateLimitStorage(cfg)
+	if err != nil {
+		log.Printf("Rate limit store unavailable, falling back to in-memory counters: %v", err)
+		limiterStorage = nil
+	}
+	if limiterStorage != nil {
+		app.Hooks().OnShutdown(limiterStorage.Close)
+	}
+
+	// Rate limiting - stricter for API endpoints, with trusted callers exempt
+	app.Use("/api/v1/licenses/verify", middleware.VerifyRateLimiter(cfg, limiterStorage))
 
 	// General API rate limiting (more lenient)
-	app.Use("/api", limiter.New(limiter.Config{
-		Max:        300, // 300 requests per window
-		Expiration: 60,  // 1 minute window
-	}))
+	app.Use("/api", middleware.APIRateLimiter(cfg, limiterStorage))
 
 	// Static files - use filesystem in development, embedded in production
 	if cfg.IsDevelopment() {
@@ -159,37 +180,69 @@ func NewApp(cfg *config.Config, db *gorm.DB, templateFS embed.FS, staticFS embed
 	}
 
 	// Routes
-	setupRoutes(app, dashboardHandler, usersHandler, productsHandler, customersHandler, licenseKeysHandler, settingsHandler, apiHandler, webhookHandler)
+	setupRoutes(app, cfg, dashboardHandler, usersHandler, productsHandler, customersHandler, licenseKeysHandler, settingsHandler, apiHandler, webhookHandler, ssoHandler, webhookEventsHandler)
 
 	return app
 }
 
-func setupRoutes(app *fiber.App, dashboardHandler *handlers.DashboardHandler, usersHandler *handlers.UsersHandler, productsHandler *handlers.ProductsHandler, customersHandler *handlers.CustomersHandler, licenseKeysHandler *handlers.LicenseKeysHandler, settingsHandler *handlers.SettingsHandler, apiHandler *handlers.APIHandler, webhookHandler *handlers.WebhookHandler) {
+// Shutdown stops accepting connections and waits up to timeout for in-flight
+// requests to finish, then closes the database so SQLite can checkpoint its WAL
+// cleanly. Background workers are stopped by the app's shutdown hook.
+func Shutdown(app *fiber.App, db *gorm.DB, timeout time.Duration) error {
+	shutdownErr := app.ShutdownWithTimeout(timeout)
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	if err := sqlDB.Close(); err != nil {
+		return err
+	}
+
+	return shutdownErr
+}
+
+func setupRoutes(app *fiber.App, cfg *config.Config, dashboardHandler *handlers.DashboardHandler, usersHandler *handlers.UsersHandler, productsHandler *handlers.ProductsHandler, customersHandler *handlers.CustomersHandler, licenseKeysHandler *handlers.LicenseKeysHandler, settingsHandler *handlers.SettingsHandler, apiHandler *handlers.APIHandler, webhookHandler *handlers.WebhookHandler, ssoHandler *handlers.SSOHandler, webhookEventsHandler *handlers.WebhookEventsHandler) {
 	// Redirect root to admin dashboard
 	app.Get("/", func(c *fiber.Ctx) error {
-		return c.Redirect("/admin/")
+		return c.Redirect(middleware.AdminURL("/"))
 	})
 
 	// Admin routes
-	admin := app.Group("/admin")
+	admin := app.Group(cfg.AdminPath)
 
 	// Public admin routes (no auth required)
 	admin.Get("/login", usersHandler.LoginPage)
 	admin.Post("/login", usersHandler.Login)
 	admin.Get("/logout", usersHandler.Logout)
 
+	// External single sign-on, alongside local login
+	if cfg.OIDCEnabled() {
+		admin.Get("/login/sso", ssoHandler.Start)
+		admin.Get("/login/sso/callback", ssoHandler.Callback)
+	}
+
 	// Protected admin routes
 	admin.Get("/", middleware.RequireAuth, dashboardHandler.Dashboard)
+	admin.Get("/password", middleware.RequireAuth, usersHandler.ChangePasswordPage)
+	admin.Post("/password", middleware.RequireAuth, usersHandler.ChangePassword)
+	admin.Post("/account/theme", middleware.RequireAuth, usersHandler.UpdateTheme)
 
 	// Products
 	admin.Get("/products", middleware.RequireAuth, productsHandler.Index)
 	admin.Get("/products/new", middleware.RequireAuth, productsHandler.New)
 	admin.Post("/products", middleware.RequireAuth, productsHandler.Create)
+	admin.Post("/products/import", middleware.RequireAuth, productsHandler.Import)
 	admin.Get("/products/:id", middleware.RequireAuth, productsHandler.Show)
+	admin.Get("/products/:id/analytics", middleware.RequireAuth, productsHandler.Analytics)
 	admin.Get("/products/:id/edit", middleware.RequireAuth, productsHandler.Edit)
 	admin.Put("/products/:id", middleware.RequireAuth, productsHandler.Update)
 	admin.Post("/products/:id", middleware.RequireAuth, productsHandler.Update) // For form method override
 	admin.Delete("/products/:id", middleware.RequireAuth, productsHandler.Delete)
+	admin.Post("/products/:id/api-key", middleware.RequireAuth, productsHandler.RegenerateAPIKey)
+	admin.Delete("/products/:id/api-key", middleware.RequireAuth, productsHandler.RemoveAPIKey)
+	admin.Post("/products/:id/api-key/rate-limit", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, productsHandler.UpdateRateLimitExempt)
+	admin.Post("/products/:id/email-template", middleware.RequireAuth, productsHandler.UpdateEmailTemplate)
 
 	// Customers
 	admin.Get("/customers", middleware.RequireAuth, customersHandler.Index)
@@ -197,6 +250,7 @@ func setupRoutes(app *fiber.App, dashboardHandler *handlers.DashboardHandler, us
 	admin.Post("/customers", middleware.RequireAuth, customersHandler.Create)
 	admin.Get("/customers/:id", middleware.RequireAuth, customersHandler.Show)
 	admin.Get("/customers/:id/edit", middleware.RequireAuth, customersHandler.Edit)
+	admin.Get("/customers/:id/export", middleware.RequireAuth, customersHandler.Export)
 	admin.Put("/customers/:id", middleware.RequireAuth, customersHandler.Update)
 	admin.Post("/customers/:id", middleware.RequireAuth, customersHandler.Update) // For form method override
 	admin.Delete("/customers/:id", middleware.RequireAuth, customersHandler.Delete)
@@ -204,7 +258,10 @@ func setupRoutes(app *fiber.App, dashboardHandler *handlers.DashboardHandler, us
 	// License Keys
 	admin.Get("/license-keys", middleware.RequireAuth, licenseKeysHandler.Index)
 	admin.Get("/license-keys/new", middleware.RequireAuth, licenseKeysHandler.New)
+	admin.Get("/license-keys/search", middleware.RequireAuth, licenseKeysHandler.Search)
 	admin.Post("/license-keys", middleware.RequireAuth, licenseKeysHandler.Create)
+	admin.Post("/license-keys/bulk-email", middleware.RequireAuth, licenseKeysHandler.BulkEmail)
+	admin.Post("/license-keys/import", middleware.RequireAuth, licenseKeysHandler.Import)
 	admin.Get("/license-keys/:id", middleware.RequireAuth, licenseKeysHandler.Show)
 	admin.Get("/license-keys/:id/edit", middleware.RequireAuth, licenseKeysHandler.Edit)
 	admin.Put("/license-keys/:id", middleware.RequireAuth, licenseKeysHandler.Update)
@@ -212,21 +269,46 @@ func setupRoutes(app *fiber.App, dashboardHandler *handlers.DashboardHandler, us
 	admin.Delete("/license-keys/:id", middleware.RequireAuth, licenseKeysHandler.Delete)
 	admin.Post("/license-keys/:id/revoke", middleware.RequireAuth, licenseKeysHandler.Revoke)
 	admin.Post("/license-keys/:id/reactivate", middleware.RequireAuth, licenseKeysHandler.Reactivate)
+	admin.Post("/license-keys/:id/rotate", middleware.RequireAuth, licenseKeysHandler.Rotate)
+	admin.Post("/license-keys/:id/reset-activations", middleware.RequireAuth, licenseKeysHandler.ResetActivations)
+	admin.Get("/license-keys/:id/activations", middleware.RequireAuth, licenseKeysHandler.Activations)
+	admin.Delete("/license-keys/:id/activations/:deviceId", middleware.RequireAuth, licenseKeysHandler.Deactivate)
 	admin.Post("/license-keys/:id/send-email", middleware.RequireAuth, licenseKeysHandler.SendEmail)
+	admin.Post("/license-keys/:id/notes", middleware.RequireAuth, licenseKeysHandler.AddNote)
+
+	// Settings. Email delivery is shared by the whole instance, so only
+	// unscoped owners manage it.
+	admin.Get("/settings/email", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.ShowEmailSettings)
+	admin.Post("/settings/email", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.CreateEmailSettings)
+	admin.Post("/settings/email/test", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.TestEmailSettings)
+	admin.Post("/settings/email/:id", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.UpdateEmailSettings)
+	admin.Put("/settings/email/:id", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.UpdateEmailSettings)
+	admin.Post("/settings/email/:id/activate", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.ActivateEmailSettings)
+	admin.Delete("/settings/email/:id", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.DeleteEmailSettings)
+	admin.Get("/settings/templates", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.ShowEmailTemplates)
+	admin.Post("/settings/templates/:type", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.UpdateEmailTemplate)
+
+	// Webhook secrets, product mappings and received events
+	if cfg.IsEnabled(config.FeatureWebhooks) {
+		admin.Get("/settings/webhooks", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.ShowWebhookSettings)
+		admin.Post("/settings/webhooks/:provider", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.UpdateWebhookSettings)
+		admin.Post("/settings/webhooks/:provider/secondary", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.UpdateWebhookSecondarySecret)
+		admin.Post("/settings/webhooks/:provider/promote", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.PromoteWebhookSecret)
+		admin.Get("/settings/product-mappings", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.ShowProductMappings)
+		admin.Post("/settings/product-mappings", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.CreateProductMapping)
+		admin.Delete("/settings/product-mappings/:id", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.DeleteProductMapping)
+		admin.Get("/webhooks", middleware.RequireAuth, middleware.RequireUnscoped, webhookEventsHandler.Index)
+		admin.Get("/webhooks/simulate", middleware.RequireAuth, middleware.RequireUnscoped, webhookEventsHandler.SimulateForm)
+		admin.Post("/webhooks/simulate", middleware.RequireAuth, middleware.RequireUnscoped, webhookEventsHandler.Simulate)
+		admin.Get("/webhooks/:id", middleware.RequireAuth, middleware.RequireUnscoped, webhookEventsHandler.Show)
+		admin.Post("/webhooks/:id/retry", middleware.RequireAuth, middleware.RequireUnscoped, webhookEventsHandler.Retry)
+		admin.Post("/webhooks/:id/replay", middleware.RequireAuth, middleware.RequireUnscoped, webhookEventsHandler.Replay)
+	}
 
-	// Settings
-	admin.Get("/settings/email", middleware.RequireAuth, settingsHandler.ShowEmailSettings)
-	admin.Post("/settings/email", middleware.RequireAuth, settingsHandler.CreateEmailSettings)
-	admin.Post("/settings/email/:id", middleware.RequireAuth, settingsHandler.UpdateEmailSettings)
-	admin.Put("/settings/email/:id", middleware.RequireAuth, settingsHandler.UpdateEmailSettings)
-	admin.Post("/settings/email/:id/activate", middleware.RequireAuth, settingsHandler.ActivateEmailSettings)
-	admin.Delete("/settings/email/:id", middleware.RequireAuth, settingsHandler.DeleteEmailSettings)
-	admin.Post("/settings/email/test", middleware.RequireAuth, settingsHandler.TestEmailSettings)
-
-	// Email Configuration (legacy - keeping for compatibility)
-	admin.Get("/email-config", middleware.RequireAuth, dashboardHandler.EmailConfigPage)
-	admin.Post("/email-config", middleware.RequireAuth, dashboardHandler.EmailConfigUpdate)
-	admin.Post("/email-config/test", middleware.RequireAuth, dashboardHandler.EmailTestSend)
+	// Legacy single-configuration email routes, handled by the email settings
+	admin.Get("/email-config", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.EmailConfigPage)
+	admin.Post("/email-config", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.EmailConfigUpdate)
+	admin.Post("/email-config/test", middleware.RequireAuth, middleware.RequireUnscoped, middleware.RequireOwner, settingsHandler.TestEmailSettings)
 
 	// Catch-all for non-existent admin routes - must be last in admin group
 	admin.All("/*", func(c *fiber.Ctx) error {
@@ -237,12 +319,25 @@ func setupRoutes(app *fiber.App, dashboardHandler *handlers.DashboardHandler, us
 
 	// API routes
 	api := app.Group("/api/v1")
+	api.Post("/licenses", apiHandler.CreateLicense)
+	api.Post("/licenses/revoke", apiHandler.RevokeLicense)
 	api.Post("/licenses/verify", apiHandler.VerifyLicense)
+	api.Get("/licenses/verify", apiHandler.VerifyLicense) // For clients that can only GET
+	api.Post("/licenses/info", apiHandler.LicenseInfo)
+	api.Post("/licenses/heartbeat", apiHandler.Heartbeat)
+	api.Get("/products/:permalink", apiHandler.Product)
+	if cfg.IsEnabled(config.FeatureAPIDocs) {
+		api.Get("/openapi.json", apiHandler.OpenAPISpec)
+		app.Get("/api/docs", apiHandler.APIDocs)
+	}
 
 	// Webhook routes
-	api.Post("/webhooks/stripe", webhookHandler.StripeWebhook)
-	api.Post("/webhooks/gumroad", webhookHandler.GumroadWebhook)
-	api.Post("/webhooks/paypal", webhookHandler.PayPalWebhook)
+	if cfg.IsEnabled(config.FeatureWebhooks) {
+		webhookLimit := middleware.BodyLimit(cfg.WebhookBodyLimit)
+		api.Post("/webhooks/stripe", webhookLimit, webhookHandler.StripeWebhook)
+		api.Post("/webhooks/gumroad", webhookLimit, webhookHandler.GumroadWebhook)
+		api.Post("/webhooks/paypal", webhookLimit, webhookHandler.PayPalWebhook)
+	}
 
 	// 404 handler - must be last
 	app.Use(func(c *fiber.Ctx) error {
@@ -0,0 +1,193 @@
+package app
+
+import (
+	"embed"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"matcha/internal/config"
+	"matcha/internal/middleware"
+	"matcha/internal/models"
+	"matcha/internal/testutils"
+)
+
+func TestShutdown_DrainsInFlightRequests(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+
+	started := make(chan struct{})
+	var finished atomic.Bool
+
+	fiberApp := fiber.New(fiber.Config{DisableStartupMessage: true})
+	fiberApp.Get("/slow", func(c *fiber.Ctx) error {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		finished.Store(true)
+		return c.SendString("done")
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = fiberApp.Listener(ln) }()
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/slow")
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+
+	<-started
+	require.NoError(t, Shutdown(fiberApp, db, 5*time.Second))
+
+	assert.True(t, finished.Load(), "shutdown should wait for the in-flight request")
+	assert.Equal(t, http.StatusOK, <-status)
+
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	assert.Error(t, sqlDB.Ping(), "database should be closed after shutdown")
+}
+
+func TestNewApp_AdminPath(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+
+	// Development mode reads templates from ./templates at the repo root
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir("../.."))
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	cfg := config.New()
+	cfg.Environment = "development"
+	cfg.AdminPath = "/backstage"
+	t.Cleanup(func() { middleware.InitAuth(config.New()) })
+
+	fiberApp := NewApp(cfg, db, embed.FS{}, embed.FS{})
+	t.Cleanup(func() { _ = fiberApp.Shutdown() })
+
+	_, err = models.CreateDefaultAdmin(db, "admin", "bootstrap-pass")
+	require.NoError(t, err)
+	var admin models.AdminUser
+	require.NoError(t, db.Where("username = ?", "admin").First(&admin).Error)
+	require.NoError(t, db.Model(&admin).Update("must_change_password", false).Error)
+
+	get := func(path string, loggedIn bool) *http.Response {
+		req := httptest.NewRequest("GET", path, nil)
+		if loggedIn {
+			req.Header.Set("Cookie", middleware.SessionCookie(admin.ID))
+		}
+		resp, err := fiberApp.Test(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("AdminPath - Login Under Prefix", func(t *testing.T) {
+		resp := get("/backstage/login", false)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("AdminPath - Dashboard Under Prefix", func(t *testing.T) {
+		resp := get("/backstage/", true)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("AdminPath - Redirects Use Prefix", func(t *testing.T) {
+		resp := get("/backstage/", false)
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+		assert.Equal(t, "/backstage/login", resp.Header.Get("Location"))
+
+		resp = get("/", false)
+		assert.Equal(t, "/backstage/", resp.Header.Get("Location"))
+	})
+
+	t.Run("AdminPath - Default Prefix Not Served", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, get("/admin/login", false).StatusCode)
+		assert.Equal(t, http.StatusNotFound, get("/admin/", true).StatusCode)
+	})
+}
+
+func TestNewApp_Features(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir("../.."))
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	cfg := config.New()
+	cfg.Environment = "development"
+	cfg.Features = []string{config.FeatureAPIDocs}
+
+	fiberApp := NewApp(cfg, db, embed.FS{}, embed.FS{})
+	t.Cleanup(func() { _ = fiberApp.Shutdown() })
+
+	registered := func(method, path string) bool {
+		for _, route := range fiberApp.GetRoutes(true) {
+			if route.Method == method && route.Path == path {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("Features - Enabled Feature Registered", func(t *testing.T) {
+		assert.True(t, registered("GET", "/api/v1/openapi.json"))
+		assert.True(t, registered("GET", "/api/docs"))
+
+		resp, err := fiberApp.Test(httptest.NewRequest("GET", "/api/v1/openapi.json", nil))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Features - Disabled Feature Not Registered", func(t *testing.T) {
+		assert.False(t, registered("POST", "/api/v1/webhooks/stripe"))
+		assert.False(t, registered("GET", "/admin/webhooks"))
+		assert.False(t, registered("GET", "/admin/settings/webhooks"))
+
+		resp, err := fiberApp.Test(httptest.NewRequest("POST", "/api/v1/webhooks/stripe", nil))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestNewApp_InstanceSettingsRefuseTenants(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir("../.."))
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	cfg := config.New()
+	cfg.Environment = "development"
+	cfg.MultiTenant = true
+	t.Cleanup(func() { middleware.InitAuth(config.New()) })
+
+	fiberApp := NewApp(cfg, db, embed.FS{}, embed.FS{})
+	t.Cleanup(func() { _ = fiberApp.Shutdown() })
+
+	acme := uint(1)
+	tenant := models.AdminUser{Username: "acme-owner", PasswordHash: "x", Role: models.RoleOwner, OwnerID: &acme}
+	require.NoError(t, db.Create(&tenant).Error)
+
+	// Email delivery is shared by every tenant, so a tenant owner can't see or change it
+	for _, path := range []string{"/admin/settings/email", "/admin/settings/templates", "/admin/email-config"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Cookie", middleware.SessionCookie(tenant.ID))
+		resp, err := fiberApp.Test(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, path)
+	}
+}
@@ -0,0 +1,99 @@
+// Package cli holds the maintenance commands matcha runs instead of starting
+// the server, e.g. `matcha admin reset-password --username admin` for an
+// admin who is locked out. They work on the database directly.
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"gorm.io/gorm"
+
+	"matcha/internal/models"
+)
+
+// ErrUsage is returned for a command line that names no known command
+var ErrUsage = errors.New(`usage:
+  matcha admin create --username NAME [--password PASSWORD] [--role owner|support|readonly] [--owner-id ID]
+  matcha admin reset-password --username NAME [--password PASSWORD]
+Leave out --password to generate one, which must be changed on first login`)
+
+// Run executes the command in args, the program's arguments without its
+// name, and reports what it did to out
+func Run(db *gorm.DB, args []string, out io.Writer) error {
+	if len(args) < 2 || args[0] != "admin" {
+		return ErrUsage
+	}
+	switch args[1] {
+	case "create":
+		return createAdmin(db, args[2:], out)
+	case "reset-password":
+		return resetAdminPassword(db, args[2:], out)
+	default:
+		return ErrUsage
+	}
+}
+
+func createAdmin(db *gorm.DB, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("admin create", flag.ContinueOnError)
+	flags.SetOutput(out)
+	username := flags.String("username", "", "username to sign in with")
+	password := flags.String("password", "", "password; generated when left out")
+	role := flags.String("role", models.RoleOwner, "owner, support or readonly")
+	ownerID := flags.Uint("owner-id", 0, "tenant the admin is confined to when MULTI_TENANT is on")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *username == "" {
+		return errors.New("--username is required")
+	}
+
+	admin, generated, err := models.CreateAdmin(db, *username, *password, *role)
+	if err != nil {
+		return err
+	}
+	if *ownerID > 0 {
+		id := *ownerID
+		admin.OwnerID = &id
+		if err := db.Save(admin).Error; err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(out, "Created %s admin %q\n", admin.Role, admin.Username)
+	printGenerated(out, generated)
+	return nil
+}
+
+func resetAdminPassword(db *gorm.DB, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("admin reset-password", flag.ContinueOnError)
+	flags.SetOutput(out)
+	username := flags.String("username", "", "admin whose password to reset")
+	password := flags.String("password", "", "new password; generated when left out")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *username == "" {
+		return errors.New("--username is required")
+	}
+
+	generated, err := models.ResetAdminPassword(db, *username, *password)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("no admin is named %q", *username)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Reset the password of admin %q and cleared their failed logins\n", *username)
+	printGenerated(out, generated)
+	return nil
+}
+
+func printGenerated(out io.Writer, generated string) {
+	if generated != "" {
+		fmt.Fprintf(out, "Generated password: %s (it must be changed on first login)\n", generated)
+	}
+}
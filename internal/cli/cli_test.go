@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"matcha/internal/database"
+	"matcha/internal/models"
+)
+
+func setupTempDB(t *testing.T) *gorm.DB {
+	db, err := database.New(filepath.Join(t.TempDir(), "matcha.db"), database.Pragmas{}, database.Pool{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.AdminUser{}, &models.LoginThrottle{}))
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			_ = sqlDB.Close()
+		}
+	})
+	return db
+}
+
+func findAdmin(t *testing.T, db *gorm.DB, username string) models.AdminUser {
+	var admin models.AdminUser
+	require.NoError(t, db.Where("username = ?", username).First(&admin).Error)
+	return admin
+}
+
+func TestRun_AdminCreate(t *testing.T) {
+	t.Run("Create - With Password", func(t *testing.T) {
+		db := setupTempDB(t)
+		var out bytes.Buffer
+
+		err := Run(db, []string{"admin", "create", "--username", "ops", "--password", "recovery-pass", "--role", "support"}, &out)
+		require.NoError(t, err)
+		assert.Contains(t, out.String(), `Created support admin "ops"`)
+
+		admin := findAdmin(t, db, "ops")
+		assert.True(t, admin.CheckPassword("recovery-pass"))
+		assert.Equal(t, models.RoleSupport, admin.Role)
+		assert.False(t, admin.MustChangePassword, "a chosen password is kept")
+	})
+
+	t.Run("Create - Generated Password", func(t *testing.T) {
+		db := setupTempDB(t)
+		var out bytes.Buffer
+
+		require.NoError(t, Run(db, []string{"admin", "create", "--username", "ops", "--owner-id", "7"}, &out))
+		_, generated, found := strings.Cut(out.String(), "Generated password: ")
+		require.True(t, found, "the generated password is printed")
+		generated, _, _ = strings.Cut(generated, " ")
+
+		admin := findAdmin(t, db, "ops")
+		assert.True(t, admin.CheckPassword(generated))
+		assert.Equal(t, models.RoleOwner, admin.Role)
+		assert.True(t, admin.MustChangePassword)
+		require.NotNil(t, admin.OwnerID)
+		assert.Equal(t, uint(7), *admin.OwnerID)
+	})
+
+	t.Run("Create - Rejects Bad Input", func(t *testing.T) {
+		db := setupTempDB(t)
+		var out bytes.Buffer
+		require.NoError(t, Run(db, []string{"admin", "create", "--username", "ops", "--password", "recovery-pass"}, &out))
+
+		assert.ErrorIs(t, Run(db, []string{"admin", "create", "--username", "ops", "--password", "another-pass"}, &out), models.ErrAdminExists)
+		assert.Error(t, Run(db, []string{"admin", "create", "--username", "new", "--password", "short"}, &out))
+		assert.Error(t, Run(db, []string{"admin", "create", "--username", "new", "--role", "superuser"}, &out))
+		assert.Error(t, Run(db, []string{"admin", "create"}, &out))
+		assert.ErrorIs(t, Run(db, []string{"admin", "delete"}, &out), ErrUsage)
+	})
+}
+
+func TestRun_AdminResetPassword(t *testing.T) {
+	db := setupTempDB(t)
+	_, err := models.CreateDefaultAdmin(db, "admin", "forgotten-pass")
+	require.NoError(t, err)
+
+	// Lock the admin out with failed logins
+	policy := models.LoginThrottlePolicy{MaxFailures: 1, Window: time.Hour, Lockout: time.Hour}
+	keys := models.LoginThrottleKeys("admin", "203.0.113.9")
+	locked, err := models.RecordLoginFailure(db, keys, time.Now(), policy)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	var out bytes.Buffer
+	require.NoError(t, Run(db, []string{"admin", "reset-password", "--username", "admin", "--password", "a-new-password"}, &out))
+
+	admin := findAdmin(t, db, "admin")
+	assert.True(t, admin.CheckPassword("a-new-password"))
+	assert.False(t, admin.CheckPassword("forgotten-pass"))
+	assert.False(t, admin.MustChangePassword)
+
+	locked, err = models.LoginLocked(db, keys[:1], time.Now())
+	require.NoError(t, err)
+	assert.False(t, locked, "the username lockout is lifted")
+
+	err = Run(db, []string{"admin", "reset-password", "--username", "nobody"}, &out)
+	assert.ErrorContains(t, err, "no admin is named")
+}
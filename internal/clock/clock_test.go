@@ -0,0 +1,30 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	fake := NewFake(start)
+
+	if !fake.Now().Equal(start) {
+		t.Errorf("Expected %v, got %v", start, fake.Now())
+	}
+
+	fake.Advance(36 * time.Hour)
+	if want := start.Add(36 * time.Hour); !fake.Now().Equal(want) {
+		t.Errorf("Expected %v after advancing, got %v", want, fake.Now())
+	}
+
+	fake.Set(start)
+	if !fake.Now().Equal(start) {
+		t.Errorf("Expected %v after setting, got %v", start, fake.Now())
+	}
+
+	var _ Clock = Real{}
+	if (Real{}).Now().IsZero() {
+		t.Error("Expected the real clock to tell the time")
+	}
+}
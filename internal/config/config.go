@@ -2,8 +2,67 @@ package config
 
 import (
 	"fmt"
+	"log"
+	"net"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+)
+
+// Rate limiter defaults, applied when the corresponding setting is unset
+const (
+	DefaultVerifyRateLimit = 60
+	DefaultAPIRateLimit    = 300
+	DefaultRateLimitWindow = time.Minute
+)
+
+// Request body limits in bytes. Payment provider webhooks are a few KB.
+const (
+	DefaultBodyLimit        = 4 * 1024 * 1024
+	DefaultWebhookBodyLimit = 256 * 1024
+)
+
+// Admin index page sizes: the page size used when none is requested, and the
+// largest one a per_page param may ask for
+const (
+	DefaultPageSize    = 25
+	DefaultMaxPageSize = 100
+)
+
+// DefaultEmailFromName is the sender name when none is configured
+const DefaultEmailFromName = "Matcha"
+
+// SMTP delivery defaults. A stalled server is given up on after the timeout;
+// connection failures and 4xx replies are retried with a doubling delay.
+const (
+	DefaultSMTPTimeout    = 30 * time.Second
+	DefaultSMTPRetries    = 2
+	DefaultSMTPRetryDelay = 2 * time.Second
+)
+
+// DefaultDBQueryTimeout bounds the queries of one request. SQLite answers
+// license checks in milliseconds, so anything near this is stuck on a lock.
+const DefaultDBQueryTimeout = 5 * time.Second
+
+// DefaultAdminPath is where the admin panel is mounted when ADMIN_PATH is unset
+const DefaultAdminPath = "/admin"
+
+// Optional subsystems that FEATURES can switch off. Every one of them is on
+// when FEATURES is unset.
+const (
+	FeatureWebhooks = "webhooks" // Payment provider webhooks and their admin pages
+	FeatureAPIDocs  = "api_docs" // The OpenAPI spec and the API docs page
+)
+
+// KnownFeatures lists every feature name FEATURES accepts
+var KnownFeatures = []string{FeatureWebhooks, FeatureAPIDocs}
+
+// Admin login lockout defaults
+const (
+	DefaultLoginMaxAttempts   = 5
+	DefaultLoginAttemptWindow = 15 * time.Minute
+	DefaultLoginLockout       = 15 * time.Minute
 )
 
 type Config struct {
@@ -12,6 +71,112 @@ type Config struct {
 	DatabaseURL string
 	SecretKey   string
 	Debug       bool
+	Timezone    string
+
+	// SQLite pragmas added to DatabaseURL; parameters already in the URL win
+	SQLiteJournalMode string
+	SQLiteSynchronous string
+	SQLiteCacheSize   int
+
+	// Connection pool sizes; zero keeps the single SQLite connection
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+
+	// How long the database work of a single request may take before it is
+	// cancelled and the request fails
+	DBQueryTimeout time.Duration
+
+	// Largest request body accepted, in bytes; webhooks get the stricter
+	// WebhookBodyLimit since anyone can post to them
+	BodyLimit        int
+	WebhookBodyLimit int
+
+	// Rows per page on the admin indexes, and the most per_page may request
+	PageSize    int
+	MaxPageSize int
+
+	// How long shutdown waits for in-flight requests before closing connections
+	ShutdownTimeout time.Duration
+
+	// A license email identical to one sent successfully within this window is
+	// skipped rather than sent again; zero disables the check
+	EmailResendWindow time.Duration
+
+	// Sender name used when the active email settings leave From Name blank
+	EmailFromName string
+
+	// How long one SMTP attempt may take, from connecting to the server
+	// accepting the message, and how often a transient failure is retried
+	SMTPTimeout    time.Duration
+	SMTPRetries    int
+	SMTPRetryDelay time.Duration
+
+	// Optional subsystems that are switched on, see KnownFeatures
+	Features []string
+
+	// URL prefix the admin panel is served under, e.g. "/admin"; always has a
+	// leading slash and no trailing one
+	AdminPath string
+
+	// Bootstrap admin created on first start; a random password is generated when unset
+	AdminUsername string
+	AdminPassword string
+
+	// Scope the admin panel by tenant, so an admin with an owner ID only sees
+	// the products, customers and keys carrying it. Admins without one still
+	// see everything.
+	MultiTenant bool
+
+	// Failed admin logins allowed per username or IP within LoginAttemptWindow
+	// before further attempts are refused for LoginLockout
+	LoginMaxAttempts   int
+	LoginAttemptWindow time.Duration
+	LoginLockout       time.Duration
+
+	// Redirect plain HTTP requests to HTTPS; on by default in production. Turn
+	// it off behind a proxy that terminates TLS without setting
+	// X-Forwarded-Proto, or every request would loop back to itself.
+	ForceHTTPS bool
+
+	// Flags for the admin session cookie; Secure defaults to on in production
+	CookieSecure   bool
+	CookieSameSite string
+	SessionTTL     time.Duration
+
+	// Origins allowed to make cross-origin requests; "*" allows any origin but
+	// without credentials. Empty disables CORS.
+	AllowedOrigins []string
+
+	// Requests allowed per client IP within RateLimitWindow, for license
+	// verification and for the API as a whole
+	VerifyRateLimit int
+	APIRateLimit    int
+	RateLimitWindow time.Duration
+
+	// Where limiter counters live: "memory" (per process) or "redis", which
+	// shares them between instances and keeps them across restarts
+	RateLimitStore string
+	RedisURL       string
+
+	// Callers from these IPs bypass the rate limiters. Trusted API keys are
+	// marked on their product instead, see Product.RateLimitExempt
+	RateLimitExemptIPs []string
+
+	// Header a reverse proxy puts the client IP in, e.g. X-Forwarded-For or
+	// X-Real-IP. Empty uses the connection's address, which behind a proxy is
+	// the proxy's own. When TrustedProxies (IPs or CIDR ranges) is set, the
+	// header is only believed from those peers.
+	ProxyHeader    string
+	TrustedProxies []string
+
+	// OIDC single sign-on for the admin panel; disabled unless issuer and client ID are set
+	OIDCIssuer        string
+	OIDCClientID      string
+	OIDCClientSecret  string
+	OIDCRedirectURL   string
+	OIDCAutoProvision bool
+	OIDCDefaultRole   string
 }
 
 func New() *Config {
@@ -22,13 +187,236 @@ func New() *Config {
 		Port:        getEnv("PORT", "8080"),
 		SecretKey:   getEnv("SECRET_KEY", getDefaultSecretKey(env)),
 		Debug:       getBoolEnv("DEBUG", env == "development"),
+		Timezone:    getEnv("TIMEZONE", "UTC"),
+
+		SQLiteJournalMode: strings.ToUpper(getEnv("SQLITE_JOURNAL_MODE", "WAL")),
+		SQLiteSynchronous: strings.ToUpper(getEnv("SQLITE_SYNCHRONOUS", "NORMAL")),
+		SQLiteCacheSize:   getIntEnv("SQLITE_CACHE_SIZE", 1000),
+
+		DBMaxOpenConns:    getIntEnv("DB_MAX_OPEN_CONNS", 0),
+		DBMaxIdleConns:    getIntEnv("DB_MAX_IDLE_CONNS", 0),
+		DBConnMaxLifetime: getDurationEnv("DB_CONN_MAX_LIFETIME", 0),
+		DBQueryTimeout:    getDurationEnv("DB_QUERY_TIMEOUT", DefaultDBQueryTimeout),
+
+		BodyLimit:        getIntEnv("BODY_LIMIT", DefaultBodyLimit),
+		WebhookBodyLimit: getIntEnv("WEBHOOK_BODY_LIMIT", DefaultWebhookBodyLimit),
+
+		PageSize:    getIntEnv("PAGE_SIZE", DefaultPageSize),
+		MaxPageSize: getIntEnv("MAX_PAGE_SIZE", DefaultMaxPageSize),
+
+		ShutdownTimeout: getDurationEnv("SHUTDOWN_TIMEOUT", 30*time.Second),
+
+		EmailResendWindow: getDurationEnv("EMAIL_RESEND_WINDOW", 10*time.Minute),
+		EmailFromName:     getEnv("EMAIL_FROM_NAME", DefaultEmailFromName),
+
+		SMTPTimeout:    getDurationEnv("SMTP_TIMEOUT", DefaultSMTPTimeout),
+		SMTPRetries:    getIntEnv("SMTP_RETRIES", DefaultSMTPRetries),
+		SMTPRetryDelay: getDurationEnv("SMTP_RETRY_DELAY", DefaultSMTPRetryDelay),
+
+		LoginMaxAttempts:   getIntEnv("LOGIN_MAX_ATTEMPTS", DefaultLoginMaxAttempts),
+		LoginAttemptWindow: getDurationEnv("LOGIN_ATTEMPT_WINDOW", DefaultLoginAttemptWindow),
+		LoginLockout:       getDurationEnv("LOGIN_LOCKOUT", DefaultLoginLockout),
+
+		ForceHTTPS: getBoolEnv("FORCE_HTTPS", env == "production"),
+
+		CookieSecure:   getBoolEnv("COOKIE_SECURE", env == "production"),
+		CookieSameSite: getEnv("COOKIE_SAMESITE", "Lax"),
+		SessionTTL:     getDurationEnv("SESSION_TTL", 720*time.Hour),
+
+		AdminPath:     normalizeAdminPath(getEnv("ADMIN_PATH", DefaultAdminPath)),
+		AdminUsername: getEnv("ADMIN_USERNAME", "admin"),
+		AdminPassword: getEnv("ADMIN_PASSWORD", ""),
+
+		MultiTenant: getBoolEnv("MULTI_TENANT", false),
+
+		VerifyRateLimit: getIntEnv("VERIFY_RATE_LIMIT", DefaultVerifyRateLimit),
+		APIRateLimit:    getIntEnv("API_RATE_LIMIT", DefaultAPIRateLimit),
+		RateLimitWindow: getDurationEnv("RATE_LIMIT_WINDOW", DefaultRateLimitWindow),
+		RateLimitStore:  strings.ToLower(getEnv("RATE_LIMIT_STORE", "memory")),
+		RedisURL:        getEnv("REDIS_URL", ""),
+
+		RateLimitExemptIPs: getListEnv("RATE_LIMIT_EXEMPT_IPS"),
+
+		ProxyHeader:    getEnv("PROXY_HEADER", ""),
+		TrustedProxies: getListEnv("TRUSTED_PROXIES"),
+
+		OIDCIssuer:        getEnv("OIDC_ISSUER", ""),
+		OIDCClientID:      getEnv("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret:  getEnv("OIDC_CLIENT_SECRET", ""),
+		OIDCAutoProvision: getBoolEnv("OIDC_AUTO_PROVISION", false),
+		OIDCDefaultRole:   getEnv("OIDC_DEFAULT_ROLE", "readonly"),
 	}
 
 	cfg.DatabaseURL = getEnv("DATABASE_URL", getDefaultDatabaseURL(env))
+	cfg.OIDCRedirectURL = getEnv("OIDC_REDIRECT_URL", "http://localhost:8080"+cfg.AdminPath+"/login/sso/callback")
+
+	cfg.Features = getFeaturesEnv("FEATURES")
+
+	cfg.AllowedOrigins = getListEnv("ALLOWED_ORIGINS")
+	if cfg.AllowedOrigins == nil && env == "development" {
+		cfg.AllowedOrigins = []string{"*"}
+	}
 
 	return cfg
 }
 
+// Validate reports settings that would leave the app misbehaving at runtime
+func (c *Config) Validate() error {
+	if c.IsProduction() && isPlaceholderSecret(c.SecretKey) {
+		return fmt.Errorf("SECRET_KEY must be set in production; it signs sessions and encrypts stored secrets")
+	}
+	if c.SessionTTL <= 0 {
+		return fmt.Errorf("SESSION_TTL must be a positive duration, got %s", c.SessionTTL)
+	}
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("SHUTDOWN_TIMEOUT must be a positive duration, got %s", c.ShutdownTimeout)
+	}
+	if c.EmailResendWindow < 0 {
+		return fmt.Errorf("EMAIL_RESEND_WINDOW must not be negative, got %s", c.EmailResendWindow)
+	}
+	if c.SMTPTimeout <= 0 {
+		return fmt.Errorf("SMTP_TIMEOUT must be a positive duration, got %s", c.SMTPTimeout)
+	}
+	if c.SMTPRetries < 0 || c.SMTPRetryDelay < 0 {
+		return fmt.Errorf("SMTP_RETRIES and SMTP_RETRY_DELAY must not be negative, got %d and %s", c.SMTPRetries, c.SMTPRetryDelay)
+	}
+	switch c.SQLiteJournalMode {
+	case "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF":
+	default:
+		return fmt.Errorf("SQLITE_JOURNAL_MODE must be one of DELETE, TRUNCATE, PERSIST, MEMORY, WAL or OFF, got %q", c.SQLiteJournalMode)
+	}
+	switch c.SQLiteSynchronous {
+	case "OFF", "NORMAL", "FULL", "EXTRA":
+	default:
+		return fmt.Errorf("SQLITE_SYNCHRONOUS must be one of OFF, NORMAL, FULL or EXTRA, got %q", c.SQLiteSynchronous)
+	}
+	if c.DBMaxOpenConns < 0 || c.DBMaxIdleConns < 0 || c.DBConnMaxLifetime < 0 {
+		return fmt.Errorf("DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS and DB_CONN_MAX_LIFETIME must not be negative")
+	}
+	if c.DBQueryTimeout <= 0 {
+		return fmt.Errorf("DB_QUERY_TIMEOUT must be a positive duration, got %s", c.DBQueryTimeout)
+	}
+	if c.BodyLimit <= 0 || c.WebhookBodyLimit <= 0 {
+		return fmt.Errorf("BODY_LIMIT and WEBHOOK_BODY_LIMIT must be positive byte counts, got %d and %d", c.BodyLimit, c.WebhookBodyLimit)
+	}
+	if c.PageSize <= 0 || c.MaxPageSize < c.PageSize {
+		return fmt.Errorf("PAGE_SIZE must be positive and at most MAX_PAGE_SIZE, got %d and %d", c.PageSize, c.MaxPageSize)
+	}
+	if !strings.HasPrefix(c.AdminPath, "/") || c.AdminPath == "/" {
+		return fmt.Errorf("ADMIN_PATH must be a path below the site root such as /admin, got %q", c.AdminPath)
+	}
+	if c.AdminPath == "/api" || strings.HasPrefix(c.AdminPath, "/api/") {
+		return fmt.Errorf("ADMIN_PATH must not be under /api, got %q", c.AdminPath)
+	}
+	if c.LoginMaxAttempts <= 0 {
+		return fmt.Errorf("LOGIN_MAX_ATTEMPTS must be a positive number, got %d", c.LoginMaxAttempts)
+	}
+	if c.LoginAttemptWindow <= 0 || c.LoginLockout <= 0 {
+		return fmt.Errorf("LOGIN_ATTEMPT_WINDOW and LOGIN_LOCKOUT must be positive durations, got %s and %s", c.LoginAttemptWindow, c.LoginLockout)
+	}
+	if c.VerifyRateLimit <= 0 {
+		return fmt.Errorf("VERIFY_RATE_LIMIT must be a positive number, got %d", c.VerifyRateLimit)
+	}
+	if c.APIRateLimit <= 0 {
+		return fmt.Errorf("API_RATE_LIMIT must be a positive number, got %d", c.APIRateLimit)
+	}
+	if c.RateLimitWindow < time.Second {
+		return fmt.Errorf("RATE_LIMIT_WINDOW must be at least 1s, got %s", c.RateLimitWindow)
+	}
+	if len(c.TrustedProxies) > 0 && c.ProxyHeader == "" {
+		return fmt.Errorf("TRUSTED_PROXIES requires PROXY_HEADER to be set")
+	}
+	if c.ProxyHeader != "" && len(c.TrustedProxies) == 0 {
+		return fmt.Errorf("PROXY_HEADER requires TRUSTED_PROXIES to be set, or any client could pick its own IP")
+	}
+	for _, proxy := range c.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				return fmt.Errorf("TRUSTED_PROXIES entry %q is not an IP address or CIDR range", proxy)
+			}
+		}
+	}
+	for _, feature := range c.Features {
+		if !isKnownFeature(feature) {
+			return fmt.Errorf("FEATURES lists unknown feature %q; known features are %s", feature, strings.Join(KnownFeatures, ", "))
+		}
+	}
+	switch c.RateLimitStore {
+	case "", "memory":
+	case "redis":
+		if c.RedisURL == "" {
+			return fmt.Errorf("REDIS_URL is required when RATE_LIMIT_STORE=redis")
+		}
+	default:
+		return fmt.Errorf("RATE_LIMIT_STORE must be memory or redis, got %q", c.RateLimitStore)
+	}
+	return nil
+}
+
+// Location returns the configured display timezone, falling back to UTC when
+// the zone name cannot be loaded. Times are always stored in UTC.
+func (c *Config) Location() *time.Location {
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		log.Printf("Unknown timezone %q, falling back to UTC: %v", c.Timezone, err)
+		return time.UTC
+	}
+	return loc
+}
+
+// AllowsAnyOrigin reports whether CORS is open to every origin
+func (c *Config) AllowsAnyOrigin() bool {
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// OIDCEnabled reports whether external single sign-on is configured
+func (c *Config) OIDCEnabled() bool {
+	return c.OIDCIssuer != "" && c.OIDCClientID != ""
+}
+
+// IsEnabled reports whether an optional subsystem is switched on
+func (c *Config) IsEnabled(feature string) bool {
+	for _, enabled := range c.Features {
+		if enabled == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Redacted returns a loggable summary of the configuration with secrets masked
+func (c *Config) Redacted() string {
+	return fmt.Sprintf(
+		"Environment: %s, Port: %s, DatabaseURL: %s, SecretKey: %s, Debug: %v, Timezone: %s, AdminUsername: %s, AdminPassword: %s, AllowedOrigins: %v, OIDCIssuer: %s, OIDCClientSecret: %s, RateLimitStore: %s, RedisURL: %s, RateLimitExemptIPs: %v, ProxyHeader: %s, TrustedProxies: %v, Features: %v",
+		c.Environment, c.Port, c.DatabaseURL, Redact(c.SecretKey), c.Debug, c.Timezone,
+		c.AdminUsername, Redact(c.AdminPassword), c.AllowedOrigins,
+		c.OIDCIssuer, Redact(c.OIDCClientSecret), c.RateLimitStore, Redact(c.RedisURL), c.RateLimitExemptIPs, c.ProxyHeader, c.TrustedProxies, c.Features,
+	)
+}
+
+// String implements fmt.Stringer so printing a Config never leaks secrets
+func (c *Config) String() string {
+	return c.Redacted()
+}
+
+// Redact masks a secret for logging, keeping only a short prefix of long
+// values so different secrets can still be told apart
+func Redact(secret string) string {
+	switch {
+	case secret == "":
+		return "(not set)"
+	case len(secret) < 12:
+		return "****"
+	default:
+		return secret[:4] + "****"
+	}
+}
+
 func (c *Config) IsDevelopment() bool {
 	return c.Environment == "development"
 }
@@ -57,6 +445,77 @@ func getBoolEnv(key string, defaultValue bool) bool {
 	return defaultValue
 }
 
+// getIntEnv reads an integer, falling back on parse errors
+func getIntEnv(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err == nil {
+			return parsed
+		}
+		log.Printf("Invalid integer %s=%q, falling back to %d: %v", key, value, defaultValue, err)
+	}
+	return defaultValue
+}
+
+// getDurationEnv reads a duration such as "30s", falling back on parse errors
+func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err == nil {
+			return parsed
+		}
+		log.Printf("Invalid duration %s=%q, falling back to %s: %v", key, value, defaultValue, err)
+	}
+	return defaultValue
+}
+
+// getListEnv reads a comma-separated list, ignoring blank entries
+func getListEnv(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getFeaturesEnv reads the list of enabled features. Unset means all of them
+// and "none" means none; names are case-insensitive.
+func getFeaturesEnv(key string) []string {
+	values := getListEnv(key)
+	if values == nil {
+		return append([]string(nil), KnownFeatures...)
+	}
+	features := []string{}
+	for _, value := range values {
+		value = strings.ToLower(value)
+		if value != "none" {
+			features = append(features, value)
+		}
+	}
+	return features
+}
+
+func isKnownFeature(feature string) bool {
+	for _, known := range KnownFeatures {
+		if known == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeAdminPath gives an admin prefix a leading slash and drops any
+// trailing one, so "admin/" and "/admin" mean the same thing
+func normalizeAdminPath(path string) string {
+	path = strings.TrimRight(strings.TrimSpace(path), "/")
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
 func getDefaultDatabaseURL(env string) string {
 	switch env {
 	case "test":
@@ -68,11 +527,25 @@ func getDefaultDatabaseURL(env string) string {
 	}
 }
 
+// placeholderSecretPrefix starts the secret key production falls back to when
+// SECRET_KEY is unset, which Validate refuses
+const placeholderSecretPrefix = "CHANGE_ME_IN_PRODUCTION_"
+
 func getDefaultSecretKey(env string) string {
 	switch env {
 	case "production":
-		return "CHANGE_ME_IN_PRODUCTION_" + fmt.Sprintf("%d", os.Getpid())
+		return placeholderSecretPrefix + fmt.Sprintf("%d", os.Getpid())
 	default:
 		return "dev-secret-key-not-for-production"
 	}
 }
+
+// isPlaceholderSecret reports whether the secret key is unset or one of the
+// placeholders from the defaults or .env.example
+func isPlaceholderSecret(secret string) bool {
+	switch secret {
+	case "", "dev-secret-key-not-for-production", "your-secret-key-change-in-production":
+		return true
+	}
+	return strings.HasPrefix(secret, placeholderSecretPrefix)
+}
@@ -0,0 +1,298 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfig_RedactedHidesSecrets(t *testing.T) {
+	cfg := &Config{
+		Environment:      "production",
+		Port:             "8080",
+		SecretKey:        "super-secret-signing-key-123",
+		OIDCClientSecret: "oidc-client-secret-456",
+		AdminPassword:    "initial-admin-password-789",
+	}
+
+	for _, output := range []string{cfg.Redacted(), cfg.String(), fmt.Sprintf("%v", cfg)} {
+		if strings.Contains(output, cfg.SecretKey) {
+			t.Errorf("Redacted output leaks the secret key: %s", output)
+		}
+		if strings.Contains(output, cfg.OIDCClientSecret) {
+			t.Errorf("Redacted output leaks the OIDC client secret: %s", output)
+		}
+		if strings.Contains(output, cfg.AdminPassword) {
+			t.Errorf("Redacted output leaks the admin password: %s", output)
+		}
+		if !strings.Contains(output, "Environment: production") {
+			t.Errorf("Redacted output should keep non-secret fields: %s", output)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	cases := map[string]string{
+		"":                             "(not set)",
+		"short":                        "****",
+		"super-secret-signing-key-123": "supe****",
+	}
+	for secret, expected := range cases {
+		if got := Redact(secret); got != expected {
+			t.Errorf("Redact(%q) = %q, expected %q", secret, got, expected)
+		}
+	}
+}
+
+func TestNew_CookieSecureFollowsEnvironment(t *testing.T) {
+	t.Setenv("GO_ENV", "production")
+	if !New().CookieSecure {
+		t.Error("Cookies should be secure in production")
+	}
+
+	t.Setenv("GO_ENV", "development")
+	if New().CookieSecure {
+		t.Error("Cookies should not require HTTPS in development")
+	}
+
+	t.Setenv("COOKIE_SECURE", "true")
+	if !New().CookieSecure {
+		t.Error("COOKIE_SECURE should override the environment default")
+	}
+}
+
+func TestNew_ForceHTTPSFollowsEnvironment(t *testing.T) {
+	t.Setenv("GO_ENV", "production")
+	if !New().ForceHTTPS {
+		t.Error("HTTP should be redirected to HTTPS in production")
+	}
+
+	t.Setenv("FORCE_HTTPS", "false")
+	if New().ForceHTTPS {
+		t.Error("FORCE_HTTPS should override the environment default")
+	}
+
+	t.Setenv("GO_ENV", "development")
+	t.Setenv("FORCE_HTTPS", "")
+	if New().ForceHTTPS {
+		t.Error("HTTP should be served as is in development")
+	}
+}
+
+func TestNew_MultiTenantOffByDefault(t *testing.T) {
+	t.Setenv("MULTI_TENANT", "")
+	if New().MultiTenant {
+		t.Error("the admin panel should be single-tenant unless MULTI_TENANT is set")
+	}
+
+	t.Setenv("MULTI_TENANT", "true")
+	if !New().MultiTenant {
+		t.Error("MULTI_TENANT=true should scope the admin panel by tenant")
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	cfg := &Config{
+		SessionTTL:         time.Hour,
+		ShutdownTimeout:    time.Second,
+		VerifyRateLimit:    DefaultVerifyRateLimit,
+		APIRateLimit:       DefaultAPIRateLimit,
+		RateLimitWindow:    DefaultRateLimitWindow,
+		LoginMaxAttempts:   DefaultLoginMaxAttempts,
+		LoginAttemptWindow: DefaultLoginAttemptWindow,
+		LoginLockout:       DefaultLoginLockout,
+		SQLiteJournalMode:  "WAL",
+		SQLiteSynchronous:  "NORMAL",
+		BodyLimit:          DefaultBodyLimit,
+		WebhookBodyLimit:   DefaultWebhookBodyLimit,
+		DBQueryTimeout:     DefaultDBQueryTimeout,
+		SMTPTimeout:        DefaultSMTPTimeout,
+		PageSize:           DefaultPageSize,
+		MaxPageSize:        DefaultMaxPageSize,
+		AdminPath:          DefaultAdminPath,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected valid config, got %v", err)
+	}
+
+	cfg.SessionTTL = -time.Hour
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected a negative SESSION_TTL to be rejected")
+	}
+
+	cfg.SessionTTL = time.Hour
+	cfg.LoginMaxAttempts = 0
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected a zero LOGIN_MAX_ATTEMPTS to be rejected")
+	}
+
+	cfg.LoginMaxAttempts = DefaultLoginMaxAttempts
+	cfg.DBQueryTimeout = 0
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected a zero DB_QUERY_TIMEOUT to be rejected")
+	}
+
+	cfg.DBQueryTimeout = DefaultDBQueryTimeout
+	cfg.SMTPTimeout = 0
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected a zero SMTP_TIMEOUT to be rejected")
+	}
+
+	cfg.SMTPTimeout = DefaultSMTPTimeout
+	cfg.PageSize = DefaultMaxPageSize + 1
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected a PAGE_SIZE above MAX_PAGE_SIZE to be rejected")
+	}
+
+	cfg.PageSize = DefaultPageSize
+	cfg.SQLiteJournalMode = "JOURNAL"
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected an unknown SQLITE_JOURNAL_MODE to be rejected")
+	}
+
+	cfg.SQLiteJournalMode = "WAL"
+	cfg.Environment = "production"
+	for _, secret := range []string{"", "CHANGE_ME_IN_PRODUCTION_42", "your-secret-key-change-in-production"} {
+		cfg.SecretKey = secret
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected SECRET_KEY %q to be rejected in production", secret)
+		}
+	}
+	cfg.SecretKey = "a-real-production-secret"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected a set SECRET_KEY to be accepted in production, got %v", err)
+	}
+
+	t.Setenv("SQLITE_JOURNAL_MODE", "delete")
+	if got := New().SQLiteJournalMode; got != "DELETE" {
+		t.Errorf("Expected SQLITE_JOURNAL_MODE to be normalized, got %q", got)
+	}
+
+	t.Setenv("SESSION_TTL", "15m")
+	if got := New().SessionTTL; got != 15*time.Minute {
+		t.Errorf("Expected SESSION_TTL to be parsed, got %s", got)
+	}
+}
+
+func TestNew_AdminPath(t *testing.T) {
+	cfg := New()
+	if cfg.AdminPath != "/admin" || cfg.OIDCRedirectURL != "http://localhost:8080/admin/login/sso/callback" {
+		t.Errorf("Unexpected admin path defaults: path=%q redirect=%q", cfg.AdminPath, cfg.OIDCRedirectURL)
+	}
+
+	t.Setenv("ADMIN_PATH", "backstage/")
+	cfg = New()
+	if cfg.AdminPath != "/backstage" {
+		t.Errorf("Expected ADMIN_PATH to be normalized, got %q", cfg.AdminPath)
+	}
+	if cfg.OIDCRedirectURL != "http://localhost:8080/backstage/login/sso/callback" {
+		t.Errorf("Expected the SSO callback to follow ADMIN_PATH, got %q", cfg.OIDCRedirectURL)
+	}
+
+	for _, path := range []string{"/", "/api", "/api/admin"} {
+		t.Setenv("ADMIN_PATH", path)
+		if err := New().Validate(); err == nil {
+			t.Errorf("Expected ADMIN_PATH %q to be rejected", path)
+		}
+	}
+}
+
+func TestNew_Features(t *testing.T) {
+	cfg := New()
+	for _, feature := range KnownFeatures {
+		if !cfg.IsEnabled(feature) {
+			t.Errorf("Expected %q to be enabled by default", feature)
+		}
+	}
+
+	t.Setenv("FEATURES", "Webhooks, ")
+	cfg = New()
+	if !cfg.IsEnabled(FeatureWebhooks) || cfg.IsEnabled(FeatureAPIDocs) {
+		t.Errorf("Expected only webhooks to be enabled, got %v", cfg.Features)
+	}
+
+	t.Setenv("FEATURES", "none")
+	cfg = New()
+	if len(cfg.Features) != 0 || cfg.Validate() != nil {
+		t.Errorf("Expected FEATURES=none to disable every feature, got %v", cfg.Features)
+	}
+
+	t.Setenv("FEATURES", "webhooks,telepathy")
+	if err := New().Validate(); err == nil {
+		t.Error("Expected an unknown feature to be rejected")
+	}
+}
+
+func TestNew_RateLimits(t *testing.T) {
+	cfg := New()
+	if cfg.VerifyRateLimit != 60 || cfg.APIRateLimit != 300 || cfg.RateLimitWindow != time.Minute {
+		t.Errorf("Unexpected rate limit defaults: verify=%d api=%d window=%s", cfg.VerifyRateLimit, cfg.APIRateLimit, cfg.RateLimitWindow)
+	}
+
+	t.Setenv("VERIFY_RATE_LIMIT", "5")
+	t.Setenv("API_RATE_LIMIT", "50")
+	t.Setenv("RATE_LIMIT_WINDOW", "30s")
+	cfg = New()
+	if cfg.VerifyRateLimit != 5 || cfg.APIRateLimit != 50 || cfg.RateLimitWindow != 30*time.Second {
+		t.Errorf("Rate limits not parsed from env: verify=%d api=%d window=%s", cfg.VerifyRateLimit, cfg.APIRateLimit, cfg.RateLimitWindow)
+	}
+
+	t.Setenv("VERIFY_RATE_LIMIT", "lots")
+	if got := New().VerifyRateLimit; got != DefaultVerifyRateLimit {
+		t.Errorf("Expected an invalid VERIFY_RATE_LIMIT to fall back to the default, got %d", got)
+	}
+
+	t.Setenv("VERIFY_RATE_LIMIT", "0")
+	if err := New().Validate(); err == nil {
+		t.Error("Expected a zero VERIFY_RATE_LIMIT to be rejected")
+	}
+}
+
+func TestConfig_ValidateRateLimitStore(t *testing.T) {
+	t.Setenv("RATE_LIMIT_STORE", "Redis")
+	cfg := New()
+	if cfg.RateLimitStore != "redis" {
+		t.Errorf("Expected RATE_LIMIT_STORE to be normalized, got %q", cfg.RateLimitStore)
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected the redis store without REDIS_URL to be rejected")
+	}
+
+	t.Setenv("REDIS_URL", "redis://localhost:6379/0")
+	if err := New().Validate(); err != nil {
+		t.Errorf("Expected the redis store with REDIS_URL to be valid, got %v", err)
+	}
+
+	t.Setenv("RATE_LIMIT_STORE", "memcached")
+	if err := New().Validate(); err == nil {
+		t.Error("Expected an unknown RATE_LIMIT_STORE to be rejected")
+	}
+}
+
+func TestConfig_ValidateTrustedProxies(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.1, 172.16.0.0/12")
+	if err := New().Validate(); err == nil {
+		t.Error("Expected TRUSTED_PROXIES without PROXY_HEADER to be rejected")
+	}
+
+	t.Setenv("TRUSTED_PROXIES", "")
+	t.Setenv("PROXY_HEADER", "X-Forwarded-For")
+	if err := New().Validate(); err == nil {
+		t.Error("Expected PROXY_HEADER without TRUSTED_PROXIES to be rejected")
+	}
+
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.1, 172.16.0.0/12")
+	cfg := New()
+	if len(cfg.TrustedProxies) != 2 || cfg.TrustedProxies[1] != "172.16.0.0/12" {
+		t.Errorf("Expected TRUSTED_PROXIES to be parsed as a list, got %v", cfg.TrustedProxies)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected IPs and CIDR ranges to be valid, got %v", err)
+	}
+
+	t.Setenv("TRUSTED_PROXIES", "proxy.internal")
+	if err := New().Validate(); err == nil {
+		t.Error("Expected a hostname in TRUSTED_PROXIES to be rejected")
+	}
+}
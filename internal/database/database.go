@@ -1,8 +1,12 @@
 package database
 
 import (
+	"database/sql"
 	"fmt"
 	"math"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"gorm.io/driver/sqlite"
@@ -10,29 +14,119 @@ import (
 	"gorm.io/gorm/logger"
 )
 
-func New(databaseURL string) (*gorm.DB, error) {
-	db, err := gorm.Open(sqlite.Open(databaseURL+"?_journal_mode=WAL&_synchronous=NORMAL&_cache_size=1000&_foreign_keys=on"), &gorm.Config{
+// Pragmas are the SQLite settings applied to every connection unless the
+// database URL already sets them
+type Pragmas struct {
+	JournalMode string // WAL by default; networked filesystems need DELETE
+	Synchronous string
+	CacheSize   int
+}
+
+// DefaultPragmas suit a single server on a local disk
+var DefaultPragmas = Pragmas{JournalMode: "WAL", Synchronous: "NORMAL", CacheSize: 1000}
+
+// pragmaParams maps each connection parameter to the aliases the driver also
+// accepts, so a URL using either spelling counts as setting it
+var pragmaParams = map[string][]string{
+	"_journal_mode": {"_journal_mode", "_journal"},
+	"_synchronous":  {"_synchronous", "_sync"},
+	"_cache_size":   {"_cache_size"},
+	"_foreign_keys": {"_foreign_keys", "_fk"},
+}
+
+// DSN adds the pragmas to databaseURL as query parameters, keeping any the
+// URL already has. Empty fields in pragmas fall back to DefaultPragmas.
+func DSN(databaseURL string, pragmas Pragmas) (string, error) {
+	path, rawQuery, _ := strings.Cut(databaseURL, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", fmt.Errorf("invalid database URL parameters: %w", err)
+	}
+
+	defaults := map[string]string{
+		"_journal_mode": orDefault(pragmas.JournalMode, DefaultPragmas.JournalMode),
+		"_synchronous":  orDefault(pragmas.Synchronous, DefaultPragmas.Synchronous),
+		"_cache_size":   strconv.Itoa(DefaultPragmas.CacheSize),
+		"_foreign_keys": "on",
+	}
+	if pragmas.CacheSize != 0 {
+		defaults["_cache_size"] = strconv.Itoa(pragmas.CacheSize)
+	}
+
+	for param, value := range defaults {
+		set := false
+		for _, alias := range pragmaParams[param] {
+			set = set || query.Has(alias)
+		}
+		if !set {
+			query.Set(param, value)
+		}
+	}
+	return path + "?" + query.Encode(), nil
+}
+
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// Pool sizes the connection pool. Zero fields take their value from
+// SQLitePool.
+type Pool struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// SQLitePool keeps a single connection, since SQLite allows only one writer
+// at a time. Drivers with real concurrency should be given larger sizes.
+var SQLitePool = Pool{MaxOpenConns: 1, MaxIdleConns: 1, ConnMaxLifetime: time.Hour}
+
+// ConfigurePool applies pool to sqlDB and returns it with unset fields filled
+// in from SQLitePool
+func ConfigurePool(sqlDB *sql.DB, pool Pool) Pool {
+	if pool.MaxOpenConns == 0 {
+		pool.MaxOpenConns = SQLitePool.MaxOpenConns
+	}
+	if pool.MaxIdleConns == 0 {
+		pool.MaxIdleConns = SQLitePool.MaxIdleConns
+	}
+	if pool.ConnMaxLifetime == 0 {
+		pool.ConnMaxLifetime = SQLitePool.ConnMaxLifetime
+	}
+
+	sqlDB.SetMaxOpenConns(pool.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(pool.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	return pool
+}
+
+func New(databaseURL string, pragmas Pragmas, pool Pool) (*gorm.DB, error) {
+	dsn, err := DSN(databaseURL, pragmas)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Info),
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	// Configure SQLite connection pool for single writer
 	sqlDB, err := db.DB()
 	if err != nil {
 		return nil, err
 	}
-
-	// SQLite only supports one writer, so limit connections
-	sqlDB.SetMaxOpenConns(1)
-	sqlDB.SetMaxIdleConns(1)
-	sqlDB.SetConnMaxLifetime(time.Hour)
+	ConfigurePool(sqlDB, pool)
 
 	return db, nil
 }
 
-// PerformWrite executes a database write operation with retry logic and exponential backoff
+// PerformWrite executes a database write operation with retry logic and
+// exponential backoff. Retries stop early once db's context is done.
 func PerformWrite(db *gorm.DB, operation func(*gorm.DB) error) error {
 	maxRetries := 5
 	baseDelay := 50 * time.Millisecond
@@ -57,7 +151,11 @@ func PerformWrite(db *gorm.DB, operation func(*gorm.DB) error) error {
 			jitter := time.Duration(float64(delay) * jitterFactor)
 			delay = delay + jitter
 
-			time.Sleep(delay)
+			select {
+			case <-time.After(delay):
+			case <-db.Statement.Context.Done():
+				return err
+			}
 			continue
 		}
 
@@ -67,20 +165,26 @@ func PerformWrite(db *gorm.DB, operation func(*gorm.DB) error) error {
 	return fmt.Errorf("database write failed after %d attempts", maxRetries+1)
 }
 
+// lockErrorMessages are lowercase fragments of SQLite errors that clear up on retry
+var lockErrorMessages = []string{
+	"database is locked",
+	"database table is locked",
+	"sqlite_busy", // Also matches SQLITE_BUSY_RECOVERY, _SNAPSHOT and _TIMEOUT
+	"sqlite_locked",
+	"cannot start a transaction within a transaction",
+}
+
 // isLockError checks if the error is related to database locking
 func isLockError(err error) bool {
 	if err == nil {
 		return false
 	}
 
-	errStr := err.Error()
-	return contains(errStr, "database is locked") ||
-		contains(errStr, "SQLITE_BUSY") ||
-		contains(errStr, "database table is locked") ||
-		contains(errStr, "cannot start a transaction within a transaction")
-}
-
-// contains is a simple string contains check
-func contains(s, substr string) bool {
-	return len(s) >= len(substr) && (s == substr || len(substr) == 0 || s[0:len(substr)] == substr || contains(s[1:], substr))
+	errStr := strings.ToLower(err.Error())
+	for _, msg := range lockErrorMessages {
+		if strings.Contains(errStr, msg) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsLockError(t *testing.T) {
+	lockErrors := []string{
+		"database is locked",
+		"Database Is Locked",
+		"database is locked (5) (SQLITE_BUSY)",
+		"SQLITE_BUSY",
+		"sqlite_busy_snapshot: cannot upgrade read transaction",
+		"SQLITE_BUSY_RECOVERY",
+		"SQLITE_BUSY_TIMEOUT",
+		"database table is locked: license_keys",
+		"SQLITE_LOCKED",
+		"cannot start a transaction within a transaction",
+	}
+	for _, msg := range lockErrors {
+		if !isLockError(errors.New(msg)) {
+			t.Errorf("Expected %q to be classified as a lock error", msg)
+		}
+	}
+
+	wrapped := fmt.Errorf("saving license key: %w", errors.New("database is locked"))
+	if !isLockError(wrapped) {
+		t.Error("Expected wrapped lock error to be classified as a lock error")
+	}
+
+	otherErrors := []string{
+		"UNIQUE constraint failed: license_keys.key",
+		"no such table: products",
+		"record not found",
+		"disk I/O error",
+		"database disk image is malformed",
+	}
+	for _, msg := range otherErrors {
+		if isLockError(errors.New(msg)) {
+			t.Errorf("Expected %q not to be classified as a lock error", msg)
+		}
+	}
+
+	if isLockError(nil) {
+		t.Error("nil should not be a lock error")
+	}
+
+	// The old recursive matcher blew the stack on long messages
+	long := strings.Repeat("x", 1<<20) + " database is locked"
+	if !isLockError(errors.New(long)) {
+		t.Error("Expected lock error at the end of a long message to be detected")
+	}
+}
+
+func TestDSN(t *testing.T) {
+	dsn, err := DSN("db/license_manager.db", DefaultPragmas)
+	if err != nil {
+		t.Fatalf("DSN failed: %v", err)
+	}
+	want := "db/license_manager.db?_cache_size=1000&_foreign_keys=on&_journal_mode=WAL&_synchronous=NORMAL"
+	if dsn != want {
+		t.Errorf("Expected defaults to fill in\n got: %s\nwant: %s", dsn, want)
+	}
+
+	dsn, err = DSN("/mnt/nfs/matcha.db?_journal_mode=DELETE&_busy_timeout=5000", DefaultPragmas)
+	if err != nil {
+		t.Fatalf("DSN failed: %v", err)
+	}
+	if !strings.Contains(dsn, "_journal_mode=DELETE") || strings.Contains(dsn, "WAL") {
+		t.Errorf("Expected the URL's journal mode to be kept, got %s", dsn)
+	}
+	if !strings.Contains(dsn, "_busy_timeout=5000") || !strings.Contains(dsn, "_synchronous=NORMAL") {
+		t.Errorf("Expected other parameters kept and missing defaults added, got %s", dsn)
+	}
+
+	// Driver aliases count as setting the pragma
+	dsn, _ = DSN("test.db?_journal=TRUNCATE&_fk=off", DefaultPragmas)
+	if strings.Contains(dsn, "_journal_mode") || strings.Contains(dsn, "_foreign_keys") {
+		t.Errorf("Expected aliased parameters not to be duplicated, got %s", dsn)
+	}
+
+	// Configured pragmas replace the defaults, but not what the URL sets
+	dsn, _ = DSN("test.db?_synchronous=FULL", Pragmas{JournalMode: "DELETE", Synchronous: "OFF", CacheSize: 4000})
+	want = "test.db?_cache_size=4000&_foreign_keys=on&_journal_mode=DELETE&_synchronous=FULL"
+	if dsn != want {
+		t.Errorf("Expected configured pragmas\n got: %s\nwant: %s", dsn, want)
+	}
+}
+
+func TestNew_ConfiguresPool(t *testing.T) {
+	db, err := New(":memory:", DefaultPragmas, Pool{})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	sqlDB, _ := db.DB()
+	defer sqlDB.Close()
+	if got := sqlDB.Stats().MaxOpenConnections; got != 1 {
+		t.Errorf("Expected SQLite to default to a single connection, got %d", got)
+	}
+
+	db, err = New(":memory:", DefaultPragmas, Pool{MaxOpenConns: 8, MaxIdleConns: 4, ConnMaxLifetime: time.Minute})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	sqlDB, _ = db.DB()
+	defer sqlDB.Close()
+	if got := sqlDB.Stats().MaxOpenConnections; got != 8 {
+		t.Errorf("Expected the configured 8 connections, got %d", got)
+	}
+}
+
+func TestConfigurePool_FillsDefaults(t *testing.T) {
+	db, err := New(":memory:", DefaultPragmas, Pool{})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	sqlDB, _ := db.DB()
+	defer sqlDB.Close()
+
+	applied := ConfigurePool(sqlDB, Pool{MaxIdleConns: 3})
+	want := Pool{MaxOpenConns: 1, MaxIdleConns: 3, ConnMaxLifetime: time.Hour}
+	if applied != want {
+		t.Errorf("Expected %+v, got %+v", want, applied)
+	}
+}
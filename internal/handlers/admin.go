@@ -56,12 +56,12 @@ func (h *AdminHandler) Login(c *fiber.Ctx) error {
 		return c.Status(500).SendString("Login failed")
 	}
 
-	return c.Redirect("/admin/")
+	return c.Redirect(middleware.AdminURL("/"))
 }
 
 func (h *AdminHandler) Logout(c *fiber.Ctx) error {
 	_ = middleware.Logout(c)
-	return c.Redirect("/admin/login")
+	return c.Redirect(middleware.AdminURL("/login"))
 }
 
 // Dashboard
@@ -89,7 +89,7 @@ func (h *AdminHandler) Dashboard(c *fiber.Ctx) error {
 	h.db.Model(&models.Customer{}).Count(&stats.TotalCustomers)
 	h.db.Model(&models.LicenseKey{}).Count(&stats.TotalLicenses)
 	h.db.Model(&models.LicenseKey{}).Where("status = ?", "active").Count(&stats.ActiveLicenses)
-	h.db.Model(&models.LicenseKey{}).Where("expires_at < ?", time.Now()).Count(&stats.ExpiredLicenses)
+	stats.ExpiredLicenses, _ = models.CountExpiredLicenseKeys(h.db, time.Now())
 
 	var recentLicenses []models.LicenseKey
 	h.db.Preload("Product").Preload("Customer").
@@ -164,12 +164,12 @@ func (h *AdminHandler) ProductsCreate(c *fiber.Ctx) error {
 	if err != nil {
 		return c.Render("admin/products/new", fiber.Map{
 			"Error":   "Failed to create product: " + err.Error(),
-			"Product": product,
+			"Product": &product,
 			"ShowNav": true,
 		})
 	}
 
-	return c.Redirect("/admin/products")
+	return c.Redirect(middleware.AdminURL("/products"))
 }
 
 func (h *AdminHandler) ProductsShow(c *fiber.Ctx) error {
@@ -182,7 +182,7 @@ func (h *AdminHandler) ProductsShow(c *fiber.Ctx) error {
 	return c.Render("admin/products/show", fiber.Map{
 		"ShowNav":  true,
 		"PageType": "products-show",
-		"Product":  product,
+		"Product":  &product,
 	})
 }
 
@@ -196,7 +196,7 @@ func (h *AdminHandler) ProductsEdit(c *fiber.Ctx) error {
 	return c.Render("admin/products/edit", fiber.Map{
 		"ShowNav":   true,
 		"PageType":  "products-edit",
-		"Product":   product,
+		"Product":   &product,
 		"CSRFToken": "",
 	})
 }
@@ -231,21 +231,16 @@ func (h *AdminHandler) ProductsUpdate(c *fiber.Ctx) error {
 	if err != nil {
 		return c.Render("admin/products/edit", fiber.Map{
 			"Error":     "Failed to update product: " + err.Error(),
-			"Product":   product,
+			"Product":   &product,
 			"CSRFToken": "",
 		})
 	}
 
-	return c.Redirect("/admin/products/" + c.Params("id"))
+	return c.Redirect(middleware.AdminURL("/products/") + c.Params("id"))
 }
 
 func (h *AdminHandler) ProductsDelete(c *fiber.Ctx) error {
-	id, _ := strconv.Atoi(c.Params("id"))
-	if err := h.db.Delete(&models.Product{}, id).Error; err != nil {
-		return c.Status(500).SendString("Failed to delete product")
-	}
-
-	return c.Redirect("/admin/products")
+	return deleteProduct(c, h.db)
 }
 
 // Customers
@@ -302,7 +297,7 @@ func (h *AdminHandler) CustomersCreate(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.Redirect("/admin/customers")
+	return c.Redirect(middleware.AdminURL("/customers"))
 }
 
 func (h *AdminHandler) CustomersShow(c *fiber.Ctx) error {
@@ -376,7 +371,7 @@ func (h *AdminHandler) CustomersUpdate(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.Redirect("/admin/customers/" + c.Params("id"))
+	return c.Redirect(middleware.AdminURL("/customers/") + c.Params("id"))
 }
 
 func (h *AdminHandler) CustomersDelete(c *fiber.Ctx) error {
@@ -389,7 +384,7 @@ func (h *AdminHandler) CustomersDelete(c *fiber.Ctx) error {
 		return c.Status(500).SendString("Failed to delete customer")
 	}
 
-	return c.Redirect("/admin/customers")
+	return c.Redirect(middleware.AdminURL("/customers"))
 }
 
 // License Keys
@@ -442,7 +437,7 @@ func (h *AdminHandler) LicenseKeysCreate(c *fiber.Ctx) error {
 		return c.Status(500).SendString("Failed to create license key")
 	}
 
-	return c.Redirect("/admin/license-keys/" + strconv.Itoa(int(licenseKey.ID)))
+	return c.Redirect(middleware.AdminURL("/license-keys/") + strconv.Itoa(int(licenseKey.ID)))
 }
 
 func (h *AdminHandler) LicenseKeysShow(c *fiber.Ctx) error {
@@ -521,7 +516,7 @@ func (h *AdminHandler) LicenseKeysUpdate(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.Redirect("/admin/license-keys/" + c.Params("id"))
+	return c.Redirect(middleware.AdminURL("/license-keys/") + c.Params("id"))
 }
 
 func (h *AdminHandler) LicenseKeysDelete(c *fiber.Ctx) error {
@@ -530,7 +525,7 @@ func (h *AdminHandler) LicenseKeysDelete(c *fiber.Ctx) error {
 		return c.Status(500).SendString("Failed to delete license key")
 	}
 
-	return c.Redirect("/admin/license-keys")
+	return c.Redirect(middleware.AdminURL("/license-keys"))
 }
 
 func (h *AdminHandler) LicenseKeysRevoke(c *fiber.Ctx) error {
@@ -540,11 +535,11 @@ func (h *AdminHandler) LicenseKeysRevoke(c *fiber.Ctx) error {
 		return c.Status(404).SendString("License key not found")
 	}
 
-	if err := licenseKey.Revoke(h.db); err != nil {
+	if err := licenseKey.Revoke(h.db, c.FormValue("reason")); err != nil {
 		return c.Status(500).SendString("Failed to revoke license key")
 	}
 
-	return c.Redirect("/admin/license-keys/" + c.Params("id"))
+	return c.Redirect(middleware.AdminURL("/license-keys/") + c.Params("id"))
 }
 
 func (h *AdminHandler) LicenseKeysReactivate(c *fiber.Ctx) error {
@@ -554,15 +549,15 @@ func (h *AdminHandler) LicenseKeysReactivate(c *fiber.Ctx) error {
 		return c.Status(404).SendString("License key not found")
 	}
 
-	if err := licenseKey.Reactivate(h.db); err != nil {
+	if err := licenseKey.Reactivate(h.db, c.FormValue("override") == "true"); err != nil {
 		return c.Status(500).SendString("Failed to reactivate license key")
 	}
 
-	return c.Redirect("/admin/license-keys/" + c.Params("id"))
+	return c.Redirect(middleware.AdminURL("/license-keys/") + c.Params("id"))
 }
 
 func (h *AdminHandler) LicenseKeysSendEmail(c *fiber.Ctx) error {
 	// This would require the email service to be injected
 	// For now, just redirect back
-	return c.Redirect("/admin/license-keys/" + c.Params("id"))
+	return c.Redirect(middleware.AdminURL("/license-keys/") + c.Params("id"))
 }
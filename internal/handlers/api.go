@@ -1,58 +1,412 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
+	"log"
+	"matcha/internal/clock"
+	"matcha/internal/database"
+	"matcha/internal/middleware"
 	"matcha/internal/models"
+	"matcha/internal/services"
 	"strconv"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
 )
 
 type APIHandler struct {
-	db *gorm.DB
+	db      *gorm.DB
+	emailer services.LicenseKeySender
+	Clock   clock.Clock // Stamps seat heartbeats and verifications; tests swap in a clock.Fake
 }
 
-func NewAPIHandler(db *gorm.DB) *APIHandler {
-	return &APIHandler{db: db}
+func NewAPIHandler(db *gorm.DB, emailer services.LicenseKeySender) *APIHandler {
+	return &APIHandler{db: db, emailer: emailer, Clock: clock.Real{}}
+}
+
+// VerifyRequest is the body of a verify call, sent form-encoded as Gumroad
+// clients do or as JSON
+type VerifyRequest struct {
+	ProductID          json.Number `json:"product_id" form:"product_id" query:"product_id" required:"true" doc:"ID of the product the key belongs to"`
+	LicenseKey         string      `json:"license_key" form:"license_key" query:"license_key" required:"true" doc:"The license key to verify"`
+	DeviceID           string      `json:"device_id" form:"device_id" query:"device_id" doc:"Device identifier; required for floating licenses"`
+	Hostname           string      `json:"hostname" form:"hostname" query:"hostname" doc:"Device hostname, shown to admins next to a floating seat"`
+	Version            string      `json:"version" form:"version" query:"version" doc:"Client version, compared with the purchased major version"`
+	IncrementUsesCount *bool       `json:"increment_uses_count" form:"increment_uses_count" query:"increment_uses_count" doc:"Whether to spend an activation; defaults to the product's policy"`
+	IncrementUsage     bool        `json:"increment_usage" form:"increment_usage" query:"increment_usage" doc:"Meter one use against the key's usage limit"`
+}
+
+// VerifyResponse is the Gumroad-compatible answer to a successful verify call
+type VerifyResponse struct {
+	Success          bool            `json:"success"`
+	Purchase         models.Purchase `json:"purchase"`
+	UpgradeRequired  bool            `json:"upgrade_required" doc:"The client version is newer than the purchased major version"`
+	HeartbeatTimeout int             `json:"heartbeat_timeout,omitempty" doc:"Seconds a floating seat is held without a heartbeat"`
+	ValidUntil       *string         `json:"valid_until" doc:"ISO 8601 time the license stops being valid, null for perpetual licenses"`
+	DaysRemaining    *int            `json:"days_remaining" doc:"Whole days left until valid_until, never negative; null for perpetual licenses"`
 }
 
 func (h *APIHandler) VerifyLicense(c *fiber.Ctx) error {
-	productIDStr := c.FormValue("product_id")
-	licenseKey := c.FormValue("license_key")
-	incrementUsesStr := c.FormValue("increment_uses_count")
+	db := requestDB(c, h.db)
+	req, err := parseVerifyRequest(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"success": false, "error": "Invalid request body"})
+	}
 
-	if productIDStr == "" || licenseKey == "" {
+	license, status, failure := h.findLicense(c, req.ProductID.String(), req.LicenseKey)
+	if failure != nil {
+		return c.Status(status).JSON(failure)
+	}
+
+	if !license.IsValidForUse() {
+		invalid := fiber.Map{"success": false, "reason": license.InvalidReason()}
+		if license.IsRevoked() && license.RevokedReason != "" {
+			invalid["revoked_reason"] = license.RevokedReason
+		}
+		return c.Status(404).JSON(invalid)
+	}
+
+	if license.IsFloating() {
+		// Floating keys hold a seat per device instead of consuming activations
+		if req.DeviceID == "" {
+			return c.Status(400).JSON(fiber.Map{
+				"success": false,
+				"error":   "device_id is required for floating licenses",
+			})
+		}
+		if err := database.PerformWrite(db, func(db *gorm.DB) error {
+			return license.CheckoutSeat(db, req.DeviceID, req.Hostname, h.Clock.Now())
+		}); err != nil {
+			if errors.Is(err, models.ErrNoSeatsAvailable) {
+				return c.Status(409).JSON(fiber.Map{
+					"success": false,
+					"error":   "No floating seats available",
+				})
+			}
+			return c.Status(500).JSON(fiber.Map{"success": false})
+		}
+	} else if incrementOnVerify(req.IncrementUsesCount, &license.Product) {
+		// As with Gumroad, verifying activates the device unless the client or product opts out
+		if err := database.PerformWrite(db, license.RegisterActivation); err != nil {
+			if errors.Is(err, models.ErrActivationLimitReached) {
+				return c.Status(404).JSON(fiber.Map{"success": false, "reason": "activation_limit_reached"})
+			}
+			return c.Status(500).JSON(fiber.Map{"success": false})
+		}
+	}
+
+	// Usage metering against the key's usage limit is opt-in
+	if req.IncrementUsage {
+		if err := database.PerformWrite(db, license.IncrementUsage); err != nil {
+			if errors.Is(err, models.ErrUsageLimitReached) {
+				return c.Status(404).JSON(fiber.Map{"success": false, "reason": "usage_limit_reached"})
+			}
+			return c.Status(500).JSON(fiber.Map{"success": false})
+		}
+	}
+
+	// Analytics are best effort; a failed counter must not fail the verification
+	if err := database.PerformWrite(db, func(db *gorm.DB) error {
+		return models.RecordVerification(db, license.ProductID, h.Clock.Now())
+	}); err != nil {
+		log.Printf("Failed to record verification for product %d: %v", license.ProductID, err)
+	}
+
+	// Verification still succeeds past the purchased major; clients decide how to prompt for the upgrade
+	purchase := license.ToPurchase()
+	response := VerifyResponse{
+		Success:         true,
+		Purchase:        purchase,
+		UpgradeRequired: license.RequiresUpgrade(req.Version),
+		ValidUntil:      purchase.ExpiresAt,
+		DaysRemaining:   license.DaysRemaining(),
+	}
+	if license.IsFloating() {
+		response.HeartbeatTimeout = int(models.FloatingSeatTimeout.Seconds())
+	}
+	return c.JSON(response)
+}
+
+// LicenseInfo reports a key's status, expiry and activations without touching
+// them, so client apps can check it on startup without spending an activation.
+// Invalid keys are still described, with valid false and a reason.
+func (h *APIHandler) LicenseInfo(c *fiber.Ctx) error {
+	license, status, failure := h.findLicense(c, c.FormValue("product_id"), c.FormValue("license_key"))
+	if failure != nil {
+		return c.Status(status).JSON(failure)
+	}
+
+	response := license.ToInfoResponse()
+	response["upgrade_required"] = license.RequiresUpgrade(c.FormValue("version"))
+	return c.JSON(response)
+}
+
+// parseVerifyRequest reads a form or JSON verify body, or the query string
+// when there is no body, so clients that can only GET verify the same way. An
+// empty request is rejected by findLicense like an unknown key.
+func parseVerifyRequest(c *fiber.Ctx) (VerifyRequest, error) {
+	var req VerifyRequest
+	if len(c.Body()) == 0 {
+		err := c.QueryParser(&req)
+		return req, err
+	}
+	err := c.BodyParser(&req)
+	return req, err
+}
+
+// incrementOnVerify decides whether a verification activates the device. An
+// explicit increment_uses_count wins; otherwise the product's policy applies.
+func incrementOnVerify(requested *bool, product *models.Product) bool {
+	if requested != nil {
+		return *requested
+	}
+	return product.IncrementsOnVerify()
+}
+
+// Heartbeat keeps a floating seat checked out. Once it returns 404 the seat
+// has been reclaimed and the client must verify again to get a new one.
+func (h *APIHandler) Heartbeat(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
+	license, status, failure := h.findLicense(c, c.FormValue("product_id"), c.FormValue("license_key"))
+	if failure != nil {
+		return c.Status(status).JSON(failure)
+	}
+
+	if !license.IsFloating() {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"error":   "Heartbeats only apply to floating licenses",
+		})
+	}
+	if !license.IsValidForUse() {
 		return c.Status(404).JSON(fiber.Map{"success": false})
 	}
 
-	productID, err := strconv.Atoi(productIDStr)
+	deviceID := c.FormValue("device_id")
+	if deviceID == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"error":   "device_id is required for floating licenses",
+		})
+	}
+
+	if err := database.PerformWrite(db, func(db *gorm.DB) error {
+		return license.Heartbeat(db, deviceID, h.Clock.Now())
+	}); err != nil {
+		if errors.Is(err, models.ErrSeatNotCheckedOut) {
+			return c.Status(404).JSON(fiber.Map{
+				"success": false,
+				"error":   "Seat is no longer checked out",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{"success": false})
+	}
+
+	return c.JSON(fiber.Map{
+		"success":           true,
+		"heartbeat_timeout": int(models.FloatingSeatTimeout.Seconds()),
+	})
+}
+
+// RevokeLicense lets external systems revoke a key, e.g. when a subscription
+// is cancelled. Like CreateLicense it only works for products with an API key.
+func (h *APIHandler) RevokeLicense(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
+	license, status, failure := h.findLicense(c, c.FormValue("product_id"), c.FormValue("license_key"))
+	if failure != nil {
+		return c.Status(status).JSON(failure)
+	}
+	if !license.Product.RequiresAPIKey() {
+		return c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"error":   "Invalid or missing API key",
+		})
+	}
+
+	// Integrators revoke on refunds and chargebacks; say so unless told otherwise
+	reason := c.FormValue("reason")
+	if reason == "" {
+		reason = "Revoked via API"
+	}
+	err := database.PerformWrite(db, func(db *gorm.DB) error {
+		return license.Revoke(db, reason)
+	})
 	if err != nil {
-		return c.Status(404).JSON(fiber.Map{"success": false})
+		log.Printf("Failed to revoke license %d via API: %v", license.ID, err)
+		return c.Status(500).JSON(fiber.Map{"success": false, "error": "Failed to revoke license"})
 	}
 
+	return c.JSON(fiber.Map{
+		"success":        true,
+		"license_key":    license.Key,
+		"status":         license.Status,
+		"revoked_reason": license.RevokedReason,
+	})
+}
+
+// Product describes a product by its permalink, without authentication, so
+// a storefront can build buy buttons from it
+func (h *APIHandler) Product(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
 	var product models.Product
-	if err := h.db.First(&product, productID).Error; err != nil {
-		return c.Status(404).JSON(fiber.Map{"success": false})
+	if err := db.Where("permalink = ?", c.Params("permalink")).First(&product).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"success": false, "error": "Product not found"})
 	}
 
-	var license models.LicenseKey
-	if err := h.db.Preload("Product").Preload("Customer").
-		Where("product_id = ? AND key = ?", productID, licenseKey).
-		First(&license).Error; err != nil {
-		return c.Status(404).JSON(fiber.Map{"success": false})
+	return c.JSON(fiber.Map{"success": true, "product": product.ToPublic()})
+}
+
+// CreateLicense provisions a license from an integrator's backend without a
+// payment webhook. Only products with an API key accept it, and the key must
+// be sent with the request.
+func (h *APIHandler) CreateLicense(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
+	var product models.Product
+	if productID := c.FormValue("product_id"); productID != "" {
+		if err := db.Where("id = ?", productID).First(&product).Error; err != nil {
+			return c.Status(404).JSON(fiber.Map{"success": false, "error": "Product not found"})
+		}
+	} else if permalink := c.FormValue("product_permalink"); permalink != "" {
+		found, err := models.FindProductByPermalink(db, permalink)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"success": false, "error": "Product not found"})
+		}
+		product = *found
+	} else {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"error":   "product_id or product_permalink is required",
+		})
 	}
 
-	if !license.IsValidForUse() {
-		return c.Status(404).JSON(fiber.Map{"success": false})
+	if !product.RequiresAPIKey() || !product.CheckAPIKey(middleware.APIKeyFromRequest(c)) {
+		return c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"error":   "Invalid or missing API key",
+		})
 	}
 
-	// Check if we should increment usage count (default is true)
-	incrementUses := incrementUsesStr != "false"
-	if incrementUses {
-		if err := license.IncrementUsage(h.db); err != nil {
-			return c.Status(500).JSON(fiber.Map{"success": false})
+	// Validate the optional overrides before anything is written
+	var expiresAt *time.Time
+	if value := c.FormValue("expires_at"); value != "" {
+		parsed, err := parseExpiry(value)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"success": false,
+				"error":   "expires_at must be a date (2006-01-02) or RFC 3339 timestamp",
+			})
+		}
+		expiresAt = &parsed
+	}
+	maxActivations := -1
+	if value := c.FormValue("max_activations"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return c.Status(400).JSON(fiber.Map{
+				"success": false,
+				"error":   "max_activations must be a non-negative integer",
+			})
+		}
+		maxActivations = parsed
+	}
+
+	var customer *models.Customer
+	err := database.PerformWrite(db, func(db *gorm.DB) error {
+		var err error
+		customer, err = (&models.Customer{}).FindOrCreateByEmail(db, c.FormValue("email"), c.FormValue("name"))
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidEmail) {
+			return c.Status(400).JSON(fiber.Map{"success": false, "error": "A valid email is required"})
+		}
+		log.Printf("Failed to find or create customer for API license: %v", err)
+		return c.Status(500).JSON(fiber.Map{"success": false, "error": "Failed to create customer"})
+	}
+
+	license, err := product.GenerateLicenseKeyFor(db, customer)
+	if err != nil {
+		log.Printf("Failed to create API license for product %d: %v", product.ID, err)
+		return c.Status(500).JSON(fiber.Map{"success": false, "error": "Failed to create license"})
+	}
+
+	if expiresAt != nil || maxActivations >= 0 {
+		if expiresAt != nil {
+			license.ExpiresAt = expiresAt
 		}
+		if maxActivations >= 0 {
+			license.MaxActivations = maxActivations
+		}
+		if err := database.PerformWrite(db, func(db *gorm.DB) error {
+			return db.Save(license).Error
+		}); err != nil {
+			log.Printf("Failed to apply overrides to license %d: %v", license.ID, err)
+			return c.Status(500).JSON(fiber.Map{"success": false, "error": "Failed to create license"})
+		}
+	}
+	license.Product = product
+	license.Customer = *customer
+
+	emailSent := false
+	if sendEmailFlag(c.FormValue("send_email"), false) && h.emailer != nil {
+		// The license exists either way; a failed email is reported, not fatal
+		if err := h.emailer.SendLicenseKey(license); err != nil {
+			log.Printf("Failed to email API license %d: %v", license.ID, err)
+		} else {
+			emailSent = true
+		}
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"success":    true,
+		"license":    license,
+		"email_sent": emailSent,
+	})
+}
+
+// parseExpiry accepts a plain date (end of that day in UTC) or an RFC 3339 timestamp
+func parseExpiry(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t.Add(24*time.Hour - time.Second), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// findLicense resolves the product_id/license_key pair of an API request and
+// checks the product's API key. On failure it returns the status and body to send.
+func (h *APIHandler) findLicense(c *fiber.Ctx, productIDStr, licenseKey string) (*models.LicenseKey, int, fiber.Map) {
+	db := requestDB(c, h.db)
+	if productIDStr == "" || licenseKey == "" {
+		return nil, 404, fiber.Map{"success": false}
+	}
+
+	productID, err := strconv.Atoi(productIDStr)
+	if err != nil {
+		return nil, 404, fiber.Map{"success": false}
+	}
+
+	var product models.Product
+	if err := db.First(&product, productID).Error; err != nil {
+		return nil, 404, fiber.Map{"success": false}
+	}
+
+	if !product.CheckAPIKey(middleware.APIKeyFromRequest(c)) {
+		return nil, 401, fiber.Map{
+			"success": false,
+			"error":   "Invalid or missing API key",
+		}
+	}
+
+	// Forgive case and whitespace in what the customer typed. Generated keys
+	// have no dashes, so dashes added to group the characters are ignored too.
+	var license models.LicenseKey
+	if err := db.Preload("Product").Preload("Customer").
+		Where("product_id = ? AND lookup_key IN ?", productID, product.KeyLookupCandidates(licenseKey)).
+		First(&license).Error; err != nil {
+		return nil, 404, fiber.Map{"success": false}
 	}
 
-	return c.JSON(license.ToAPIResponse())
+	return &license, 0, nil
 }
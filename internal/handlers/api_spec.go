@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"matcha/internal/models"
+	"matcha/internal/openapi"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// The types below document the endpoints that still read fields with
+// c.FormValue and answer with maps, so they must change whenever one of those
+// fields is added or renamed. Verify is described by the types it parses and
+// returns, see VerifyRequest.
+
+// LicenseLookupRequest identifies a license; every license endpoint takes it
+type LicenseLookupRequest struct {
+	ProductID  int    `form:"product_id" required:"true" doc:"ID of the product the key belongs to"`
+	LicenseKey string `form:"license_key" required:"true" doc:"The license key to look up"`
+}
+
+// LicenseInfoRequest is the body of POST /api/v1/licenses/info
+type LicenseInfoRequest struct {
+	LicenseLookupRequest
+	Version string `form:"version" doc:"Client version, compared with the purchased major version"`
+}
+
+// HeartbeatRequest is the body of POST /api/v1/licenses/heartbeat
+type HeartbeatRequest struct {
+	LicenseLookupRequest
+	DeviceID string `form:"device_id" required:"true" doc:"Device holding the floating seat"`
+}
+
+// RevokeLicenseRequest is the body of POST /api/v1/licenses/revoke
+type RevokeLicenseRequest struct {
+	LicenseLookupRequest
+	Reason string `form:"reason" doc:"Why the key is revoked, e.g. Refunded; returned by verify from then on"`
+}
+
+// CreateLicenseRequest is the body of POST /api/v1/licenses
+type CreateLicenseRequest struct {
+	ProductID        int    `form:"product_id" doc:"Product to license; either this or product_permalink is required"`
+	ProductPermalink string `form:"product_permalink" doc:"Product permalink, as returned in purchase.permalink"`
+	Email            string `form:"email" required:"true" doc:"Customer email; the customer is created if needed"`
+	Name             string `form:"name" doc:"Customer name"`
+	ExpiresAt        string `form:"expires_at" doc:"Date (2006-01-02) or RFC 3339 timestamp overriding the product default"`
+	MaxActivations   *int   `form:"max_activations" doc:"Activation limit overriding the product default; 0 is unlimited"`
+	SendEmail        bool   `form:"send_email" doc:"Email the key to the customer; off by default"`
+}
+
+// ErrorResponse is returned by every endpoint on failure
+type ErrorResponse struct {
+	Success       bool   `json:"success"`
+	Error         string `json:"error,omitempty" doc:"Human readable error, when there is one"`
+	Reason        string `json:"reason,omitempty" doc:"Machine readable reason the key is invalid"`
+	RevokedReason string `json:"revoked_reason,omitempty" doc:"Why the key was revoked, as given by the admin or integrator"`
+}
+
+// LicenseInfo mirrors the license object built by LicenseKey.ToInfoResponse
+type LicenseInfo struct {
+	LicenseKey           string  `json:"license_key"`
+	ProductID            int     `json:"product_id"`
+	ProductName          string  `json:"product_name"`
+	LicenseType          string  `json:"license_type"`
+	Status               string  `json:"status"`
+	Valid                bool    `json:"valid"`
+	Reason               string  `json:"reason" doc:"Why the key is invalid, empty when valid"`
+	ExpiresAt            *string `json:"expires_at" doc:"Expiry timestamp, null for perpetual keys"`
+	Perpetual            bool    `json:"perpetual"`
+	ActivationsUsed      int     `json:"activations_used"`
+	ActivationsRemaining int     `json:"activations_remaining"`
+	MaxActivations       int     `json:"max_activations"`
+	UsageCount           int     `json:"usage_count"`
+	UsageRemaining       int     `json:"usage_remaining"`
+}
+
+// LicenseInfoResponse is returned by POST /api/v1/licenses/info
+type LicenseInfoResponse struct {
+	Success         bool        `json:"success"`
+	License         LicenseInfo `json:"license"`
+	UpgradeRequired bool        `json:"upgrade_required"`
+}
+
+// HeartbeatResponse is returned by POST /api/v1/licenses/heartbeat
+type HeartbeatResponse struct {
+	Success          bool `json:"success"`
+	HeartbeatTimeout int  `json:"heartbeat_timeout" doc:"Seconds until the seat is reclaimed without another heartbeat"`
+}
+
+// RevokeLicenseResponse is returned by POST /api/v1/licenses/revoke
+type RevokeLicenseResponse struct {
+	Success       bool   `json:"success"`
+	LicenseKey    string `json:"license_key"`
+	Status        string `json:"status"`
+	RevokedReason string `json:"revoked_reason"`
+}
+
+// CreateLicenseResponse is returned by POST /api/v1/licenses
+type CreateLicenseResponse struct {
+	Success   bool              `json:"success"`
+	License   models.LicenseKey `json:"license"`
+	EmailSent bool              `json:"email_sent"`
+}
+
+// ProductResponse is returned by GET /api/v1/products/{permalink}
+type ProductResponse struct {
+	Success bool                 `json:"success"`
+	Product models.PublicProduct `json:"product"`
+}
+
+// APIOperations lists the documented API endpoints
+func APIOperations() []openapi.Operation {
+	notFound := openapi.Response{Description: "Unknown product or key, or the key is not valid", Body: ErrorResponse{}}
+	unauthorized := openapi.Response{Description: "The product requires an API key and it is missing or wrong", Body: ErrorResponse{}}
+
+	return []openapi.Operation{
+		{
+			Method:      "POST",
+			Path:        "/api/v1/licenses/verify",
+			Summary:     "Verify a license and activate it",
+			Description: "Gumroad-compatible verification. Spends an activation unless increment_uses_count is false or the product opts out; floating keys check out a seat for device_id instead.",
+			Tags:        []string{"Licenses"},
+			Request:     VerifyRequest{},
+			AcceptsJSON: true,
+			Secured:     true,
+			Responses: map[int]openapi.Response{
+				200: {Description: "The key is valid", Body: VerifyResponse{}},
+				400: {Description: "device_id is missing for a floating license", Body: ErrorResponse{}},
+				401: unauthorized,
+				404: notFound,
+				409: {Description: "No floating seats available", Body: ErrorResponse{}},
+			},
+		},
+		{
+			Method:      "GET",
+			Path:        "/api/v1/licenses/verify",
+			Summary:     "Verify a license from query parameters",
+			Description: "The same verification as the POST, for clients that can only make GET requests.",
+			Tags:        []string{"Licenses"},
+			Request:     VerifyRequest{},
+			Secured:     true,
+			Responses: map[int]openapi.Response{
+				200: {Description: "The key is valid", Body: VerifyResponse{}},
+				400: {Description: "device_id is missing for a floating license", Body: ErrorResponse{}},
+				401: unauthorized,
+				404: notFound,
+				409: {Description: "No floating seats available", Body: ErrorResponse{}},
+			},
+		},
+		{
+			Method:      "POST",
+			Path:        "/api/v1/licenses/info",
+			Summary:     "Describe a license without activating it",
+			Description: "Read-only status check; invalid keys are described with valid false and a reason.",
+			Tags:        []string{"Licenses"},
+			Request:     LicenseInfoRequest{},
+			Secured:     true,
+			Responses: map[int]openapi.Response{
+				200: {Description: "The key exists", Body: LicenseInfoResponse{}},
+				401: unauthorized,
+				404: notFound,
+			},
+		},
+		{
+			Method:  "POST",
+			Path:    "/api/v1/licenses/heartbeat",
+			Summary: "Keep a floating seat checked out",
+			Tags:    []string{"Licenses"},
+			Request: HeartbeatRequest{},
+			Secured: true,
+			Responses: map[int]openapi.Response{
+				200: {Description: "The seat is still held", Body: HeartbeatResponse{}},
+				400: {Description: "Not a floating license, or device_id is missing", Body: ErrorResponse{}},
+				401: unauthorized,
+				404: {Description: "The seat was reclaimed; verify again", Body: ErrorResponse{}},
+			},
+		},
+		{
+			Method:      "POST",
+			Path:        "/api/v1/licenses",
+			Summary:     "Create a license",
+			Description: "Provisions a key from an integrator's backend. Only products with an API key accept it.",
+			Tags:        []string{"License management"},
+			Request:     CreateLicenseRequest{},
+			Secured:     true,
+			Responses: map[int]openapi.Response{
+				201: {Description: "The license was created", Body: CreateLicenseResponse{}},
+				400: {Description: "Invalid or missing fields", Body: ErrorResponse{}},
+				401: unauthorized,
+				404: {Description: "Unknown product", Body: ErrorResponse{}},
+			},
+		},
+		{
+			Method:      "POST",
+			Path:        "/api/v1/licenses/revoke",
+			Summary:     "Revoke a license",
+			Description: "Only products with an API key accept it.",
+			Tags:        []string{"License management"},
+			Request:     RevokeLicenseRequest{},
+			Secured:     true,
+			Responses: map[int]openapi.Response{
+				200: {Description: "The license was revoked", Body: RevokeLicenseResponse{}},
+				401: unauthorized,
+				404: notFound,
+			},
+		},
+		{
+			Method:      "GET",
+			Path:        "/api/v1/products/{permalink}",
+			Summary:     "Describe a product",
+			Description: "Public product details for building buy buttons. No API key is needed.",
+			Tags:        []string{"Products"},
+			Responses: map[int]openapi.Response{
+				200: {Description: "The product exists", Body: ProductResponse{}},
+				404: {Description: "Unknown permalink", Body: ErrorResponse{}},
+			},
+		},
+	}
+}
+
+// OpenAPISpec serves the OpenAPI 3 document for the license API
+func (h *APIHandler) OpenAPISpec(c *fiber.Ctx) error {
+	return c.JSON(openapi.Document(openapi.Info{
+		Title:       "Matcha License API",
+		Version:     "1.0.0",
+		Description: "Fields are sent form-encoded. Products with an API key require it as a Bearer token or X-API-Key header.",
+	}, APIOperations()))
+}
+
+// APIDocs renders Swagger UI for the spec served by OpenAPISpec
+func (h *APIHandler) APIDocs(c *fiber.Ctx) error {
+	c.Type("html")
+	return c.SendString(apiDocsPage)
+}
+
+const apiDocsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Matcha License API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "/api/v1/openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
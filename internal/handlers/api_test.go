@@ -0,0 +1,876 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"matcha/internal/clock"
+	"matcha/internal/models"
+	"matcha/internal/testutils"
+)
+
+func createVerifiableLicense(t *testing.T, db *gorm.DB, apiKey string) (models.Product, models.LicenseKey) {
+	product := models.Product{
+		Name:                  "API Product",
+		Version:               "1.0.0",
+		DefaultExpirationDays: 365,
+		DefaultUsageLimit:     5,
+		APIKey:                apiKey,
+	}
+	require.NoError(t, db.Create(&product).Error)
+
+	customer := models.Customer{Name: "Jane Doe", Email: "jane@example.com"}
+	require.NoError(t, db.Create(&customer).Error)
+
+	licenseKey, err := product.GenerateLicenseKeyFor(db, &customer)
+	require.NoError(t, err)
+
+	return product, *licenseKey
+}
+
+func verifyRequest(productID uint, key string, headers map[string]string) *http.Request {
+	return verifyVersionRequest(productID, key, "", headers)
+}
+
+func verifyVersionRequest(productID uint, key, version string, headers map[string]string) *http.Request {
+	form := url.Values{
+		"product_id":           {strconv.Itoa(int(productID))},
+		"license_key":          {key},
+		"increment_uses_count": {"false"},
+	}
+	if version != "" {
+		form.Set("version", version)
+	}
+	req, _ := http.NewRequest("POST", "/api/v1/licenses/verify", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	return req
+}
+
+// Integration tests for the public API - tests full request flow with database
+func TestAPIHandler_Integration(t *testing.T) {
+	t.Run("VerifyLicense - No API Key Configured", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewAPIHandler(db, nil)
+		app.Post("/api/v1/licenses/verify", handler.VerifyLicense)
+
+		product, licenseKey := createVerifiableLicense(t, db, "")
+
+		resp, err := app.Test(verifyRequest(product.ID, licenseKey.Key, nil))
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+	})
+
+	t.Run("VerifyLicense - Valid API Key", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewAPIHandler(db, nil)
+		app.Post("/api/v1/licenses/verify", handler.VerifyLicense)
+
+		product, licenseKey := createVerifiableLicense(t, db, "mk_secret")
+
+		resp, err := app.Test(verifyRequest(product.ID, licenseKey.Key, map[string]string{
+			"Authorization": "Bearer mk_secret",
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		resp, err = app.Test(verifyRequest(product.ID, licenseKey.Key, map[string]string{
+			"X-API-Key": "mk_secret",
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+	})
+
+	t.Run("VerifyLicense - Wrong API Key", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewAPIHandler(db, nil)
+		app.Post("/api/v1/licenses/verify", handler.VerifyLicense)
+
+		product, licenseKey := createVerifiableLicense(t, db, "mk_secret")
+
+		resp, err := app.Test(verifyRequest(product.ID, licenseKey.Key, map[string]string{
+			"X-API-Key": "mk_wrong",
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+	})
+
+	t.Run("VerifyLicense - Missing Required API Key", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewAPIHandler(db, nil)
+		app.Post("/api/v1/licenses/verify", handler.VerifyLicense)
+
+		product, licenseKey := createVerifiableLicense(t, db, "mk_secret")
+
+		resp, err := app.Test(verifyRequest(product.ID, licenseKey.Key, nil))
+		require.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+	})
+
+	t.Run("VerifyLicense - Includes Metadata And Entitlements", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewAPIHandler(db, nil)
+		app.Post("/api/v1/licenses/verify", handler.VerifyLicense)
+
+		product, licenseKey := createVerifiableLicense(t, db, "")
+		require.NoError(t, licenseKey.SetMetadataMap(map[string]interface{}{"seats": "10", "tier": "pro"}))
+		require.NoError(t, db.Save(&licenseKey).Error)
+
+		resp, err := app.Test(verifyRequest(product.ID, licenseKey.Key, nil))
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var body struct {
+			Success  bool                   `json:"success"`
+			Purchase map[string]interface{} `json:"purchase"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.True(t, body.Success)
+		assert.Equal(t, licenseKey.Key, body.Purchase["license_key"])
+		assert.Equal(t, map[string]interface{}{"seats": "10", "tier": "pro"}, body.Purchase["custom_fields"])
+		assert.Equal(t, "active", body.Purchase["status"])
+		assert.Equal(t, licenseKey.ExpiresAt.UTC().Format("2006-01-02T15:04:05Z"), body.Purchase["expires_at"])
+		assert.EqualValues(t, licenseKey.UsageRemaining(), body.Purchase["usage_remaining"])
+	})
+
+	t.Run("VerifyLicense - Empty Metadata Is An Object", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewAPIHandler(db, nil)
+		app.Post("/api/v1/licenses/verify", handler.VerifyLicense)
+
+		product, licenseKey := createVerifiableLicense(t, db, "")
+		require.Empty(t, licenseKey.Metadata)
+
+		resp, err := app.Test(verifyRequest(product.ID, licenseKey.Key, nil))
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var body struct {
+			Purchase map[string]json.RawMessage `json:"purchase"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.JSONEq(t, "{}", string(body.Purchase["custom_fields"]))
+	})
+
+	t.Run("VerifyLicense - Version Entitlements", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewAPIHandler(db, nil)
+		app.Post("/api/v1/licenses/verify", handler.VerifyLicense)
+
+		product, licenseKey := createVerifiableLicense(t, db, "")
+		require.Equal(t, "1.0.0", licenseKey.PurchasedVersion)
+
+		cases := []struct {
+			name            string
+			version         string
+			upgradeRequired bool
+		}{
+			{"same version", "1.0.0", false},
+			{"newer minor", "1.4.2", false},
+			{"older version", "0.9", false},
+			{"newer major", "v3.0.0", true},
+			{"missing version", "", false},
+		}
+		for _, tc := range cases {
+			resp, err := app.Test(verifyVersionRequest(product.ID, licenseKey.Key, tc.version, nil))
+			require.NoError(t, err)
+			require.Equal(t, 200, resp.StatusCode, tc.name)
+
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			assert.Equal(t, true, body["success"], tc.name)
+			assert.Equal(t, tc.upgradeRequired, body["upgrade_required"], tc.name)
+		}
+	})
+
+	t.Run("Heartbeat - Floating Seat Checkout", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewAPIHandler(db, nil)
+		fake := clock.NewFake(time.Now())
+		handler.Clock = fake
+		app.Post("/api/v1/licenses/verify", handler.VerifyLicense)
+		app.Post("/api/v1/licenses/heartbeat", handler.Heartbeat)
+
+		product, licenseKey := createVerifiableLicense(t, db, "")
+		require.NoError(t, db.Model(&licenseKey).Updates(map[string]interface{}{
+			"license_type":    models.LicenseTypeFloating,
+			"max_activations": 1,
+		}).Error)
+
+		seatRequest := func(path, deviceID string) *http.Request {
+			form := url.Values{
+				"product_id":  {strconv.Itoa(int(product.ID))},
+				"license_key": {licenseKey.Key},
+				"device_id":   {deviceID},
+			}
+			req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return req
+		}
+
+		resp, err := app.Test(seatRequest("/api/v1/licenses/verify", "laptop"))
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		// Re-verifying from the same device keeps its seat instead of taking another
+		resp, err = app.Test(seatRequest("/api/v1/licenses/verify", "laptop"))
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		resp, err = app.Test(seatRequest("/api/v1/licenses/verify", "desktop"))
+		require.NoError(t, err)
+		assert.Equal(t, 409, resp.StatusCode)
+
+		resp, err = app.Test(seatRequest("/api/v1/licenses/heartbeat", "laptop"))
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		resp, err = app.Test(seatRequest("/api/v1/licenses/heartbeat", "desktop"))
+		require.NoError(t, err)
+		assert.Equal(t, 404, resp.StatusCode)
+
+		// The laptop goes silent past the timeout
+		fake.Advance(models.FloatingSeatTimeout + time.Minute)
+
+		resp, err = app.Test(seatRequest("/api/v1/licenses/verify", "desktop"))
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		resp, err = app.Test(seatRequest("/api/v1/licenses/heartbeat", "laptop"))
+		require.NoError(t, err)
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+
+	t.Run("Heartbeat - Node-Locked License", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewAPIHandler(db, nil)
+		app.Post("/api/v1/licenses/heartbeat", handler.Heartbeat)
+
+		product, licenseKey := createVerifiableLicense(t, db, "")
+
+		req := verifyRequest(product.ID, licenseKey.Key, nil)
+		req.URL.Path = "/api/v1/licenses/heartbeat"
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		assert.Equal(t, 400, resp.StatusCode)
+
+		var stored models.LicenseKey
+		require.NoError(t, db.First(&stored, licenseKey.ID).Error)
+		assert.Equal(t, licenseKey.CurrentActivations, stored.CurrentActivations)
+	})
+
+	t.Run("CreateLicense - Provisions Licenses", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewAPIHandler(db, nil)
+		app.Post("/api/v1/licenses", handler.CreateLicense)
+
+		product := models.Product{Name: "API Product", Version: "1.0.0", DefaultUsageLimit: 2, APIKey: "mk_secret"}
+		require.NoError(t, db.Create(&product).Error)
+		existing := models.Customer{Name: "Existing", Email: "existing@example.com"}
+		require.NoError(t, db.Create(&existing).Error)
+
+		create := func(form url.Values, apiKey string) (*http.Response, map[string]interface{}) {
+			req, _ := http.NewRequest("POST", "/api/v1/licenses", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if apiKey != "" {
+				req.Header.Set("X-API-Key", apiKey)
+			}
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			return resp, body
+		}
+
+		// Existing customer, matched case-insensitively
+		resp, body := create(url.Values{
+			"product_id": {strconv.Itoa(int(product.ID))},
+			"email":      {"Existing@Example.com"},
+		}, "mk_secret")
+		require.Equal(t, 201, resp.StatusCode)
+		license := body["license"].(map[string]interface{})
+		assert.NotEmpty(t, license["key"])
+		assert.EqualValues(t, existing.ID, license["customer_id"])
+		assert.EqualValues(t, 2, license["max_activations"])
+
+		// New customer by permalink, with overrides
+		resp, body = create(url.Values{
+			"product_permalink": {"API Product"},
+			"email":             {"new@example.com"},
+			"name":              {"New Customer"},
+			"expires_at":        {"2030-01-31"},
+			"max_activations":   {"5"},
+		}, "mk_secret")
+		require.Equal(t, 201, resp.StatusCode)
+		license = body["license"].(map[string]interface{})
+		assert.EqualValues(t, 5, license["max_activations"])
+
+		var customer models.Customer
+		require.NoError(t, db.Where("email = ?", "new@example.com").First(&customer).Error)
+		assert.Equal(t, "New Customer", customer.Name)
+
+		var stored models.LicenseKey
+		require.NoError(t, db.Where("customer_id = ?", customer.ID).First(&stored).Error)
+		require.NotNil(t, stored.ExpiresAt)
+		assert.Equal(t, "2030-01-31", stored.ExpiresAt.UTC().Format("2006-01-02"))
+
+		// Wrong or missing API key
+		resp, _ = create(url.Values{"product_id": {strconv.Itoa(int(product.ID))}, "email": {"x@example.com"}}, "wrong")
+		assert.Equal(t, 401, resp.StatusCode)
+		resp, _ = create(url.Values{"product_id": {strconv.Itoa(int(product.ID))}, "email": {"x@example.com"}}, "")
+		assert.Equal(t, 401, resp.StatusCode)
+	})
+
+	t.Run("CreateLicense - Email Only When Asked", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		emailer := &stubEmailer{}
+		handler := NewAPIHandler(db, emailer)
+		app.Post("/api/v1/licenses", handler.CreateLicense)
+
+		product := models.Product{Name: "API Product", APIKey: "mk_secret"}
+		require.NoError(t, db.Create(&product).Error)
+
+		create := func(form url.Values) map[string]interface{} {
+			form.Set("product_id", strconv.Itoa(int(product.ID)))
+			req, _ := http.NewRequest("POST", "/api/v1/licenses", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("X-API-Key", "mk_secret")
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			require.Equal(t, 201, resp.StatusCode)
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			return body
+		}
+
+		body := create(url.Values{"email": {"quiet@example.com"}})
+		assert.Equal(t, false, body["email_sent"])
+		assert.Empty(t, emailer.sentTo)
+
+		body = create(url.Values{"email": {"loud@example.com"}, "send_email": {"true"}})
+		assert.Equal(t, true, body["email_sent"])
+		assert.Equal(t, []string{"loud@example.com"}, emailer.sentTo)
+	})
+
+	t.Run("CreateLicense - Unknown Product", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewAPIHandler(db, nil)
+		app.Post("/api/v1/licenses", handler.CreateLicense)
+
+		form := url.Values{"product_id": {"99999"}, "email": {"buyer@example.com"}}
+		req, _ := http.NewRequest("POST", "/api/v1/licenses", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-API-Key", "mk_secret")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		assert.Equal(t, 404, resp.StatusCode)
+
+		var count int64
+		db.Model(&models.Customer{}).Count(&count)
+		assert.Equal(t, int64(0), count)
+	})
+
+	t.Run("RevokeLicense - Revokes And Verify Reports Reason", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewAPIHandler(db, nil)
+		app.Post("/api/v1/licenses/verify", handler.VerifyLicense)
+		app.Post("/api/v1/licenses/revoke", handler.RevokeLicense)
+
+		product, licenseKey := createVerifiableLicense(t, db, "mk_secret")
+		auth := map[string]string{"X-API-Key": "mk_secret"}
+
+		revoke := verifyRequest(product.ID, licenseKey.Key, auth)
+		revoke.URL.Path = "/api/v1/licenses/revoke"
+		resp, err := app.Test(revoke)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, "revoked", body["status"])
+
+		resp, err = app.Test(verifyRequest(product.ID, licenseKey.Key, auth))
+		require.NoError(t, err)
+		assert.Equal(t, 404, resp.StatusCode)
+		body = nil
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, false, body["success"])
+		assert.Equal(t, "revoked", body["reason"])
+		assert.Equal(t, "Revoked via API", body["revoked_reason"])
+	})
+
+	t.Run("RevokeLicense - Rejected Requests", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewAPIHandler(db, nil)
+		app.Post("/api/v1/licenses/revoke", handler.RevokeLicense)
+
+		product, licenseKey := createVerifiableLicense(t, db, "mk_secret")
+
+		revokeRequest := func(key string, headers map[string]string) *http.Request {
+			req := verifyRequest(product.ID, key, headers)
+			req.URL.Path = "/api/v1/licenses/revoke"
+			return req
+		}
+
+		resp, err := app.Test(revokeRequest("NO-SUCH-KEY", map[string]string{"X-API-Key": "mk_secret"}))
+		require.NoError(t, err)
+		assert.Equal(t, 404, resp.StatusCode)
+
+		resp, err = app.Test(revokeRequest(licenseKey.Key, nil))
+		require.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+
+		var stored models.LicenseKey
+		require.NoError(t, db.First(&stored, licenseKey.ID).Error)
+		assert.Equal(t, "active", stored.Status)
+	})
+
+	t.Run("LicenseInfo - Does Not Consume Activations", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewAPIHandler(db, nil)
+		app.Post("/api/v1/licenses/info", handler.LicenseInfo)
+		app.Post("/api/v1/licenses/verify", handler.VerifyLicense)
+
+		product, licenseKey := createVerifiableLicense(t, db, "secret-api-key")
+		form := url.Values{
+			"product_id":  {strconv.Itoa(int(product.ID))},
+			"license_key": {licenseKey.Key},
+		}
+		post := func(path, apiKey string) *http.Response {
+			req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("X-API-Key", apiKey)
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			return resp
+		}
+
+		for i := 0; i < 3; i++ {
+			resp := post("/api/v1/licenses/info", "secret-api-key")
+			require.Equal(t, 200, resp.StatusCode)
+
+			var body struct {
+				Success bool                   `json:"success"`
+				License map[string]interface{} `json:"license"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			assert.True(t, body.Success)
+			assert.Equal(t, "API Product", body.License["product_name"])
+			assert.Equal(t, "active", body.License["status"])
+			assert.Equal(t, true, body.License["valid"])
+			assert.Equal(t, float64(0), body.License["activations_used"])
+			assert.Equal(t, float64(5), body.License["activations_remaining"])
+			assert.NotNil(t, body.License["expires_at"])
+		}
+
+		var stored models.LicenseKey
+		require.NoError(t, db.First(&stored, licenseKey.ID).Error)
+		assert.Equal(t, 0, stored.CurrentActivations)
+		assert.Equal(t, 0, stored.UsageCount)
+		assert.Nil(t, stored.LastValidatedAt)
+
+		// Verify increments by default, unlike info
+		resp := post("/api/v1/licenses/verify", "secret-api-key")
+		require.Equal(t, 200, resp.StatusCode)
+		require.NoError(t, db.First(&stored, licenseKey.ID).Error)
+		assert.Equal(t, 1, stored.CurrentActivations)
+
+		// Info still requires the product's API key
+		resp = post("/api/v1/licenses/info", "wrong-key")
+		assert.Equal(t, 401, resp.StatusCode)
+	})
+
+	t.Run("VerifyLicense - Activation And Usage Counters", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewAPIHandler(db, nil)
+		app.Post("/api/v1/licenses/verify", handler.VerifyLicense)
+
+		product, licenseKey := createVerifiableLicense(t, db, "")
+		require.NoError(t, db.Model(&licenseKey).Updates(map[string]interface{}{"max_activations": 1, "usage_limit": 2}).Error)
+
+		verify := func(params url.Values) (int, map[string]interface{}) {
+			params.Set("product_id", strconv.Itoa(int(product.ID)))
+			params.Set("license_key", licenseKey.Key)
+			req, _ := http.NewRequest("POST", "/api/v1/licenses/verify", strings.NewReader(params.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			return resp.StatusCode, body
+		}
+		stored := func() models.LicenseKey {
+			var lk models.LicenseKey
+			require.NoError(t, db.First(&lk, licenseKey.ID).Error)
+			return lk
+		}
+
+		// The default verification takes an activation and leaves usage alone
+		status, _ := verify(url.Values{})
+		require.Equal(t, 200, status)
+		assert.Equal(t, 1, stored().CurrentActivations)
+		assert.Equal(t, 0, stored().UsageCount)
+
+		// With every activation taken, new activations fail but the key stays active
+		status, body := verify(url.Values{})
+		assert.Equal(t, 404, status)
+		assert.Equal(t, "activation_limit_reached", body["reason"])
+		assert.Equal(t, "active", stored().Status)
+		status, _ = verify(url.Values{"increment_uses_count": {"false"}})
+		assert.Equal(t, 200, status)
+
+		// Metered usage counts separately against the usage limit
+		for i := 0; i < 2; i++ {
+			status, _ = verify(url.Values{"increment_uses_count": {"false"}, "increment_usage": {"true"}})
+			require.Equal(t, 200, status)
+		}
+		status, body = verify(url.Values{"increment_uses_count": {"false"}, "increment_usage": {"true"}})
+		assert.Equal(t, 404, status)
+		assert.Equal(t, "usage_limit_reached", body["reason"])
+		assert.Equal(t, 1, stored().CurrentActivations)
+		assert.Equal(t, 2, stored().UsageCount)
+	})
+
+	t.Run("VerifyLicense - Product Increment Policy", func(t *testing.T) {
+		cases := []struct {
+			name     string
+			policy   bool
+			override string
+			want     int
+		}{
+			{"Policy On", true, "", 1},
+			{"Policy Off", false, "", 0},
+			{"Policy Off, Client Asks To Increment", false, "true", 1},
+			{"Policy On, Client Opts Out", true, "false", 0},
+		}
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				db := testutils.SetupTestDB(t)
+				app := testutils.SetupTestAppWithDB(t, db)
+				handler := NewAPIHandler(db, nil)
+				app.Post("/api/v1/licenses/verify", handler.VerifyLicense)
+
+				product, licenseKey := createVerifiableLicense(t, db, "")
+				require.NoError(t, db.Model(&product).Update("increment_on_verify", tc.policy).Error)
+
+				form := url.Values{
+					"product_id":  {strconv.Itoa(int(product.ID))},
+					"license_key": {licenseKey.Key},
+				}
+				if tc.override != "" {
+					form.Set("increment_uses_count", tc.override)
+				}
+				req, _ := http.NewRequest("POST", "/api/v1/licenses/verify", strings.NewReader(form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				resp, err := app.Test(req)
+				require.NoError(t, err)
+				require.Equal(t, 200, resp.StatusCode)
+
+				var stored models.LicenseKey
+				require.NoError(t, db.First(&stored, licenseKey.ID).Error)
+				assert.Equal(t, tc.want, stored.CurrentActivations)
+			})
+		}
+	})
+}
+
+func TestAPIHandler_OpenAPISpec(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestAppWithDB(t, db)
+	handler := NewAPIHandler(db, nil)
+	app.Get("/api/v1/openapi.json", handler.OpenAPISpec)
+	app.Get("/api/docs", handler.APIDocs)
+
+	t.Run("Spec - Valid JSON Listing Verify", func(t *testing.T) {
+		resp := testutils.TestRequest(t, app, "GET", "/api/v1/openapi.json", "")
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var spec struct {
+			OpenAPI    string                            `json:"openapi"`
+			Paths      map[string]map[string]interface{} `json:"paths"`
+			Components struct {
+				Schemas map[string]struct {
+					Properties map[string]interface{} `json:"properties"`
+				} `json:"schemas"`
+			} `json:"components"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&spec))
+		assert.Equal(t, "3.0.3", spec.OpenAPI)
+		require.Contains(t, spec.Paths, "/api/v1/licenses/verify")
+		assert.Contains(t, spec.Paths["/api/v1/licenses/verify"], "post")
+		assert.Contains(t, spec.Paths, "/api/v1/licenses")
+
+		assert.Contains(t, spec.Components.Schemas["Purchase"].Properties, "license_key")
+
+		// The info response is still built as a map, so check the documented fields cover it
+		license := models.LicenseKey{}
+		info := license.ToInfoResponse()["license"].(map[string]interface{})
+		for field := range info {
+			assert.Contains(t, spec.Components.Schemas["LicenseInfo"].Properties, field)
+		}
+	})
+
+	t.Run("Docs - Swagger UI Page", func(t *testing.T) {
+		resp := testutils.TestRequest(t, app, "GET", "/api/docs", "")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+	})
+}
+
+func TestAPIHandler_VerifyRequestFormats(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestAppWithDB(t, db)
+	handler := NewAPIHandler(db, nil)
+	app.Post("/api/v1/licenses/verify", handler.VerifyLicense)
+	app.Get("/api/v1/licenses/verify", handler.VerifyLicense)
+	app.Post("/parse", func(c *fiber.Ctx) error {
+		req, err := parseVerifyRequest(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(req)
+	})
+
+	product, licenseKey := createVerifiableLicense(t, db, "")
+	form := url.Values{
+		"product_id":           {strconv.Itoa(int(product.ID))},
+		"license_key":          {licenseKey.Key},
+		"version":              {"1.2.0"},
+		"increment_uses_count": {"false"},
+	}.Encode()
+	jsonBody := fmt.Sprintf(`{"product_id": %d, "license_key": %q, "version": "1.2.0", "increment_uses_count": false}`, product.ID, licenseKey.Key)
+
+	send := func(path, contentType, body string) (int, string) {
+		req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(raw)
+	}
+
+	t.Run("Parse - Form And JSON Match", func(t *testing.T) {
+		formStatus, fromForm := send("/parse", "application/x-www-form-urlencoded", form)
+		jsonStatus, fromJSON := send("/parse", "application/json", jsonBody)
+		require.Equal(t, 200, formStatus, fromForm)
+		require.Equal(t, 200, jsonStatus, fromJSON)
+		assert.JSONEq(t, fromForm, fromJSON)
+
+		var parsed VerifyRequest
+		require.NoError(t, json.Unmarshal([]byte(fromJSON), &parsed))
+		assert.Equal(t, licenseKey.Key, parsed.LicenseKey)
+		require.NotNil(t, parsed.IncrementUsesCount)
+		assert.False(t, *parsed.IncrementUsesCount)
+	})
+
+	t.Run("Verify - Form And JSON Responses Match", func(t *testing.T) {
+		formStatus, fromForm := send("/api/v1/licenses/verify", "application/x-www-form-urlencoded", form)
+		jsonStatus, fromJSON := send("/api/v1/licenses/verify", "application/json", jsonBody)
+		assert.Equal(t, 200, formStatus)
+		assert.Equal(t, 200, jsonStatus)
+		assert.JSONEq(t, fromForm, fromJSON)
+	})
+
+	t.Run("Verify - Malformed JSON", func(t *testing.T) {
+		status, _ := send("/api/v1/licenses/verify", "application/json", `{"product_id":`)
+		assert.Equal(t, 400, status)
+	})
+
+	get := func(query string) (int, string) {
+		req, _ := http.NewRequest("GET", "/api/v1/licenses/verify?"+query, nil)
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(raw)
+	}
+
+	t.Run("Verify - GET And POST Responses Match", func(t *testing.T) {
+		formStatus, fromForm := send("/api/v1/licenses/verify", "application/x-www-form-urlencoded", form)
+		getStatus, fromGet := get(form)
+		assert.Equal(t, 200, formStatus)
+		assert.Equal(t, 200, getStatus)
+		assert.JSONEq(t, fromForm, fromGet)
+
+		unknown := url.Values{"product_id": {strconv.Itoa(int(product.ID))}, "license_key": {"NOT-A-KEY"}}.Encode()
+		formStatus, fromForm = send("/api/v1/licenses/verify", "application/x-www-form-urlencoded", unknown)
+		getStatus, fromGet = get(unknown)
+		assert.Equal(t, 404, formStatus)
+		assert.Equal(t, 404, getStatus)
+		assert.JSONEq(t, fromForm, fromGet)
+	})
+
+	t.Run("Verify - GET Spends Activations Like POST", func(t *testing.T) {
+		query := url.Values{"product_id": {strconv.Itoa(int(product.ID))}, "license_key": {licenseKey.Key}}.Encode()
+		var before models.LicenseKey
+		require.NoError(t, db.First(&before, licenseKey.ID).Error)
+
+		status, _ := get(query)
+		require.Equal(t, 200, status)
+		var afterGet models.LicenseKey
+		require.NoError(t, db.First(&afterGet, licenseKey.ID).Error)
+		assert.Equal(t, before.CurrentActivations+1, afterGet.CurrentActivations)
+
+		status, _ = send("/api/v1/licenses/verify", "application/x-www-form-urlencoded", query)
+		require.Equal(t, 200, status)
+		var afterPost models.LicenseKey
+		require.NoError(t, db.First(&afterPost, licenseKey.ID).Error)
+		assert.Equal(t, afterGet.CurrentActivations+1, afterPost.CurrentActivations)
+	})
+}
+
+func TestAPIHandler_Product(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestAppWithDB(t, db)
+	handler := NewAPIHandler(db, nil)
+	app.Get("/api/v1/products/:permalink", handler.Product)
+
+	product := models.Product{Name: "Pro Plan", Description: "Everything", Version: "2.1.0", DefaultUsageLimit: 3}
+	require.NoError(t, db.Create(&product).Error)
+	_, err := product.RegenerateAPIKey(db)
+	require.NoError(t, err)
+
+	t.Run("Product - Public Lookup By Permalink", func(t *testing.T) {
+		resp := testutils.TestRequest(t, app, "GET", "/api/v1/products/pro-plan", "")
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var body struct {
+			Success bool                   `json:"success"`
+			Product map[string]interface{} `json:"product"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.True(t, body.Success)
+		assert.Equal(t, "pro-plan", body.Product["permalink"])
+		assert.Equal(t, "Pro Plan", body.Product["name"])
+		assert.Equal(t, "2.1.0", body.Product["version"])
+		assert.Equal(t, float64(3), body.Product["default_usage_limit"])
+		assert.NotContains(t, body.Product, "id")
+		assert.NotContains(t, body.Product, "api_key")
+	})
+
+	t.Run("Product - Unknown Permalink", func(t *testing.T) {
+		resp := testutils.TestRequest(t, app, "GET", "/api/v1/products/Pro%20Plan", "")
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+}
+
+func TestAPIHandler_VerifyNormalizesKey(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestAppWithDB(t, db)
+	handler := NewAPIHandler(db, nil)
+	app.Post("/api/v1/licenses/verify", handler.VerifyLicense)
+
+	product, licenseKey := createVerifiableLicense(t, db, "")
+	key := licenseKey.Key
+
+	handEntered := models.LicenseKey{Key: " abcd-efgh-1234 \n", ProductID: product.ID, CustomerID: licenseKey.CustomerID, Status: "active", MaxActivations: 5}
+	require.NoError(t, db.Create(&handEntered).Error)
+	assert.Equal(t, "ABCD-EFGH-1234", handEntered.Key, "keys are stored normalized")
+
+	for name, submitted := range map[string]string{
+		"Lower Case":            strings.ToLower(key),
+		"Embedded Spaces":       " " + key[:8] + " " + key[8:16] + "\t" + key[16:] + "\n",
+		"Grouped With Dashes":   strings.ToLower(key[:8] + "-" + key[8:16] + "-" + key[16:]),
+		"Hand-Entered Lower":    "abcd-efgh-1234",
+		"Hand-Entered Dashless": "ABCDEFGH1234",
+	} {
+		t.Run("Verify - "+name, func(t *testing.T) {
+			resp, err := app.Test(verifyRequest(product.ID, submitted, nil))
+			require.NoError(t, err)
+			assert.Equal(t, 200, resp.StatusCode)
+		})
+	}
+
+	t.Run("Verify - Different Key Still Rejected", func(t *testing.T) {
+		resp, err := app.Test(verifyRequest(product.ID, key[:len(key)-1], nil))
+		require.NoError(t, err)
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+}
+
+func TestAPIHandler_VerifyValidUntil(t *testing.T) {
+	now := time.Date(2026, 3, 1, 9, 30, 0, 0, time.UTC)
+	defer models.UseClock(clock.NewFake(now))()
+
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestAppWithDB(t, db)
+	handler := NewAPIHandler(db, nil)
+	app.Post("/api/v1/licenses/verify", handler.VerifyLicense)
+
+	product, licenseKey := createVerifiableLicense(t, db, "")
+	verify := func(key string) map[string]json.RawMessage {
+		resp, err := app.Test(verifyRequest(product.ID, key, nil))
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		var body map[string]json.RawMessage
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return body
+	}
+
+	t.Run("VerifyLicense - Twelve Days Left", func(t *testing.T) {
+		expiresAt := now.AddDate(0, 0, 12)
+		require.NoError(t, db.Model(&licenseKey).Update("expires_at", expiresAt).Error)
+
+		body := verify(licenseKey.Key)
+		assert.JSONEq(t, `"2026-03-13T09:30:00Z"`, string(body["valid_until"]))
+		assert.JSONEq(t, "12", string(body["days_remaining"]))
+	})
+
+	t.Run("VerifyLicense - Last Hours Count As Zero Days", func(t *testing.T) {
+		require.NoError(t, db.Model(&licenseKey).Update("expires_at", now.Add(5*time.Hour)).Error)
+
+		body := verify(licenseKey.Key)
+		assert.JSONEq(t, "0", string(body["days_remaining"]))
+	})
+
+	t.Run("VerifyLicense - Perpetual Key", func(t *testing.T) {
+		require.NoError(t, db.Model(&licenseKey).Update("expires_at", nil).Error)
+
+		body := verify(licenseKey.Key)
+		assert.JSONEq(t, "null", string(body["valid_until"]))
+		assert.JSONEq(t, "null", string(body["days_remaining"]))
+	})
+
+	t.Run("VerifyLicense - Expired Key Reports Reason", func(t *testing.T) {
+		require.NoError(t, db.Model(&licenseKey).Update("expires_at", now.Add(-time.Hour)).Error)
+
+		resp, err := app.Test(verifyRequest(product.ID, licenseKey.Key, nil))
+		require.NoError(t, err)
+		assert.Equal(t, 404, resp.StatusCode)
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, "expired", body["reason"])
+		assert.NotContains(t, body, "days_remaining")
+	})
+}
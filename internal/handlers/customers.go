@@ -1,6 +1,9 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 
@@ -8,6 +11,7 @@ import (
 	"gorm.io/gorm"
 
 	"matcha/internal/database"
+	"matcha/internal/middleware"
 	"matcha/internal/models"
 )
 
@@ -20,14 +24,35 @@ func NewCustomersHandler(db *gorm.DB) *CustomersHandler {
 }
 
 func (h *CustomersHandler) Index(c *fiber.Ctx) error {
+	q := c.Query("q")
+	tag := c.Query("tag")
+	pagination := paginationFromQuery(c)
+
+	h.db.Model(&models.Customer{}).Scopes(tenantScope(c), models.SearchCustomers(q), models.CustomersTagged(tag)).Count(&pagination.Total)
+
 	var customers []models.Customer
-	h.db.Preload("LicenseKeys").Find(&customers)
+	h.db.Scopes(tenantScope(c), models.SearchCustomers(q), models.CustomersTagged(tag)).
+		Preload("LicenseKeys").
+		Order("created_at DESC").
+		Offset(pagination.Offset()).
+		Limit(pagination.PerPage).
+		Find(&customers)
+
+	if wantsJSON(c) {
+		return c.JSON(fiber.Map{
+			"customers":  customers,
+			"pagination": pagination,
+		})
+	}
 
 	return c.Render("admin/customers/index", fiber.Map{
-		"ShowNav":   true,
-		"PageType":  "customers-index",
-		"Customers": customers,
-		"CSRFToken": "",
+		"ShowNav":    true,
+		"PageType":   "customers-index",
+		"Customers":  customers,
+		"Query":      q,
+		"Tag":        tag,
+		"Pagination": pagination,
+		"CSRFToken":  "",
 	})
 }
 
@@ -40,45 +65,40 @@ func (h *CustomersHandler) New(c *fiber.Ctx) error {
 }
 
 func (h *CustomersHandler) Create(c *fiber.Ctx) error {
-	customer := models.Customer{
-		Email:     c.FormValue("email"),
-		FirstName: c.FormValue("first_name"),
-		LastName:  c.FormValue("last_name"),
-		Company:   c.FormValue("company"),
+	db := requestDB(c, h.db)
+	form, err := parseFormInput(c)
+	if err != nil {
+		return jsonError(c, 400, "Invalid JSON body")
 	}
 
-	// Set Name field as combination of first and last name
-	if customer.FirstName != "" || customer.LastName != "" {
-		customer.Name = strings.TrimSpace(customer.FirstName + " " + customer.LastName)
-	} else if customer.Email != "" {
-		// Extract name from email if no name provided (get part before @)
-		atIndex := strings.Index(customer.Email, "@")
-		if atIndex > 0 {
-			customer.Name = customer.Email[:atIndex]
-		} else {
-			customer.Name = customer.Email
-		}
+	customer := models.Customer{OwnerID: middleware.CurrentOwnerID(c)}
+	if errs := applyCustomerForm(form, &customer); len(errs) > 0 {
+		return renderCustomerForm(c, 400, customer, errs, errs.Error())
 	}
 
 	// Use PerformWrite for database operation with retry logic
-	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+	err = database.PerformWrite(db, func(db *gorm.DB) error {
 		return db.Create(&customer).Error
 	})
+	if models.IsUniqueViolation(err) {
+		errs := ValidationErrors{"email": duplicateEmailMessage}
+		return renderCustomerForm(c, 400, customer, errs, errs.Error())
+	}
 	if err != nil {
-		return c.Render("admin/customers/new", fiber.Map{
-			"Error":    "Failed to create customer: " + err.Error(),
-			"Customer": customer,
-			"ShowNav":  true,
-		})
+		return renderCustomerForm(c, 500, customer, nil, "Failed to create customer: "+err.Error())
 	}
 
-	return c.Redirect("/admin/customers")
+	if wantsJSON(c) {
+		return c.Status(201).JSON(customer)
+	}
+	middleware.SetFlash(c, middleware.FlashSuccess, "Customer created")
+	return c.Redirect(middleware.AdminURL("/customers"))
 }
 
 func (h *CustomersHandler) Show(c *fiber.Ctx) error {
 	id, _ := strconv.Atoi(c.Params("id"))
 	var customer models.Customer
-	if err := h.db.Preload("LicenseKeys.Product").First(&customer, id).Error; err != nil {
+	if err := h.db.Scopes(tenantScope(c)).Preload("LicenseKeys.Product").First(&customer, id).Error; err != nil {
 		return c.Status(404).SendString("Customer not found")
 	}
 
@@ -89,10 +109,31 @@ func (h *CustomersHandler) Show(c *fiber.Ctx) error {
 	})
 }
 
+// Export downloads the customer and their license keys as a JSON bundle, see
+// models.CustomerBundle
+func (h *CustomersHandler) Export(c *fiber.Ctx) error {
+	id, _ := strconv.Atoi(c.Params("id"))
+	bundle, err := models.ExportCustomer(h.db.Scopes(tenantScope(c)), uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(404).SendString("Customer not found")
+	}
+	if err != nil {
+		return c.Status(500).SendString("Failed to export customer")
+	}
+
+	body, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return c.Status(500).SendString("Failed to export customer")
+	}
+	c.Attachment(fmt.Sprintf("customer-%d.json", id))
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+	return c.Send(body)
+}
+
 func (h *CustomersHandler) Edit(c *fiber.Ctx) error {
 	id, _ := strconv.Atoi(c.Params("id"))
 	var customer models.Customer
-	if err := h.db.First(&customer, id).Error; err != nil {
+	if err := h.db.Scopes(tenantScope(c)).First(&customer, id).Error; err != nil {
 		return c.Status(404).SendString("Customer not found")
 	}
 
@@ -105,22 +146,73 @@ func (h *CustomersHandler) Edit(c *fiber.Ctx) error {
 }
 
 func (h *CustomersHandler) Update(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
+	form, err := parseFormInput(c)
+	if err != nil {
+		return jsonError(c, 400, "Invalid JSON body")
+	}
+
 	// Accept both PUT requests and POST requests with _method=PUT
-	if c.Method() != "PUT" && !(c.Method() == "POST" && c.FormValue("_method") == "PUT") {
+	if c.Method() != "PUT" && !(c.Method() == "POST" && form.Value("_method") == "PUT") {
 		return c.Status(405).SendString("Method not allowed")
 	}
 
 	id, _ := strconv.Atoi(c.Params("id"))
 	var customer models.Customer
-	if err := h.db.First(&customer, id).Error; err != nil {
+	if err := db.Scopes(tenantScope(c)).First(&customer, id).Error; err != nil {
+		if wantsJSON(c) {
+			return jsonError(c, 404, "Customer not found")
+		}
 		return c.Status(404).SendString("Customer not found")
 	}
 
-	customer.Email = c.FormValue("email")
-	customer.Company = c.FormValue("company")
+	expectedVersion := lockVersionFrom(form, customer.LockVersion)
+
+	if errs := applyCustomerForm(form, &customer); len(errs) > 0 {
+		return renderCustomerForm(c, 400, customer, errs, errs.Error())
+	}
+
+	err = database.PerformWrite(db, func(db *gorm.DB) error {
+		return models.SaveIfUnchanged(db, &customer, expectedVersion)
+	})
+	if errors.Is(err, models.ErrStaleRecord) {
+		return renderCustomerForm(c, 409, customer, nil, staleRecordMessage)
+	}
+	if models.IsUniqueViolation(err) {
+		errs := ValidationErrors{"email": duplicateEmailMessage}
+		return renderCustomerForm(c, 400, customer, errs, errs.Error())
+	}
+	if err != nil {
+		return renderCustomerForm(c, 500, customer, nil, "Failed to update customer: "+err.Error())
+	}
+
+	if wantsJSON(c) {
+		return c.JSON(customer)
+	}
+	middleware.SetFlash(c, middleware.FlashSuccess, "Customer updated")
+	return c.Redirect(middleware.AdminURL("/customers/") + c.Params("id"))
+}
+
+const duplicateEmailMessage = "Another customer already has this email address"
+
+// applyCustomerForm copies the submitted details onto customer and reports
+// the fields that can't be saved. An invalid email is kept as typed so the
+// form can show it back.
+func applyCustomerForm(form *formInput, customer *models.Customer) ValidationErrors {
+	errs := ValidationErrors{}
+
+	customer.Email = strings.TrimSpace(form.Value("email"))
+	if email, err := models.NormalizeEmail(customer.Email); err != nil {
+		errs.Add("email", "Please enter a valid email address")
+	} else {
+		customer.Email = email
+	}
+	customer.Company = form.Value("company")
+	customer.Notes = form.Value("notes")
+	customer.SetTags(form.Value("tags"))
 
 	// Handle name field - can be either a combined name or separate first/last names
-	if name := c.FormValue("name"); name != "" {
+	if name := form.Value("name"); name != "" {
 		customer.Name = name
 		// Try to split the name into first and last parts
 		nameParts := strings.Fields(name)
@@ -132,8 +224,8 @@ func (h *CustomersHandler) Update(c *fiber.Ctx) error {
 		}
 	} else {
 		// Handle separate first_name and last_name fields (for backwards compatibility)
-		customer.FirstName = c.FormValue("first_name")
-		customer.LastName = c.FormValue("last_name")
+		customer.FirstName = form.Value("first_name")
+		customer.LastName = form.Value("last_name")
 
 		// Update Name field from first and last name
 		if customer.FirstName != "" || customer.LastName != "" {
@@ -151,31 +243,50 @@ func (h *CustomersHandler) Update(c *fiber.Ctx) error {
 			customer.Name = customer.Email
 		}
 	}
+	return errs
+}
 
-	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
-		return db.Save(&customer).Error
-	})
-	if err != nil {
-		return c.Render("admin/customers/edit", fiber.Map{
-			"Error":     "Failed to update customer: " + err.Error(),
-			"Customer":  customer,
-			"ShowNav":   true,
-			"CSRFToken": "",
-		})
+// renderCustomerForm shows the new or edit form again, keeping what was
+// submitted, with msg above it and errs under their fields
+func renderCustomerForm(c *fiber.Ctx, status int, customer models.Customer, errs ValidationErrors, msg string) error {
+	if wantsJSON(c) {
+		return jsonError(c, status, msg)
 	}
-
-	return c.Redirect("/admin/customers/" + c.Params("id"))
+	page := "new"
+	if customer.ID != 0 {
+		page = "edit"
+	}
+	return c.Status(status).Render("admin/customers/"+page, fiber.Map{
+		"ShowNav":          true,
+		"PageType":         "customers-" + page,
+		"Error":            msg,
+		"Customer":         customer,
+		"ValidationErrors": errs,
+		"CSRFToken":        "",
+	})
 }
 
 func (h *CustomersHandler) Delete(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
 	id, _ := strconv.Atoi(c.Params("id"))
 
-	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
-		return db.Delete(&models.Customer{}, id).Error
+	// Check if customer still owns license keys
+	var licenseKeyCount int64
+	db.Model(&models.LicenseKey{}).Where("customer_id = ?", id).Count(&licenseKeyCount)
+
+	if licenseKeyCount > 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Cannot delete customer with associated license keys",
+		})
+	}
+
+	err := database.PerformWrite(db, func(db *gorm.DB) error {
+		return db.Scopes(tenantScope(c)).Delete(&models.Customer{}, id).Error
 	})
 	if err != nil {
 		return c.Status(500).SendString("Failed to delete customer")
 	}
 
-	return c.Redirect("/admin/customers")
+	middleware.SetFlash(c, middleware.FlashSuccess, "Customer deleted")
+	return c.Redirect(middleware.AdminURL("/customers"))
 }
@@ -1,11 +1,13 @@
 package handlers
 
 import (
+	"encoding/json"
 	"net/http/httptest"
 	"net/url"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/assert"
@@ -63,6 +65,85 @@ func TestCustomersHandler_Index(t *testing.T) {
 	}
 }
 
+func TestCustomersHandler_IndexSearch(t *testing.T) {
+	seed := func(t *testing.T, db *gorm.DB) {
+		customers := []models.Customer{
+			{Name: "Alice Smith", Email: "alice@acme.com", Company: "Acme Corporation"},
+			{Name: "Bob Jones", Email: "bob@globex.com", Company: "Globex"},
+			{Name: "Carol White", Email: "carol@example.com", Company: "ACME Labs"},
+		}
+		for i := range customers {
+			require.NoError(t, db.Create(&customers[i]).Error)
+		}
+	}
+
+	search := func(t *testing.T, app *fiber.App, query string) ([]models.Customer, Pagination) {
+		req := httptest.NewRequest("GET", "/customers?"+query, nil)
+		req.Header.Set("Accept", "application/json")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var body struct {
+			Customers  []models.Customer `json:"customers"`
+			Pagination Pagination        `json:"pagination"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return body.Customers, body.Pagination
+	}
+
+	t.Run("partial company name matches case-insensitively", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestApp()
+		handler := NewCustomersHandler(db)
+		app.Get("/customers", handler.Index)
+		seed(t, db)
+
+		customers, pagination := search(t, app, "q=acm")
+		require.Len(t, customers, 2)
+		assert.Equal(t, int64(2), pagination.Total)
+		for _, customer := range customers {
+			assert.Contains(t, strings.ToLower(customer.Company), "acme")
+		}
+	})
+
+	t.Run("empty query returns all customers", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestApp()
+		handler := NewCustomersHandler(db)
+		app.Get("/customers", handler.Index)
+		seed(t, db)
+
+		customers, pagination := search(t, app, "q=")
+		assert.Len(t, customers, 3)
+		assert.Equal(t, int64(3), pagination.Total)
+	})
+
+	t.Run("results are paginated", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestApp()
+		handler := NewCustomersHandler(db)
+		app.Get("/customers", handler.Index)
+		seed(t, db)
+
+		customers, pagination := search(t, app, "per_page=2&page=2")
+		assert.Len(t, customers, 1)
+		assert.Equal(t, int64(3), pagination.Total)
+		assert.Equal(t, 2, pagination.TotalPages())
+	})
+
+	t.Run("wildcards in the query are matched literally", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestApp()
+		handler := NewCustomersHandler(db)
+		app.Get("/customers", handler.Index)
+		seed(t, db)
+
+		customers, _ := search(t, app, "q=%25")
+		assert.Empty(t, customers)
+	})
+}
+
 func TestCustomersHandler_New(t *testing.T) {
 	db := testutils.SetupTestDB(t)
 	app := testutils.SetupTestApp()
@@ -84,6 +165,7 @@ func TestCustomersHandler_Create(t *testing.T) {
 		expectedStatus int
 		expectedResult string
 		expectedName   string
+		expectedEmail  string
 	}{
 		{
 			name: "should create customer with full name",
@@ -116,6 +198,24 @@ func TestCustomersHandler_Create(t *testing.T) {
 			expectedResult: "/admin/customers",
 			expectedName:   "Bob",
 		},
+		{
+			name: "should trim and lowercase email",
+			formData: map[string]string{
+				"email": "  Alice@Example.COM ",
+			},
+			expectedStatus: 302,
+			expectedResult: "/admin/customers",
+			expectedName:   "alice",
+			expectedEmail:  "alice@example.com",
+		},
+		{
+			name: "should reject invalid email",
+			formData: map[string]string{
+				"email":      "not-an-email",
+				"first_name": "Nobody",
+			},
+			expectedStatus: 400,
+		},
 	}
 
 	for _, tt := range tests {
@@ -151,12 +251,64 @@ func TestCustomersHandler_Create(t *testing.T) {
 				var customer models.Customer
 				db.First(&customer)
 				assert.Equal(t, tt.expectedName, customer.Name)
-				assert.Equal(t, tt.formData["email"], customer.Email)
+				expectedEmail := tt.expectedEmail
+				if expectedEmail == "" {
+					expectedEmail = tt.formData["email"]
+				}
+				assert.Equal(t, expectedEmail, customer.Email)
+			} else {
+				var count int64
+				db.Model(&models.Customer{}).Count(&count)
+				assert.Equal(t, int64(0), count)
 			}
 		})
 	}
 }
 
+func TestCustomersHandler_CreateJSON(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestAppWithDB(t, db)
+	handler := NewCustomersHandler(db)
+	app.Post("/customers", handler.Create)
+
+	resp := testutils.TestRequestJSON(t, app, "POST", "/customers",
+		`{"email": "API@Example.com", "first_name": "Ada", "last_name": "Lovelace", "tags": "vip"}`)
+	require.Equal(t, 201, resp.StatusCode)
+
+	var created models.Customer
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	require.NotZero(t, created.ID)
+	assert.Equal(t, "api@example.com", created.Email)
+	assert.Equal(t, "Ada Lovelace", created.Name)
+
+	resp = testutils.TestRequestJSON(t, app, "POST", "/customers", `{"email": "not-an-email"}`)
+	assert.Equal(t, 400, resp.StatusCode)
+	var body map[string]string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, "Please enter a valid email address", body["error"])
+}
+
+func TestCustomersHandler_CreateCaseInsensitiveDuplicate(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestApp()
+	handler := NewCustomersHandler(db)
+	app.Post("/test", handler.Create)
+
+	existing := models.Customer{Name: "John", Email: "john@example.com"}
+	require.NoError(t, db.Create(&existing).Error)
+
+	form := url.Values{"email": {"John@Example.com"}}
+	req := httptest.NewRequest("POST", "/test", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := app.Test(req)
+	require.NoError(t, err)
+	assert.NotEqual(t, 302, resp.StatusCode)
+
+	var count int64
+	db.Model(&models.Customer{}).Count(&count)
+	assert.Equal(t, int64(1), count, "case variant must hit the unique index")
+}
+
 func TestCustomersHandler_Show(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -205,6 +357,78 @@ func TestCustomersHandler_Show(t *testing.T) {
 	}
 }
 
+func TestCustomersHandler_Export(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestApp()
+	handler := NewCustomersHandler(db)
+	app.Get("/customers/:id/export", handler.Export)
+
+	product := models.Product{Name: "Pro App", Permalink: "pro-app", Version: "2.0.0"}
+	require.NoError(t, db.Create(&product).Error)
+	customer := models.Customer{Name: "John Doe", Email: "john@example.com", Company: "Acme"}
+	require.NoError(t, db.Create(&customer).Error)
+
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, db.Create(&models.LicenseKey{Key: "KEY-PERPETUAL", ProductID: product.ID, CustomerID: customer.ID}).Error)
+	require.NoError(t, db.Create(&models.LicenseKey{Key: "KEY-EXPIRING", ProductID: product.ID, CustomerID: customer.ID, ExpiresAt: &expires, Metadata: `{"seat":"3"}`}).Error)
+
+	other := models.Customer{Name: "Jane Roe", Email: "jane@example.com"}
+	require.NoError(t, db.Create(&other).Error)
+	require.NoError(t, db.Create(&models.LicenseKey{Key: "KEY-OTHER", ProductID: product.ID, CustomerID: other.ID}).Error)
+
+	t.Run("Export - Bundle Contains Customer And Keys", func(t *testing.T) {
+		resp, err := app.Test(httptest.NewRequest("GET", "/customers/"+strconv.Itoa(int(customer.ID))+"/export", nil))
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Content-Disposition"), "attachment")
+		assert.Contains(t, resp.Header.Get("Content-Type"), "application/json")
+
+		var bundle map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&bundle))
+		assert.EqualValues(t, models.CustomerBundleVersion, bundle["version"])
+
+		exported := bundle["customer"].(map[string]interface{})
+		assert.Equal(t, "john@example.com", exported["email"])
+		assert.Equal(t, "Acme", exported["company"])
+
+		keys := bundle["license_keys"].([]interface{})
+		require.Len(t, keys, 2)
+
+		perpetual := keys[0].(map[string]interface{})
+		assert.Equal(t, "KEY-PERPETUAL", perpetual["key"])
+		assert.Contains(t, perpetual, "expires_at")
+		assert.Nil(t, perpetual["expires_at"])
+		assert.NotContains(t, perpetual, "metadata")
+		assert.Equal(t, "pro-app", perpetual["product"].(map[string]interface{})["permalink"])
+
+		expiring := keys[1].(map[string]interface{})
+		assert.Equal(t, "KEY-EXPIRING", expiring["key"])
+		assert.Equal(t, "2030-01-01T00:00:00Z", expiring["expires_at"])
+		assert.Equal(t, map[string]interface{}{"seat": "3"}, expiring["metadata"])
+	})
+
+	t.Run("Export - Customer Without Keys", func(t *testing.T) {
+		lonely := models.Customer{Name: "No Keys", Email: "nokeys@example.com"}
+		require.NoError(t, db.Create(&lonely).Error)
+
+		resp, err := app.Test(httptest.NewRequest("GET", "/customers/"+strconv.Itoa(int(lonely.ID))+"/export", nil))
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var bundle models.CustomerBundle
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&bundle))
+		assert.Equal(t, "nokeys@example.com", bundle.Customer.Email)
+		assert.NotNil(t, bundle.LicenseKeys)
+		assert.Empty(t, bundle.LicenseKeys)
+	})
+
+	t.Run("Export - Missing Customer", func(t *testing.T) {
+		resp, err := app.Test(httptest.NewRequest("GET", "/customers/999/export", nil))
+		require.NoError(t, err)
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+}
+
 func TestCustomersHandler_Edit(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -379,6 +603,79 @@ func TestCustomersHandler_Update(t *testing.T) {
 	}
 }
 
+func TestCustomersHandler_NotesAndTags(t *testing.T) {
+	update := func(t *testing.T, app *fiber.App, id uint, notes, tags string) {
+		form := url.Values{
+			"_method": {"PUT"},
+			"name":    {"Jane Doe"},
+			"email":   {"jane@example.com"},
+			"notes":   {notes},
+			"tags":    {tags},
+		}
+		req := httptest.NewRequest("POST", "/customers/"+strconv.Itoa(int(id)), strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		require.Equal(t, 302, resp.StatusCode)
+	}
+
+	t.Run("should save notes and add/remove tags", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestApp()
+		handler := NewCustomersHandler(db)
+		app.Post("/customers/:id", handler.Update)
+
+		customer := models.Customer{Name: "Jane Doe", Email: "jane@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+
+		update(t, app, customer.ID, "Prefers invoices by email", " Enterprise, reseller ,,enterprise")
+
+		var saved models.Customer
+		require.NoError(t, db.First(&saved, customer.ID).Error)
+		assert.Equal(t, "Prefers invoices by email", saved.Notes)
+		assert.Equal(t, []string{"enterprise", "reseller"}, saved.TagList())
+		assert.Equal(t, "Jane Doe", saved.Name)
+
+		update(t, app, customer.ID, "Prefers invoices by email", "enterprise")
+
+		require.NoError(t, db.First(&saved, customer.ID).Error)
+		assert.Equal(t, []string{"enterprise"}, saved.TagList())
+		assert.False(t, saved.HasTag("reseller"))
+	})
+
+	t.Run("should filter index by tag", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestApp()
+		handler := NewCustomersHandler(db)
+		app.Get("/customers", handler.Index)
+
+		tagged := []struct{ email, tags string }{
+			{"a@example.com", "enterprise,reseller"},
+			{"b@example.com", "reseller"},
+			{"c@example.com", "enterprise-trial"},
+			{"d@example.com", ""},
+		}
+		for _, c := range tagged {
+			customer := models.Customer{Name: c.email, Email: c.email}
+			customer.SetTags(c.tags)
+			require.NoError(t, db.Create(&customer).Error)
+		}
+
+		req := httptest.NewRequest("GET", "/customers?tag=Enterprise", nil)
+		req.Header.Set("Accept", "application/json")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var body struct {
+			Customers []models.Customer `json:"customers"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		require.Len(t, body.Customers, 1, "tag filter must match whole tags only")
+		assert.Equal(t, "a@example.com", body.Customers[0].Email)
+	})
+}
+
 func TestCustomersHandler_Delete(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -397,6 +694,25 @@ func TestCustomersHandler_Delete(t *testing.T) {
 			},
 			expectedStatus: 302,
 		},
+		{
+			name: "should not delete customer with license keys",
+			setupData: func(db *gorm.DB) uint {
+				customer := models.Customer{
+					Name:  "Test Customer",
+					Email: "test@example.com",
+				}
+				db.Create(&customer)
+				product := models.Product{Name: "Test Product"}
+				db.Create(&product)
+				db.Create(&models.LicenseKey{
+					Key:        "TEST-KEY-123",
+					ProductID:  product.ID,
+					CustomerID: customer.ID,
+				})
+				return customer.ID
+			},
+			expectedStatus: 400,
+		},
 	}
 
 	for _, tt := range tests {
@@ -422,6 +738,10 @@ func TestCustomersHandler_Delete(t *testing.T) {
 				var count int64
 				db.Model(&models.Customer{}).Where("id = ?", customerID).Count(&count)
 				assert.Equal(t, int64(0), count)
+			} else {
+				var count int64
+				db.Model(&models.Customer{}).Where("id = ?", customerID).Count(&count)
+				assert.Equal(t, int64(1), count)
 			}
 		})
 	}
@@ -2,6 +2,9 @@ package handlers
 
 import (
 	"fmt"
+	"html/template"
+	"log"
+	"net/url"
 	"strconv"
 	"time"
 
@@ -9,16 +12,17 @@ import (
 	"gorm.io/gorm"
 
 	"matcha/internal/config"
+	"matcha/internal/middleware"
 	"matcha/internal/models"
-	"matcha/internal/services"
 )
 
 type DashboardHandler struct {
-	db *gorm.DB
+	db  *gorm.DB
+	cfg *config.Config
 }
 
-func NewDashboardHandler(db *gorm.DB) *DashboardHandler {
-	return &DashboardHandler{db: db}
+func NewDashboardHandler(db *gorm.DB, cfg *config.Config) *DashboardHandler {
+	return &DashboardHandler{db: db, cfg: cfg}
 }
 
 func (h *DashboardHandler) Dashboard(c *fiber.Ctx) error {
@@ -31,6 +35,8 @@ func (h *DashboardHandler) Dashboard(c *fiber.Ctx) error {
 
 	// Add timestamp to URL parameters to ensure fresh request
 	timestamp := time.Now().Unix()
+	loc := h.cfg.Location()
+	now := time.Now().In(loc)
 
 	var stats struct {
 		TotalProducts   int64
@@ -38,173 +44,106 @@ func (h *DashboardHandler) Dashboard(c *fiber.Ctx) error {
 		TotalLicenses   int64
 		ActiveLicenses  int64
 		ExpiredLicenses int64
+		ExpiringSoon    int64
+		ExpiringToday   int64
 	}
 
-	h.db.Model(&models.Product{}).Count(&stats.TotalProducts)
-	h.db.Model(&models.Customer{}).Count(&stats.TotalCustomers)
-	h.db.Model(&models.LicenseKey{}).Count(&stats.TotalLicenses)
-	h.db.Model(&models.LicenseKey{}).Where("status = ?", "active").Count(&stats.ActiveLicenses)
-	h.db.Model(&models.LicenseKey{}).Where("expires_at < ?", time.Now()).Count(&stats.ExpiredLicenses)
+	// Tenant admins only count their own records
+	db := h.db.Scopes(tenantScope(c)).Session(&gorm.Session{})
 
-	var recentLicenses []models.LicenseKey
-	h.db.Preload("Product").Preload("Customer").
-		Order("created_at DESC").
-		Limit(10).
-		Find(&recentLicenses)
+	db.Model(&models.Product{}).Count(&stats.TotalProducts)
+	db.Model(&models.Customer{}).Count(&stats.TotalCustomers)
+	db.Model(&models.LicenseKey{}).Count(&stats.TotalLicenses)
+	db.Model(&models.LicenseKey{}).Where("status = ?", "active").Count(&stats.ActiveLicenses)
+	stats.ExpiredLicenses, _ = models.CountExpiredLicenseKeys(db, now)
+	stats.ExpiringSoon, _ = models.CountExpiringSoon(db, now, models.ExpiringSoonWindow)
+
+	// "Today" is the current day in the configured display timezone
+	dayStart, dayEnd := models.DayBounds(now, loc)
+	db.Model(&models.LicenseKey{}).Where("expires_at >= ? AND expires_at < ?", dayStart, dayEnd).Count(&stats.ExpiringToday)
+
+	// Sales are summed per currency; converting between them is out of scope
+	revenue, err := models.RevenueByCurrency(db)
+	if err != nil {
+		log.Printf("Failed to load revenue: %v", err)
+	}
+	productRevenue, err := models.RevenueByProduct(db)
+	if err != nil {
+		log.Printf("Failed to load revenue by product: %v", err)
+	}
+
+	filter := activityFilterFromQuery(c, loc)
+	filter.OwnerID = middleware.CurrentOwnerID(c)
+	activity, err := models.RecentActivity(h.db, filter)
+	if err != nil {
+		log.Printf("Failed to load recent activity: %v", err)
+	}
 
 	// Render dashboard with safe fallback
 	return SafeRender(c, "admin/dashboard/index", fiber.Map{
 		"ShowNav":            true,
 		"PageType":           "dashboard",
-		"Title":              "Dashboard - Live " + time.Now().Format("15:04:05"),
+		"Title":              "Dashboard - Live " + now.Format("15:04:05"),
 		"ProductCount":       stats.TotalProducts,
 		"CustomerCount":      stats.TotalCustomers,
 		"TotalLicenseCount":  stats.TotalLicenses,
 		"ActiveLicenseCount": stats.ActiveLicenses,
-		"RecentLicenses":     recentLicenses,
+		"ExpiredCount":       stats.ExpiredLicenses,
+		"ExpiringSoonCount":  stats.ExpiringSoon,
+		"ExpiringTodayCount": stats.ExpiringToday,
+		"Revenue":            revenue,
+		"ProductRevenue":     productRevenue,
+		"Activity":           activity,
+		"ActivityTypes":      models.ActivityTypes,
+		"ActivityType":       filter.Type,
+		"ActivityFrom":       c.Query("from"),
+		"ActivityTo":         c.Query("to"),
+		"ActivityMore":       moreActivityQuery(c, filter, len(activity)),
 		"CacheBuster":        timestamp,
-		"CurrentTime":        time.Now().Format("2006-01-02 15:04:05"),
+		"CurrentTime":        now.Format("2006-01-02 15:04:05 MST"),
 	})
 }
 
-// Email Configuration
-func (h *DashboardHandler) EmailConfigPage(c *fiber.Ctx) error {
-	var settings models.EmailSettings
+// Activity feed page sizes; "load more" adds activityPageSize entries at a time
+const (
+	activityPageSize = 10
+	maxActivity      = 100
+)
 
-	// Try to get active email settings
-	activeSettings, err := models.GetActiveEmailSettings(h.db)
-	if err != nil {
-		// No active settings found, show empty form
-		settings = models.EmailSettings{
-			SMTPPort:       587,
-			SMTPEncryption: "tls",
+// activityFilterFromQuery reads the feed's type, from and to (YYYY-MM-DD days
+// in loc, both inclusive) and limit query params. Invalid values are ignored.
+func activityFilterFromQuery(c *fiber.Ctx, loc *time.Location) models.ActivityFilter {
+	filter := models.ActivityFilter{Limit: activityPageSize}
+	for _, kind := range models.ActivityTypes {
+		if c.Query("type") == kind {
+			filter.Type = kind
 		}
-	} else {
-		settings = *activeSettings
-	}
-
-	// Try to render template, fallback to JSON if no template engine
-	return SafeRender(c, "admin/dashboard/email-config", fiber.Map{
-		"ShowNav":   true,
-		"Config":    settings,
-		"CSRFToken": "",
-	})
-}
-
-func (h *DashboardHandler) EmailConfigUpdate(c *fiber.Ctx) error {
-	// Extract form values
-	smtpHost := c.FormValue("smtp_host")
-	smtpPortStr := c.FormValue("smtp_port")
-	smtpUsername := c.FormValue("smtp_username")
-	smtpPassword := c.FormValue("smtp_password")
-	smtpEncryption := c.FormValue("smtp_encryption")
-	fromEmail := c.FormValue("from_email")
-	fromName := c.FormValue("from_name")
-
-	// Validate SMTP port
-	smtpPort, err := strconv.Atoi(smtpPortStr)
-	if err != nil || smtpPort <= 0 || smtpPort > 65535 {
-		return c.Status(400).JSON(fiber.Map{
-			"error": "Invalid SMTP port",
-		})
 	}
-
-	// Create or update email settings
-	var settings models.EmailSettings
-	// Try to get any existing settings (not just active ones)
-	if err := h.db.First(&settings).Error; err != nil {
-		// Create new settings if none exist
-		settings = models.EmailSettings{
-			Provider:       c.FormValue("provider"), // Get provider from form
-			SMTPHost:       smtpHost,
-			SMTPPort:       smtpPort,
-			SMTPUsername:   smtpUsername,
-			SMTPPassword:   smtpPassword,
-			SMTPEncryption: smtpEncryption,
-			FromEmail:      fromEmail,
-			FromName:       fromName,
-			IsActive:       true,
-		}
-	} else {
-		// Update existing settings
-		if provider := c.FormValue("provider"); provider != "" {
-			settings.Provider = provider
-		}
-		settings.SMTPHost = smtpHost
-		settings.SMTPPort = smtpPort
-		settings.SMTPUsername = smtpUsername
-		settings.SMTPPassword = smtpPassword
-		settings.SMTPEncryption = smtpEncryption
-		settings.FromEmail = fromEmail
-		settings.FromName = fromName
-		settings.IsActive = true // Make it active when updating
+	if day, err := time.ParseInLocation("2006-01-02", c.Query("from"), loc); err == nil {
+		filter.Since, _ = models.DayBounds(day, loc)
 	}
-
-	// Save to database
-	if err := settings.Save(h.db); err != nil {
-		return SafeRenderWithStatus(c, 500, "admin/email-config", fiber.Map{
-			"ShowNav":   true,
-			"Error":     fmt.Sprintf("Failed to save email configuration: %v", err),
-			"Config":    settings,
-			"CSRFToken": "",
-		}, fmt.Sprintf("Failed to save email configuration: %v", err))
+	if day, err := time.ParseInLocation("2006-01-02", c.Query("to"), loc); err == nil {
+		_, filter.Until = models.DayBounds(day, loc)
 	}
-
-	// Try to render success template, fallback to redirect
-	if renderErr := c.Render("admin/email-config", fiber.Map{
-		"ShowNav":   true,
-		"Success":   "Email configuration saved successfully",
-		"Config":    settings,
-		"CSRFToken": "",
-	}); renderErr != nil {
-		return c.Redirect("/admin/email-config")
+	if limit, err := strconv.Atoi(c.Query("limit")); err == nil && limit > 0 {
+		filter.Limit = min(limit, maxActivity)
 	}
-	return nil
+	return filter
 }
 
-func (h *DashboardHandler) EmailTestSend(c *fiber.Ctx) error {
-	testEmail := c.FormValue("test_email")
-	if testEmail == "" {
-		settings, _ := models.GetActiveEmailSettings(h.db)
-		if settings == nil {
-			settings = &models.EmailSettings{}
-		}
-		return c.Render("admin/email-config", fiber.Map{
-			"ShowNav":   true,
-			"Error":     "Please enter a test email address",
-			"Config":    *settings,
-			"CSRFToken": "",
-		})
+// moreActivityQuery is the query string that loads the next batch of the feed
+// with the same filters, or empty when everything matching is shown. It is
+// already encoded, so it is a template.URL the view won't escape again.
+func moreActivityQuery(c *fiber.Ctx, filter models.ActivityFilter, shown int) template.URL {
+	if shown < filter.Limit || filter.Limit >= maxActivity {
+		return ""
 	}
-
-	// Get current settings for display
-	settings, err := models.GetActiveEmailSettings(h.db)
-	if err != nil {
-		return c.Render("admin/email-config", fiber.Map{
-			"ShowNav":   true,
-			"Error":     "No email configuration found. Please configure email settings first.",
-			"Config":    models.EmailSettings{},
-			"CSRFToken": "",
-		})
-	}
-
-	// Send a test email
-	cfg := config.New()
-	emailService := services.NewEmailService(cfg, h.db)
-	err = emailService.SendTestEmail(testEmail)
-	if err != nil {
-		return c.Render("admin/email-config", fiber.Map{
-			"ShowNav":   true,
-			"Error":     fmt.Sprintf("Failed to send test email: %v", err),
-			"Config":    *settings,
-			"CSRFToken": "",
-		})
+	query := url.Values{}
+	for _, param := range []string{"type", "from", "to"} {
+		if value := c.Query(param); value != "" {
+			query.Set(param, value)
+		}
 	}
-
-	return c.Render("admin/email-config", fiber.Map{
-		"ShowNav":   true,
-		"Success":   fmt.Sprintf("Test email sent successfully to %s", testEmail),
-		"Config":    *settings,
-		"CSRFToken": "",
-	})
+	query.Set("limit", strconv.Itoa(min(filter.Limit+activityPageSize, maxActivity)))
+	return template.URL(query.Encode())
 }
@@ -1,12 +1,14 @@
 package handlers
 
 import (
-	"net/url"
+	"io"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"matcha/internal/config"
 	"matcha/internal/models"
 	"matcha/internal/testutils"
 )
@@ -16,7 +18,7 @@ func TestDashboardHandler_Integration(t *testing.T) {
 	t.Run("Dashboard - Empty Stats", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewDashboardHandler(db)
+		handler := NewDashboardHandler(db, config.New())
 
 		app.Get("/dashboard", handler.Dashboard)
 
@@ -27,7 +29,7 @@ func TestDashboardHandler_Integration(t *testing.T) {
 	t.Run("Dashboard - With Statistics", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewDashboardHandler(db)
+		handler := NewDashboardHandler(db, config.New())
 
 		app.Get("/dashboard", handler.Dashboard)
 
@@ -57,140 +59,135 @@ func TestDashboardHandler_Integration(t *testing.T) {
 		assert.Equal(t, 200, resp.StatusCode)
 	})
 
-	t.Run("EmailConfigPage - Display Email Configuration", func(t *testing.T) {
+	t.Run("Dashboard - Expired Count Skips Perpetual And Revoked", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewDashboardHandler(db)
+		handler := NewDashboardHandler(db, config.New())
 
-		app.Get("/email-config", handler.EmailConfigPage)
+		app.Get("/dashboard", handler.Dashboard)
 
-		resp := testutils.TestRequest(t, app, "GET", "/email-config", "")
-		assert.Equal(t, 200, resp.StatusCode)
-	})
+		product := models.Product{Name: "Test Product", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
 
-	t.Run("EmailConfigPage - With Existing Settings", func(t *testing.T) {
-		db := testutils.SetupTestDB(t)
-		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewDashboardHandler(db)
-
-		app.Get("/email-config", handler.EmailConfigPage)
-
-		// Create email settings
-		emailSettings := models.EmailSettings{
-			Provider:     "Gmail",
-			SMTPHost:     "smtp.gmail.com",
-			SMTPPort:     587,
-			SMTPUsername: "test@gmail.com",
-			SMTPPassword: "password",
-			FromEmail:    "test@gmail.com",
-			FromName:     "Test App",
-			IsActive:     true,
+		past := time.Now().AddDate(0, 0, -10)
+		soon := time.Now().AddDate(0, 0, 10)
+		keys := []models.LicenseKey{
+			{Key: "EXPIRED", ExpiresAt: &past, Status: "active"},
+			{Key: "REVOKED", ExpiresAt: &past, Status: "revoked"},
+			{Key: "PERPETUAL", Status: "active"},
+			{Key: "SOON", ExpiresAt: &soon, Status: "active"},
+		}
+		for i := range keys {
+			keys[i].ProductID = product.ID
+			keys[i].CustomerID = customer.ID
+			require.NoError(t, db.Create(&keys[i]).Error)
 		}
-		require.NoError(t, db.Create(&emailSettings).Error)
 
-		resp := testutils.TestRequest(t, app, "GET", "/email-config", "")
+		resp := testutils.TestRequest(t, app, "GET", "/dashboard", "")
 		assert.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "1 expiring in the next 30 days &middot; 1 expired")
 	})
 
-	t.Run("EmailConfigUpdate - Valid Configuration", func(t *testing.T) {
+	t.Run("Dashboard - Revenue Summed Per Currency", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewDashboardHandler(db)
-
-		app.Post("/email-config", handler.EmailConfigUpdate)
-
-		form := url.Values{
-			"provider":      {"Gmail"},
-			"smtp_host":     {"smtp.gmail.com"},
-			"smtp_port":     {"587"},
-			"smtp_username": {"test@gmail.com"},
-			"smtp_password": {"password"},
-			"from_email":    {"test@gmail.com"},
-			"from_name":     {"Test App"},
-			"is_active":     {"true"},
-		}
+		handler := NewDashboardHandler(db, config.New())
 
-		resp := testutils.TestRequest(t, app, "POST", "/email-config", form.Encode())
-		assert.Equal(t, 302, resp.StatusCode) // Should redirect
+		app.Get("/dashboard", handler.Dashboard)
 
-		// Verify email settings were created/updated
-		var emailSettings models.EmailSettings
-		err := db.First(&emailSettings).Error
-		require.NoError(t, err)
-		assert.Equal(t, "Gmail", emailSettings.Provider)
-		assert.Equal(t, "smtp.gmail.com", emailSettings.SMTPHost)
-		assert.Equal(t, 587, emailSettings.SMTPPort)
-		assert.Equal(t, "test@gmail.com", emailSettings.SMTPUsername)
-		assert.Equal(t, "test@gmail.com", emailSettings.FromEmail)
-		assert.Equal(t, "Test App", emailSettings.FromName)
-		assert.True(t, emailSettings.IsActive)
-	})
+		pro := models.Product{Name: "Pro Plan", Version: "1.0.0"}
+		require.NoError(t, db.Create(&pro).Error)
+		lite := models.Product{Name: "Lite Plan", Version: "1.0.0"}
+		require.NoError(t, db.Create(&lite).Error)
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
 
-	t.Run("EmailConfigUpdate - Update Existing Settings", func(t *testing.T) {
-		db := testutils.SetupTestDB(t)
-		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewDashboardHandler(db)
-
-		app.Post("/email-config", handler.EmailConfigUpdate)
-
-		// Create existing settings
-		emailSettings := models.EmailSettings{
-			Provider:     "SendGrid",
-			SMTPHost:     "smtp.sendgrid.net",
-			SMTPPort:     587,
-			SMTPUsername: "apikey",
-			SMTPPassword: "old_password",
-			FromEmail:    "old@example.com",
-			FromName:     "Old App",
-			IsActive:     false,
+		keys := []models.LicenseKey{
+			{Key: "PRO-USD-1", ProductID: pro.ID, Price: 4900, Currency: "USD"},
+			{Key: "PRO-USD-2", ProductID: pro.ID, Price: 4900, Currency: "USD"},
+			{Key: "PRO-EUR", ProductID: pro.ID, Price: 4500, Currency: "EUR"},
+			{Key: "LITE-USD", ProductID: lite.ID, Price: 1999, Currency: "USD"},
+			{Key: "MANUAL", ProductID: lite.ID},
 		}
-		require.NoError(t, db.Create(&emailSettings).Error)
-
-		// Update with new values
-		form := url.Values{
-			"provider":      {"Gmail"},
-			"smtp_host":     {"smtp.gmail.com"},
-			"smtp_port":     {"587"},
-			"smtp_username": {"new@gmail.com"},
-			"smtp_password": {"new_password"},
-			"from_email":    {"new@gmail.com"},
-			"from_name":     {"New App"},
-			"is_active":     {"true"},
+		for i := range keys {
+			keys[i].CustomerID = customer.ID
+			require.NoError(t, db.Create(&keys[i]).Error)
 		}
 
-		resp := testutils.TestRequest(t, app, "POST", "/email-config", form.Encode())
-		assert.Equal(t, 302, resp.StatusCode)
+		totals, err := models.RevenueByCurrency(db)
+		require.NoError(t, err)
+		assert.Equal(t, []models.RevenueTotal{
+			{Currency: "EUR", Amount: 4500, Sales: 1},
+			{Currency: "USD", Amount: 11799, Sales: 3},
+		}, totals)
 
-		// Verify settings were updated
-		var updatedSettings models.EmailSettings
-		err := db.First(&updatedSettings).Error
+		resp := testutils.TestRequest(t, app, "GET", "/dashboard", "")
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
 		require.NoError(t, err)
-		assert.Equal(t, "Gmail", updatedSettings.Provider)
-		assert.Equal(t, "new@gmail.com", updatedSettings.SMTPUsername)
-		assert.Equal(t, "new@gmail.com", updatedSettings.FromEmail)
-		assert.Equal(t, "New App", updatedSettings.FromName)
-		assert.True(t, updatedSettings.IsActive)
+		assert.Contains(t, string(body), "117.99 USD")
+		assert.Contains(t, string(body), "45.00 EUR")
+		assert.Contains(t, string(body), "98.00 USD", "per-product totals keep currencies apart")
+		assert.Contains(t, string(body), "19.99 USD")
 	})
 
-	t.Run("EmailConfigUpdate - Invalid Port", func(t *testing.T) {
+	t.Run("Dashboard - Activity Feed", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewDashboardHandler(db)
-
-		app.Post("/email-config", handler.EmailConfigUpdate)
-
-		form := url.Values{
-			"provider":      {"Gmail"},
-			"smtp_host":     {"smtp.gmail.com"},
-			"smtp_port":     {"invalid_port"},
-			"smtp_username": {"test@gmail.com"},
-			"smtp_password": {"password"},
-			"from_email":    {"test@gmail.com"},
-			"from_name":     {"Test App"},
+		handler := NewDashboardHandler(db, config.New())
+
+		app.Get("/dashboard", handler.Dashboard)
+
+		product := models.Product{Name: "Pro Plan", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+
+		manual := models.LicenseKey{Key: "MANUAL-KEY", ProductID: product.ID, CustomerID: customer.ID}
+		require.NoError(t, db.Create(&manual).Error)
+		sold := models.LicenseKey{Key: "SOLD-KEY", ProductID: product.ID, CustomerID: customer.ID}
+		require.NoError(t, db.Create(&sold).Error)
+		require.NoError(t, db.Create(&models.WebhookEvent{Provider: "stripe", Payload: "{}", Status: "processed", LicenseKeyID: &sold.ID}).Error)
+		refunded := models.LicenseKey{Key: "REFUNDED-KEY", ProductID: product.ID, CustomerID: customer.ID}
+		require.NoError(t, db.Create(&refunded).Error)
+		require.NoError(t, refunded.Revoke(db, "Refunded"))
+
+		events, err := models.RecentActivity(db, models.ActivityFilter{})
+		require.NoError(t, err)
+		kinds := map[string][]string{}
+		for _, event := range events {
+			kinds[event.Type] = append(kinds[event.Type], event.LicenseKey.Key)
 		}
+		assert.Equal(t, []string{"REFUNDED-KEY", "MANUAL-KEY"}, kinds[models.ActivityCreated])
+		assert.Equal(t, []string{"SOLD-KEY"}, kinds[models.ActivityProvisioned])
+		assert.Equal(t, []string{"REFUNDED-KEY"}, kinds[models.ActivityRevoked])
+		assert.Equal(t, models.ActivityRevoked, events[0].Type, "the revoke is the newest event")
+
+		get := func(path string) string {
+			resp := testutils.TestRequest(t, app, "GET", path, "")
+			require.Equal(t, 200, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return string(body)
+		}
+
+		body := get("/dashboard")
+		assert.Contains(t, body, "Refunded")
+		assert.Contains(t, body, "MANUAL-KEY")
+
+		body = get("/dashboard?type=revoked")
+		assert.Contains(t, body, "REFUNDED-KEY")
+		assert.NotContains(t, body, "MANUAL-KEY")
+		assert.NotContains(t, body, "SOLD-KEY")
+
+		body = get("/dashboard?type=provisioned&to=2000-01-01")
+		assert.NotContains(t, body, "SOLD-KEY", "the date filter excludes newer events")
 
-		resp := testutils.TestRequest(t, app, "POST", "/email-config", form.Encode())
-		// Should handle the error gracefully - could be 400 or redirect with error
-		assert.True(t, resp.StatusCode == 400 || resp.StatusCode == 302)
+		body = get("/dashboard?limit=1")
+		assert.Contains(t, body, "limit=11", "a full page offers to load more")
 	})
 }
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"matcha/internal/middleware"
+	"matcha/internal/models"
+)
+
+// formInput reads submitted fields from an HTML form or, for API clients, a
+// JSON object with the same field names. JSON numbers and booleans are read
+// back in their form spelling, so handlers parse both the same way.
+type formInput struct {
+	c    *fiber.Ctx
+	json map[string]interface{}
+}
+
+func parseFormInput(c *fiber.Ctx) (*formInput, error) {
+	input := &formInput{c: c}
+	if !isJSONRequest(c) {
+		return input, nil
+	}
+	if err := c.BodyParser(&input.json); err != nil {
+		return nil, err
+	}
+	if input.json == nil {
+		input.json = map[string]interface{}{} // A literal null body
+	}
+	return input, nil
+}
+
+// Value returns the named field, or "" when it was not submitted
+func (in *formInput) Value(name string) string {
+	if in.json == nil {
+		return in.c.FormValue(name)
+	}
+
+	switch value := in.json[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case bool:
+		return strconv.FormatBool(value)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		// Objects and arrays, e.g. metadata, are kept as raw JSON
+		raw, _ := json.Marshal(value)
+		return string(raw)
+	}
+}
+
+// Has reports whether the named field was submitted at all, so a field sent
+// blank on purpose can be told apart from one the client left out
+func (in *formInput) Has(name string) bool {
+	if in.json != nil {
+		_, ok := in.json[name]
+		return ok
+	}
+	if form, err := in.c.MultipartForm(); err == nil {
+		_, ok := form.Value[name]
+		return ok
+	}
+	return in.c.Request().PostArgs().Has(name)
+}
+
+// lockVersionFrom reads the lock_version an edit form was rendered with.
+// Clients that don't send it edit whatever version is current.
+func lockVersionFrom(form *formInput, current int) int {
+	if version, err := strconv.Atoi(form.Value("lock_version")); err == nil {
+		return version
+	}
+	return current
+}
+
+// sendEmailFlag reads the send_email flag every license creation path takes.
+// Values other than true or false keep the path's default: off when an admin
+// or integrator creates keys, on for payment webhooks.
+func sendEmailFlag(value string, byDefault bool) bool {
+	if send, err := strconv.ParseBool(value); err == nil {
+		return send
+	}
+	return byDefault
+}
+
+func isJSONRequest(c *fiber.Ctx) bool {
+	return strings.HasPrefix(string(c.Request().Header.ContentType()), fiber.MIMEApplicationJSON)
+}
+
+const staleRecordMessage = "This record was changed by someone else since you opened it. Reload the page and apply your changes again."
+
+// jsonError is the JSON counterpart of re-rendering a form with an error
+func jsonError(c *fiber.Ctx, status int, message string) error {
+	return c.Status(status).JSON(fiber.Map{"error": message})
+}
+
+// requestDB scopes db to the request's context, so its queries are cancelled
+// once the deadline set by middleware.QueryTimeout passes
+func requestDB(c *fiber.Ctx, db *gorm.DB) *gorm.DB {
+	return db.WithContext(c.UserContext())
+}
+
+// tenantScope narrows a query to the records the current admin's tenant owns,
+// see middleware.CurrentOwnerID. Records of other tenants then read as not
+// found.
+func tenantScope(c *fiber.Ctx) func(*gorm.DB) *gorm.DB {
+	return models.OwnedBy(middleware.CurrentOwnerID(c))
+}
@@ -1,28 +1,56 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
 
 	"matcha/internal/database"
+	"matcha/internal/middleware"
 	"matcha/internal/models"
+	"matcha/internal/services"
 )
 
 type LicenseKeysHandler struct {
-	db *gorm.DB
+	db      *gorm.DB
+	emailer services.LicenseKeySender
+	// Zone the admin form's expiry dates are entered in
+	loc *time.Location
 }
 
-func NewLicenseKeysHandler(db *gorm.DB) *LicenseKeysHandler {
-	return &LicenseKeysHandler{db: db}
+func NewLicenseKeysHandler(db *gorm.DB, emailer services.LicenseKeySender, loc *time.Location) *LicenseKeysHandler {
+	return &LicenseKeysHandler{db: db, emailer: emailer, loc: loc}
+}
+
+// emailQueued reports whether sender only queues emails, so a successful send
+// means the email is waiting for delivery rather than delivered, as
+// testEmailSuccess words it
+func emailQueued(sender services.LicenseKeySender) bool {
+	queuer, ok := sender.(interface{ Queued() bool })
+	return ok && queuer.Queued()
 }
 
 func (h *LicenseKeysHandler) Index(c *fiber.Ctx) error {
+	label := c.Query("label")
+	pagination := paginationFromQuery(c)
+
+	h.db.Model(&models.LicenseKey{}).Scopes(tenantScope(c), models.LicenseKeysLabeled(label)).Count(&pagination.Total)
+
 	var licenseKeys []models.LicenseKey
-	h.db.Preload("Product").Preload("Customer").
+	h.db.Scopes(tenantScope(c), models.LicenseKeysLabeled(label)).
+		Preload("Product").Preload("Customer").
 		Order("created_at DESC").
+		Offset(pagination.Offset()).
+		Limit(pagination.PerPage).
 		Find(&licenseKeys)
 
 	// Try to render template, fallback to JSON if no template engine
@@ -30,20 +58,64 @@ func (h *LicenseKeysHandler) Index(c *fiber.Ctx) error {
 		"ShowNav":     true,
 		"PageType":    "license-keys-index",
 		"LicenseKeys": licenseKeys,
+		"Label":       label,
+		"Pagination":  pagination,
 		"CSRFToken":   "",
 	}); err != nil {
 		return c.Status(200).JSON(fiber.Map{
 			"licenseKeys": licenseKeys,
+			"pagination":  pagination,
 		})
 	}
 	return nil
 }
 
+// Search finds license keys by the key string alone, across every product,
+// for support agents who don't know which product a customer bought. A single
+// match opens the key; several, possible since keys are only unique within a
+// product, are listed.
+func (h *LicenseKeysHandler) Search(c *fiber.Ctx) error {
+	key := strings.TrimSpace(c.Query("key"))
+	if key == "" {
+		return c.Redirect(middleware.AdminURL("/license-keys"))
+	}
+
+	matches, err := models.FindLicenseKeysByKey(requestDB(c, h.db).Scopes(tenantScope(c)), key)
+	if err != nil {
+		if wantsJSON(c) {
+			return jsonError(c, 500, "Failed to search license keys")
+		}
+		return c.Status(500).SendString("Failed to search license keys")
+	}
+
+	if wantsJSON(c) {
+		if len(matches) == 0 {
+			return jsonError(c, 404, "License key not found")
+		}
+		return c.JSON(fiber.Map{"licenseKeys": matches})
+	}
+	if len(matches) == 1 {
+		return c.Redirect(middleware.AdminURL("/license-keys/") + strconv.Itoa(int(matches[0].ID)))
+	}
+
+	status := fiber.StatusOK
+	if len(matches) == 0 {
+		status = fiber.StatusNotFound
+	}
+	return c.Status(status).Render("admin/license-keys/index", fiber.Map{
+		"ShowNav":     true,
+		"PageType":    "license-keys-index",
+		"LicenseKeys": matches,
+		"Search":      key,
+		"CSRFToken":   "",
+	})
+}
+
 func (h *LicenseKeysHandler) New(c *fiber.Ctx) error {
 	var products []models.Product
 	var customers []models.Customer
-	h.db.Find(&products)
-	h.db.Find(&customers)
+	h.db.Scopes(tenantScope(c)).Find(&products)
+	h.db.Scopes(tenantScope(c)).Find(&customers)
 
 	// Try to render template, fallback to JSON if no template engine
 	if err := c.Render("admin/license-keys/new", fiber.Map{
@@ -62,20 +134,36 @@ func (h *LicenseKeysHandler) New(c *fiber.Ctx) error {
 }
 
 func (h *LicenseKeysHandler) Create(c *fiber.Ctx) error {
-	productID, _ := strconv.Atoi(c.FormValue("product_id"))
-	customerID, _ := strconv.Atoi(c.FormValue("customer_id"))
-	key := c.FormValue("key")
-	maxActivations, _ := strconv.Atoi(c.FormValue("max_activations"))
+	db := requestDB(c, h.db)
+	form, err := parseFormInput(c)
+	if err != nil {
+		return jsonError(c, 400, "Invalid JSON body")
+	}
+
+	productID, _ := strconv.Atoi(form.Value("product_id"))
+	customerID, _ := strconv.Atoi(form.Value("customer_id"))
+	key := form.Value("key")
+	maxActivations, _ := strconv.Atoi(form.Value("max_activations"))
+	perpetual := form.Value("perpetual") == "true"
 
 	var product models.Product
 	var customer models.Customer
 
-	if err := h.db.First(&product, productID).Error; err != nil {
-		return c.Status(400).SendString("Invalid product")
+	errs := ValidationErrors{}
+	if err := db.Scopes(tenantScope(c)).First(&product, productID).Error; err != nil {
+		errs.Add("product_id", "Invalid product")
+	}
+	if err := db.Scopes(tenantScope(c)).First(&customer, customerID).Error; err != nil {
+		errs.Add("customer_id", "Invalid customer")
+	}
+	if len(errs) > 0 {
+		submitted := models.LicenseKey{ProductID: uint(productID), CustomerID: uint(customerID), Key: key, MaxActivations: maxActivations}
+		return h.renderNew(c, 400, submitted, form, errs, errs.Error())
 	}
 
-	if err := h.db.First(&customer, customerID).Error; err != nil {
-		return c.Status(400).SendString("Invalid customer")
+	// Ticking perpetual issues a lifetime key even when the product defaults to an expiry
+	if perpetual {
+		product.Perpetual = true
 	}
 
 	// Create license key with provided details or generate defaults
@@ -85,49 +173,131 @@ func (h *LicenseKeysHandler) Create(c *fiber.Ctx) error {
 		Key:                key,
 		MaxActivations:     maxActivations,
 		CurrentActivations: 0,
+		PurchasedVersion:   product.Version,
+		LicenseType:        models.NormalizeLicenseType(product.LicenseType),
+		Metadata:           product.DefaultMetadata,
 		Status:             "active",
 		IsTrial:            false,
+		OwnerID:            product.OwnerID,
 	}
 
-	// If no key provided, generate one
 	if licenseKey.Key == "" {
-		generatedKey, err := product.GenerateLicenseKeyFor(h.db, &customer)
+		// If no key provided, generate one
+		licenseKey, err = product.GenerateLicenseKeyFor(db, &customer)
 		if err != nil {
+			if wantsJSON(c) {
+				return jsonError(c, 500, "Failed to create license key")
+			}
 			return c.Status(500).SendString("Failed to create license key")
 		}
-		return c.Redirect("/admin/license-keys/" + strconv.Itoa(int(generatedKey.ID)))
-	}
+	} else {
+		// If max activations not provided, use product default
+		if licenseKey.MaxActivations == 0 {
+			licenseKey.MaxActivations = product.DefaultUsageLimit
+		}
 
-	// If max activations not provided, use product default
-	if licenseKey.MaxActivations == 0 {
-		licenseKey.MaxActivations = product.DefaultUsageLimit
+		// Set expiration if product has default
+		if product.DefaultExpirationDays > 0 {
+			licenseKey.ExpiresAt = product.DefaultExpiry(time.Now())
+		}
+
+		err = database.PerformWrite(db, func(db *gorm.DB) error {
+			return db.Create(licenseKey).Error
+		})
+		if models.IsUniqueViolation(err) {
+			return h.renderNew(c, 409, *licenseKey, form, ValidationErrors{"key": duplicateKeyMessage}, duplicateKeyMessage)
+		}
+		if err != nil {
+			if wantsJSON(c) {
+				return jsonError(c, 500, "Failed to create license key")
+			}
+			return c.Status(500).SendString("Failed to create license key")
+		}
+	}
+	licenseKey.Product = product
+	licenseKey.Customer = customer
+
+	// Keys an admin creates aren't emailed unless asked for; the key exists
+	// either way, so a failed email is reported rather than fatal
+	flash, message := middleware.FlashSuccess, "License key created"
+	if sendEmailFlag(form.Value("send_email"), false) {
+		if h.emailer == nil {
+			flash, message = middleware.FlashError, "License key created, but email is not configured"
+		} else if err := h.emailer.SendLicenseKey(licenseKey); err != nil {
+			log.Printf("Failed to email new license key %d: %v", licenseKey.ID, err)
+			flash, message = middleware.FlashError, "License key created, but the email could not be sent: "+err.Error()
+		} else if emailQueued(h.emailer) {
+			message = "License key created; the email to " + customer.Email + " is queued for delivery"
+		} else {
+			message = "License key created and emailed to " + customer.Email
+		}
 	}
 
-	// Set expiration if product has default
-	if product.DefaultExpirationDays > 0 {
-		expiresAt := time.Now().AddDate(0, 0, product.DefaultExpirationDays)
-		licenseKey.ExpiresAt = &expiresAt
+	if wantsJSON(c) {
+		return c.Status(201).JSON(licenseKey)
 	}
+	middleware.SetFlash(c, flash, message)
+	return c.Redirect(middleware.AdminURL("/license-keys/") + strconv.Itoa(int(licenseKey.ID)))
+}
 
-	if err := h.db.Create(licenseKey).Error; err != nil {
-		return c.Status(500).SendString("Failed to create license key")
+// renderNew shows the new form again, keeping what was submitted, with msg
+// above it and errs under their fields
+func (h *LicenseKeysHandler) renderNew(c *fiber.Ctx, status int, licenseKey models.LicenseKey, form *formInput, errs ValidationErrors, msg string) error {
+	if wantsJSON(c) {
+		return jsonError(c, status, msg)
 	}
 
-	return c.Redirect("/admin/license-keys/" + strconv.Itoa(int(licenseKey.ID)))
+	var products []models.Product
+	var customers []models.Customer
+	h.db.Scopes(tenantScope(c)).Find(&products)
+	h.db.Scopes(tenantScope(c)).Find(&customers)
+
+	return c.Status(status).Render("admin/license-keys/new", fiber.Map{
+		"ShowNav":          true,
+		"PageType":         "license-keys-new",
+		"Error":            msg,
+		"LicenseKey":       licenseKey,
+		"Perpetual":        form.Value("perpetual") == "true",
+		"SendEmail":        sendEmailFlag(form.Value("send_email"), false),
+		"ValidationErrors": errs,
+		"Products":         products,
+		"Customers":        customers,
+		"CSRFToken":        "",
+	})
 }
 
+// duplicateKeyMessage explains a rejected hand-entered key. Keys only need to
+// be unique within their product.
+const duplicateKeyMessage = "This product already has a license key with that value"
+
 func (h *LicenseKeysHandler) Show(c *fiber.Ctx) error {
 	id, _ := strconv.Atoi(c.Params("id"))
 	var licenseKey models.LicenseKey
-	if err := h.db.Preload("Product").Preload("Customer").First(&licenseKey, id).Error; err != nil {
+	if err := h.db.Scopes(tenantScope(c)).Preload("Product").Preload("Customer").First(&licenseKey, id).Error; err != nil {
 		return c.Status(404).SendString("License key not found")
 	}
 
+	emailLogs, err := models.EmailLogsForLicenseKey(h.db, licenseKey.ID)
+	if err != nil {
+		log.Printf("Failed to load email log for license key %d: %v", licenseKey.ID, err)
+	}
+	notes, err := models.NotesForLicenseKey(h.db, licenseKey.ID)
+	if err != nil {
+		log.Printf("Failed to load notes for license key %d: %v", licenseKey.ID, err)
+	}
+	rotations, err := models.RotationsForLicenseKey(h.db, licenseKey.ID)
+	if err != nil {
+		log.Printf("Failed to load rotations for license key %d: %v", licenseKey.ID, err)
+	}
+
 	// Try to render template, fallback to JSON if no template engine
 	if err := c.Render("admin/license-keys/show", fiber.Map{
 		"ShowNav":    true,
 		"PageType":   "license-keys-show",
 		"LicenseKey": licenseKey,
+		"EmailLogs":  emailLogs,
+		"Notes":      notes,
+		"Rotations":  rotations,
 	}); err != nil {
 		return c.Status(200).JSON(fiber.Map{
 			"licenseKey": licenseKey,
@@ -139,14 +309,14 @@ func (h *LicenseKeysHandler) Show(c *fiber.Ctx) error {
 func (h *LicenseKeysHandler) Edit(c *fiber.Ctx) error {
 	id, _ := strconv.Atoi(c.Params("id"))
 	var licenseKey models.LicenseKey
-	if err := h.db.Preload("Product").Preload("Customer").First(&licenseKey, id).Error; err != nil {
+	if err := h.db.Scopes(tenantScope(c)).Preload("Product").Preload("Customer").First(&licenseKey, id).Error; err != nil {
 		return c.Status(404).SendString("License key not found")
 	}
 
 	var products []models.Product
 	var customers []models.Customer
-	h.db.Find(&products)
-	h.db.Find(&customers)
+	h.db.Scopes(tenantScope(c)).Find(&products)
+	h.db.Scopes(tenantScope(c)).Find(&customers)
 
 	// Try to render template, fallback to JSON if no template engine
 	if err := c.Render("admin/license-keys/edit", fiber.Map{
@@ -167,111 +337,597 @@ func (h *LicenseKeysHandler) Edit(c *fiber.Ctx) error {
 }
 
 func (h *LicenseKeysHandler) Update(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
+	form, err := parseFormInput(c)
+	if err != nil {
+		return jsonError(c, 400, "Invalid JSON body")
+	}
+
 	// Accept both PUT requests and POST requests with _method=PUT
-	if c.Method() != "PUT" && !(c.Method() == "POST" && c.FormValue("_method") == "PUT") {
+	if c.Method() != "PUT" && !(c.Method() == "POST" && form.Value("_method") == "PUT") {
 		return c.Status(405).SendString("Method not allowed")
 	}
 
 	id, _ := strconv.Atoi(c.Params("id"))
 	var licenseKey models.LicenseKey
-	if err := h.db.First(&licenseKey, id).Error; err != nil {
+	if err := db.Scopes(tenantScope(c)).First(&licenseKey, id).Error; err != nil {
+		if wantsJSON(c) {
+			return jsonError(c, 404, "License key not found")
+		}
 		return c.Status(404).SendString("License key not found")
 	}
 
-	// Update product ID
-	if productID, err := strconv.Atoi(c.FormValue("product_id")); err == nil && productID > 0 {
-		licenseKey.ProductID = uint(productID)
+	expectedVersion := lockVersionFrom(form, licenseKey.LockVersion)
+
+	errs := ValidationErrors{}
+
+	// Update product ID. The key belongs to its product's tenant, so moving it
+	// moves the owner too.
+	if productID, err := strconv.Atoi(form.Value("product_id")); err == nil && productID > 0 && uint(productID) != licenseKey.ProductID {
+		var product models.Product
+		if err := db.Scopes(tenantScope(c)).First(&product, productID).Error; err != nil {
+			errs.Add("product_id", "Invalid product")
+		} else {
+			licenseKey.ProductID = product.ID
+			licenseKey.OwnerID = product.OwnerID
+		}
 	}
 
 	// Update customer ID
-	if customerID, err := strconv.Atoi(c.FormValue("customer_id")); err == nil && customerID > 0 {
-		licenseKey.CustomerID = uint(customerID)
+	if customerID, err := strconv.Atoi(form.Value("customer_id")); err == nil && customerID > 0 && uint(customerID) != licenseKey.CustomerID {
+		if err := db.Scopes(tenantScope(c)).First(&models.Customer{}, customerID).Error; err != nil {
+			errs.Add("customer_id", "Invalid customer")
+		} else {
+			licenseKey.CustomerID = uint(customerID)
+		}
 	}
 
-	// Update expiration date - handle both date and datetime-local formats
-	if expiresAtStr := c.FormValue("expires_at"); expiresAtStr != "" {
-		// Try datetime-local format first (YYYY-MM-DDTHH:MM)
-		if expiresAt, err := time.Parse("2006-01-02T15:04", expiresAtStr); err == nil {
-			licenseKey.ExpiresAt = &expiresAt
-		} else if expiresAt, err := time.Parse("2006-01-02", expiresAtStr); err == nil {
-			// Fallback to date format (YYYY-MM-DD)
-			licenseKey.ExpiresAt = &expiresAt
+	// Update expiration date, entered in the configured timezone
+	if expiresAt, ok := parseLocalExpiry(form.Value("expires_at"), h.loc); ok {
+		// A past date invalidates the key at once, so backdating needs the
+		// override. Resubmitting an already-past expiry unchanged is fine.
+		if expiryChanged(licenseKey.ExpiresAt, expiresAt) && expiresAt.Before(time.Now()) &&
+			form.Value("allow_past_expiry") != "true" {
+			errs.Add("expires_at", pastExpiryMessage)
 		}
-		// If neither format works, leave ExpiresAt unchanged
+		licenseKey.ExpiresAt = &expiresAt
 	}
 
 	// Update max activations
-	if maxActivations, err := strconv.Atoi(c.FormValue("max_activations")); err == nil {
+	if maxActivations, err := strconv.Atoi(form.Value("max_activations")); err == nil {
 		licenseKey.MaxActivations = maxActivations
 	}
 
 	// Update usage limit
-	if usageLimit, err := strconv.Atoi(c.FormValue("usage_limit")); err == nil {
+	if usageLimit, err := strconv.Atoi(form.Value("usage_limit")); err == nil {
 		licenseKey.UsageLimit = usageLimit
 	}
 
-	licenseKey.Metadata = c.FormValue("metadata")
+	licenseKey.SetLabels(form.Value("labels"))
+
+	// The form sends metadata as key/value rows; older clients still post raw JSON
+	if keys := formValues(c, "metadata_key"); len(keys) > 0 {
+		metadata, err := models.MetadataFromPairs(keys, formValues(c, "metadata_value"))
+		if err == nil {
+			err = licenseKey.SetMetadataMap(metadata)
+		}
+		if err != nil {
+			errs.Add("metadata", "Invalid metadata: "+err.Error())
+		}
+	} else {
+		licenseKey.Metadata = form.Value("metadata")
+	}
+	if len(errs) > 0 {
+		return h.renderEdit(c, 400, licenseKey, errs, errs.Error())
+	}
 
-	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
-		return db.Save(&licenseKey).Error
+	err = database.PerformWrite(db, func(db *gorm.DB) error {
+		return models.SaveIfUnchanged(db, &licenseKey, expectedVersion)
 	})
+	if errors.Is(err, models.ErrStaleRecord) {
+		return h.renderEdit(c, 409, licenseKey, nil, staleRecordMessage)
+	}
 	if err != nil {
-		var products []models.Product
-		var customers []models.Customer
-		h.db.Find(&products)
-		h.db.Find(&customers)
-
-		return c.Render("admin/license-keys/edit", fiber.Map{
-			"Error":      "Failed to update license key: " + err.Error(),
-			"LicenseKey": licenseKey,
-			"Products":   products,
-			"Customers":  customers,
-			"CSRFToken":  "",
-		})
+		if wantsJSON(c) {
+			return jsonError(c, 500, "Failed to update license key: "+err.Error())
+		}
+		return h.renderEdit(c, 200, licenseKey, nil, "Failed to update license key: "+err.Error())
+	}
+
+	if wantsJSON(c) {
+		return c.JSON(licenseKey)
+	}
+
+	middleware.SetFlash(c, middleware.FlashSuccess, "License key updated")
+	return c.Redirect(middleware.AdminURL("/license-keys/") + c.Params("id"))
+}
+
+// renderEdit shows the edit form again with msg above it and errs under
+// their fields
+func (h *LicenseKeysHandler) renderEdit(c *fiber.Ctx, status int, licenseKey models.LicenseKey, errs ValidationErrors, msg string) error {
+	if wantsJSON(c) {
+		return jsonError(c, status, msg)
 	}
 
-	return c.Redirect("/admin/license-keys/" + c.Params("id"))
+	var products []models.Product
+	var customers []models.Customer
+	h.db.Scopes(tenantScope(c)).Find(&products)
+	h.db.Scopes(tenantScope(c)).Find(&customers)
+
+	return c.Status(status).Render("admin/license-keys/edit", fiber.Map{
+		"ShowNav":          true,
+		"PageType":         "license-keys-edit",
+		"Error":            msg,
+		"LicenseKey":       licenseKey,
+		"ValidationErrors": errs,
+		"Products":         products,
+		"Customers":        customers,
+		"CSRFToken":        "",
+	})
 }
 
 func (h *LicenseKeysHandler) Delete(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
 	id, _ := strconv.Atoi(c.Params("id"))
-	if err := h.db.Delete(&models.LicenseKey{}, id).Error; err != nil {
+	err := database.PerformWrite(db, func(db *gorm.DB) error {
+		return db.Scopes(tenantScope(c)).Delete(&models.LicenseKey{}, id).Error
+	})
+	if err != nil {
 		return c.Status(500).SendString("Failed to delete license key")
 	}
 
-	return c.Redirect("/admin/license-keys")
+	middleware.SetFlash(c, middleware.FlashSuccess, "License key deleted")
+	return c.Redirect(middleware.AdminURL("/license-keys"))
 }
 
 func (h *LicenseKeysHandler) Revoke(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
 	id, _ := strconv.Atoi(c.Params("id"))
 	var licenseKey models.LicenseKey
-	if err := h.db.First(&licenseKey, id).Error; err != nil {
+	if err := db.Scopes(tenantScope(c)).First(&licenseKey, id).Error; err != nil {
 		return c.Status(404).SendString("License key not found")
 	}
 
-	if err := licenseKey.Revoke(h.db); err != nil {
+	reason := c.FormValue("reason")
+	err := database.PerformWrite(db, func(db *gorm.DB) error {
+		return licenseKey.Revoke(db, reason)
+	})
+	if err != nil {
 		return c.Status(500).SendString("Failed to revoke license key")
 	}
 
-	return c.Redirect("/admin/license-keys/" + c.Params("id"))
+	middleware.SetFlash(c, middleware.FlashSuccess, "License key revoked")
+	return c.Redirect(middleware.AdminURL("/license-keys/") + c.Params("id"))
 }
 
 func (h *LicenseKeysHandler) Reactivate(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
 	id, _ := strconv.Atoi(c.Params("id"))
 	var licenseKey models.LicenseKey
-	if err := h.db.First(&licenseKey, id).Error; err != nil {
+	if err := db.Scopes(tenantScope(c)).First(&licenseKey, id).Error; err != nil {
 		return c.Status(404).SendString("License key not found")
 	}
 
-	if err := licenseKey.Reactivate(h.db); err != nil {
+	override := c.FormValue("override") == "true"
+	refunded, reason := licenseKey.RevokedForPaymentReversal(), licenseKey.RevokedReason
+	err := database.PerformWrite(db, func(db *gorm.DB) error {
+		return licenseKey.Reactivate(db, override)
+	})
+	if errors.Is(err, models.ErrReactivationNeedsOverride) {
+		middleware.SetFlash(c, middleware.FlashError, "This key was revoked for a refund or chargeback. Confirm the override to reactivate it.")
+		return c.Redirect(middleware.AdminURL("/license-keys/") + c.Params("id"))
+	}
+	if err != nil {
 		return c.Status(500).SendString("Failed to reactivate license key")
 	}
 
-	return c.Redirect("/admin/license-keys/" + c.Params("id"))
+	if refunded {
+		actor := "unknown"
+		if admin := middleware.GetCurrentAdmin(c); admin != nil {
+			actor = admin.Username
+		}
+		log.Printf("audit: admin %q overrode %q revocation to reactivate license key %d", actor, reason, licenseKey.ID)
+	}
+
+	middleware.SetFlash(c, middleware.FlashSuccess, "License key reactivated")
+	return c.Redirect(middleware.AdminURL("/license-keys/") + c.Params("id"))
+}
+
+// Rotate replaces a key's string in place, e.g. after it leaked, keeping its
+// product, customer, expiry and activations. The old string stops verifying
+// immediately; only its hash is kept, in the key's rotation history. The new
+// key is emailed to the customer when send_email is set.
+func (h *LicenseKeysHandler) Rotate(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
+	id, _ := strconv.Atoi(c.Params("id"))
+	var licenseKey models.LicenseKey
+	if err := db.Scopes(tenantScope(c)).Preload("Product").Preload("Customer").First(&licenseKey, id).Error; err != nil {
+		if wantsJSON(c) {
+			return jsonError(c, 404, "License key not found")
+		}
+		return c.Status(404).SendString("License key not found")
+	}
+
+	actor := "unknown"
+	if admin := middleware.GetCurrentAdmin(c); admin != nil {
+		actor = admin.Username
+	}
+	oldHash := models.HashKey(licenseKey.Key)
+	err := database.PerformWrite(db, func(db *gorm.DB) error {
+		return licenseKey.RotateKey(db, actor)
+	})
+	if err != nil {
+		log.Printf("Failed to rotate license key %d: %v", licenseKey.ID, err)
+		if wantsJSON(c) {
+			return jsonError(c, 500, "Failed to rotate license key")
+		}
+		return c.Status(500).SendString("Failed to rotate license key")
+	}
+	log.Printf("audit: admin %q rotated license key %d (old key sha256 %s)", actor, licenseKey.ID, oldHash)
+
+	// The rotation has happened either way, so a failed email is reported
+	// rather than fatal
+	flash, message := middleware.FlashSuccess, "License key rotated; the old key no longer works"
+	if sendEmailFlag(c.FormValue("send_email"), false) {
+		if h.emailer == nil {
+			flash, message = middleware.FlashError, "License key rotated, but email is not configured"
+		} else if err := h.emailer.SendLicenseKey(&licenseKey); err != nil {
+			log.Printf("Failed to email rotated license key %d: %v", licenseKey.ID, err)
+			flash, message = middleware.FlashError, "License key rotated, but the email could not be sent: "+err.Error()
+		} else if emailQueued(h.emailer) {
+			message = "License key rotated; the email to " + licenseKey.Customer.Email + " is queued for delivery"
+		} else {
+			message = "License key rotated and emailed to " + licenseKey.Customer.Email
+		}
+	}
+
+	if wantsJSON(c) {
+		return c.JSON(licenseKey)
+	}
+	middleware.SetFlash(c, flash, message)
+	return c.Redirect(middleware.AdminURL("/license-keys/") + strconv.Itoa(int(licenseKey.ID)))
+}
+
+// AddNote attaches an internal support note to a license key, attributed to
+// the signed-in admin
+func (h *LicenseKeysHandler) AddNote(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
+	admin := middleware.GetCurrentAdmin(c)
+	if admin == nil {
+		return c.Redirect(middleware.AdminURL("/login"))
+	}
+	id, _ := strconv.Atoi(c.Params("id"))
+	var licenseKey models.LicenseKey
+	if err := db.Scopes(tenantScope(c)).First(&licenseKey, id).Error; err != nil {
+		return c.Status(404).SendString("License key not found")
+	}
+
+	err := database.PerformWrite(db, func(db *gorm.DB) error {
+		_, err := models.AddLicenseKeyNote(db, licenseKey.ID, admin, c.FormValue("body"))
+		return err
+	})
+	if err != nil {
+		middleware.SetFlash(c, middleware.FlashError, "Could not add note: "+err.Error())
+	} else {
+		middleware.SetFlash(c, middleware.FlashSuccess, "Note added")
+	}
+	return c.Redirect(middleware.AdminURL("/license-keys/") + strconv.Itoa(int(licenseKey.ID)))
+}
+
+// ResetActivations frees up the seats on a key, e.g. when a customer moves to a new machine
+func (h *LicenseKeysHandler) ResetActivations(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
+	id, _ := strconv.Atoi(c.Params("id"))
+	var licenseKey models.LicenseKey
+	if err := db.Scopes(tenantScope(c)).First(&licenseKey, id).Error; err != nil {
+		return c.Status(404).SendString("License key not found")
+	}
+
+	previous := licenseKey.CurrentActivations
+	if err := database.PerformWrite(db, licenseKey.ResetActivations); err != nil {
+		return c.Status(500).SendString("Failed to reset activations")
+	}
+
+	actor := "unknown"
+	if admin := middleware.GetCurrentAdmin(c); admin != nil {
+		actor = admin.Username
+	}
+	log.Printf("audit: admin %q reset activations on license key %d (%d -> 0)", actor, licenseKey.ID, previous)
+
+	middleware.SetFlash(c, middleware.FlashSuccess, "License key activations reset")
+	return c.Redirect(middleware.AdminURL("/license-keys/") + c.Params("id"))
+}
+
+// Activations lists the devices holding seats on a key against its
+// activation limit. Node-locked keys only count activations, so they list no
+// devices.
+func (h *LicenseKeysHandler) Activations(c *fiber.Ctx) error {
+	id, _ := strconv.Atoi(c.Params("id"))
+	var licenseKey models.LicenseKey
+	if err := h.db.Scopes(tenantScope(c)).Preload("Product").Preload("Customer").First(&licenseKey, id).Error; err != nil {
+		if wantsJSON(c) {
+			return jsonError(c, 404, "License key not found")
+		}
+		return c.Status(404).SendString("License key not found")
+	}
+
+	seats, err := models.SeatsForLicenseKey(h.db, licenseKey.ID)
+	if err != nil {
+		log.Printf("Failed to load activations for license key %d: %v", licenseKey.ID, err)
+		if wantsJSON(c) {
+			return jsonError(c, 500, "Failed to load activations")
+		}
+		return c.Status(500).SendString("Failed to load activations")
+	}
+
+	if wantsJSON(c) {
+		return c.JSON(fiber.Map{
+			"license_key_id":        licenseKey.ID,
+			"current_activations":   licenseKey.CurrentActivations,
+			"max_activations":       licenseKey.MaxActivations,
+			"activations_remaining": licenseKey.ActivationsRemaining(),
+			"activations":           seats,
+		})
+	}
+	return SafeRender(c, "admin/license-keys/activations", fiber.Map{
+		"ShowNav":     true,
+		"PageType":    "license-keys-activations",
+		"LicenseKey":  licenseKey,
+		"Activations": seats,
+	})
+}
+
+// Deactivate frees the seat one device holds, e.g. a machine the customer
+// lost, without touching the key's other activations
+func (h *LicenseKeysHandler) Deactivate(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
+	id, _ := strconv.Atoi(c.Params("id"))
+	var licenseKey models.LicenseKey
+	if err := db.Scopes(tenantScope(c)).First(&licenseKey, id).Error; err != nil {
+		if wantsJSON(c) {
+			return jsonError(c, 404, "License key not found")
+		}
+		return c.Status(404).SendString("License key not found")
+	}
+	deviceID, err := url.QueryUnescape(c.Params("deviceId"))
+	if err != nil {
+		deviceID = c.Params("deviceId")
+	}
+
+	err = database.PerformWrite(db, func(db *gorm.DB) error {
+		return licenseKey.ReleaseSeat(db, deviceID)
+	})
+	if errors.Is(err, models.ErrSeatNotCheckedOut) {
+		if wantsJSON(c) {
+			return jsonError(c, 404, "That device holds no seat on this license key")
+		}
+		middleware.SetFlash(c, middleware.FlashError, "That device holds no seat on this license key")
+		return c.Redirect(middleware.AdminURL("/license-keys/") + c.Params("id") + "/activations")
+	}
+	if err != nil {
+		if wantsJSON(c) {
+			return jsonError(c, 500, "Failed to deactivate device")
+		}
+		return c.Status(500).SendString("Failed to deactivate device")
+	}
+
+	actor := "unknown"
+	if admin := middleware.GetCurrentAdmin(c); admin != nil {
+		actor = admin.Username
+	}
+	log.Printf("audit: admin %q deactivated device %q on license key %d", actor, deviceID, licenseKey.ID)
+
+	if wantsJSON(c) {
+		return c.JSON(fiber.Map{
+			"success":             true,
+			"current_activations": licenseKey.CurrentActivations,
+		})
+	}
+	middleware.SetFlash(c, middleware.FlashSuccess, "Device deactivated")
+	return c.Redirect(middleware.AdminURL("/license-keys/") + c.Params("id") + "/activations")
 }
 
 func (h *LicenseKeysHandler) SendEmail(c *fiber.Ctx) error {
 	// This would require the email service to be injected
 	// For now, just redirect back
-	return c.Redirect("/admin/license-keys/" + c.Params("id"))
+	return c.Redirect(middleware.AdminURL("/license-keys/") + c.Params("id"))
+}
+
+// BulkEmail sends each selected license key to its customer, a few at a time,
+// and reports which sends failed. Every attempt lands in the email log.
+func (h *LicenseKeysHandler) BulkEmail(c *fiber.Ctx) error {
+	var ids []uint
+	for _, value := range formValues(c, "license_key_ids") {
+		if id, err := strconv.Atoi(value); err == nil && id > 0 {
+			ids = append(ids, uint(id))
+		}
+	}
+	if len(ids) == 0 {
+		if wantsJSON(c) {
+			return jsonError(c, 400, "Select at least one license key")
+		}
+		middleware.SetFlash(c, middleware.FlashError, "Select at least one license key to email")
+		return c.Redirect(middleware.AdminURL("/license-keys"))
+	}
+	if h.emailer == nil {
+		if wantsJSON(c) {
+			return jsonError(c, 503, "Email is not configured")
+		}
+		middleware.SetFlash(c, middleware.FlashError, "Email is not configured")
+		return c.Redirect(middleware.AdminURL("/license-keys"))
+	}
+
+	var licenseKeys []models.LicenseKey
+	if err := h.db.Scopes(tenantScope(c)).Preload("Product").Preload("Customer").
+		Where("id IN ?", ids).
+		Order("id").
+		Find(&licenseKeys).Error; err != nil {
+		if wantsJSON(c) {
+			return jsonError(c, 500, "Failed to load license keys")
+		}
+		return c.Status(500).SendString("Failed to load license keys")
+	}
+
+	result := services.SendLicenseKeys(h.emailer, licenseKeys, services.BulkEmailWorkers)
+
+	found := make(map[uint]bool, len(licenseKeys))
+	for _, licenseKey := range licenseKeys {
+		found[licenseKey.ID] = true
+	}
+	for _, id := range ids {
+		if !found[id] {
+			result.Failed = append(result.Failed, services.BulkEmailFailure{LicenseKeyID: id, Error: "license key not found"})
+			found[id] = true // Report repeated IDs once
+		}
+	}
+
+	if wantsJSON(c) {
+		return c.JSON(result)
+	}
+	sent := fmt.Sprintf("Emailed %d license keys", len(result.Sent))
+	if emailQueued(h.emailer) {
+		sent = fmt.Sprintf("Queued %d license key emails for delivery", len(result.Sent))
+	}
+	if len(result.Failed) == 0 {
+		middleware.SetFlash(c, middleware.FlashSuccess, sent)
+	} else {
+		first := result.Failed[0]
+		middleware.SetFlash(c, middleware.FlashError, fmt.Sprintf("%s, %d failed (key %d: %s)",
+			sent, len(result.Failed), first.LicenseKeyID, first.Error))
+	}
+	return c.Redirect(middleware.AdminURL("/license-keys"))
+}
+
+// Import adds the keys in a JSON bundle, such as one from customer export or
+// another licensing system, see models.ImportLicenseBundle. The bundle is
+// either the request body or an uploaded "bundle" file.
+func (h *LicenseKeysHandler) Import(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
+	replyJSON := wantsJSON(c) || isJSONRequest(c)
+
+	// Bundles match customers and products across the whole database, so
+	// they're for admins who can see all of it
+	if middleware.CurrentOwnerID(c) != nil {
+		if replyJSON {
+			return jsonError(c, 403, "Importing is not available to tenant admins")
+		}
+		middleware.SetFlash(c, middleware.FlashError, "Importing is not available to tenant admins")
+		return c.Redirect(middleware.AdminURL("/license-keys"))
+	}
+	data := c.Body()
+	if !isJSONRequest(c) {
+		file, err := c.FormFile("bundle")
+		if err != nil {
+			middleware.SetFlash(c, middleware.FlashError, "Choose a bundle file to import")
+			return c.Redirect(middleware.AdminURL("/license-keys"))
+		}
+		f, err := file.Open()
+		if err != nil {
+			return c.Status(500).SendString("Failed to read bundle")
+		}
+		defer func() { _ = f.Close() }()
+		if data, err = io.ReadAll(f); err != nil {
+			return c.Status(500).SendString("Failed to read bundle")
+		}
+	}
+
+	var bundle models.CustomerBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		if replyJSON {
+			return jsonError(c, 400, "Invalid bundle JSON")
+		}
+		middleware.SetFlash(c, middleware.FlashError, "The bundle is not valid JSON")
+		return c.Redirect(middleware.AdminURL("/license-keys"))
+	}
+
+	var summary *models.BundleImportSummary
+	err := database.PerformWrite(db, func(db *gorm.DB) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			summary, err = models.ImportLicenseBundle(tx, &bundle)
+			return err
+		})
+	})
+	if err != nil {
+		if replyJSON {
+			return jsonError(c, 500, "Failed to import bundle")
+		}
+		return c.Status(500).SendString("Failed to import bundle")
+	}
+
+	// Imported keys were usually delivered by the old system already, so
+	// they're only emailed when asked for
+	response := importResponse{BundleImportSummary: summary}
+	if sendEmailFlag(c.FormValue("send_email"), false) && h.emailer != nil && len(summary.ImportedIDs) > 0 {
+		var licenseKeys []models.LicenseKey
+		if err := h.db.Preload("Product").Preload("Customer").
+			Where("id IN ?", summary.ImportedIDs).
+			Order("id").
+			Find(&licenseKeys).Error; err != nil {
+			log.Printf("Failed to load imported license keys for emailing: %v", err)
+		} else {
+			result := services.SendLicenseKeys(h.emailer, licenseKeys, services.BulkEmailWorkers)
+			response.Emails = &result
+		}
+	}
+
+	if replyJSON {
+		return c.JSON(response)
+	}
+	message := fmt.Sprintf("Imported %d license keys, skipped %d that already exist", summary.Imported, len(summary.Skipped))
+	if response.Emails != nil && emailQueued(h.emailer) {
+		message += fmt.Sprintf(", queued %d emails", len(response.Emails.Sent))
+	} else if response.Emails != nil {
+		message += fmt.Sprintf(", emailed %d", len(response.Emails.Sent))
+	}
+	if len(summary.Failed) > 0 {
+		first := summary.Failed[0]
+		middleware.SetFlash(c, middleware.FlashError, fmt.Sprintf("%s, %d failed (%s: %s)", message, len(summary.Failed), first.Key, first.Error))
+	} else {
+		middleware.SetFlash(c, middleware.FlashSuccess, message)
+	}
+	return c.Redirect(middleware.AdminURL("/license-keys"))
+}
+
+// importResponse is an import summary plus the outcome of emailing the
+// imported keys, when that was asked for
+type importResponse struct {
+	*models.BundleImportSummary
+	Emails *services.BulkEmailResult `json:"emails,omitempty"`
+}
+
+// formValues returns every value submitted for a repeated form field
+func formValues(c *fiber.Ctx, name string) []string {
+	if form, err := c.MultipartForm(); err == nil {
+		return form.Value[name]
+	}
+
+	var values []string
+	for _, value := range c.Request().PostArgs().PeekMulti(name) {
+		values = append(values, string(value))
+	}
+	return values
+}
+
+const pastExpiryMessage = "The expiry date is in the past, so the key would stop working immediately. Tick \"Allow a past expiry date\" to backdate it on purpose."
+
+// expiryChanged reports whether a submitted expiry differs from the stored
+// one. The form only has minute precision, so seconds are ignored.
+func expiryChanged(current *time.Time, submitted time.Time) bool {
+	return current == nil || !current.Truncate(time.Minute).Equal(submitted)
+}
+
+// parseLocalExpiry reads an expiry from the admin form, either datetime-local
+// (YYYY-MM-DDTHH:MM) or a plain date (YYYY-MM-DD), as wall-clock time in loc.
+// The result is converted to UTC for storage.
+func parseLocalExpiry(value string, loc *time.Location) (time.Time, bool) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
 }
@@ -1,15 +1,27 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
 
+	"matcha/internal/config"
+	"matcha/internal/middleware"
 	"matcha/internal/models"
+	"matcha/internal/services"
 	"matcha/internal/testutils"
 )
 
@@ -18,7 +30,7 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 	t.Run("Index - Display License Keys", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewLicenseKeysHandler(db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
 
 		app.Get("/license-keys", handler.Index)
 
@@ -48,7 +60,7 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 	t.Run("New - Display Create Form", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewLicenseKeysHandler(db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
 
 		app.Get("/license-keys/new", handler.New)
 
@@ -66,7 +78,7 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 	t.Run("Create - Valid License Key", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewLicenseKeysHandler(db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
 
 		app.Post("/license-keys", handler.Create)
 
@@ -103,10 +115,103 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 		assert.Equal(t, 5, licenseKey.MaxActivations)
 	})
 
+	t.Run("Create - Retries Transient Lock Error", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
+
+		app.Post("/license-keys", handler.Create)
+
+		product := models.Product{Name: "Test Product", Version: "1.0.0", DefaultUsageLimit: 1}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+
+		// Fail the first license key insert as SQLite does under write contention
+		attempts := 0
+		require.NoError(t, db.Callback().Create().Before("gorm:create").Register("test:lock_once", func(tx *gorm.DB) {
+			if tx.Statement.Table != "license_keys" {
+				return
+			}
+			attempts++
+			if attempts == 1 {
+				_ = tx.AddError(errors.New("database is locked (5) (SQLITE_BUSY)"))
+			}
+		}))
+
+		form := url.Values{
+			"key":         {"LOCKED-ONCE-KEY"},
+			"product_id":  {strconv.Itoa(int(product.ID))},
+			"customer_id": {strconv.Itoa(int(customer.ID))},
+		}
+
+		resp := testutils.TestRequest(t, app, "POST", "/license-keys", form.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+		assert.Equal(t, 2, attempts, "create should be retried once")
+
+		var licenseKey models.LicenseKey
+		require.NoError(t, db.Where("key = ?", "LOCKED-ONCE-KEY").First(&licenseKey).Error)
+	})
+
+	t.Run("Create - Perpetual Key Has No Expiry", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
+
+		app.Post("/license-keys", handler.Create)
+
+		product := models.Product{Name: "Test Product", Version: "1.0.0", DefaultExpirationDays: 365, DefaultUsageLimit: 1}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+
+		form := url.Values{
+			"product_id":  {strconv.Itoa(int(product.ID))},
+			"customer_id": {strconv.Itoa(int(customer.ID))},
+			"perpetual":   {"true"},
+		}
+
+		resp := testutils.TestRequest(t, app, "POST", "/license-keys", form.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+
+		var licenseKey models.LicenseKey
+		require.NoError(t, db.First(&licenseKey).Error)
+		assert.Nil(t, licenseKey.ExpiresAt)
+		assert.False(t, licenseKey.IsExpired())
+	})
+
+	t.Run("Create - Key Unique Per Product", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
+
+		app.Post("/license-keys", handler.Create)
+
+		first := models.Product{Name: "First"}
+		require.NoError(t, db.Create(&first).Error)
+		second := models.Product{Name: "Second"}
+		require.NoError(t, db.Create(&second).Error)
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+
+		create := func(product models.Product) int {
+			form := url.Values{
+				"product_id":  {strconv.Itoa(int(product.ID))},
+				"customer_id": {strconv.Itoa(int(customer.ID))},
+				"key":         {"SHORT-KEY"},
+			}
+			return testutils.TestRequest(t, app, "POST", "/license-keys", form.Encode()).StatusCode
+		}
+
+		assert.Equal(t, 302, create(first))
+		assert.Equal(t, 302, create(second), "another product may use the same key")
+		assert.Equal(t, 409, create(first))
+	})
+
 	t.Run("Create - Invalid Product", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewLicenseKeysHandler(db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
 
 		app.Post("/license-keys", handler.Create)
 
@@ -125,7 +230,7 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 	t.Run("Create - Invalid Customer", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewLicenseKeysHandler(db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
 
 		app.Post("/license-keys", handler.Create)
 
@@ -144,7 +249,7 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 	t.Run("Show - Existing License Key", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewLicenseKeysHandler(db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
 
 		app.Get("/license-keys/:id", handler.Show)
 
@@ -167,10 +272,79 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 		assert.Equal(t, 200, resp.StatusCode)
 	})
 
+	t.Run("Show - Email Log", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
+
+		app.Get("/license-keys/:id", handler.Show)
+
+		product := models.Product{Name: "Test Product", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+		licenseKey := models.LicenseKey{Key: "TEST-KEY-123", ProductID: product.ID, CustomerID: customer.ID, Status: "active"}
+		require.NoError(t, db.Create(&licenseKey).Error)
+		require.NoError(t, db.Create(&models.EmailLog{
+			To: "john@example.com", Subject: "Your License Key", Type: models.EmailTemplateLicenseKey,
+			LicenseKeyID: &licenseKey.ID, Status: models.EmailStatusFailed, Error: "connection refused",
+		}).Error)
+
+		resp := testutils.TestRequest(t, app, "GET", "/license-keys/"+strconv.Itoa(int(licenseKey.ID)), "")
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "Email Log")
+		assert.Contains(t, string(body), "connection refused")
+	})
+
+	t.Run("AddNote - Rendered With Author And Time", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
+
+		admin := models.AdminUser{Username: "support-sam", PasswordHash: "x"}
+		require.NoError(t, db.Create(&admin).Error)
+		app.Use(func(c *fiber.Ctx) error {
+			c.Locals("current_admin", &admin)
+			return c.Next()
+		})
+		app.Post("/license-keys/:id/notes", handler.AddNote)
+		app.Get("/license-keys/:id", handler.Show)
+
+		product := models.Product{Name: "Test Product", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+		licenseKey := models.LicenseKey{Key: "TEST-KEY-123", ProductID: product.ID, CustomerID: customer.ID, Status: "active"}
+		require.NoError(t, db.Create(&licenseKey).Error)
+		path := "/license-keys/" + strconv.Itoa(int(licenseKey.ID))
+
+		resp := testutils.TestRequest(t, app, "POST", path+"/notes", url.Values{"body": {"Customer reported issue X, comped extra seat"}}.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+
+		resp = testutils.TestRequest(t, app, "POST", path+"/notes", url.Values{"body": {"   "}}.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+
+		notes, err := models.NotesForLicenseKey(db, licenseKey.ID)
+		require.NoError(t, err)
+		require.Len(t, notes, 1, "a blank note is rejected")
+		assert.Equal(t, admin.ID, notes[0].AdminUserID)
+		assert.Equal(t, "support-sam", notes[0].Author())
+
+		resp = testutils.TestRequest(t, app, "GET", path, "")
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "Customer reported issue X, comped extra seat")
+		assert.Contains(t, string(body), "support-sam")
+		assert.Contains(t, string(body), notes[0].CreatedAt.UTC().Format("01/02/2006 15:04"))
+	})
+
 	t.Run("Show - Non-existent License Key", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewLicenseKeysHandler(db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
 
 		app.Get("/license-keys/:id", handler.Show)
 
@@ -181,7 +355,7 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 	t.Run("Edit - Existing License Key", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewLicenseKeysHandler(db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
 
 		app.Get("/license-keys/:id/edit", handler.Edit)
 
@@ -207,7 +381,7 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 	t.Run("Edit - Non-existent License Key", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewLicenseKeysHandler(db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
 
 		app.Get("/license-keys/:id/edit", handler.Edit)
 
@@ -218,7 +392,7 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 	t.Run("Update - Complete Update", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewLicenseKeysHandler(db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
 
 		app.Put("/license-keys/:id", handler.Update)
 
@@ -248,7 +422,7 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 			"product_id":      {strconv.Itoa(int(product2.ID))},
 			"customer_id":     {strconv.Itoa(int(customer2.ID))},
 			"max_activations": {"10"},
-			"expires_at":      {"2025-12-31T15:04"}, // Use datetime-local format
+			"expires_at":      {"2099-12-31T15:04"}, // Use datetime-local format
 			"usage_limit":     {"5"},
 			"metadata":        {"Updated metadata"},
 		}
@@ -267,16 +441,339 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 		assert.Equal(t, 5, updatedLicense.UsageLimit)
 		assert.Equal(t, "Updated metadata", updatedLicense.Metadata)
 
-		expectedTime, _ := time.Parse("2006-01-02T15:04", "2025-12-31T15:04")
+		expectedTime, _ := time.Parse("2006-01-02T15:04", "2099-12-31T15:04")
 		if updatedLicense.ExpiresAt != nil {
 			assert.Equal(t, expectedTime, *updatedLicense.ExpiresAt)
 		}
 	})
 
+	t.Run("Update - Stale Edit Rejected", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
+
+		app.Put("/license-keys/:id", handler.Update)
+
+		product := models.Product{Name: "Test Product", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+		licenseKey := models.LicenseKey{Key: "LOCK-KEY", ProductID: product.ID, CustomerID: customer.ID, MaxActivations: 1}
+		require.NoError(t, db.Create(&licenseKey).Error)
+		path := "/license-keys/" + strconv.Itoa(int(licenseKey.ID))
+
+		// Two admins open the edit form at version 0; the first save wins
+		first := url.Values{"lock_version": {"0"}, "max_activations": {"5"}}
+		resp := testutils.TestRequest(t, app, "PUT", path, first.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+
+		second := url.Values{"lock_version": {"0"}, "max_activations": {"9"}}
+		resp = testutils.TestRequest(t, app, "PUT", path, second.Encode())
+		assert.Equal(t, 409, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Contains(t, string(body), "changed by someone else")
+
+		var stored models.LicenseKey
+		require.NoError(t, db.First(&stored, licenseKey.ID).Error)
+		assert.Equal(t, 5, stored.MaxActivations)
+		assert.Equal(t, 1, stored.LockVersion)
+
+		// After reloading, the second admin's edit goes through
+		second.Set("lock_version", "1")
+		resp = testutils.TestRequest(t, app, "PUT", path, second.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+		require.NoError(t, db.First(&stored, licenseKey.ID).Error)
+		assert.Equal(t, 9, stored.MaxActivations)
+		assert.Equal(t, 2, stored.LockVersion)
+	})
+
+	t.Run("Update - Expiry In Configured Timezone", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		tokyo := time.FixedZone("UTC+9", 9*60*60)
+		app := testutils.SetupTestAppInZone(t, db, tokyo)
+		handler := NewLicenseKeysHandler(db, nil, tokyo)
+
+		app.Put("/license-keys/:id", handler.Update)
+		app.Get("/license-keys/:id/edit", handler.Edit)
+
+		product := models.Product{Name: "Test Product", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+		licenseKey := models.LicenseKey{Key: "TZ-KEY", ProductID: product.ID, CustomerID: customer.ID}
+		require.NoError(t, db.Create(&licenseKey).Error)
+		path := "/license-keys/" + strconv.Itoa(int(licenseKey.ID))
+
+		form := url.Values{"expires_at": {"2099-07-01T08:30"}}
+		resp := testutils.TestRequest(t, app, "PUT", path, form.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+
+		// 08:30 in Tokyo is 23:30 the previous day in UTC
+		var stored models.LicenseKey
+		require.NoError(t, db.First(&stored, licenseKey.ID).Error)
+		require.NotNil(t, stored.ExpiresAt)
+		assert.True(t, stored.ExpiresAt.Equal(time.Date(2099, 6, 30, 23, 30, 0, 0, time.UTC)), "got %v", stored.ExpiresAt)
+
+		// The edit form shows it back as the local time that was entered
+		resp = testutils.TestRequest(t, app, "GET", path+"/edit", "")
+		assert.Equal(t, 200, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Contains(t, string(body), `value="2099-07-01T08:30"`)
+	})
+
+	t.Run("Update - Past Expiry Rejected", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
+
+		app.Put("/license-keys/:id", handler.Update)
+
+		product := models.Product{Name: "Test Product", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+		licenseKey := models.LicenseKey{Key: "PAST-KEY", ProductID: product.ID, CustomerID: customer.ID, Status: "active"}
+		require.NoError(t, db.Create(&licenseKey).Error)
+		path := "/license-keys/" + strconv.Itoa(int(licenseKey.ID))
+		past := time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02T15:04")
+
+		form := url.Values{"expires_at": {past}, "max_activations": {"4"}}
+		resp := testutils.TestRequest(t, app, "PUT", path, form.Encode())
+		assert.Equal(t, 400, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Contains(t, string(body), "expiry date is in the past")
+
+		var stored models.LicenseKey
+		require.NoError(t, db.First(&stored, licenseKey.ID).Error)
+		assert.Nil(t, stored.ExpiresAt)
+		assert.NotEqual(t, 4, stored.MaxActivations)
+
+		// Ticking the override backdates the key deliberately
+		form.Set("allow_past_expiry", "true")
+		resp = testutils.TestRequest(t, app, "PUT", path, form.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+		require.NoError(t, db.First(&stored, licenseKey.ID).Error)
+		require.NotNil(t, stored.ExpiresAt)
+		assert.True(t, stored.IsExpired())
+
+		// Later edits that leave the past expiry as it is don't need the override
+		form.Del("allow_past_expiry")
+		form.Set("lock_version", strconv.Itoa(stored.LockVersion))
+		form.Set("max_activations", "6")
+		resp = testutils.TestRequest(t, app, "PUT", path, form.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+	})
+
+	t.Run("Update - Future Expiry Accepted", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
+
+		app.Put("/license-keys/:id", handler.Update)
+
+		product := models.Product{Name: "Test Product", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+		licenseKey := models.LicenseKey{Key: "FUTURE-KEY", ProductID: product.ID, CustomerID: customer.ID, Status: "active"}
+		require.NoError(t, db.Create(&licenseKey).Error)
+		path := "/license-keys/" + strconv.Itoa(int(licenseKey.ID))
+		future := time.Now().UTC().AddDate(0, 1, 0).Truncate(time.Minute)
+
+		form := url.Values{"expires_at": {future.Format("2006-01-02T15:04")}}
+		resp := testutils.TestRequest(t, app, "PUT", path, form.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+
+		var stored models.LicenseKey
+		require.NoError(t, db.First(&stored, licenseKey.ID).Error)
+		require.NotNil(t, stored.ExpiresAt)
+		assert.True(t, stored.ExpiresAt.Equal(future))
+		assert.False(t, stored.IsExpired())
+	})
+
+	t.Run("Update - Metadata Key/Value Rows", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
+
+		app.Put("/license-keys/:id", handler.Update)
+		app.Get("/license-keys/:id", handler.Show)
+
+		product := models.Product{Name: "Test Product", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+		licenseKey := models.LicenseKey{Key: "META-KEY", ProductID: product.ID, CustomerID: customer.ID}
+		require.NoError(t, db.Create(&licenseKey).Error)
+
+		path := "/license-keys/" + strconv.Itoa(int(licenseKey.ID))
+		form := url.Values{
+			"metadata_key":   {"order_id", "seats", "", "plan"},
+			"metadata_value": {"ORD-42", "10", "", "Team"},
+		}
+		resp := testutils.TestRequest(t, app, "PUT", path, form.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+
+		var updated models.LicenseKey
+		require.NoError(t, db.First(&updated, licenseKey.ID).Error)
+		assert.Equal(t, map[string]interface{}{"order_id": "ORD-42", "seats": "10", "plan": "Team"}, updated.GetMetadataMap())
+
+		resp = testutils.TestRequest(t, app, "GET", path, "")
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "ORD-42")
+
+		// Duplicate keys are rejected and leave the stored metadata alone
+		form = url.Values{
+			"metadata_key":   {"plan", "plan"},
+			"metadata_value": {"Team", "Solo"},
+		}
+		resp = testutils.TestRequest(t, app, "PUT", path, form.Encode())
+		assert.Equal(t, 400, resp.StatusCode)
+		require.NoError(t, db.First(&updated, licenseKey.ID).Error)
+		assert.Equal(t, "Team", updated.GetMetadataMap()["plan"])
+	})
+
+	t.Run("Update - Labels", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
+
+		app.Put("/license-keys/:id", handler.Update)
+
+		product := models.Product{Name: "Test Product", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+		licenseKey := models.LicenseKey{Key: "LABEL-KEY", ProductID: product.ID, CustomerID: customer.ID}
+		require.NoError(t, db.Create(&licenseKey).Error)
+
+		path := "/license-keys/" + strconv.Itoa(int(licenseKey.ID))
+		form := url.Values{"labels": {" VIP, beta,,vip "}}
+		resp := testutils.TestRequest(t, app, "PUT", path, form.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+
+		var updated models.LicenseKey
+		require.NoError(t, db.First(&updated, licenseKey.ID).Error)
+		assert.Equal(t, "vip,beta", updated.Labels)
+		assert.Equal(t, []string{"vip", "beta"}, updated.LabelList())
+
+		resp = testutils.TestRequest(t, app, "PUT", path, url.Values{"labels": {""}}.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+		require.NoError(t, db.First(&updated, licenseKey.ID).Error)
+		assert.Empty(t, updated.Labels)
+	})
+
+	t.Run("Index - Filter By Label", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
+
+		app.Get("/license-keys", handler.Index)
+
+		product := models.Product{Name: "Test Product", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+		for key, labels := range map[string]string{"VIP-KEY": "vip,beta", "BETA-KEY": "beta-tester", "PLAIN-KEY": ""} {
+			licenseKey := models.LicenseKey{Key: key, ProductID: product.ID, CustomerID: customer.ID, Labels: labels}
+			require.NoError(t, db.Create(&licenseKey).Error)
+		}
+
+		index := func(query string) string {
+			resp := testutils.TestRequest(t, app, "GET", "/license-keys"+query, "")
+			require.Equal(t, 200, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return string(body)
+		}
+
+		body := index("?label=Beta")
+		assert.Contains(t, body, "VIP-KEY")
+		assert.NotContains(t, body, "BETA-KEY", "labels match whole words only")
+		assert.NotContains(t, body, "PLAIN-KEY")
+
+		body = index("?label=support-comp")
+		assert.NotContains(t, body, "VIP-KEY")
+		assert.Contains(t, body, "No license keys labeled support-comp")
+
+		body = index("")
+		assert.Contains(t, body, "VIP-KEY")
+		assert.Contains(t, body, "BETA-KEY")
+		assert.Contains(t, body, "PLAIN-KEY")
+	})
+
+	t.Run("Show - Malformed Metadata", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
+
+		app.Get("/license-keys/:id", handler.Show)
+		app.Get("/license-keys/:id/edit", handler.Edit)
+
+		product := models.Product{Name: "Test Product", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+		licenseKey := models.LicenseKey{
+			Key:        "BROKEN-META-KEY",
+			ProductID:  product.ID,
+			CustomerID: customer.ID,
+			Metadata:   "{not json",
+		}
+		require.NoError(t, db.Create(&licenseKey).Error)
+
+		path := "/license-keys/" + strconv.Itoa(int(licenseKey.ID))
+		resp := testutils.TestRequest(t, app, "GET", path, "")
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "{not json")
+
+		resp = testutils.TestRequest(t, app, "GET", path+"/edit", "")
+		assert.Equal(t, 200, resp.StatusCode)
+	})
+
+	t.Run("Show - Metadata Escaped", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
+
+		app.Get("/license-keys/:id", handler.Show)
+
+		product := models.Product{Name: "Test Product", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+
+		get := func(licenseKey *models.LicenseKey) string {
+			require.NoError(t, db.Create(licenseKey).Error)
+			resp := testutils.TestRequest(t, app, "GET", "/license-keys/"+strconv.Itoa(int(licenseKey.ID)), "")
+			assert.Equal(t, 200, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return string(body)
+		}
+
+		tagged := &models.LicenseKey{Key: "SCRIPT-META-KEY", ProductID: product.ID, CustomerID: customer.ID}
+		require.NoError(t, tagged.SetMetadataMap(map[string]interface{}{"<b>note</b>": "<script>alert(1)</script>\u202e"}))
+		body := get(tagged)
+		assert.NotContains(t, body, "<script>alert(1)</script>")
+		assert.NotContains(t, body, "<b>note</b>")
+		assert.Contains(t, body, "&lt;script&gt;alert(1)&lt;/script&gt;")
+		assert.NotContains(t, body, "\u202e")
+
+		raw := &models.LicenseKey{Key: "SCRIPT-RAW-KEY", ProductID: product.ID, CustomerID: customer.ID, Metadata: "<script>alert(2)</script>"}
+		body = get(raw)
+		assert.NotContains(t, body, "<script>alert(2)</script>")
+		assert.Contains(t, body, "&lt;script&gt;alert(2)&lt;/script&gt;")
+	})
+
 	t.Run("Update - Partial Update", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewLicenseKeysHandler(db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
 
 		app.Put("/license-keys/:id", handler.Update)
 
@@ -318,7 +815,7 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 	t.Run("Update - Non-existent License Key", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewLicenseKeysHandler(db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
 
 		app.Put("/license-keys/:id", handler.Update)
 
@@ -334,7 +831,7 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 	t.Run("Delete - Existing License Key", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewLicenseKeysHandler(db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
 
 		app.Delete("/license-keys/:id", handler.Delete)
 
@@ -366,7 +863,7 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 	t.Run("Revoke - Active License Key", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewLicenseKeysHandler(db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
 
 		app.Post("/license-keys/:id/revoke", handler.Revoke)
 
@@ -385,15 +882,22 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 		}
 		require.NoError(t, db.Create(&licenseKey).Error)
 
-		url := "/license-keys/" + strconv.Itoa(int(licenseKey.ID)) + "/revoke"
-		resp := testutils.TestRequest(t, app, "POST", url, "")
+		path := "/license-keys/" + strconv.Itoa(int(licenseKey.ID)) + "/revoke"
+		resp := testutils.TestRequest(t, app, "POST", path, url.Values{"reason": {"Refunded"}}.Encode())
 		assert.Equal(t, 302, resp.StatusCode)
+
+		var stored models.LicenseKey
+		require.NoError(t, db.First(&stored, licenseKey.ID).Error)
+		assert.Equal(t, "revoked", stored.Status)
+		assert.Equal(t, "Refunded", stored.RevokedReason)
+		require.NotNil(t, stored.RevokedAt)
+		assert.WithinDuration(t, time.Now(), *stored.RevokedAt, time.Minute)
 	})
 
 	t.Run("Reactivate - Revoked License Key", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewLicenseKeysHandler(db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
 
 		app.Post("/license-keys/:id/reactivate", handler.Reactivate)
 
@@ -408,19 +912,128 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 			Key:        "TEST-KEY-123",
 			ProductID:  product.ID,
 			CustomerID: customer.ID,
-			Status:     "revoked",
+			Status:     "active",
 		}
 		require.NoError(t, db.Create(&licenseKey).Error)
+		require.NoError(t, licenseKey.Revoke(db, "Shared publicly"))
 
 		url := "/license-keys/" + strconv.Itoa(int(licenseKey.ID)) + "/reactivate"
 		resp := testutils.TestRequest(t, app, "POST", url, "")
 		assert.Equal(t, 302, resp.StatusCode)
+
+		var stored models.LicenseKey
+		require.NoError(t, db.First(&stored, licenseKey.ID).Error)
+		assert.Equal(t, "active", stored.Status)
+		assert.Nil(t, stored.RevokedAt)
+		assert.Empty(t, stored.RevokedReason)
+	})
+
+	t.Run("Reactivate - Refunded Key Needs Override", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
+
+		app.Post("/license-keys/:id/reactivate", handler.Reactivate)
+
+		product := models.Product{Name: "Test Product", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+		licenseKey := models.LicenseKey{Key: "REFUND-KEY", ProductID: product.ID, CustomerID: customer.ID, Status: "active"}
+		require.NoError(t, db.Create(&licenseKey).Error)
+		require.NoError(t, licenseKey.Revoke(db, "Refunded"))
+		path := "/license-keys/" + strconv.Itoa(int(licenseKey.ID)) + "/reactivate"
+
+		resp := testutils.TestRequest(t, app, "POST", path, "")
+		assert.Equal(t, 302, resp.StatusCode)
+		var stored models.LicenseKey
+		require.NoError(t, db.First(&stored, licenseKey.ID).Error)
+		assert.Equal(t, "revoked", stored.Status)
+		assert.Equal(t, "Refunded", stored.RevokedReason)
+
+		resp = testutils.TestRequest(t, app, "POST", path, url.Values{"override": {"true"}}.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+		require.NoError(t, db.First(&stored, licenseKey.ID).Error)
+		assert.Equal(t, "active", stored.Status)
+		assert.Empty(t, stored.RevokedReason)
+	})
+
+	t.Run("ResetActivations - Key At Activation Limit", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
+
+		app.Post("/license-keys/:id/reset-activations", handler.ResetActivations)
+
+		product := models.Product{Name: "Test Product", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+
+		licenseKey := models.LicenseKey{
+			Key:            "SEAT-KEY-123",
+			ProductID:      product.ID,
+			CustomerID:     customer.ID,
+			MaxActivations: 2,
+		}
+		require.NoError(t, db.Create(&licenseKey).Error)
+		require.NoError(t, licenseKey.RegisterActivation(db))
+		require.NoError(t, licenseKey.RegisterActivation(db))
+		require.ErrorIs(t, licenseKey.RegisterActivation(db), models.ErrActivationLimitReached)
+		require.False(t, licenseKey.HasFreeActivation())
+
+		url := "/license-keys/" + strconv.Itoa(int(licenseKey.ID)) + "/reset-activations"
+		resp := testutils.TestRequest(t, app, "POST", url, "")
+		assert.Equal(t, 302, resp.StatusCode)
+
+		var reset models.LicenseKey
+		require.NoError(t, db.First(&reset, licenseKey.ID).Error)
+		assert.Equal(t, 0, reset.CurrentActivations)
+		assert.Equal(t, "active", reset.Status)
+		assert.True(t, reset.HasFreeActivation())
+	})
+
+	t.Run("ResetActivations - Revoked Key Stays Revoked", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
+
+		app.Post("/license-keys/:id/reset-activations", handler.ResetActivations)
+
+		product := models.Product{Name: "Test Product", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+
+		licenseKey := models.LicenseKey{
+			Key:                "SEAT-KEY-456",
+			ProductID:          product.ID,
+			CustomerID:         customer.ID,
+			MaxActivations:     3,
+			CurrentActivations: 1,
+			Status:             "revoked",
+		}
+		require.NoError(t, db.Create(&licenseKey).Error)
+
+		url := "/license-keys/" + strconv.Itoa(int(licenseKey.ID)) + "/reset-activations"
+		resp := testutils.TestRequest(t, app, "POST", url, "")
+		assert.Equal(t, 302, resp.StatusCode)
+
+		var reset models.LicenseKey
+		require.NoError(t, db.First(&reset, licenseKey.ID).Error)
+		assert.Equal(t, 0, reset.CurrentActivations)
+		assert.Equal(t, "revoked", reset.Status)
+
+		resp = testutils.TestRequest(t, app, "POST", "/license-keys/99999/reset-activations", "")
+		assert.Equal(t, 404, resp.StatusCode)
 	})
 
 	t.Run("SendEmail - License Key", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewLicenseKeysHandler(db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
 
 		app.Post("/license-keys/:id/send-email", handler.SendEmail)
 
@@ -431,7 +1044,7 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 	t.Run("Template Rendering - Nil Pointer Handling", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewLicenseKeysHandler(db)
+		handler := NewLicenseKeysHandler(db, nil, time.UTC)
 
 		app.Get("/license-keys/:id", handler.Show)
 		app.Get("/license-keys/:id/edit", handler.Edit)
@@ -474,3 +1087,479 @@ func TestLicenseKeysHandler_Integration(t *testing.T) {
 		assert.True(t, resp.StatusCode == 200 || resp.StatusCode == 500)
 	})
 }
+
+// stubEmailer fails for the listed addresses and records who it sent to
+type stubEmailer struct {
+	mu      sync.Mutex
+	failFor map[string]bool
+	sentTo  []string
+}
+
+func (s *stubEmailer) SendLicenseKey(licenseKey *models.LicenseKey) error {
+	if s.failFor[licenseKey.Customer.Email] {
+		return errors.New("mailbox unavailable")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sentTo = append(s.sentTo, licenseKey.Customer.Email)
+	return nil
+}
+
+func TestEmailQueued(t *testing.T) {
+	assert.False(t, emailQueued(&stubEmailer{}))
+
+	emailService := services.NewEmailService(&config.Config{}, testutils.SetupTestDB(t))
+	assert.False(t, emailQueued(emailService))
+	emailService.UseQueue(1)
+	assert.True(t, emailQueued(emailService))
+}
+
+func TestLicenseKeysHandler_CreateSendEmail(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestAppWithDB(t, db)
+	emailer := &stubEmailer{}
+	handler := NewLicenseKeysHandler(db, emailer, time.UTC)
+	app.Post("/license-keys", handler.Create)
+
+	product := models.Product{Name: "Emailed Product"}
+	require.NoError(t, db.Create(&product).Error)
+	customer := models.Customer{Name: "Buyer", Email: "buyer@example.com"}
+	require.NoError(t, db.Create(&customer).Error)
+
+	create := func(extra url.Values) {
+		form := url.Values{"product_id": {strconv.Itoa(int(product.ID))}, "customer_id": {strconv.Itoa(int(customer.ID))}}
+		for key, values := range extra {
+			form[key] = values
+		}
+		resp := testutils.TestRequest(t, app, "POST", "/license-keys", form.Encode())
+		require.Equal(t, 302, resp.StatusCode)
+	}
+
+	t.Run("Create - Not Emailed By Default", func(t *testing.T) {
+		emailer.sentTo = nil
+		create(nil)
+		create(url.Values{"key": {"HAND-ENTERED-1"}})
+		assert.Empty(t, emailer.sentTo)
+	})
+
+	t.Run("Create - Emailed When Asked", func(t *testing.T) {
+		emailer.sentTo = nil
+		create(url.Values{"send_email": {"true"}})
+		create(url.Values{"key": {"HAND-ENTERED-2"}, "send_email": {"true"}})
+		assert.Equal(t, []string{"buyer@example.com", "buyer@example.com"}, emailer.sentTo)
+	})
+
+	t.Run("Import - Emailed Only When Asked", func(t *testing.T) {
+		importer := NewLicenseKeysHandler(db, emailer, time.UTC)
+		app.Post("/license-keys/import", importer.Import)
+		bundle := func(key string) string {
+			return `{"customer": {"email": "imported@example.com"}, "license_keys": [{"key": "` + key + `", "product": {"name": "Emailed Product"}}]}`
+		}
+
+		emailer.sentTo = nil
+		resp := testutils.TestRequestJSON(t, app, "POST", "/license-keys/import", bundle("IMPORTED-QUIET"))
+		require.Equal(t, 200, resp.StatusCode)
+		assert.Empty(t, emailer.sentTo)
+
+		resp = testutils.TestRequestJSON(t, app, "POST", "/license-keys/import?send_email=true", bundle("IMPORTED-LOUD"))
+		require.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, []string{"imported@example.com"}, emailer.sentTo)
+	})
+}
+
+func TestLicenseKeysHandler_Rotate(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestAppWithDB(t, db)
+	emailer := &stubEmailer{}
+	handler := NewLicenseKeysHandler(db, emailer, time.UTC)
+	app.Post("/license-keys/:id/rotate", handler.Rotate)
+	app.Post("/api/v1/licenses/verify", NewAPIHandler(db, nil).VerifyLicense)
+
+	product, licenseKey := createVerifiableLicense(t, db, "")
+	require.NoError(t, licenseKey.RegisterActivation(db))
+	path := "/license-keys/" + strconv.Itoa(int(licenseKey.ID)) + "/rotate"
+
+	verify := func(key string) (int, VerifyResponse) {
+		resp, err := app.Test(verifyRequest(product.ID, key, nil))
+		require.NoError(t, err)
+		var body VerifyResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp.StatusCode, body
+	}
+
+	t.Run("Rotate - Old Key Stops Verifying", func(t *testing.T) {
+		oldKey := licenseKey.Key
+
+		resp := testutils.TestRequest(t, app, "POST", path, "")
+		assert.Equal(t, 302, resp.StatusCode)
+
+		var rotated models.LicenseKey
+		require.NoError(t, db.First(&rotated, licenseKey.ID).Error)
+		assert.NotEqual(t, oldKey, rotated.Key)
+		assert.Equal(t, licenseKey.ProductID, rotated.ProductID)
+		assert.Equal(t, licenseKey.CustomerID, rotated.CustomerID)
+		assert.Equal(t, 1, rotated.CurrentActivations)
+		require.NotNil(t, rotated.ExpiresAt)
+		assert.True(t, licenseKey.ExpiresAt.Equal(*rotated.ExpiresAt))
+
+		status, _ := verify(oldKey)
+		assert.Equal(t, 404, status)
+
+		status, body := verify(rotated.Key)
+		assert.Equal(t, 200, status)
+		assert.True(t, body.Success)
+		assert.Equal(t, rotated.Key, body.Purchase.LicenseKey)
+		assert.Equal(t, "jane@example.com", body.Purchase.Email)
+
+		rotations, err := models.RotationsForLicenseKey(db, licenseKey.ID)
+		require.NoError(t, err)
+		require.Len(t, rotations, 1)
+		assert.Equal(t, models.HashKey(oldKey), rotations[0].OldKeyHash)
+		assert.Empty(t, emailer.sentTo)
+	})
+
+	t.Run("Rotate - Emailed When Asked", func(t *testing.T) {
+		emailer.sentTo = nil
+
+		resp := testutils.TestRequest(t, app, "POST", path, url.Values{"send_email": {"true"}}.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+		assert.Equal(t, []string{"jane@example.com"}, emailer.sentTo)
+
+		rotations, err := models.RotationsForLicenseKey(db, licenseKey.ID)
+		require.NoError(t, err)
+		assert.Len(t, rotations, 2)
+	})
+
+	t.Run("Rotate - Missing Key", func(t *testing.T) {
+		resp := testutils.TestRequest(t, app, "POST", "/license-keys/99999/rotate", "")
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+}
+
+func TestLicenseKeysHandler_Activations(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestAppWithDB(t, db)
+	handler := NewLicenseKeysHandler(db, nil, time.UTC)
+	app.Get("/license-keys/:id/activations", handler.Activations)
+	app.Delete("/license-keys/:id/activations/:deviceId", handler.Deactivate)
+
+	product := models.Product{Name: "Floating Product", LicenseType: models.LicenseTypeFloating}
+	require.NoError(t, db.Create(&product).Error)
+	customer := models.Customer{Name: "Seat Holder", Email: "seats@example.com"}
+	require.NoError(t, db.Create(&customer).Error)
+	licenseKey := models.LicenseKey{
+		Key:            "FLOAT-KEY-1",
+		ProductID:      product.ID,
+		CustomerID:     customer.ID,
+		LicenseType:    models.LicenseTypeFloating,
+		MaxActivations: 2,
+	}
+	require.NoError(t, db.Create(&licenseKey).Error)
+
+	now := time.Now()
+	require.NoError(t, licenseKey.CheckoutSeat(db, "device-a", "build-01", now))
+	require.NoError(t, licenseKey.CheckoutSeat(db, "laptop/2", "", now.Add(time.Second)))
+	require.ErrorIs(t, licenseKey.CheckoutSeat(db, "device-c", "", now), models.ErrNoSeatsAvailable)
+
+	path := "/license-keys/" + strconv.Itoa(int(licenseKey.ID)) + "/activations"
+
+	t.Run("Activations - Lists Seeded Devices", func(t *testing.T) {
+		resp := testutils.TestRequest(t, app, "GET", path+"?format=json", "")
+		require.Equal(t, 200, resp.StatusCode)
+		var body struct {
+			CurrentActivations int                   `json:"current_activations"`
+			MaxActivations     int                   `json:"max_activations"`
+			Activations        []models.SeatCheckout `json:"activations"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, 2, body.CurrentActivations)
+		assert.Equal(t, 2, body.MaxActivations)
+		require.Len(t, body.Activations, 2)
+		assert.Equal(t, "device-a", body.Activations[0].DeviceID)
+		assert.Equal(t, "build-01", body.Activations[0].Hostname)
+		assert.Equal(t, "laptop/2", body.Activations[1].DeviceID)
+
+		resp = testutils.TestRequest(t, app, "GET", path, "")
+		require.Equal(t, 200, resp.StatusCode)
+		html, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(html), "build-01")
+		assert.Contains(t, string(html), "2 / 2")
+		assert.Contains(t, string(html), path+"/laptop%2F2")
+	})
+
+	t.Run("Deactivate - Frees A Seat", func(t *testing.T) {
+		resp := testutils.TestRequest(t, app, "DELETE", path+"/"+url.QueryEscape("laptop/2"), "")
+		assert.Equal(t, 302, resp.StatusCode)
+
+		var stored models.LicenseKey
+		require.NoError(t, db.First(&stored, licenseKey.ID).Error)
+		assert.Equal(t, 1, stored.CurrentActivations)
+		seats, err := models.SeatsForLicenseKey(db, licenseKey.ID)
+		require.NoError(t, err)
+		require.Len(t, seats, 1)
+		assert.Equal(t, "device-a", seats[0].DeviceID)
+
+		require.NoError(t, stored.CheckoutSeat(db, "device-c", "", time.Now()))
+	})
+
+	t.Run("Deactivate - Unknown Device", func(t *testing.T) {
+		resp := testutils.TestRequest(t, app, "DELETE", path+"/no-such-device?format=json", "")
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+}
+
+func TestLicenseKeysHandler_BulkEmail(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestAppWithDB(t, db)
+	emailer := &stubEmailer{failFor: map[string]bool{"bounce@example.com": true}}
+	handler := NewLicenseKeysHandler(db, emailer, time.UTC)
+	app.Post("/license-keys/bulk-email", handler.BulkEmail)
+
+	product := models.Product{Name: "Bulk Product"}
+	require.NoError(t, db.Create(&product).Error)
+	var ids []string
+	for i, email := range []string{"a@example.com", "bounce@example.com", "b@example.com"} {
+		customer := models.Customer{Name: email, Email: email}
+		require.NoError(t, db.Create(&customer).Error)
+		key := models.LicenseKey{Key: fmt.Sprintf("BULK-%d", i), ProductID: product.ID, CustomerID: customer.ID}
+		require.NoError(t, db.Create(&key).Error)
+		ids = append(ids, strconv.Itoa(int(key.ID)))
+	}
+
+	t.Run("JSON Summary Of Sent And Failed", func(t *testing.T) {
+		emailer.sentTo = nil
+		form := url.Values{"license_key_ids": append(ids, "99999")}
+		req, _ := http.NewRequest("POST", "/license-keys/bulk-email", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var result struct {
+			Sent   []uint `json:"sent"`
+			Failed []struct {
+				LicenseKeyID uint   `json:"license_key_id"`
+				Email        string `json:"email"`
+				Error        string `json:"error"`
+			} `json:"failed"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Len(t, result.Sent, 2)
+		assert.ElementsMatch(t, []string{"a@example.com", "b@example.com"}, emailer.sentTo)
+		require.Len(t, result.Failed, 2)
+		assert.Equal(t, "bounce@example.com", result.Failed[0].Email)
+		assert.Equal(t, "mailbox unavailable", result.Failed[0].Error)
+		assert.Equal(t, uint(99999), result.Failed[1].LicenseKeyID)
+	})
+
+	t.Run("Form Submission Flashes Summary", func(t *testing.T) {
+		form := url.Values{"license_key_ids": ids}
+		resp := testutils.TestRequest(t, app, "POST", "/license-keys/bulk-email", form.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Set-Cookie"), "flash=")
+	})
+
+	t.Run("Nothing Selected", func(t *testing.T) {
+		resp := testutils.TestRequestJSON(t, app, "POST", "/license-keys/bulk-email", "")
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+}
+
+func TestLicenseKeysHandler_Import(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestAppWithDB(t, db)
+	handler := NewLicenseKeysHandler(db, nil, time.UTC)
+	app.Post("/license-keys/import", handler.Import)
+
+	product := models.Product{Name: "Existing Product", Permalink: "existing-product"}
+	require.NoError(t, db.Create(&product).Error)
+
+	importBundle := func(bundle string) models.BundleImportSummary {
+		resp := testutils.TestRequestJSON(t, app, "POST", "/license-keys/import", bundle)
+		require.Equal(t, 200, resp.StatusCode)
+		var summary models.BundleImportSummary
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&summary))
+		return summary
+	}
+
+	t.Run("Import - Creates New Customer", func(t *testing.T) {
+		summary := importBundle(`{
+			"version": 1,
+			"customer": {"email": "Migrated@Example.com", "name": "Migrated User", "company": "Acme"},
+			"license_keys": [
+				{"key": "MIGRATED-1", "product": {"permalink": "existing-product"}, "expires_at": "2030-01-01T00:00:00Z", "metadata": {"seat": "3"}},
+				{"key": "MIGRATED-2", "product": {"name": "Legacy App", "permalink": "legacy-app"}, "expires_at": null}
+			]
+		}`)
+		assert.Equal(t, 2, summary.Imported)
+		assert.Equal(t, 1, summary.CustomersCreated)
+		assert.Equal(t, 1, summary.ProductsCreated)
+		assert.Empty(t, summary.Skipped)
+		assert.Empty(t, summary.Failed)
+
+		var customer models.Customer
+		require.NoError(t, db.Where("email = ?", "migrated@example.com").First(&customer).Error)
+		assert.Equal(t, "Migrated User", customer.Name)
+		assert.Equal(t, "Acme", customer.Company)
+
+		var expiring models.LicenseKey
+		require.NoError(t, db.Where("key = ?", "MIGRATED-1").First(&expiring).Error)
+		assert.Equal(t, product.ID, expiring.ProductID)
+		assert.Equal(t, customer.ID, expiring.CustomerID)
+		require.NotNil(t, expiring.ExpiresAt)
+		assert.True(t, expiring.ExpiresAt.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)))
+		assert.Equal(t, "3", expiring.GetMetadataMap()["seat"])
+		assert.Equal(t, "active", expiring.Status)
+
+		var perpetual models.LicenseKey
+		require.NoError(t, db.Preload("Product").Where("key = ?", "MIGRATED-2").First(&perpetual).Error)
+		assert.Nil(t, perpetual.ExpiresAt)
+		assert.Equal(t, "legacy-app", perpetual.Product.Permalink)
+	})
+
+	t.Run("Import - Skips Existing Key", func(t *testing.T) {
+		customer := models.Customer{Name: "Owner", Email: "owner@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+		require.NoError(t, db.Create(&models.LicenseKey{Key: "ALREADY-HERE", ProductID: product.ID, CustomerID: customer.ID}).Error)
+
+		summary := importBundle(`{
+			"license_keys": [
+				{"key": "ALREADY-HERE", "customer_email": "someone@example.com", "product": {"permalink": "existing-product"}},
+				{"key": "BRAND-NEW", "customer_email": "owner@example.com", "product": {"permalink": "existing-product"}}
+			]
+		}`)
+		assert.Equal(t, 1, summary.Imported)
+		assert.Equal(t, []string{"ALREADY-HERE"}, summary.Skipped)
+		assert.Equal(t, 0, summary.CustomersCreated)
+
+		var existing models.LicenseKey
+		require.NoError(t, db.Where("key = ?", "ALREADY-HERE").First(&existing).Error)
+		assert.Equal(t, customer.ID, existing.CustomerID, "existing key is left untouched")
+
+		var count int64
+		db.Model(&models.Customer{}).Where("email = ?", "someone@example.com").Count(&count)
+		assert.Zero(t, count, "skipped keys create no customers")
+	})
+
+	t.Run("Import - Invalid JSON", func(t *testing.T) {
+		resp := testutils.TestRequestJSON(t, app, "POST", "/license-keys/import", `{"license_keys": [`)
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+}
+
+func TestLicenseKeysHandler_Search(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestAppWithDB(t, db)
+	handler := NewLicenseKeysHandler(db, nil, time.UTC)
+	app.Get("/license-keys/search", handler.Search)
+
+	desktop := models.Product{Name: "Desktop"}
+	require.NoError(t, db.Create(&desktop).Error)
+	mobile := models.Product{Name: "Mobile"}
+	require.NoError(t, db.Create(&mobile).Error)
+	customer := models.Customer{Name: "Ada", Email: "ada@example.com"}
+	require.NoError(t, db.Create(&customer).Error)
+
+	unique := models.LicenseKey{Key: "ONLY-DESKTOP-1", ProductID: desktop.ID, CustomerID: customer.ID}
+	require.NoError(t, db.Create(&unique).Error)
+	for _, productID := range []uint{desktop.ID, mobile.ID} {
+		require.NoError(t, db.Create(&models.LicenseKey{Key: "SHARED-KEY-1", ProductID: productID, CustomerID: customer.ID}).Error)
+	}
+
+	t.Run("Search - Found Key Redirects", func(t *testing.T) {
+		resp := testutils.TestRequest(t, app, "GET", "/license-keys/search?key="+url.QueryEscape(" only-desktop-1 "), "")
+		assert.Equal(t, 302, resp.StatusCode)
+		assert.Equal(t, "/admin/license-keys/"+strconv.Itoa(int(unique.ID)), resp.Header.Get("Location"))
+	})
+
+	t.Run("Search - Unknown Key Not Found", func(t *testing.T) {
+		resp := testutils.TestRequest(t, app, "GET", "/license-keys/search?key=NO-SUCH-KEY", "")
+		assert.Equal(t, 404, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "No license key matches")
+
+		resp = testutils.TestRequest(t, app, "GET", "/license-keys/search?key=NO-SUCH-KEY&format=json", "")
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+
+	t.Run("Search - Key In Several Products Is Listed", func(t *testing.T) {
+		resp := testutils.TestRequest(t, app, "GET", "/license-keys/search?key=SHARED-KEY-1", "")
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "Desktop")
+		assert.Contains(t, string(body), "Mobile")
+	})
+}
+
+func TestLicenseKeysHandler_MultiTenant(t *testing.T) {
+	middleware.InitAuth(&config.Config{MultiTenant: true})
+	defer middleware.InitAuth(&config.Config{})
+
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestAppWithDB(t, db)
+	handler := NewLicenseKeysHandler(db, nil, time.UTC)
+
+	acme, globex := uint(1), uint(2)
+	admin := models.AdminUser{Username: "acme-reseller", PasswordHash: "x", OwnerID: &acme}
+	require.NoError(t, db.Create(&admin).Error)
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("current_admin", &admin)
+		return c.Next()
+	})
+	app.Get("/license-keys", handler.Index)
+	app.Get("/license-keys/:id", handler.Show)
+	app.Put("/license-keys/:id", handler.Update)
+
+	customer := models.Customer{Name: "Ada", Email: "ada@example.com"}
+	require.NoError(t, db.Create(&customer).Error)
+	ownProduct := models.Product{Name: "Acme App", OwnerID: &acme}
+	require.NoError(t, db.Create(&ownProduct).Error)
+	otherProduct := models.Product{Name: "Globex App", OwnerID: &globex}
+	require.NoError(t, db.Create(&otherProduct).Error)
+
+	own := models.LicenseKey{Key: "ACME-KEY-1", ProductID: ownProduct.ID, CustomerID: customer.ID, Status: "active", OwnerID: &acme}
+	require.NoError(t, db.Create(&own).Error)
+	other := models.LicenseKey{Key: "GLOBEX-KEY-1", ProductID: otherProduct.ID, CustomerID: customer.ID, Status: "active", MaxActivations: 1, OwnerID: &globex}
+	require.NoError(t, db.Create(&other).Error)
+
+	t.Run("Index - Only Own Keys", func(t *testing.T) {
+		resp := testutils.TestRequest(t, app, "GET", "/license-keys", "")
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "ACME-KEY-1")
+		assert.NotContains(t, string(body), "GLOBEX-KEY-1")
+	})
+
+	t.Run("Show - Other Tenant's Key Not Found", func(t *testing.T) {
+		resp := testutils.TestRequest(t, app, "GET", "/license-keys/"+strconv.Itoa(int(own.ID)), "")
+		assert.Equal(t, 200, resp.StatusCode)
+
+		resp = testutils.TestRequest(t, app, "GET", "/license-keys/"+strconv.Itoa(int(other.ID)), "")
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+
+	t.Run("Update - Other Tenant's Key Not Found", func(t *testing.T) {
+		form := url.Values{"max_activations": {"50"}}
+		resp := testutils.TestRequest(t, app, "PUT", "/license-keys/"+strconv.Itoa(int(other.ID)), form.Encode())
+		assert.Equal(t, 404, resp.StatusCode)
+
+		var reloaded models.LicenseKey
+		require.NoError(t, db.First(&reloaded, other.ID).Error)
+		assert.Equal(t, 1, reloaded.MaxActivations, "another tenant's key must not change")
+	})
+
+	t.Run("Update - Cannot Move Key To Other Tenant's Product", func(t *testing.T) {
+		form := url.Values{"product_id": {strconv.Itoa(int(otherProduct.ID))}}
+		resp := testutils.TestRequest(t, app, "PUT", "/license-keys/"+strconv.Itoa(int(own.ID)), form.Encode())
+		assert.Equal(t, 400, resp.StatusCode)
+
+		var reloaded models.LicenseKey
+		require.NoError(t, db.First(&reloaded, own.ID).Error)
+		assert.Equal(t, ownProduct.ID, reloaded.ProductID)
+	})
+}
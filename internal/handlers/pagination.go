@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+
+	"matcha/internal/config"
+)
+
+// Page sizes for every admin index, set from the config by InitPagination
+var (
+	defaultPerPage = config.DefaultPageSize
+	maxPerPage     = config.DefaultMaxPageSize
+)
+
+// InitPagination applies the configured page sizes; unset values keep the defaults
+func InitPagination(cfg *config.Config) {
+	defaultPerPage, maxPerPage = config.DefaultPageSize, config.DefaultMaxPageSize
+	if cfg.PageSize > 0 {
+		defaultPerPage = cfg.PageSize
+	}
+	if cfg.MaxPageSize > 0 {
+		maxPerPage = cfg.MaxPageSize
+	}
+}
+
+// Pagination describes one page of an index listing
+type Pagination struct {
+	Page    int   `json:"page"`
+	PerPage int   `json:"per_page"`
+	Total   int64 `json:"total"`
+}
+
+// paginationFromQuery reads the page and per_page query params, falling back
+// to sane defaults for missing or out-of-range values
+func paginationFromQuery(c *fiber.Ctx) Pagination {
+	page, err := strconv.Atoi(c.Query("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	perPage, err := strconv.Atoi(c.Query("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = defaultPerPage
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+
+	return Pagination{Page: page, PerPage: perPage}
+}
+
+func (p Pagination) Offset() int {
+	return (p.Page - 1) * p.PerPage
+}
+
+func (p Pagination) TotalPages() int {
+	if p.Total == 0 {
+		return 1
+	}
+	return int((p.Total + int64(p.PerPage) - 1) / int64(p.PerPage))
+}
+
+func (p Pagination) HasPrev() bool {
+	return p.Page > 1
+}
+
+func (p Pagination) HasNext() bool {
+	return p.Page < p.TotalPages()
+}
+
+func (p Pagination) PrevPage() int {
+	return p.Page - 1
+}
+
+func (p Pagination) NextPage() int {
+	return p.Page + 1
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"matcha/internal/config"
+	"matcha/internal/models"
+	"matcha/internal/testutils"
+)
+
+func TestInitPagination_ConfiguredPageSizes(t *testing.T) {
+	InitPagination(&config.Config{PageSize: 2, MaxPageSize: 3})
+	defer InitPagination(&config.Config{})
+
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestAppWithDB(t, db)
+	app.Get("/products", NewProductsHandler(db).Index)
+	app.Get("/customers", NewCustomersHandler(db).Index)
+	app.Get("/license-keys", NewLicenseKeysHandler(db, nil, time.UTC).Index)
+
+	for i := 1; i <= 3; i++ {
+		product := models.Product{Name: fmt.Sprintf("Product %d", i)}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: fmt.Sprintf("Customer %d", i), Email: fmt.Sprintf("customer%d@example.com", i)}
+		require.NoError(t, db.Create(&customer).Error)
+		require.NoError(t, db.Create(&models.LicenseKey{Key: fmt.Sprintf("KEY-%d", i), ProductID: product.ID, CustomerID: customer.ID}).Error)
+	}
+
+	get := func(path string) string {
+		resp := testutils.TestRequest(t, app, "GET", path, "")
+		require.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	for _, index := range []string{"/products", "/customers", "/license-keys"} {
+		assert.Contains(t, get(index), "Page 1 of 2", "%s uses the configured page size", index)
+		assert.NotContains(t, get(index+"?per_page=50"), "Page 1 of", "%s caps per_page at the configured maximum", index)
+	}
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"matcha/internal/database"
+	"matcha/internal/middleware"
+	"matcha/internal/models"
+)
+
+// productImport is one entry of a product import. Omitted limits fall back to
+// the same defaults as the new product form.
+type productImport struct {
+	Name                  string `json:"name"`
+	Description           string `json:"description"`
+	Version               string `json:"version"`
+	DefaultExpirationDays *int   `json:"default_expiration_days"`
+	DefaultUsageLimit     *int   `json:"default_usage_limit"`
+}
+
+// productImportResult reports what happened to each entry, by name
+type productImportResult struct {
+	Created []string             `json:"created"`
+	Skipped []string             `json:"skipped"` // Names that already exist
+	Errors  []productImportError `json:"errors"`
+}
+
+type productImportError struct {
+	Index int    `json:"index"` // Position in the submitted array
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// Import creates products from a JSON array, to seed a new install quickly.
+// Invalid entries are reported and left out; entries whose name already
+// exists for the admin's tenant, ignoring case, are skipped. The rest are
+// created in one transaction, owned by that tenant.
+func (h *ProductsHandler) Import(c *fiber.Ctx) error {
+	var entries []productImport
+	if err := json.Unmarshal(c.Body(), &entries); err != nil {
+		return jsonError(c, 400, "Expected a JSON array of products")
+	}
+	if len(entries) == 0 {
+		return jsonError(c, 400, "No products to import")
+	}
+
+	ownerID := middleware.CurrentOwnerID(c)
+	var result productImportResult
+	err := database.PerformWrite(requestDB(c, h.db), func(db *gorm.DB) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			result = productImportResult{Created: []string{}, Skipped: []string{}, Errors: []productImportError{}}
+			seen := map[string]bool{}
+			for i, entry := range entries {
+				product, err := entry.product()
+				if err != nil {
+					result.Errors = append(result.Errors, productImportError{Index: i, Name: entry.Name, Error: err.Error()})
+					continue
+				}
+				product.OwnerID = ownerID
+
+				name := strings.ToLower(product.Name)
+				if !seen[name] {
+					seen[name] = true
+					var count int64
+					if err := tx.Model(&models.Product{}).Scopes(tenantScope(c)).Where("LOWER(name) = ?", name).Count(&count).Error; err != nil {
+						return err
+					}
+					if count == 0 {
+						if err := tx.Create(&product).Error; err != nil {
+							return err
+						}
+						result.Created = append(result.Created, product.Name)
+						continue
+					}
+				}
+				result.Skipped = append(result.Skipped, product.Name)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return jsonError(c, 500, "Failed to import products: "+err.Error())
+	}
+
+	status := 200
+	if len(result.Created) > 0 {
+		status = 201
+	}
+	return c.Status(status).JSON(result)
+}
+
+// product validates the entry and builds the product it describes
+func (entry productImport) product() (models.Product, error) {
+	product := models.Product{
+		Name:                  strings.TrimSpace(entry.Name),
+		Description:           entry.Description,
+		Version:               entry.Version,
+		DefaultExpirationDays: 365,
+		DefaultExpirationUnit: models.ExpirationUnitDays,
+		DefaultUsageLimit:     1,
+		LicenseType:           models.LicenseTypeNodeLocked,
+		KeyLength:             models.DefaultKeyLength,
+		KeyCharset:            models.KeyCharsetAlphanumeric,
+	}
+	if product.Name == "" {
+		return product, errors.New("name is required")
+	}
+	if entry.DefaultExpirationDays != nil {
+		if *entry.DefaultExpirationDays < 0 {
+			return product, errors.New("default_expiration_days must not be negative")
+		}
+		product.DefaultExpirationDays = *entry.DefaultExpirationDays
+	}
+	if entry.DefaultUsageLimit != nil {
+		if *entry.DefaultUsageLimit < 0 {
+			return product, errors.New("default_usage_limit must not be negative")
+		}
+		product.DefaultUsageLimit = *entry.DefaultUsageLimit
+	}
+	return product, nil
+}
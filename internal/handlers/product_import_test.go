@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"matcha/internal/config"
+	"matcha/internal/middleware"
+	"matcha/internal/models"
+	"matcha/internal/testutils"
+)
+
+func TestProductsHandler_Import(t *testing.T) {
+	setup := func(t *testing.T) func(body string) (int, productImportResult) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewProductsHandler(db)
+		app.Post("/products/import", handler.Import)
+
+		require.NoError(t, db.Create(&models.Product{Name: "Existing App"}).Error)
+
+		return func(body string) (int, productImportResult) {
+			resp := testutils.TestRequestJSON(t, app, "POST", "/products/import", body)
+			var result productImportResult
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+			return resp.StatusCode, result
+		}
+	}
+
+	t.Run("Import - Valid Set", func(t *testing.T) {
+		importProducts := setup(t)
+
+		status, result := importProducts(`[
+			{"name": "Desktop App", "description": "For macOS", "version": "2.1.0", "default_expiration_days": 30, "default_usage_limit": 3},
+			{"name": "CLI Tool"}
+		]`)
+		assert.Equal(t, 201, status)
+		assert.Equal(t, []string{"Desktop App", "CLI Tool"}, result.Created)
+		assert.Empty(t, result.Skipped)
+		assert.Empty(t, result.Errors)
+	})
+
+	t.Run("Import - Missing Name", func(t *testing.T) {
+		importProducts := setup(t)
+
+		status, result := importProducts(`[{"name": "Plugin"}, {"name": "  ", "version": "1.0.0"}, {"name": "Theme", "default_usage_limit": -1}]`)
+		assert.Equal(t, 201, status)
+		assert.Equal(t, []string{"Plugin"}, result.Created)
+		require.Len(t, result.Errors, 2)
+		assert.Equal(t, 1, result.Errors[0].Index)
+		assert.Equal(t, "name is required", result.Errors[0].Error)
+		assert.Equal(t, 2, result.Errors[1].Index)
+	})
+
+	t.Run("Import - Duplicate Name", func(t *testing.T) {
+		importProducts := setup(t)
+
+		status, result := importProducts(`[{"name": "existing app"}, {"name": "Server"}, {"name": "SERVER"}]`)
+		assert.Equal(t, 201, status)
+		assert.Equal(t, []string{"Server"}, result.Created)
+		assert.Equal(t, []string{"existing app", "SERVER"}, result.Skipped)
+
+		status, result = importProducts(`[{"name": "Server"}]`)
+		assert.Equal(t, 200, status, "nothing new was created")
+		assert.Equal(t, []string{"Server"}, result.Skipped)
+	})
+
+	t.Run("Import - Defaults And Stored Fields", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		app.Post("/products/import", NewProductsHandler(db).Import)
+
+		resp := testutils.TestRequestJSON(t, app, "POST", "/products/import", `[{"name": "Desktop App", "version": "2.1.0", "default_usage_limit": 3}]`)
+		assert.Equal(t, 201, resp.StatusCode)
+
+		var product models.Product
+		require.NoError(t, db.Where("name = ?", "Desktop App").First(&product).Error)
+		assert.Equal(t, "2.1.0", product.Version)
+		assert.Equal(t, 365, product.DefaultExpirationDays)
+		assert.Equal(t, 3, product.DefaultUsageLimit)
+		assert.Equal(t, "desktop-app", product.Permalink)
+	})
+
+	t.Run("Import - Owned By Tenant", func(t *testing.T) {
+		middleware.InitAuth(&config.Config{MultiTenant: true})
+		defer middleware.InitAuth(&config.Config{})
+
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		acme, globex := uint(1), uint(2)
+		admin := models.AdminUser{Username: "acme-reseller", PasswordHash: "x", OwnerID: &acme}
+		require.NoError(t, db.Create(&admin).Error)
+		app.Use(func(c *fiber.Ctx) error {
+			c.Locals("current_admin", &admin)
+			return c.Next()
+		})
+		app.Post("/products/import", NewProductsHandler(db).Import)
+		require.NoError(t, db.Create(&models.Product{Name: "Globex App", OwnerID: &globex}).Error)
+
+		resp := testutils.TestRequestJSON(t, app, "POST", "/products/import", `[{"name": "Globex App"}]`)
+		assert.Equal(t, 201, resp.StatusCode, "another tenant's product of the same name doesn't count")
+
+		var product models.Product
+		require.NoError(t, db.Where("name = ? AND owner_id = ?", "Globex App", acme).First(&product).Error)
+	})
+
+	t.Run("Import - Not An Array", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		app.Post("/products/import", NewProductsHandler(db).Import)
+
+		resp := testutils.TestRequestJSON(t, app, "POST", "/products/import", `{"name": "Desktop App"}`)
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+}
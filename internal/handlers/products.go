@@ -1,13 +1,17 @@
 package handlers
 
 import (
+	"errors"
 	"log"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
 
 	"matcha/internal/database"
+	"matcha/internal/middleware"
 	"matcha/internal/models"
 )
 
@@ -20,14 +24,22 @@ func NewProductsHandler(db *gorm.DB) *ProductsHandler {
 }
 
 func (h *ProductsHandler) Index(c *fiber.Ctx) error {
+	pagination := paginationFromQuery(c)
+	h.db.Model(&models.Product{}).Scopes(tenantScope(c)).Count(&pagination.Total)
+
 	var products []models.Product
-	h.db.Preload("LicenseKeys").Find(&products)
+	h.db.Scopes(tenantScope(c)).Preload("LicenseKeys").
+		Order("id").
+		Offset(pagination.Offset()).
+		Limit(pagination.PerPage).
+		Find(&products)
 
 	return SafeRender(c, "admin/products/index", fiber.Map{
-		"ShowNav":   true,
-		"PageType":  "products-index",
-		"Products":  products,
-		"CSRFToken": "",
+		"ShowNav":    true,
+		"PageType":   "products-index",
+		"Products":   products,
+		"Pagination": pagination,
+		"CSRFToken":  "",
 	})
 }
 
@@ -40,65 +52,93 @@ func (h *ProductsHandler) New(c *fiber.Ctx) error {
 }
 
 func (h *ProductsHandler) Create(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
+	form, err := parseFormInput(c)
+	if err != nil {
+		return jsonError(c, 400, "Invalid JSON body")
+	}
+
 	log.Printf("ProductsCreate: Method=%s, Path=%s", c.Method(), c.Path())
 	log.Printf("ProductsCreate: Form values - name=%s, description=%s, version=%s",
-		c.FormValue("name"), c.FormValue("description"), c.FormValue("version"))
-
-	// Validate required fields
-	name := c.FormValue("name")
-	if name == "" {
-		return c.Status(400).JSON(fiber.Map{
-			"error": "Product name is required",
-		})
-	}
+		form.Value("name"), form.Value("description"), form.Value("version"))
 
 	product := models.Product{
-		Name:        name,
-		Description: c.FormValue("description"),
-		Version:     c.FormValue("version"),
+		Name:                  form.Value("name"),
+		Description:           form.Value("description"),
+		Version:               form.Value("version"),
+		LicenseType:           models.NormalizeLicenseType(form.Value("license_type")),
+		DefaultExpirationUnit: models.NormalizeExpirationUnit(form.Value("default_expiration_unit")),
+		Perpetual:             form.Value("perpetual") == "true",
+		KeyCharset:            models.NormalizeKeyCharset(form.Value("key_charset")),
+		DefaultMetadata:       strings.TrimSpace(form.Value("default_metadata")),
+		OwnerID:               middleware.CurrentOwnerID(c),
 	}
+	incrementOnVerify := form.Value("increment_on_verify") == "true"
+	product.IncrementOnVerify = &incrementOnVerify
 
 	// Handle expiration days
-	if days, err := strconv.Atoi(c.FormValue("default_expiration_days")); err == nil {
+	if days, err := strconv.Atoi(form.Value("default_expiration_days")); err == nil {
 		product.DefaultExpirationDays = days
 	} else {
 		product.DefaultExpirationDays = 365
 	}
 
 	// Handle usage limit
-	if limit, err := strconv.Atoi(c.FormValue("default_usage_limit")); err == nil {
+	if limit, err := strconv.Atoi(form.Value("default_usage_limit")); err == nil {
 		product.DefaultUsageLimit = limit
 	} else {
 		product.DefaultUsageLimit = 1
 	}
 
+	product.KeyLength = models.DefaultKeyLength
+	if errs := validateProduct(db, form, &product); len(errs) > 0 {
+		return renderProductForm(c, 400, product, errs, errs.Error())
+	}
+
 	// Use PerformWrite for database operation with retry logic
-	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+	err = database.PerformWrite(db, func(db *gorm.DB) error {
 		return db.Create(&product).Error
 	})
 	if err != nil {
-		return SafeRenderWithStatus(c, 500, "admin/products/new", fiber.Map{
-			"Error":   "Failed to create product: " + err.Error(),
-			"Product": product,
-			"ShowNav": true,
-		}, "Failed to create product: "+err.Error())
+		return renderProductForm(c, 500, product, nil, "Failed to create product: "+err.Error())
 	}
 
-	return c.Redirect("/admin/products")
+	if wantsJSON(c) {
+		return c.Status(201).JSON(product)
+	}
+	middleware.SetFlash(c, middleware.FlashSuccess, "Product created")
+	return c.Redirect(middleware.AdminURL("/products"))
 }
 
 func (h *ProductsHandler) Show(c *fiber.Ctx) error {
 	id, _ := strconv.Atoi(c.Params("id"))
 	var product models.Product
-	if err := h.db.Preload("LicenseKeys.Customer").First(&product, id).Error; err != nil {
+	if err := h.db.Scopes(tenantScope(c)).Preload("LicenseKeys.Customer").First(&product, id).Error; err != nil {
 		return c.Status(404).SendString("Product not found")
 	}
 
+	analytics, err := product.Analytics(h.db, time.Now(), analyticsDays)
+	if err != nil {
+		log.Printf("Failed to load analytics for product %d: %v", product.ID, err)
+	}
+
+	// The form starts from the template emails currently use, so an
+	// override begins as a copy of the global one
+	emailTemplate, err := models.ProductEmailTemplate(h.db, product.ID, models.EmailTemplateLicenseKey)
+	customEmail := err == nil
+	if !customEmail {
+		global := models.GetEmailTemplate(h.db, models.EmailTemplateLicenseKey)
+		emailTemplate = &global
+	}
+
 	// Try to render template, fallback to JSON if no template engine
 	if err := c.Render("admin/products/show", fiber.Map{
-		"ShowNav":  true,
-		"PageType": "products-show",
-		"Product":  product,
+		"ShowNav":       true,
+		"PageType":      "products-show",
+		"Product":       &product,
+		"Analytics":     analytics,
+		"EmailTemplate": emailTemplate,
+		"CustomEmail":   customEmail,
 	}); err != nil {
 		return c.Status(200).JSON(fiber.Map{
 			"product": product,
@@ -107,10 +147,31 @@ func (h *ProductsHandler) Show(c *fiber.Ctx) error {
 	return nil
 }
 
+// analyticsDays is how far back the verification series goes
+const analyticsDays = 30
+
+// Analytics returns key status breakdowns, usage totals and daily verification
+// counts for a product
+func (h *ProductsHandler) Analytics(c *fiber.Ctx) error {
+	id, _ := strconv.Atoi(c.Params("id"))
+	var product models.Product
+	if err := h.db.Scopes(tenantScope(c)).First(&product, id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+	}
+
+	analytics, err := product.Analytics(h.db, time.Now(), analyticsDays)
+	if err != nil {
+		log.Printf("Failed to load analytics for product %d: %v", product.ID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load analytics"})
+	}
+
+	return c.JSON(analytics)
+}
+
 func (h *ProductsHandler) Edit(c *fiber.Ctx) error {
 	id, _ := strconv.Atoi(c.Params("id"))
 	var product models.Product
-	if err := h.db.First(&product, id).Error; err != nil {
+	if err := h.db.Scopes(tenantScope(c)).First(&product, id).Error; err != nil {
 		return c.Status(404).SendString("Product not found")
 	}
 
@@ -118,7 +179,7 @@ func (h *ProductsHandler) Edit(c *fiber.Ctx) error {
 	if err := c.Render("admin/products/edit", fiber.Map{
 		"ShowNav":   true,
 		"PageType":  "products-edit",
-		"Product":   product,
+		"Product":   &product,
 		"CSRFToken": "",
 	}); err != nil {
 		return c.Status(200).JSON(fiber.Map{
@@ -129,72 +190,287 @@ func (h *ProductsHandler) Edit(c *fiber.Ctx) error {
 }
 
 func (h *ProductsHandler) Update(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
+	form, err := parseFormInput(c)
+	if err != nil {
+		return jsonError(c, 400, "Invalid JSON body")
+	}
+
 	// Accept both PUT requests and POST requests with _method=PUT
-	if c.Method() != "PUT" && !(c.Method() == "POST" && c.FormValue("_method") == "PUT") {
+	if c.Method() != "PUT" && !(c.Method() == "POST" && form.Value("_method") == "PUT") {
 		return c.Status(405).SendString("Method not allowed")
 	}
 
 	id, _ := strconv.Atoi(c.Params("id"))
 	var product models.Product
-	if err := h.db.First(&product, id).Error; err != nil {
+	if err := db.Scopes(tenantScope(c)).First(&product, id).Error; err != nil {
+		if wantsJSON(c) {
+			return jsonError(c, 404, "Product not found")
+		}
 		return c.Status(404).SendString("Product not found")
 	}
 
+	expectedVersion := lockVersionFrom(form, product.LockVersion)
+
 	// Only update non-empty fields
-	if name := c.FormValue("name"); name != "" {
+	if name := form.Value("name"); name != "" {
 		product.Name = name
 	}
-	if description := c.FormValue("description"); description != "" {
+	if description := form.Value("description"); description != "" {
 		product.Description = description
 	}
-	if version := c.FormValue("version"); version != "" {
+	if version := form.Value("version"); version != "" {
 		product.Version = version
 	}
+	if licenseType := form.Value("license_type"); licenseType != "" {
+		product.LicenseType = models.NormalizeLicenseType(licenseType)
+	}
+	// Unticked checkboxes aren't submitted, so absence means not perpetual
+	product.Perpetual = form.Value("perpetual") == "true"
+	incrementOnVerify := form.Value("increment_on_verify") == "true"
+	product.IncrementOnVerify = &incrementOnVerify
 
-	if days, err := strconv.Atoi(c.FormValue("default_expiration_days")); err == nil {
+	if days, err := strconv.Atoi(form.Value("default_expiration_days")); err == nil {
 		product.DefaultExpirationDays = days
 	}
+	if unit := form.Value("default_expiration_unit"); unit != "" {
+		product.DefaultExpirationUnit = models.NormalizeExpirationUnit(unit)
+	}
 
-	if limit, err := strconv.Atoi(c.FormValue("default_usage_limit")); err == nil {
+	if limit, err := strconv.Atoi(form.Value("default_usage_limit")); err == nil {
 		product.DefaultUsageLimit = limit
 	}
 
-	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
-		return db.Save(&product).Error
+	if charset := form.Value("key_charset"); charset != "" {
+		product.KeyCharset = models.NormalizeKeyCharset(charset)
+	}
+	if form.Has("default_metadata") {
+		product.DefaultMetadata = strings.TrimSpace(form.Value("default_metadata"))
+	}
+	if errs := validateProduct(db, form, &product); len(errs) > 0 {
+		return renderProductForm(c, 400, product, errs, errs.Error())
+	}
+
+	err = database.PerformWrite(db, func(db *gorm.DB) error {
+		return models.SaveIfUnchanged(db, &product, expectedVersion)
 	})
+	if errors.Is(err, models.ErrStaleRecord) {
+		return renderProductForm(c, 409, product, nil, staleRecordMessage)
+	}
+	if err != nil {
+		return renderProductForm(c, 400, product, nil, "Failed to update product: "+err.Error())
+	}
+
+	if wantsJSON(c) {
+		return c.JSON(product)
+	}
+	middleware.SetFlash(c, middleware.FlashSuccess, "Product updated")
+	return c.Redirect(middleware.AdminURL("/products/") + c.Params("id"))
+}
+
+// validateProduct checks a product built from a submitted form, applying the
+// fields whose parsing can fail along the way. Each problem is reported
+// against the form field it came from.
+func validateProduct(db *gorm.DB, form *formInput, product *models.Product) ValidationErrors {
+	errs := ValidationErrors{}
+	if strings.TrimSpace(product.Name) == "" {
+		errs.Add("name", "Product name is required")
+	}
+
+	keyLength, err := keyLengthFrom(form, product.KeyLength)
 	if err != nil {
-		// Try to render template, fallback to JSON error
-		if renderErr := c.Render("admin/products/edit", fiber.Map{
-			"Error":     "Failed to update product: " + err.Error(),
-			"Product":   product,
-			"CSRFToken": "",
-		}); renderErr != nil {
-			return c.Status(400).JSON(fiber.Map{
-				"error": "Failed to update product: " + err.Error(),
-			})
+		errs.Add("key_length", err.Error())
+	}
+	product.KeyLength = keyLength
+
+	if err := defaultMetadataError(product.DefaultMetadata); err != nil {
+		errs.Add("default_metadata", err.Error())
+	}
+
+	// Left blank, the permalink is generated from the name on create
+	if permalink := form.Value("permalink"); permalink != "" && models.Slugify(permalink) != product.Permalink {
+		if err := product.SetPermalink(db, permalink); err != nil {
+			errs.Add("permalink", err.Error())
+			product.Permalink = permalink // Shown back in the form for correcting
 		}
-		return nil
 	}
+	return errs
+}
+
+// renderProductForm shows the new or edit form again, keeping what was
+// submitted, with msg above it and errs under their fields
+func renderProductForm(c *fiber.Ctx, status int, product models.Product, errs ValidationErrors, msg string) error {
+	if wantsJSON(c) {
+		return jsonError(c, status, msg)
+	}
+	page := "new"
+	if product.ID != 0 {
+		page = "edit"
+	}
+	return SafeRenderWithStatus(c, status, "admin/products/"+page, fiber.Map{
+		"ShowNav":          true,
+		"PageType":         "products-" + page,
+		"Error":            msg,
+		"Product":          &product,
+		"ValidationErrors": errs,
+		"CSRFToken":        "",
+	}, msg)
+}
+
+// defaultMetadataError explains default metadata that isn't a JSON object
+func defaultMetadataError(raw string) error {
+	if err := models.ValidateMetadataJSON(raw); err != nil {
+		return errors.New("default " + err.Error())
+	}
+	return nil
+}
 
-	return c.Redirect("/admin/products/" + c.Params("id"))
+// keyLengthFrom reads the generated key length, keeping current when the
+// field is left empty
+func keyLengthFrom(form *formInput, current int) (int, error) {
+	value := form.Value("key_length")
+	if value == "" {
+		return current, nil
+	}
+	length, err := strconv.Atoi(value)
+	if err != nil {
+		return current, errors.New("key length must be a number")
+	}
+	if err := models.ValidateKeyLength(length); err != nil {
+		return current, err
+	}
+	return length, nil
 }
 
 func (h *ProductsHandler) Delete(c *fiber.Ctx) error {
-	id, _ := strconv.Atoi(c.Params("id"))
+	return deleteProduct(c, requestDB(c, h.db))
+}
 
-	// Check if product has associated license keys
-	var licenseKeyCount int64
-	h.db.Model(&models.LicenseKey{}).Where("product_id = ?", id).Count(&licenseKeyCount)
+// deleteProduct backs every product delete route so they share the license key
+// guard. Passing ?cascade=true deletes the product's keys along with it.
+func deleteProduct(c *fiber.Ctx, db *gorm.DB) error {
+	id, _ := strconv.Atoi(c.Params("id"))
+	var product models.Product
+	if err := db.Scopes(tenantScope(c)).First(&product, id).Error; err != nil {
+		return c.Status(404).SendString("Product not found")
+	}
 
-	if licenseKeyCount > 0 {
+	err := database.PerformWrite(db, func(db *gorm.DB) error {
+		return product.DeleteWithGuard(db, c.QueryBool("cascade"))
+	})
+	if errors.Is(err, models.ErrProductHasLicenseKeys) {
 		return c.Status(400).JSON(fiber.Map{
 			"error": "Cannot delete product with associated license keys",
 		})
 	}
-
-	if err := h.db.Delete(&models.Product{}, id).Error; err != nil {
+	if err != nil {
 		return c.Status(500).SendString("Failed to delete product")
 	}
 
-	return c.Redirect("/admin/products")
+	middleware.SetFlash(c, middleware.FlashSuccess, "Product deleted")
+	return c.Redirect(middleware.AdminURL("/products"))
+}
+
+// RegenerateAPIKey issues a new API key for the product, replacing any existing one
+func (h *ProductsHandler) RegenerateAPIKey(c *fiber.Ctx) error {
+	id, _ := strconv.Atoi(c.Params("id"))
+	var product models.Product
+	if err := h.db.Scopes(tenantScope(c)).First(&product, id).Error; err != nil {
+		return c.Status(404).SendString("Product not found")
+	}
+
+	var key string
+	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+		var err error
+		key, err = product.RegenerateAPIKey(db)
+		return err
+	})
+	if err != nil {
+		return c.Status(500).SendString("Failed to regenerate API key")
+	}
+
+	// Only a digest is stored, so this is the one time the key is shown
+	middleware.SetFlash(c, middleware.FlashSuccess, "New API key: "+key+". Copy it now, it won't be shown again.")
+	return c.Redirect(middleware.AdminURL("/products/") + c.Params("id"))
+}
+
+// RemoveAPIKey clears the product's API key so verification no longer requires one
+func (h *ProductsHandler) RemoveAPIKey(c *fiber.Ctx) error {
+	id, _ := strconv.Atoi(c.Params("id"))
+	var product models.Product
+	if err := h.db.Scopes(tenantScope(c)).First(&product, id).Error; err != nil {
+		return c.Status(404).SendString("Product not found")
+	}
+
+	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+		return product.RemoveAPIKey(db)
+	})
+	if err != nil {
+		return c.Status(500).SendString("Failed to remove API key")
+	}
+
+	return c.Redirect(middleware.AdminURL("/products/") + c.Params("id"))
+}
+
+// UpdateRateLimitExempt sets whether requests carrying the product's API key
+// skip rate limits
+func (h *ProductsHandler) UpdateRateLimitExempt(c *fiber.Ctx) error {
+	id, _ := strconv.Atoi(c.Params("id"))
+	var product models.Product
+	if err := h.db.Scopes(tenantScope(c)).First(&product, id).Error; err != nil {
+		return c.Status(404).SendString("Product not found")
+	}
+	if !product.RequiresAPIKey() {
+		return c.Status(400).SendString("Generate an API key before exempting it from rate limits")
+	}
+
+	exempt := c.FormValue("rate_limit_exempt") == "true"
+	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+		return db.Model(&product).Update("rate_limit_exempt", exempt).Error
+	})
+	if err != nil {
+		return c.Status(500).SendString("Failed to update rate limit exemption")
+	}
+
+	return c.Redirect(middleware.AdminURL("/products/") + c.Params("id"))
+}
+
+// UpdateEmailTemplate saves the product's own license key email, used instead
+// of the global template. Submitting reset=true removes it again.
+func (h *ProductsHandler) UpdateEmailTemplate(c *fiber.Ctx) error {
+	id, _ := strconv.Atoi(c.Params("id"))
+	var product models.Product
+	if err := h.db.Scopes(tenantScope(c)).First(&product, id).Error; err != nil {
+		return c.Status(404).SendString("Product not found")
+	}
+	redirect := middleware.AdminURL("/products/") + c.Params("id")
+
+	if c.FormValue("reset") == "true" {
+		err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+			return models.DeleteProductEmailTemplate(db, product.ID, models.EmailTemplateLicenseKey)
+		})
+		if err != nil {
+			return c.Status(500).SendString("Failed to reset email template")
+		}
+		middleware.SetFlash(c, middleware.FlashSuccess, "License email reset to the global template")
+		return c.Redirect(redirect)
+	}
+
+	tmpl := models.EmailTemplate{
+		Type:      models.EmailTemplateLicenseKey,
+		ProductID: &product.ID,
+		Subject:   c.FormValue("subject"),
+		Body:      c.FormValue("body"),
+	}
+	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+		return models.SaveEmailTemplate(db, &tmpl)
+	})
+	if err != nil {
+		log.Printf("Error saving email template for product %d: %v", product.ID, err)
+		middleware.SetFlash(c, middleware.FlashError, "Failed to save license email: "+err.Error())
+		return c.Redirect(redirect)
+	}
+
+	middleware.SetFlash(c, middleware.FlashSuccess, "License email saved for "+product.Name)
+	return c.Redirect(redirect)
 }
@@ -1,12 +1,17 @@
 package handlers
 
 import (
+	"encoding/json"
+	"io"
 	"net/url"
 	"strconv"
 	"testing"
+	"time"
 
+	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
 
 	"matcha/internal/models"
 	"matcha/internal/testutils"
@@ -66,6 +71,7 @@ func TestProductsHandler_Integration(t *testing.T) {
 
 		resp := testutils.TestRequest(t, app, "POST", "/products", form.Encode())
 		assert.Equal(t, 302, resp.StatusCode) // Should redirect
+		assert.Contains(t, resp.Header.Get("Set-Cookie"), "flash=", "should flash a success message")
 
 		// Verify database state
 		var product models.Product
@@ -78,6 +84,129 @@ func TestProductsHandler_Integration(t *testing.T) {
 		assert.Equal(t, 1, product.DefaultUsageLimit)
 	})
 
+	t.Run("Create - Increment On Verify Policy", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewProductsHandler(db)
+
+		app.Post("/products", handler.Create)
+
+		// An unticked checkbox isn't submitted and must be stored as false, not the column default
+		resp := testutils.TestRequest(t, app, "POST", "/products", url.Values{"name": {"Check Only"}}.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+		resp = testutils.TestRequest(t, app, "POST", "/products", url.Values{"name": {"Consuming"}, "increment_on_verify": {"true"}}.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+
+		var checkOnly, consuming models.Product
+		require.NoError(t, db.Where("name = ?", "Check Only").First(&checkOnly).Error)
+		require.NoError(t, db.Where("name = ?", "Consuming").First(&consuming).Error)
+		assert.False(t, checkOnly.IncrementsOnVerify())
+		assert.True(t, consuming.IncrementsOnVerify())
+
+		// Products created without the field keep the default
+		legacy := models.Product{Name: "Legacy"}
+		require.NoError(t, db.Create(&legacy).Error)
+		require.NoError(t, db.First(&legacy, legacy.ID).Error)
+		assert.True(t, legacy.IncrementsOnVerify())
+	})
+
+	t.Run("Create - Key Format", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewProductsHandler(db)
+
+		app.Post("/products", handler.Create)
+
+		resp := testutils.TestRequest(t, app, "POST", "/products",
+			url.Values{"name": {"Short Keys"}, "key_length": {"8"}}.Encode())
+		assert.Equal(t, 400, resp.StatusCode)
+		var count int64
+		db.Model(&models.Product{}).Where("name = ?", "Short Keys").Count(&count)
+		assert.Zero(t, count)
+
+		resp = testutils.TestRequest(t, app, "POST", "/products",
+			url.Values{"name": {"Readable Keys"}, "key_length": {"20"}, "key_charset": {"crockford"}}.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+		var product models.Product
+		require.NoError(t, db.Where("name = ?", "Readable Keys").First(&product).Error)
+		assert.Equal(t, 20, product.KeyLength)
+		assert.Equal(t, models.KeyCharsetCrockford, product.KeyCharset)
+
+		customer := models.Customer{Name: "John Doe", Email: "john@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+		licenseKey, err := product.GenerateLicenseKeyFor(db, &customer)
+		require.NoError(t, err)
+		assert.Len(t, licenseKey.Key, 20)
+		assert.NotContains(t, licenseKey.Key, "O")
+	})
+
+	t.Run("Create - Default Metadata", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewProductsHandler(db)
+
+		app.Post("/products", handler.Create)
+		app.Put("/products/:id", handler.Update)
+
+		resp := testutils.TestRequest(t, app, "POST", "/products",
+			url.Values{"name": {"Broken Defaults"}, "default_metadata": {"{tier: standard}"}}.Encode())
+		assert.Equal(t, 400, resp.StatusCode)
+		var count int64
+		db.Model(&models.Product{}).Where("name = ?", "Broken Defaults").Count(&count)
+		assert.Zero(t, count)
+
+		resp = testutils.TestRequestJSON(t, app, "POST", "/products",
+			`{"name": "Tiered", "default_metadata": {"tier": "standard"}}`)
+		require.Equal(t, 201, resp.StatusCode)
+		var product models.Product
+		require.NoError(t, db.Where("name = ?", "Tiered").First(&product).Error)
+		assert.Equal(t, "standard", product.DefaultMetadataMap()["tier"])
+
+		path := "/products/" + strconv.Itoa(int(product.ID))
+		resp = testutils.TestRequest(t, app, "PUT", path, url.Values{"description": {"Left alone"}}.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+		require.NoError(t, db.First(&product, product.ID).Error)
+		assert.Equal(t, "standard", product.DefaultMetadataMap()["tier"])
+
+		resp = testutils.TestRequest(t, app, "PUT", path, url.Values{"default_metadata": {"[1, 2]"}}.Encode())
+		assert.Equal(t, 400, resp.StatusCode)
+
+		resp = testutils.TestRequest(t, app, "PUT", path, url.Values{"default_metadata": {""}}.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+		require.NoError(t, db.First(&product, product.ID).Error)
+		assert.Empty(t, product.DefaultMetadata)
+	})
+
+	t.Run("Create - JSON Body", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewProductsHandler(db)
+
+		app.Post("/products", handler.Create)
+
+		resp := testutils.TestRequestJSON(t, app, "POST", "/products",
+			`{"name": "JSON Product", "version": "2.0.0", "default_expiration_days": 30, "perpetual": false, "increment_on_verify": true}`)
+		require.Equal(t, 201, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Content-Type"), "application/json")
+
+		var created models.Product
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+		require.NotZero(t, created.ID)
+		assert.Equal(t, "JSON Product", created.Name)
+
+		var stored models.Product
+		require.NoError(t, db.First(&stored, created.ID).Error)
+		assert.Equal(t, "2.0.0", stored.Version)
+		assert.Equal(t, 30, stored.DefaultExpirationDays)
+		assert.True(t, stored.IncrementsOnVerify())
+
+		resp = testutils.TestRequestJSON(t, app, "POST", "/products", `{"description": "no name"}`)
+		assert.Equal(t, 400, resp.StatusCode)
+
+		resp = testutils.TestRequestJSON(t, app, "POST", "/products", `{"name":`)
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+
 	t.Run("Create - Invalid Product (Missing Name)", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
@@ -94,6 +223,43 @@ func TestProductsHandler_Integration(t *testing.T) {
 		assert.Equal(t, 400, resp.StatusCode)
 	})
 
+	t.Run("Create - Field Validation Errors", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewProductsHandler(db)
+
+		app.Post("/products", handler.Create)
+
+		form := url.Values{
+			"name":             {""},
+			"description":      {"Kept while the name is fixed"},
+			"version":          {"3.1.4"},
+			"default_metadata": {"[1, 2]"},
+		}
+		resp := testutils.TestRequest(t, app, "POST", "/products", form.Encode())
+		assert.Equal(t, 400, resp.StatusCode)
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		body := string(raw)
+
+		assert.Contains(t, body, `<p class="mt-2 text-sm text-red-600">Product name is required</p>`)
+		assert.Contains(t, body, `<p class="mt-2 text-sm text-red-600">default metadata must be a JSON object`)
+		assert.Contains(t, body, "Kept while the name is fixed")
+		assert.Contains(t, body, `value="3.1.4"`)
+		assert.Contains(t, body, "Create Product", "a rejected new product is still a new product")
+		assert.NotContains(t, body, `name="_method"`)
+
+		var count int64
+		db.Model(&models.Product{}).Count(&count)
+		assert.Zero(t, count)
+
+		resp = testutils.TestRequestJSON(t, app, "POST", "/products", `{"description": "no name"}`)
+		assert.Equal(t, 400, resp.StatusCode)
+		var errBody map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&errBody))
+		assert.Equal(t, "Product name is required", errBody["error"])
+	})
+
 	t.Run("Show - Existing Product", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
@@ -195,6 +361,52 @@ func TestProductsHandler_Integration(t *testing.T) {
 		assert.Equal(t, 5, updatedProduct.DefaultUsageLimit)
 	})
 
+	t.Run("Update - Permalink", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewProductsHandler(db)
+
+		app.Put("/products/:id", handler.Update)
+
+		taken := models.Product{Name: "Pro Plan"}
+		require.NoError(t, db.Create(&taken).Error)
+		product := models.Product{Name: "Starter"}
+		require.NoError(t, db.Create(&product).Error)
+		path := "/products/" + strconv.Itoa(int(product.ID))
+
+		resp := testutils.TestRequestJSON(t, app, "PUT", path, `{"permalink": "pro-plan"}`)
+		assert.Equal(t, 400, resp.StatusCode)
+
+		resp = testutils.TestRequestJSON(t, app, "PUT", path, `{"permalink": "Starter Edition"}`)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var updated models.Product
+		require.NoError(t, db.First(&updated, product.ID).Error)
+		assert.Equal(t, "starter-edition", updated.Permalink)
+	})
+
+	t.Run("Update - JSON Body", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewProductsHandler(db)
+
+		app.Put("/products/:id", handler.Update)
+
+		product := models.Product{Name: "Before", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+
+		resp := testutils.TestRequestJSON(t, app, "PUT", "/products/"+strconv.Itoa(int(product.ID)),
+			`{"name": "After", "default_usage_limit": 3}`)
+		require.Equal(t, 200, resp.StatusCode)
+
+		var updated models.Product
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&updated))
+		assert.Equal(t, product.ID, updated.ID)
+		assert.Equal(t, "After", updated.Name)
+		assert.Equal(t, "1.0.0", updated.Version)
+		assert.Equal(t, 3, updated.DefaultUsageLimit)
+	})
+
 	t.Run("Update - Partial Update", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
@@ -307,4 +519,160 @@ func TestProductsHandler_Integration(t *testing.T) {
 		err := db.First(&existingProduct, product.ID).Error
 		assert.NoError(t, err) // Should still find the product
 	})
+
+	t.Run("Delete - Cascade Removes License Keys", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewProductsHandler(db)
+
+		app.Delete("/products/:id", handler.Delete)
+
+		product := models.Product{Name: "Cascade Product", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "Test Customer", Email: "test@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+		require.NoError(t, db.Create(&models.LicenseKey{
+			Key:        "CASCADE-KEY",
+			ProductID:  product.ID,
+			CustomerID: customer.ID,
+		}).Error)
+
+		url := "/products/" + strconv.Itoa(int(product.ID)) + "?cascade=true"
+		resp := testutils.TestRequest(t, app, "DELETE", url, "")
+		assert.Equal(t, 302, resp.StatusCode)
+
+		var count int64
+		db.Model(&models.Product{}).Where("id = ?", product.ID).Count(&count)
+		assert.Equal(t, int64(0), count)
+		db.Model(&models.LicenseKey{}).Where("product_id = ?", product.ID).Count(&count)
+		assert.Equal(t, int64(0), count)
+		db.Model(&models.Customer{}).Where("id = ?", customer.ID).Count(&count)
+		assert.Equal(t, int64(1), count, "cascade must not touch customers")
+	})
+
+	t.Run("Delete - Admin And Products Handlers Agree", func(t *testing.T) {
+		entryPoints := map[string]func(*gorm.DB) fiber.Handler{
+			"ProductsHandler.Delete":      func(db *gorm.DB) fiber.Handler { return NewProductsHandler(db).Delete },
+			"AdminHandler.ProductsDelete": func(db *gorm.DB) fiber.Handler { return NewAdminHandler(db).ProductsDelete },
+		}
+
+		for name, entryPoint := range entryPoints {
+			db := testutils.SetupTestDB(t)
+			app := testutils.SetupTestAppWithDB(t, db)
+			app.Delete("/products/:id", entryPoint(db))
+
+			product := models.Product{Name: "Shared Guard Product", Version: "1.0.0"}
+			require.NoError(t, db.Create(&product).Error)
+			customer := models.Customer{Name: "Test Customer", Email: "test@example.com"}
+			require.NoError(t, db.Create(&customer).Error)
+			require.NoError(t, db.Create(&models.LicenseKey{
+				Key:        "SHARED-KEY",
+				ProductID:  product.ID,
+				CustomerID: customer.ID,
+			}).Error)
+
+			url := "/products/" + strconv.Itoa(int(product.ID))
+			resp := testutils.TestRequest(t, app, "DELETE", url, "")
+			assert.Equal(t, 400, resp.StatusCode, name)
+
+			resp = testutils.TestRequest(t, app, "DELETE", url+"?cascade=true", "")
+			assert.Equal(t, 302, resp.StatusCode, name)
+
+			var count int64
+			db.Model(&models.Product{}).Where("id = ?", product.ID).Count(&count)
+			assert.Equal(t, int64(0), count, name)
+		}
+	})
+
+	t.Run("UpdateRateLimitExempt - Toggles The API Key Exemption", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewProductsHandler(db)
+
+		app.Post("/products/:id/api-key/rate-limit", handler.UpdateRateLimitExempt)
+
+		keyless := models.Product{Name: "No Key"}
+		require.NoError(t, db.Create(&keyless).Error)
+		resp := testutils.TestRequest(t, app, "POST", "/products/"+strconv.Itoa(int(keyless.ID))+"/api-key/rate-limit", "rate_limit_exempt=true")
+		assert.Equal(t, 400, resp.StatusCode, "only a product with an API key can be exempt")
+
+		product := models.Product{Name: "Trusted", APIKey: "mk_trusted"}
+		require.NoError(t, db.Create(&product).Error)
+		url := "/products/" + strconv.Itoa(int(product.ID)) + "/api-key/rate-limit"
+
+		resp = testutils.TestRequest(t, app, "POST", url, "rate_limit_exempt=true")
+		assert.Equal(t, 302, resp.StatusCode)
+		assert.True(t, models.IsRateLimitExemptAPIKey(db, "mk_trusted"))
+
+		resp = testutils.TestRequest(t, app, "POST", url, "rate_limit_exempt=false")
+		assert.Equal(t, 302, resp.StatusCode)
+		assert.False(t, models.IsRateLimitExemptAPIKey(db, "mk_trusted"))
+	})
+
+	t.Run("Analytics - Status Breakdown And Verifications", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewProductsHandler(db)
+		apiHandler := NewAPIHandler(db, nil)
+
+		app.Get("/products/:id", handler.Show)
+		app.Get("/products/:id/analytics", handler.Analytics)
+		app.Post("/api/v1/licenses/verify", apiHandler.VerifyLicense)
+
+		product := models.Product{Name: "Analytics Product", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "Test Customer", Email: "test@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+
+		past := time.Now().Add(-24 * time.Hour)
+		future := time.Now().Add(24 * time.Hour)
+		keys := []models.LicenseKey{
+			{Key: "ACTIVE-1", Status: "active", MaxActivations: 5, UsageCount: 3, CurrentActivations: 1},
+			{Key: "ACTIVE-2", Status: "active", MaxActivations: 5, ExpiresAt: &future, UsageCount: 2},
+			{Key: "EXPIRED-BY-DATE", Status: "active", ExpiresAt: &past, UsageCount: 1},
+			{Key: "EXPIRED-BY-STATUS", Status: "expired", CurrentActivations: 1},
+			{Key: "REVOKED", Status: "revoked"},
+		}
+		for i := range keys {
+			keys[i].ProductID = product.ID
+			keys[i].CustomerID = customer.ID
+			require.NoError(t, db.Create(&keys[i]).Error)
+		}
+
+		// A key for another product must not be counted
+		other := models.Product{Name: "Other Product", Version: "1.0.0"}
+		require.NoError(t, db.Create(&other).Error)
+		require.NoError(t, db.Create(&models.LicenseKey{Key: "OTHER", ProductID: other.ID, CustomerID: customer.ID, Status: "revoked"}).Error)
+
+		for i := 0; i < 2; i++ {
+			req := verifyRequest(product.ID, "ACTIVE-1", nil)
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			require.Equal(t, 200, resp.StatusCode)
+		}
+
+		resp := testutils.TestRequest(t, app, "GET", "/products/"+strconv.Itoa(int(product.ID))+"/analytics", "")
+		require.Equal(t, 200, resp.StatusCode)
+
+		var analytics models.ProductAnalytics
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&analytics))
+		assert.Equal(t, int64(5), analytics.TotalKeys)
+		assert.Equal(t, int64(2), analytics.ActiveKeys)
+		assert.Equal(t, int64(2), analytics.ExpiredKeys)
+		assert.Equal(t, int64(1), analytics.RevokedKeys)
+		assert.Equal(t, int64(6), analytics.TotalUsage)
+		assert.Equal(t, int64(2), analytics.TotalActivations)
+
+		require.Len(t, analytics.Verifications, 30)
+		today := analytics.Verifications[len(analytics.Verifications)-1]
+		assert.Equal(t, time.Now().UTC().Format("2006-01-02"), today.Day)
+		assert.Equal(t, 2, today.Count)
+
+		// The show page renders the analytics section
+		resp = testutils.TestRequest(t, app, "GET", "/products/"+strconv.Itoa(int(product.ID)), "")
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "Usage Analytics")
+	})
 }
@@ -1,9 +1,20 @@
 package handlers
 
 import (
+	"html"
+	"strings"
+
 	"github.com/gofiber/fiber/v2"
+
+	"matcha/internal/middleware"
 )
 
+// wantsJSON reports whether the client asked for JSON instead of HTML, either
+// through the Accept header or a format=json query param
+func wantsJSON(c *fiber.Ctx) bool {
+	return c.Query("format") == "json" || strings.Contains(c.Get(fiber.HeaderAccept), fiber.MIMEApplicationJSON)
+}
+
 // SafeRender attempts to render a template with fallback to 500 error page
 func SafeRender(c *fiber.Ctx, template string, data fiber.Map) error {
 	// Try to render the template
@@ -24,7 +35,8 @@ func SafeRenderWithStatus(c *fiber.Ctx, statusCode int, template string, data fi
 	return nil
 }
 
-// render500HTML returns a hardcoded 500 error page for production
+// render500HTML returns a hardcoded 500 error page for production. The page is
+// built without the template engine, so errorMsg is escaped by hand.
 func render500HTML(c *fiber.Ctx, errorMsg string) error {
 	hardcodedHTML := `<!DOCTYPE html>
 <html>
@@ -76,8 +88,8 @@ func render500HTML(c *fiber.Ctx, errorMsg string) error {
     <div class="error-container">
         <div class="error-code">500</div>
         <div class="error-message">Internal Server Error</div>
-        <div class="error-description">` + errorMsg + `</div>
-        <p><a href="/admin/" class="back-link">← Back to Dashboard</a></p>
+        <div class="error-description">` + html.EscapeString(errorMsg) + `</div>
+        <p><a href="` + middleware.AdminURL("/") + `" class="back-link">← Back to Dashboard</a></p>
     </div>
 </body>
 </html>`
@@ -4,12 +4,14 @@ import (
 	"net/http/httptest"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gorm.io/gorm"
 
+	"matcha/internal/config"
 	"matcha/internal/models"
 	"matcha/internal/testutils"
 )
@@ -19,11 +21,12 @@ func setupTestRoutes() (*fiber.App, *gorm.DB) {
 	db := testutils.SetupTestDB(&testing.T{})
 
 	// Initialize handlers
-	dashboardHandler := NewDashboardHandler(db)
-	usersHandler := NewUsersHandler(db)
+	dashboardHandler := NewDashboardHandler(db, config.New())
+	usersHandler := NewUsersHandler(db, config.New())
 	productsHandler := NewProductsHandler(db)
 	customersHandler := NewCustomersHandler(db)
-	licenseKeysHandler := NewLicenseKeysHandler(db)
+	licenseKeysHandler := NewLicenseKeysHandler(db, nil, time.UTC)
+	settingsHandler := NewSettingsHandler(db, nil)
 
 	// Setup routes without middleware to avoid auth issues in tests
 	admin := app.Group("/admin")
@@ -60,6 +63,7 @@ func setupTestRoutes() (*fiber.App, *gorm.DB) {
 	admin.Get("/license-keys", licenseKeysHandler.Index)
 	admin.Get("/license-keys/new", licenseKeysHandler.New)
 	admin.Post("/license-keys", licenseKeysHandler.Create)
+	admin.Post("/license-keys/bulk-email", licenseKeysHandler.BulkEmail)
 	admin.Get("/license-keys/:id", licenseKeysHandler.Show)
 	admin.Get("/license-keys/:id/edit", licenseKeysHandler.Edit)
 	admin.Put("/license-keys/:id", licenseKeysHandler.Update)
@@ -70,9 +74,10 @@ func setupTestRoutes() (*fiber.App, *gorm.DB) {
 	admin.Post("/license-keys/:id/send-email", licenseKeysHandler.SendEmail)
 
 	// Email Configuration
-	admin.Get("/email-config", dashboardHandler.EmailConfigPage)
-	admin.Post("/email-config", dashboardHandler.EmailConfigUpdate)
-	admin.Post("/email-config/test", dashboardHandler.EmailTestSend)
+	admin.Get("/settings/email", settingsHandler.ShowEmailSettings)
+	admin.Get("/email-config", settingsHandler.EmailConfigPage)
+	admin.Post("/email-config", settingsHandler.EmailConfigUpdate)
+	admin.Post("/email-config/test", settingsHandler.TestEmailSettings)
 
 	return app, db
 }
@@ -220,7 +225,8 @@ func TestRoutes_EmailConfig(t *testing.T) {
 		path   string
 		status int
 	}{
-		{"GET", "/admin/email-config", 200},
+		{"GET", "/admin/settings/email", 200},
+		{"GET", "/admin/email-config", 302},
 	}
 
 	for _, tt := range tests {
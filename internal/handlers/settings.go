@@ -10,16 +10,19 @@ import (
 	"gorm.io/gorm"
 
 	"matcha/internal/config"
+	"matcha/internal/database"
+	"matcha/internal/middleware"
 	"matcha/internal/models"
 	"matcha/internal/services"
 )
 
 type SettingsHandler struct {
-	db *gorm.DB
+	db     *gorm.DB
+	emails *services.EmailService // Sends test emails; nil sends them inline with the environment's config
 }
 
-func NewSettingsHandler(db *gorm.DB) *SettingsHandler {
-	return &SettingsHandler{db: db}
+func NewSettingsHandler(db *gorm.DB, emails *services.EmailService) *SettingsHandler {
+	return &SettingsHandler{db: db, emails: emails}
 }
 
 // ShowEmailSettings displays the email configuration settings
@@ -32,7 +35,7 @@ func (h *SettingsHandler) ShowEmailSettings(c *fiber.Ctx) error {
 			"PageType":      "email-settings",
 			"Title":         "Email Settings",
 			"Error":         "Failed to load email settings",
-			"EmailSettings": emailSettings,
+			"EmailSettings": models.RedactEmailSettings(emailSettings),
 		}, "Failed to load email settings")
 	}
 
@@ -40,56 +43,31 @@ func (h *SettingsHandler) ShowEmailSettings(c *fiber.Ctx) error {
 		"ShowNav":       true,
 		"PageType":      "email-settings",
 		"Title":         "Email Settings",
-		"EmailSettings": emailSettings,
+		"EmailSettings": models.RedactEmailSettings(emailSettings),
 	})
 }
 
-// CreateEmailSettings creates a new email configuration
+// CreateEmailSettings creates a new email configuration and makes it the
+// active one
 func (h *SettingsHandler) CreateEmailSettings(c *fiber.Ctx) error {
-	provider := c.FormValue("provider")
-	smtpHost := c.FormValue("smtp_host")
-	smtpUsername := c.FormValue("smtp_username")
-	smtpPassword := c.FormValue("smtp_password")
-	fromEmail := c.FormValue("from_email")
-	fromName := c.FormValue("from_name")
-	smtpEncryption := c.FormValue("smtp_encryption")
-
-	smtpPort, err := strconv.Atoi(c.FormValue("smtp_port"))
-	if err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"error": "Invalid SMTP port",
-		})
-	}
-
-	// Deactivate all existing settings
-	if err := h.db.Model(&models.EmailSettings{}).Where("is_active = ?", true).Update("is_active", false).Error; err != nil {
-		log.Printf("Error deactivating existing email settings: %v", err)
-		return c.Status(500).Render("admin/settings/email", fiber.Map{
-			"Error": "Failed to update email settings",
-		})
-	}
-
-	// Create new settings
-	emailSettings := models.EmailSettings{
-		Provider:       provider,
-		SMTPHost:       smtpHost,
-		SMTPPort:       smtpPort,
-		SMTPUsername:   smtpUsername,
-		SMTPPassword:   smtpPassword,
-		SMTPEncryption: smtpEncryption,
-		FromEmail:      fromEmail,
-		FromName:       fromName,
-		IsActive:       true,
+	var emailSettings models.EmailSettings
+	if err := emailSettingsFromForm(c, &emailSettings); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 	}
+	emailSettings.IsActive = true
 
-	if err := h.db.Create(&emailSettings).Error; err != nil {
+	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+		emailSettings.ID = 0
+		return emailSettings.Save(db)
+	})
+	if err != nil {
 		log.Printf("Error creating email settings: %v", err)
 		return c.Status(500).Render("admin/settings/email", fiber.Map{
 			"Error": "Failed to save email settings",
 		})
 	}
 
-	return c.Redirect("/admin/settings/email")
+	return c.Redirect(middleware.AdminURL("/settings/email"))
 }
 
 // UpdateEmailSettings updates an existing email configuration
@@ -113,56 +91,100 @@ func (h *SettingsHandler) UpdateEmailSettings(c *fiber.Ctx) error {
 		})
 	}
 
-	// Update fields
-	emailSettings.Provider = c.FormValue("provider")
-	emailSettings.SMTPHost = c.FormValue("smtp_host")
-	emailSettings.SMTPUsername = c.FormValue("smtp_username")
-	emailSettings.SMTPPassword = c.FormValue("smtp_password")
-	emailSettings.FromEmail = c.FormValue("from_email")
-	emailSettings.FromName = c.FormValue("from_name")
-	emailSettings.SMTPEncryption = c.FormValue("smtp_encryption")
-
-	smtpPort, err := strconv.Atoi(c.FormValue("smtp_port"))
-	if err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"error": "Invalid SMTP port",
-		})
+	if err := emailSettingsFromForm(c, &emailSettings); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 	}
-	emailSettings.SMTPPort = smtpPort
 
-	if err := h.db.Save(&emailSettings).Error; err != nil {
+	err = database.PerformWrite(h.db, func(db *gorm.DB) error {
+		return emailSettings.Save(db)
+	})
+	if err != nil {
 		log.Printf("Error updating email settings: %v", err)
 		return c.Status(500).Render("admin/settings/email", fiber.Map{
 			"Error": "Failed to update email settings",
 		})
 	}
 
-	return c.Redirect("/admin/settings/email")
+	return c.Redirect(middleware.AdminURL("/settings/email"))
 }
 
-// ActivateEmailSettings activates a specific email configuration
+// emailSettingsFromForm copies the submitted SMTP fields onto settings. A
+// blank provider or password keeps the stored value; the password is never
+// sent back to the form.
+func emailSettingsFromForm(c *fiber.Ctx, settings *models.EmailSettings) error {
+	smtpPort, err := strconv.Atoi(c.FormValue("smtp_port"))
+	if err != nil || smtpPort <= 0 || smtpPort > 65535 {
+		return errors.New("Invalid SMTP port")
+	}
+	settings.SMTPPort = smtpPort
+
+	if provider := c.FormValue("provider"); provider != "" {
+		settings.Provider = provider
+	}
+	settings.SMTPHost = c.FormValue("smtp_host")
+	settings.SMTPUsername = c.FormValue("smtp_username")
+	if password := c.FormValue("smtp_password"); password != "" {
+		settings.SMTPPassword = password
+	}
+	settings.SMTPEncryption = c.FormValue("smtp_encryption")
+	settings.SMTPRootCA = c.FormValue("smtp_root_ca")
+	settings.SMTPSkipVerify = c.FormValue("smtp_skip_verify") == "true"
+	settings.FromEmail = c.FormValue("from_email")
+	settings.FromName = c.FormValue("from_name")
+	settings.ReplyTo = c.FormValue("reply_to")
+	return nil
+}
+
+// ActivateEmailSettings activates a specific email configuration. With
+// verify=true it first connects and signs in with the settings, refusing to
+// activate ones that fail unless force=true.
 func (h *SettingsHandler) ActivateEmailSettings(c *fiber.Ctx) error {
 	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
 	if err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid settings ID"})
 	}
 
-	// Deactivate all settings
-	if err := h.db.Model(&models.EmailSettings{}).Where("is_active = ?", true).Update("is_active", false).Error; err != nil {
-		log.Printf("Error deactivating email settings: %v", err)
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to update settings"})
+	verify, _ := strconv.ParseBool(c.FormValue("verify"))
+	force, _ := strconv.ParseBool(c.FormValue("force"))
+	if verify && !force {
+		var settings models.EmailSettings
+		if err := h.db.First(&settings, uint(id)).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(404).JSON(fiber.Map{"error": "Email settings not found"})
+			}
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to load settings"})
+		}
+
+		emailService := h.emails
+		if emailService == nil {
+			emailService = services.NewEmailService(config.New(), h.db)
+		}
+		if err := emailService.VerifySettings(&settings); err != nil {
+			message := fmt.Sprintf("Could not connect with the %s settings, so they were not activated: %v", settings.Provider, err)
+			if wantsJSON(c) {
+				return jsonError(c, 400, message)
+			}
+			middleware.SetFlash(c, middleware.FlashError, message+". Tick \"Skip check\" to activate them anyway.")
+			return c.Redirect(middleware.AdminURL("/settings/email"))
+		}
 	}
 
-	// Activate the selected settings
-	if err := h.db.Model(&models.EmailSettings{}).Where("id = ?", uint(id)).Update("is_active", true).Error; err != nil {
+	err = database.PerformWrite(h.db, func(db *gorm.DB) error {
+		return models.ActivateEmailSettings(db, uint(id))
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "Email settings not found"})
+	}
+	if err != nil {
 		log.Printf("Error activating email settings: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to activate settings"})
 	}
 
-	return c.Redirect("/admin/settings/email")
+	return c.Redirect(middleware.AdminURL("/settings/email"))
 }
 
-// DeleteEmailSettings deletes an email configuration
+// DeleteEmailSettings deletes an email configuration. The active one can't be
+// deleted until another is activated.
 func (h *SettingsHandler) DeleteEmailSettings(c *fiber.Ctx) error {
 	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
 	if err != nil {
@@ -178,19 +200,45 @@ func (h *SettingsHandler) DeleteEmailSettings(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to check settings"})
 	}
 
-	if err := h.db.Delete(&models.EmailSettings{}, uint(id)).Error; err != nil {
+	// Deleting the active configuration would leave nothing to send email with
+	if settings.IsActive {
+		return c.Status(400).JSON(fiber.Map{"error": "These email settings are active; activate another configuration before deleting them"})
+	}
+
+	var deleted int64
+	err = database.PerformWrite(h.db, func(db *gorm.DB) error {
+		result := db.Where("is_active = ?", false).Delete(&models.EmailSettings{}, uint(id))
+		deleted = result.RowsAffected
+		return result.Error
+	})
+	if err != nil {
 		log.Printf("Error deleting email settings: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete settings"})
 	}
+	if deleted == 0 {
+		// Activated between the check and the delete
+		return c.Status(400).JSON(fiber.Map{"error": "These email settings are active; activate another configuration before deleting them"})
+	}
 
-	return c.Redirect("/admin/settings/email")
+	return c.Redirect(middleware.AdminURL("/settings/email"))
 }
 
-// TestEmailSettings sends a test email using active configuration
+// TestEmailSettings sends a test email using the active configuration. It is
+// reached from the settings page without an ID; when one is given it must
+// name stored settings.
 func (h *SettingsHandler) TestEmailSettings(c *fiber.Ctx) error {
-	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
-	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid settings ID"})
+	if param := c.Params("id"); param != "" {
+		id, err := strconv.ParseUint(param, 10, 32)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid settings ID"})
+		}
+		var settings models.EmailSettings
+		if err := h.db.First(&settings, uint(id)).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(404).JSON(fiber.Map{"error": "Email settings not found"})
+			}
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to load settings"})
+		}
 	}
 
 	testEmail := c.FormValue("test_email")
@@ -199,20 +247,11 @@ func (h *SettingsHandler) TestEmailSettings(c *fiber.Ctx) error {
 		testEmail = "test@example.com"
 	}
 
-	// Check if the settings exist
-	var settings models.EmailSettings
-	if err := h.db.First(&settings, uint(id)).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return c.Status(404).JSON(fiber.Map{"error": "Email settings not found"})
-		}
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to load settings"})
+	emailService := h.emails
+	if emailService == nil {
+		emailService = services.NewEmailService(config.New(), h.db)
 	}
-
-	// For tests, we'll simulate sending email without actually sending
-	// In real implementation, you would send the actual email here
-	cfg := config.New()
-	emailService := services.NewEmailService(cfg, h.db)
-	err = emailService.SendTestEmail(testEmail)
+	err := emailService.SendTestEmail(testEmail)
 
 	// Get all settings for display
 	var emailSettings []models.EmailSettings
@@ -225,7 +264,7 @@ func (h *SettingsHandler) TestEmailSettings(c *fiber.Ctx) error {
 			"PageType":      "email-settings",
 			"Title":         "Email Settings",
 			"Error":         fmt.Sprintf("Failed to send test email: %v", err),
-			"EmailSettings": emailSettings,
+			"EmailSettings": models.RedactEmailSettings(emailSettings),
 		}); renderErr != nil {
 			return c.Status(400).JSON(fiber.Map{
 				"error": fmt.Sprintf("Failed to send test email: %v", err),
@@ -239,12 +278,333 @@ func (h *SettingsHandler) TestEmailSettings(c *fiber.Ctx) error {
 		"ShowNav":       true,
 		"PageType":      "email-settings",
 		"Title":         "Email Settings",
-		"Success":       fmt.Sprintf("Test email sent successfully to %s", testEmail),
-		"EmailSettings": emailSettings,
+		"Success":       testEmailSuccess(emailService, testEmail),
+		"EmailSettings": models.RedactEmailSettings(emailSettings),
 	}); renderErr != nil {
 		return c.Status(200).JSON(fiber.Map{
-			"success": fmt.Sprintf("Test email sent successfully to %s", testEmail),
+			"success": testEmailSuccess(emailService, testEmail),
 		})
 	}
 	return nil
 }
+
+// EmailConfigPage is the legacy single-configuration page, kept so old
+// bookmarks land on the email settings
+func (h *SettingsHandler) EmailConfigPage(c *fiber.Ctx) error {
+	return c.Redirect(middleware.AdminURL("/settings/email"))
+}
+
+// EmailConfigUpdate accepts the legacy single-configuration form. It edits
+// the active settings, or the oldest stored ones when none is active, or
+// creates them, and activates the result like the settings page does.
+func (h *SettingsHandler) EmailConfigUpdate(c *fiber.Ctx) error {
+	var settings models.EmailSettings
+	err := h.db.Order("is_active DESC, id ASC").First(&settings).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load email settings"})
+	}
+	if err := emailSettingsFromForm(c, &settings); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	settings.IsActive = true
+
+	err = database.PerformWrite(h.db, func(db *gorm.DB) error {
+		return settings.Save(db)
+	})
+	if err != nil {
+		log.Printf("Error saving email configuration: %v", err)
+		middleware.SetFlash(c, middleware.FlashError, "Failed to save email configuration")
+		return c.Redirect(middleware.AdminURL("/settings/email"))
+	}
+
+	middleware.SetFlash(c, middleware.FlashSuccess, "Email configuration saved")
+	return c.Redirect(middleware.AdminURL("/settings/email"))
+}
+
+// ShowEmailTemplates displays the editable email templates, using the
+// built-in defaults for types that haven't been customized
+func (h *SettingsHandler) ShowEmailTemplates(c *fiber.Ctx) error {
+	var success string
+	if saved := c.Query("saved"); saved != "" {
+		success = fmt.Sprintf("The %s template was saved.", saved)
+	}
+
+	return SafeRender(c, "layouts/base", fiber.Map{
+		"ShowNav":        true,
+		"PageType":       "email-templates",
+		"Title":          "Email Templates",
+		"EmailTemplates": h.loadEmailTemplates(),
+		"Success":        success,
+	})
+}
+
+// UpdateEmailTemplate validates and saves the template for one email type
+func (h *SettingsHandler) UpdateEmailTemplate(c *fiber.Ctx) error {
+	tmpl := models.EmailTemplate{
+		Type:    c.Params("type"),
+		Subject: c.FormValue("subject"),
+		Body:    c.FormValue("body"),
+	}
+
+	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+		return models.SaveEmailTemplate(db, &tmpl)
+	})
+	if err != nil {
+		log.Printf("Error saving email template %s: %v", tmpl.Type, err)
+
+		templates := h.loadEmailTemplates()
+		for i := range templates {
+			if templates[i].Type == tmpl.Type {
+				templates[i] = tmpl // Keep the admin's edits so they can be fixed
+			}
+		}
+
+		return SafeRenderWithStatus(c, 400, "layouts/base", fiber.Map{
+			"ShowNav":        true,
+			"PageType":       "email-templates",
+			"Title":          "Email Templates",
+			"Error":          fmt.Sprintf("Failed to save %s template: %v", tmpl.Type, err),
+			"EmailTemplates": templates,
+		}, "Failed to save email template")
+	}
+
+	return c.Redirect(middleware.AdminURL("/settings/templates?saved=") + tmpl.Type)
+}
+
+func (h *SettingsHandler) loadEmailTemplates() []models.EmailTemplate {
+	templates := make([]models.EmailTemplate, 0, len(models.EmailTemplateTypes))
+	for _, templateType := range models.EmailTemplateTypes {
+		templates = append(templates, models.GetEmailTemplate(h.db, templateType))
+	}
+	return templates
+}
+
+// webhookSecretStatus is what the webhook settings page shows per provider;
+// the secret itself never reaches the template
+type webhookSecretStatus struct {
+	Provider   string
+	Label      string // What the provider calls the secret
+	Help       string // Where to find or send it
+	Configured bool
+	Rotating   bool // A secondary secret is accepted too
+}
+
+// webhookSecretLabels names each provider's secret and how it is checked, as
+// shown on the webhook settings page
+var webhookSecretLabels = map[string]struct{ Label, Help string }{
+	"gumroad": {"Shared Secret", "Gumroad has no signing, so the secret goes in the ping URL (/api/v1/webhooks/gumroad?secret=...) or the X-Webhook-Secret header."},
+	"stripe":  {"Signing Secret", "The endpoint's whsec_... secret from the Stripe dashboard. Requests must carry a valid Stripe-Signature header no older than five minutes."},
+	"paypal":  {"Webhook ID", "The webhook's ID from the PayPal developer dashboard. Requests must carry a transmission signature from a paypal.com certificate."},
+}
+
+// ShowWebhookSettings lists the providers whose webhooks can be verified
+func (h *SettingsHandler) ShowWebhookSettings(c *fiber.Ctx) error {
+	statuses := make([]webhookSecretStatus, 0, len(models.WebhookSecretProviders))
+	for _, provider := range models.WebhookSecretProviders {
+		settings, err := models.GetWebhookSettings(h.db, provider)
+		if err != nil {
+			log.Printf("Error loading %s webhook settings: %v", provider, err)
+		}
+		statuses = append(statuses, webhookSecretStatus{
+			Provider:   provider,
+			Label:      webhookSecretLabels[provider].Label,
+			Help:       webhookSecretLabels[provider].Help,
+			Configured: settings.Secret != "",
+			Rotating:   settings.SecondarySecret != "",
+		})
+	}
+
+	return SafeRender(c, "layouts/base", fiber.Map{
+		"ShowNav":        true,
+		"PageType":       "webhook-settings",
+		"Title":          "Webhook Settings",
+		"WebhookSecrets": statuses,
+	})
+}
+
+// UpdateWebhookSettings sets or removes the shared secret for one provider.
+// A blank secret keeps the current one unless removal is requested explicitly.
+func (h *SettingsHandler) UpdateWebhookSettings(c *fiber.Ctx) error {
+	provider := c.Params("provider")
+	secret := c.FormValue("secret")
+	remove := c.FormValue("remove") == "true"
+
+	if secret == "" && !remove {
+		middleware.SetFlash(c, middleware.FlashError, "Enter a secret, or remove the current one")
+		return c.Redirect(middleware.AdminURL("/settings/webhooks"))
+	}
+	if remove {
+		secret = ""
+	}
+
+	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+		return models.SaveWebhookSecret(db, provider, secret)
+	})
+	if err != nil {
+		log.Printf("Error saving %s webhook secret: %v", provider, err)
+		middleware.SetFlash(c, middleware.FlashError, "Failed to save webhook secret")
+		return c.Redirect(middleware.AdminURL("/settings/webhooks"))
+	}
+
+	if remove {
+		middleware.SetFlash(c, middleware.FlashSuccess, fmt.Sprintf("The %s webhook secret was removed", provider))
+	} else {
+		middleware.SetFlash(c, middleware.FlashSuccess, fmt.Sprintf("The %s webhook secret was saved", provider))
+	}
+	return c.Redirect(middleware.AdminURL("/settings/webhooks"))
+}
+
+// UpdateWebhookSecondarySecret starts a secret rotation for one provider by
+// accepting a second secret next to the current one, or cancels it
+func (h *SettingsHandler) UpdateWebhookSecondarySecret(c *fiber.Ctx) error {
+	provider := c.Params("provider")
+	secret := c.FormValue("secret")
+	remove := c.FormValue("remove") == "true"
+
+	if secret == "" && !remove {
+		middleware.SetFlash(c, middleware.FlashError, "Enter the new secret to rotate to")
+		return c.Redirect(middleware.AdminURL("/settings/webhooks"))
+	}
+	if remove {
+		secret = ""
+	}
+
+	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+		return models.SaveWebhookSecondarySecret(db, provider, secret)
+	})
+	if errors.Is(err, models.ErrNoWebhookSecret) {
+		middleware.SetFlash(c, middleware.FlashError, "Set a secret before rotating it")
+		return c.Redirect(middleware.AdminURL("/settings/webhooks"))
+	}
+	if err != nil {
+		log.Printf("Error saving %s secondary webhook secret: %v", provider, err)
+		middleware.SetFlash(c, middleware.FlashError, "Failed to save webhook secret")
+		return c.Redirect(middleware.AdminURL("/settings/webhooks"))
+	}
+
+	actor := "unknown"
+	if admin := middleware.GetCurrentAdmin(c); admin != nil {
+		actor = admin.Username
+	}
+	if remove {
+		log.Printf("audit: admin %q cancelled the %s webhook secret rotation", actor, provider)
+		middleware.SetFlash(c, middleware.FlashSuccess, fmt.Sprintf("The %s secret rotation was cancelled", provider))
+	} else {
+		log.Printf("audit: admin %q started a %s webhook secret rotation", actor, provider)
+		middleware.SetFlash(c, middleware.FlashSuccess, fmt.Sprintf("Both %s webhook secrets are now accepted. Promote the new one once %s uses it.", provider, provider))
+	}
+	return c.Redirect(middleware.AdminURL("/settings/webhooks"))
+}
+
+// PromoteWebhookSecret finishes a rotation: the secondary secret replaces the
+// current one, which stops being accepted
+func (h *SettingsHandler) PromoteWebhookSecret(c *fiber.Ctx) error {
+	provider := c.Params("provider")
+
+	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+		return models.PromoteWebhookSecondarySecret(db, provider)
+	})
+	if errors.Is(err, models.ErrNoSecondaryWebhookSecret) {
+		middleware.SetFlash(c, middleware.FlashError, "There is no new secret to promote")
+		return c.Redirect(middleware.AdminURL("/settings/webhooks"))
+	}
+	if err != nil {
+		log.Printf("Error promoting %s webhook secret: %v", provider, err)
+		middleware.SetFlash(c, middleware.FlashError, "Failed to promote webhook secret")
+		return c.Redirect(middleware.AdminURL("/settings/webhooks"))
+	}
+
+	actor := "unknown"
+	if admin := middleware.GetCurrentAdmin(c); admin != nil {
+		actor = admin.Username
+	}
+	log.Printf("audit: admin %q promoted the new %s webhook secret", actor, provider)
+	middleware.SetFlash(c, middleware.FlashSuccess, fmt.Sprintf("The new %s webhook secret is now the only one accepted", provider))
+	return c.Redirect(middleware.AdminURL("/settings/webhooks"))
+}
+
+// ShowProductMappings lists the provider product identifiers mapped to local products
+func (h *SettingsHandler) ShowProductMappings(c *fiber.Ctx) error {
+	return SafeRender(c, "layouts/base", h.productMappingsData(fiber.Map{}))
+}
+
+// CreateProductMapping maps a provider's product identifier to a local product
+func (h *SettingsHandler) CreateProductMapping(c *fiber.Ctx) error {
+	productID, _ := strconv.Atoi(c.FormValue("product_id"))
+	mapping := models.ProductMapping{
+		Provider:   c.FormValue("provider"),
+		ExternalID: c.FormValue("external_id"),
+		ProductID:  uint(productID),
+	}
+
+	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+		if err := mapping.Validate(db); err != nil {
+			return err
+		}
+		return db.Create(&mapping).Error
+	})
+	if err != nil {
+		log.Printf("Error creating product mapping: %v", err)
+		return SafeRenderWithStatus(c, 400, "layouts/base", h.productMappingsData(fiber.Map{
+			"Error":      "Failed to save mapping: " + err.Error(),
+			"NewMapping": mapping,
+		}), "Failed to save product mapping")
+	}
+
+	middleware.SetFlash(c, middleware.FlashSuccess, "Product mapping saved")
+	return c.Redirect(middleware.AdminURL("/settings/product-mappings"))
+}
+
+// DeleteProductMapping removes a mapping; later webhooks for that identifier are skipped
+func (h *SettingsHandler) DeleteProductMapping(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid mapping ID"})
+	}
+
+	var result *gorm.DB
+	err = database.PerformWrite(h.db, func(db *gorm.DB) error {
+		result = db.Delete(&models.ProductMapping{}, uint(id))
+		return result.Error
+	})
+	if err != nil {
+		log.Printf("Error deleting product mapping: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete mapping"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Product mapping not found"})
+	}
+
+	middleware.SetFlash(c, middleware.FlashSuccess, "Product mapping removed")
+	return c.Redirect(middleware.AdminURL("/settings/product-mappings"))
+}
+
+func (h *SettingsHandler) productMappingsData(data fiber.Map) fiber.Map {
+	var mappings []models.ProductMapping
+	if err := h.db.Preload("Product").Order("provider, external_id").Find(&mappings).Error; err != nil {
+		log.Printf("Error fetching product mappings: %v", err)
+	}
+	var products []models.Product
+	if err := h.db.Order("name").Find(&products).Error; err != nil {
+		log.Printf("Error fetching products: %v", err)
+	}
+
+	data["ShowNav"] = true
+	data["PageType"] = "product-mappings"
+	data["Title"] = "Product Mappings"
+	data["ProductMappings"] = mappings
+	data["Products"] = products
+	data["Providers"] = models.PaymentProviders
+	if _, ok := data["NewMapping"]; !ok {
+		data["NewMapping"] = models.ProductMapping{}
+	}
+	return data
+}
+
+// testEmailSuccess confirms a test email; a queued one hasn't been delivered yet
+func testEmailSuccess(emailService *services.EmailService, to string) string {
+	if emailService.Queued() {
+		return fmt.Sprintf("Test email to %s queued for delivery", to)
+	}
+	return fmt.Sprintf("Test email sent successfully to %s", to)
+}
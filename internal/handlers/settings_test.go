@@ -1,12 +1,19 @@
 package handlers
 
 import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http/httptest"
 	"net/url"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
 
 	"matcha/internal/models"
 	"matcha/internal/testutils"
@@ -17,7 +24,7 @@ func TestSettingsHandler_Integration(t *testing.T) {
 	t.Run("ShowEmailSettings - Empty List", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewSettingsHandler(db)
+		handler := NewSettingsHandler(db, nil)
 
 		app.Get("/email-settings", handler.ShowEmailSettings)
 
@@ -28,7 +35,7 @@ func TestSettingsHandler_Integration(t *testing.T) {
 	t.Run("ShowEmailSettings - With Data", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewSettingsHandler(db)
+		handler := NewSettingsHandler(db, nil)
 
 		app.Get("/email-settings", handler.ShowEmailSettings)
 
@@ -52,7 +59,7 @@ func TestSettingsHandler_Integration(t *testing.T) {
 	t.Run("CreateEmailSettings - Valid Settings", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewSettingsHandler(db)
+		handler := NewSettingsHandler(db, nil)
 
 		app.Post("/email-settings", handler.CreateEmailSettings)
 
@@ -85,7 +92,7 @@ func TestSettingsHandler_Integration(t *testing.T) {
 	t.Run("CreateEmailSettings - Invalid Port", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewSettingsHandler(db)
+		handler := NewSettingsHandler(db, nil)
 
 		app.Post("/email-settings", handler.CreateEmailSettings)
 
@@ -107,7 +114,7 @@ func TestSettingsHandler_Integration(t *testing.T) {
 	t.Run("UpdateEmailSettings - Valid Update", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewSettingsHandler(db)
+		handler := NewSettingsHandler(db, nil)
 
 		app.Put("/email-settings/:id", handler.UpdateEmailSettings)
 
@@ -154,7 +161,7 @@ func TestSettingsHandler_Integration(t *testing.T) {
 	t.Run("UpdateEmailSettings - Non-existent Settings", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewSettingsHandler(db)
+		handler := NewSettingsHandler(db, nil)
 
 		app.Put("/email-settings/:id", handler.UpdateEmailSettings)
 
@@ -172,7 +179,7 @@ func TestSettingsHandler_Integration(t *testing.T) {
 	t.Run("ActivateEmailSettings - Valid Settings", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewSettingsHandler(db)
+		handler := NewSettingsHandler(db, nil)
 
 		app.Post("/email-settings/:id/activate", handler.ActivateEmailSettings)
 
@@ -197,10 +204,66 @@ func TestSettingsHandler_Integration(t *testing.T) {
 		assert.True(t, activatedSettings.IsActive)
 	})
 
+	t.Run("ActivateEmailSettings - Verifies Connection", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewSettingsHandler(db, nil)
+
+		app.Post("/email-settings/:id/activate", handler.ActivateEmailSettings)
+
+		activate := func(settings models.EmailSettings, form url.Values) (int, bool) {
+			path := "/email-settings/" + strconv.Itoa(int(settings.ID)) + "/activate"
+			resp := testutils.TestRequest(t, app, "POST", path, form.Encode())
+			var stored models.EmailSettings
+			require.NoError(t, db.First(&stored, settings.ID).Error)
+			return resp.StatusCode, stored.IsActive
+		}
+		stubSettings := func(port int, password string) models.EmailSettings {
+			settings := models.EmailSettings{
+				Provider:       "smtp",
+				SMTPHost:       "127.0.0.1",
+				SMTPPort:       port,
+				SMTPEncryption: models.SMTPEncryptionNone,
+				SMTPUsername:   "mailer",
+				SMTPPassword:   password,
+				FromEmail:      "noreply@example.com",
+			}
+			require.NoError(t, db.Create(&settings).Error)
+			return settings
+		}
+		port := startStubSMTP(t, "secret")
+
+		working := stubSettings(port, "secret")
+		status, active := activate(working, url.Values{"verify": {"true"}})
+		assert.Equal(t, 302, status)
+		assert.True(t, active)
+
+		broken := stubSettings(port, "wrong")
+		status, active = activate(broken, url.Values{"verify": {"true"}})
+		assert.Equal(t, 302, status)
+		assert.False(t, active, "settings that fail to sign in must not be activated")
+		var stillActive models.EmailSettings
+		require.NoError(t, db.First(&stillActive, working.ID).Error)
+		assert.True(t, stillActive.IsActive)
+
+		req := httptest.NewRequest("POST", "/email-settings/"+strconv.Itoa(int(broken.ID))+"/activate?format=json", strings.NewReader("verify=true"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		assert.Equal(t, 400, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "535")
+
+		status, active = activate(broken, url.Values{"verify": {"true"}, "force": {"true"}})
+		assert.Equal(t, 302, status)
+		assert.True(t, active, "force should activate despite the failed check")
+	})
+
 	t.Run("DeleteEmailSettings - Existing Settings", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewSettingsHandler(db)
+		handler := NewSettingsHandler(db, nil)
 
 		app.Delete("/email-settings/:id", handler.DeleteEmailSettings)
 
@@ -223,10 +286,38 @@ func TestSettingsHandler_Integration(t *testing.T) {
 		assert.Error(t, err) // Should not find the settings
 	})
 
+	t.Run("DeleteEmailSettings - Active Settings Blocked", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewSettingsHandler(db, nil)
+
+		app.Delete("/email-settings/:id", handler.DeleteEmailSettings)
+
+		active := models.EmailSettings{Provider: "Gmail", SMTPHost: "smtp.gmail.com", SMTPPort: 587, IsActive: true}
+		require.NoError(t, db.Create(&active).Error)
+		spare := models.EmailSettings{Provider: "SendGrid", SMTPHost: "smtp.sendgrid.net", SMTPPort: 587}
+		require.NoError(t, db.Create(&spare).Error)
+
+		resp := testutils.TestRequest(t, app, "DELETE", "/email-settings/"+strconv.Itoa(int(active.ID)), "")
+		assert.Equal(t, 400, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "activate another configuration")
+
+		var kept models.EmailSettings
+		require.NoError(t, db.First(&kept, active.ID).Error)
+		assert.True(t, kept.IsActive)
+
+		// The inactive configuration can still go
+		resp = testutils.TestRequest(t, app, "DELETE", "/email-settings/"+strconv.Itoa(int(spare.ID)), "")
+		assert.Equal(t, 302, resp.StatusCode)
+		assert.Error(t, db.First(&models.EmailSettings{}, spare.ID).Error)
+	})
+
 	t.Run("DeleteEmailSettings - Non-existent Settings", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewSettingsHandler(db)
+		handler := NewSettingsHandler(db, nil)
 
 		app.Delete("/email-settings/:id", handler.DeleteEmailSettings)
 
@@ -237,7 +328,7 @@ func TestSettingsHandler_Integration(t *testing.T) {
 	t.Run("TestEmailSettings - Valid Settings", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewSettingsHandler(db)
+		handler := NewSettingsHandler(db, nil)
 
 		app.Post("/email-settings/:id/test", handler.TestEmailSettings)
 
@@ -259,4 +350,350 @@ func TestSettingsHandler_Integration(t *testing.T) {
 		// Test email may fail due to invalid credentials, but should handle gracefully
 		assert.True(t, resp.StatusCode == 200 || resp.StatusCode == 302 || resp.StatusCode == 400)
 	})
+
+	t.Run("UpdateEmailTemplate - Malformed Template Rejected", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewSettingsHandler(db, nil)
+
+		app.Post("/templates/:type", handler.UpdateEmailTemplate)
+
+		form := url.Values{
+			"subject": {"Your key for {{.ProductName"},
+			"body":    {"{{.LicenseKey}}"},
+		}
+
+		resp := testutils.TestRequest(t, app, "POST", "/templates/license_key", form.Encode())
+		assert.Equal(t, 400, resp.StatusCode)
+
+		var count int64
+		db.Model(&models.EmailTemplate{}).Count(&count)
+		assert.Equal(t, int64(0), count)
+	})
+
+	t.Run("UpdateEmailTemplate - Valid Template Saved", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewSettingsHandler(db, nil)
+
+		app.Get("/templates", handler.ShowEmailTemplates)
+		app.Post("/templates/:type", handler.UpdateEmailTemplate)
+
+		form := url.Values{
+			"subject": {"{{.ProductName}} license"},
+			"body":    {"Key: {{.LicenseKey}}"},
+		}
+
+		resp := testutils.TestRequest(t, app, "POST", "/templates/license_key", form.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+
+		tmpl := models.GetEmailTemplate(db, models.EmailTemplateLicenseKey)
+		assert.Equal(t, "{{.ProductName}} license", tmpl.Subject)
+		assert.Equal(t, "Key: {{.LicenseKey}}", tmpl.Body)
+
+		resp = testutils.TestRequest(t, app, "GET", "/templates", "")
+		assert.Equal(t, 200, resp.StatusCode)
+	})
+
+	t.Run("UpdateWebhookSettings - Save And Remove Secret", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewSettingsHandler(db, nil)
+
+		app.Get("/webhooks", handler.ShowWebhookSettings)
+		app.Post("/webhooks/:provider", handler.UpdateWebhookSettings)
+
+		form := url.Values{"secret": {"s3cret"}}
+		resp := testutils.TestRequest(t, app, "POST", "/webhooks/gumroad", form.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+
+		settings, err := models.GetWebhookSettings(db, "gumroad")
+		require.NoError(t, err)
+		assert.Equal(t, "s3cret", settings.Secret)
+
+		var stored string
+		db.Model(&models.WebhookSettings{}).Select("secret").Where("provider = ?", "gumroad").Scan(&stored)
+		assert.NotContains(t, stored, "s3cret")
+
+		resp = testutils.TestRequest(t, app, "GET", "/webhooks", "")
+		assert.Equal(t, 200, resp.StatusCode)
+
+		form = url.Values{"remove": {"true"}}
+		resp = testutils.TestRequest(t, app, "POST", "/webhooks/gumroad", form.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+
+		settings, err = models.GetWebhookSettings(db, "gumroad")
+		require.NoError(t, err)
+		assert.Empty(t, settings.Secret)
+
+		resp = testutils.TestRequest(t, app, "POST", "/webhooks/lemonsqueezy", url.Values{"secret": {"x"}}.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+		var count int64
+		db.Model(&models.WebhookSettings{}).Where("provider = ?", "lemonsqueezy").Count(&count)
+		assert.Equal(t, int64(0), count)
+	})
+
+	t.Run("UpdateWebhookSecondarySecret - Rotate And Promote", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewSettingsHandler(db, nil)
+
+		app.Get("/webhooks", handler.ShowWebhookSettings)
+		app.Post("/webhooks/:provider/secondary", handler.UpdateWebhookSecondarySecret)
+		app.Post("/webhooks/:provider/promote", handler.PromoteWebhookSecret)
+
+		// Nothing to rotate before a secret is set
+		resp := testutils.TestRequest(t, app, "POST", "/webhooks/gumroad/secondary", url.Values{"secret": {"next"}}.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+		settings, err := models.GetWebhookSettings(db, "gumroad")
+		require.NoError(t, err)
+		assert.Empty(t, settings.SecondarySecret)
+
+		require.NoError(t, models.SaveWebhookSecret(db, "gumroad", "current"))
+		resp = testutils.TestRequest(t, app, "POST", "/webhooks/gumroad/secondary", url.Values{"secret": {"next"}}.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+		settings, err = models.GetWebhookSettings(db, "gumroad")
+		require.NoError(t, err)
+		assert.Equal(t, "current", settings.Secret)
+		assert.Equal(t, "next", settings.SecondarySecret)
+
+		var stored string
+		db.Model(&models.WebhookSettings{}).Select("secondary_secret").Where("provider = ?", "gumroad").Scan(&stored)
+		assert.NotContains(t, stored, "next")
+
+		resp = testutils.TestRequest(t, app, "GET", "/webhooks", "")
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "Promote New Secret")
+
+		resp = testutils.TestRequest(t, app, "POST", "/webhooks/gumroad/promote", "")
+		assert.Equal(t, 302, resp.StatusCode)
+		settings, err = models.GetWebhookSettings(db, "gumroad")
+		require.NoError(t, err)
+		assert.Equal(t, "next", settings.Secret)
+		assert.Empty(t, settings.SecondarySecret)
+	})
+
+	t.Run("CreateProductMapping - Valid And Invalid", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewSettingsHandler(db, nil)
+
+		app.Get("/mappings", handler.ShowProductMappings)
+		app.Post("/mappings", handler.CreateProductMapping)
+		app.Delete("/mappings/:id", handler.DeleteProductMapping)
+
+		product := models.Product{Name: "Pro Plan", Version: "1.0.0"}
+		require.NoError(t, db.Create(&product).Error)
+
+		form := url.Values{
+			"provider":    {"stripe"},
+			"external_id": {" price_pro "},
+			"product_id":  {strconv.Itoa(int(product.ID))},
+		}
+		resp := testutils.TestRequest(t, app, "POST", "/mappings", form.Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+
+		resolved, err := models.ResolveProduct(db, "stripe", "price_pro")
+		require.NoError(t, err)
+		assert.Equal(t, product.ID, resolved.ID)
+
+		resp = testutils.TestRequest(t, app, "GET", "/mappings", "")
+		assert.Equal(t, 200, resp.StatusCode)
+
+		form.Set("product_id", "99999")
+		form.Set("external_id", "price_other")
+		resp = testutils.TestRequest(t, app, "POST", "/mappings", form.Encode())
+		assert.Equal(t, 400, resp.StatusCode)
+
+		var mapping models.ProductMapping
+		require.NoError(t, db.First(&mapping).Error)
+		resp = testutils.TestRequest(t, app, "DELETE", "/mappings/"+strconv.Itoa(int(mapping.ID)), "")
+		assert.Equal(t, 302, resp.StatusCode)
+
+		var count int64
+		db.Model(&models.ProductMapping{}).Count(&count)
+		assert.Equal(t, int64(0), count)
+	})
+}
+
+// startStubSMTP runs a minimal SMTP server on a local port that accepts AUTH
+// PLAIN only with password, and returns the port
+func startStubSMTP(t *testing.T, password string) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				reply := func(line string) { _, _ = io.WriteString(conn, line+"\r\n") }
+				reply("220 localhost ready")
+				for {
+					line, err := rd.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fields := strings.Fields(line)
+					if len(fields) == 0 {
+						reply("500 empty command")
+						continue
+					}
+					switch strings.ToUpper(fields[0]) {
+					case "EHLO", "HELO":
+						reply("250-localhost")
+						reply("250 AUTH PLAIN")
+					case "AUTH":
+						credentials, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+						if strings.HasSuffix(string(credentials), "\x00"+password) {
+							reply("235 authenticated")
+						} else {
+							reply("535 authentication failed")
+						}
+					case "QUIT":
+						reply("221 bye")
+						return
+					default:
+						reply("250 ok")
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestSettingsHandler_LegacyEmailConfig(t *testing.T) {
+	smtpForm := func(username string) url.Values {
+		return url.Values{
+			"provider":      {"smtp"},
+			"smtp_host":     {"smtp.example.com"},
+			"smtp_port":     {"587"},
+			"smtp_username": {username},
+			"smtp_password": {"password"},
+			"from_email":    {username},
+			"from_name":     {"Test App"},
+		}
+	}
+	activeSettings := func(t *testing.T, db *gorm.DB) []models.EmailSettings {
+		var active []models.EmailSettings
+		require.NoError(t, db.Where("is_active = ?", true).Find(&active).Error)
+		return active
+	}
+
+	t.Run("EmailConfigPage - Redirects To Settings", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewSettingsHandler(db, nil)
+
+		app.Get("/email-config", handler.EmailConfigPage)
+
+		resp := testutils.TestRequest(t, app, "GET", "/email-config", "")
+		assert.Equal(t, 302, resp.StatusCode)
+		assert.Equal(t, "/admin/settings/email", resp.Header.Get("Location"))
+	})
+
+	t.Run("EmailConfigUpdate - Creates Active Config", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewSettingsHandler(db, nil)
+
+		app.Post("/email-config", handler.EmailConfigUpdate)
+
+		resp := testutils.TestRequest(t, app, "POST", "/email-config", smtpForm("test@example.com").Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+
+		active := activeSettings(t, db)
+		require.Len(t, active, 1)
+		assert.Equal(t, "smtp.example.com", active[0].SMTPHost)
+		assert.Equal(t, 587, active[0].SMTPPort)
+		assert.Equal(t, "test@example.com", active[0].SMTPUsername)
+		assert.Equal(t, "Test App", active[0].FromName)
+	})
+
+	t.Run("EmailConfigUpdate - Updates Oldest When None Active", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewSettingsHandler(db, nil)
+
+		app.Post("/email-config", handler.EmailConfigUpdate)
+
+		existing := models.EmailSettings{Provider: "SendGrid", SMTPHost: "smtp.sendgrid.net", SMTPPort: 587, SMTPUsername: "apikey"}
+		require.NoError(t, db.Create(&existing).Error)
+
+		resp := testutils.TestRequest(t, app, "POST", "/email-config", smtpForm("new@example.com").Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+
+		var updated models.EmailSettings
+		require.NoError(t, db.First(&updated, existing.ID).Error)
+		assert.Equal(t, "new@example.com", updated.SMTPUsername)
+		assert.True(t, updated.IsActive)
+		var count int64
+		db.Model(&models.EmailSettings{}).Count(&count)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("EmailConfigUpdate - Invalid Port", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewSettingsHandler(db, nil)
+
+		app.Post("/email-config", handler.EmailConfigUpdate)
+
+		form := smtpForm("test@example.com")
+		form.Set("smtp_port", "invalid_port")
+		resp := testutils.TestRequest(t, app, "POST", "/email-config", form.Encode())
+		assert.Equal(t, 400, resp.StatusCode)
+		assert.Empty(t, activeSettings(t, db))
+	})
+
+	t.Run("Legacy And New Routes Converge", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewSettingsHandler(db, nil)
+
+		app.Post("/email-config", handler.EmailConfigUpdate)
+		app.Post("/settings/email", handler.CreateEmailSettings)
+		app.Post("/settings/email/:id/activate", handler.ActivateEmailSettings)
+
+		resp := testutils.TestRequest(t, app, "POST", "/settings/email", smtpForm("first@example.com").Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+		first := activeSettings(t, db)
+		require.Len(t, first, 1)
+
+		// The legacy form edits the active configuration rather than adding one
+		resp = testutils.TestRequest(t, app, "POST", "/email-config", smtpForm("edited@example.com").Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+		active := activeSettings(t, db)
+		require.Len(t, active, 1)
+		assert.Equal(t, first[0].ID, active[0].ID)
+		assert.Equal(t, "edited@example.com", active[0].SMTPUsername)
+
+		resp = testutils.TestRequest(t, app, "POST", "/settings/email", smtpForm("second@example.com").Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+		active = activeSettings(t, db)
+		require.Len(t, active, 1)
+		second := active[0]
+		assert.Equal(t, "second@example.com", second.SMTPUsername)
+
+		resp = testutils.TestRequest(t, app, "POST", "/email-config", smtpForm("legacy@example.com").Encode())
+		assert.Equal(t, 302, resp.StatusCode)
+		active = activeSettings(t, db)
+		require.Len(t, active, 1)
+		assert.Equal(t, second.ID, active[0].ID)
+
+		resp = testutils.TestRequest(t, app, "POST", "/settings/email/"+strconv.Itoa(int(first[0].ID))+"/activate", "")
+		assert.Equal(t, 302, resp.StatusCode)
+		active = activeSettings(t, db)
+		require.Len(t, active, 1)
+		assert.Equal(t, first[0].ID, active[0].ID)
+	})
 }
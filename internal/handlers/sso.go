@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"matcha/internal/config"
+	"matcha/internal/middleware"
+	"matcha/internal/models"
+	"matcha/internal/services"
+)
+
+// Cookies that carry the sign-on state and PKCE code verifier from Start to
+// Callback
+const (
+	oidcStateCookie    = "oidc_state"
+	oidcVerifierCookie = "oidc_verifier"
+)
+
+type SSOHandler struct {
+	db       *gorm.DB
+	cfg      *config.Config
+	provider services.OIDCProvider
+}
+
+func NewSSOHandler(db *gorm.DB, cfg *config.Config, provider services.OIDCProvider) *SSOHandler {
+	return &SSOHandler{
+		db:       db,
+		cfg:      cfg,
+		provider: provider,
+	}
+}
+
+// Start redirects the browser to the identity provider's login page
+func (h *SSOHandler) Start(c *fiber.Ctx) error {
+	state, err := randomToken(16)
+	if err != nil {
+		return h.loginError(c, "Could not start single sign-on")
+	}
+	verifier, err := randomToken(32)
+	if err != nil {
+		return h.loginError(c, "Could not start single sign-on")
+	}
+
+	authURL, err := h.provider.AuthCodeURL(c.Context(), state, verifier)
+	if err != nil {
+		log.Printf("SSO: failed to build authorization URL: %v", err)
+		return h.loginError(c, "Single sign-on is currently unavailable")
+	}
+
+	h.setFlowCookie(c, oidcStateCookie, state)
+	h.setFlowCookie(c, oidcVerifierCookie, verifier)
+	return c.Redirect(authURL)
+}
+
+func (h *SSOHandler) setFlowCookie(c *fiber.Ctx, name, value string) {
+	c.Cookie(&fiber.Cookie{
+		Name:     name,
+		Value:    value,
+		Expires:  time.Now().Add(10 * time.Minute),
+		HTTPOnly: true,
+		Secure:   h.cfg.CookieSecure,
+		SameSite: "Lax", // Must survive the cross-site redirect back from the provider
+		Path:     middleware.AdminURL("/login"),
+	})
+}
+
+// Callback completes the authorization-code flow and signs the matching admin in
+func (h *SSOHandler) Callback(c *fiber.Ctx) error {
+	state := c.Cookies(oidcStateCookie)
+	verifier := c.Cookies(oidcVerifierCookie)
+	c.ClearCookie(oidcStateCookie, oidcVerifierCookie)
+
+	if errParam := c.Query("error"); errParam != "" {
+		log.Printf("SSO: provider returned error: %s", errParam)
+		return h.loginError(c, "Single sign-on was cancelled or denied")
+	}
+
+	if state == "" || verifier == "" || subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+		return h.loginError(c, "Invalid single sign-on state, please try again")
+	}
+
+	code := c.Query("code")
+	if code == "" {
+		return h.loginError(c, "Missing authorization code")
+	}
+
+	identity, err := h.provider.Exchange(c.Context(), code, verifier)
+	if err != nil {
+		log.Printf("SSO: code exchange failed: %v", err)
+		return h.loginError(c, "Single sign-on failed, please try again")
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return h.loginError(c, "Your identity provider did not return a verified email address")
+	}
+
+	admin, err := models.FindOrProvisionAdminByEmail(h.db, identity.Email, h.cfg.OIDCAutoProvision, h.cfg.OIDCDefaultRole)
+	if err != nil {
+		if errors.Is(err, models.ErrAdminNotProvisioned) {
+			return h.loginError(c, "No admin account exists for "+identity.Email)
+		}
+		log.Printf("SSO: failed to map identity to admin: %v", err)
+		return h.loginError(c, "Single sign-on failed, please try again")
+	}
+
+	if err := middleware.Login(c, admin.ID); err != nil {
+		return c.Status(500).SendString("Login failed")
+	}
+
+	return c.Redirect(middleware.AdminURL("/"))
+}
+
+func (h *SSOHandler) loginError(c *fiber.Ctx, message string) error {
+	return SafeRenderWithStatus(c, 200, "admin/users/login", fiber.Map{
+		"Error":      message,
+		"ShowNav":    false,
+		"Title":      "Login",
+		"SSOEnabled": true,
+	}, message)
+}
+
+// randomToken returns n random bytes, hex encoded
+func randomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
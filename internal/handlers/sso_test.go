@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"matcha/internal/config"
+	"matcha/internal/middleware"
+	"matcha/internal/models"
+	"matcha/internal/services"
+	"matcha/internal/testutils"
+)
+
+type stubOIDCProvider struct {
+	identity *services.OIDCIdentity
+	verifier string
+}
+
+func (p *stubOIDCProvider) AuthCodeURL(ctx context.Context, state, codeVerifier string) (string, error) {
+	return "https://idp.example.com/authorize?state=" + state + "&code_challenge=" + services.PKCEChallenge(codeVerifier), nil
+}
+
+func (p *stubOIDCProvider) Exchange(ctx context.Context, code, codeVerifier string) (*services.OIDCIdentity, error) {
+	p.verifier = codeVerifier
+	return p.identity, nil
+}
+
+// Integration tests for SSO - tests the OIDC callback with a stubbed provider
+func TestSSOHandler_Integration(t *testing.T) {
+	identity := &services.OIDCIdentity{
+		Subject:       "123",
+		Email:         "Jane@Example.com",
+		EmailVerified: true,
+		Name:          "Jane Doe",
+	}
+
+	t.Run("Callback - Maps Identity To Existing Admin", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewSSOHandler(db, &config.Config{}, &stubOIDCProvider{identity: identity})
+		app.Get("/admin/login/sso/callback", handler.Callback)
+
+		admin := models.AdminUser{Username: "jane", Email: "jane@example.com"}
+		require.NoError(t, admin.SetPassword("secret"))
+		require.NoError(t, db.Create(&admin).Error)
+
+		req := httptest.NewRequest("GET", "/admin/login/sso/callback?code=abc&state=xyz", nil)
+		req.Header.Set("Cookie", oidcStateCookie+"=xyz; "+oidcVerifierCookie+"=v1")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+
+		assert.Equal(t, 302, resp.StatusCode)
+		assert.Equal(t, "/admin/", resp.Header.Get("Location"))
+		assert.Contains(t, strings.Join(resp.Header.Values("Set-Cookie"), ";"), middleware.SessionCookie(1))
+	})
+
+	t.Run("Callback - Auto Provisions Admin", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		cfg := &config.Config{OIDCAutoProvision: true, OIDCDefaultRole: "support"}
+		handler := NewSSOHandler(db, cfg, &stubOIDCProvider{identity: identity})
+		app.Get("/admin/login/sso/callback", handler.Callback)
+
+		req := httptest.NewRequest("GET", "/admin/login/sso/callback?code=abc&state=xyz", nil)
+		req.Header.Set("Cookie", oidcStateCookie+"=xyz; "+oidcVerifierCookie+"=v1")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		assert.Equal(t, 302, resp.StatusCode)
+
+		var admin models.AdminUser
+		require.NoError(t, db.Where("email = ?", "jane@example.com").First(&admin).Error)
+		assert.Equal(t, "support", admin.Role)
+	})
+
+	t.Run("Callback - Unknown Identity Without Auto Provisioning", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewSSOHandler(db, &config.Config{}, &stubOIDCProvider{identity: identity})
+		app.Get("/admin/login/sso/callback", handler.Callback)
+
+		req := httptest.NewRequest("GET", "/admin/login/sso/callback?code=abc&state=xyz", nil)
+		req.Header.Set("Cookie", oidcStateCookie+"=xyz; "+oidcVerifierCookie+"=v1")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var count int64
+		db.Model(&models.AdminUser{}).Count(&count)
+		assert.Equal(t, int64(0), count)
+	})
+
+	t.Run("Callback - Does Not Match Username", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewSSOHandler(db, &config.Config{}, &stubOIDCProvider{identity: identity})
+		app.Get("/admin/login/sso/callback", handler.Callback)
+
+		admin := models.AdminUser{Username: "jane@example.com"}
+		require.NoError(t, admin.SetPassword("secret"))
+		require.NoError(t, db.Create(&admin).Error)
+
+		req := httptest.NewRequest("GET", "/admin/login/sso/callback?code=abc&state=xyz", nil)
+		req.Header.Set("Cookie", oidcStateCookie+"=xyz; "+oidcVerifierCookie+"=v1")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.NotContains(t, strings.Join(resp.Header.Values("Set-Cookie"), ";"), "admin_user_id")
+	})
+
+	t.Run("Callback - Rejects State Mismatch", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		cfg := &config.Config{OIDCAutoProvision: true}
+		handler := NewSSOHandler(db, cfg, &stubOIDCProvider{identity: identity})
+		app.Get("/admin/login/sso/callback", handler.Callback)
+
+		req := httptest.NewRequest("GET", "/admin/login/sso/callback?code=abc&state=forged", nil)
+		req.Header.Set("Cookie", oidcStateCookie+"=xyz; "+oidcVerifierCookie+"=v1")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.NotContains(t, strings.Join(resp.Header.Values("Set-Cookie"), ";"), "admin_user_id")
+	})
+
+	t.Run("Callback - Rejects Missing Code Verifier", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		cfg := &config.Config{OIDCAutoProvision: true}
+		provider := &stubOIDCProvider{identity: identity}
+		handler := NewSSOHandler(db, cfg, provider)
+		app.Get("/admin/login/sso/callback", handler.Callback)
+
+		req := httptest.NewRequest("GET", "/admin/login/sso/callback?code=abc&state=xyz", nil)
+		req.Header.Set("Cookie", oidcStateCookie+"=xyz")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Empty(t, provider.verifier)
+		assert.NotContains(t, strings.Join(resp.Header.Values("Set-Cookie"), ";"), "admin_user_id")
+	})
+
+	t.Run("Start And Callback - Round Trip The PKCE Verifier", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		cfg := &config.Config{OIDCAutoProvision: true, OIDCDefaultRole: "readonly"}
+		provider := &stubOIDCProvider{identity: identity}
+		handler := NewSSOHandler(db, cfg, provider)
+		app.Get("/admin/login/sso", handler.Start)
+		app.Get("/admin/login/sso/callback", handler.Callback)
+
+		resp, err := app.Test(httptest.NewRequest("GET", "/admin/login/sso", nil))
+		require.NoError(t, err)
+		require.Equal(t, 302, resp.StatusCode)
+
+		cookies := map[string]string{}
+		for _, c := range resp.Cookies() {
+			cookies[c.Name] = c.Value
+		}
+		require.NotEmpty(t, cookies[oidcStateCookie])
+		require.NotEmpty(t, cookies[oidcVerifierCookie])
+		assert.Contains(t, resp.Header.Get("Location"), "code_challenge="+services.PKCEChallenge(cookies[oidcVerifierCookie]))
+
+		req := httptest.NewRequest("GET", "/admin/login/sso/callback?code=abc&state="+cookies[oidcStateCookie], nil)
+		req.Header.Set("Cookie", oidcStateCookie+"="+cookies[oidcStateCookie]+"; "+oidcVerifierCookie+"="+cookies[oidcVerifierCookie])
+		resp, err = app.Test(req)
+		require.NoError(t, err)
+		assert.Equal(t, 302, resp.StatusCode)
+		assert.Equal(t, cookies[oidcVerifierCookie], provider.verifier)
+
+		var admin models.AdminUser
+		require.NoError(t, db.Where("email = ?", "jane@example.com").First(&admin).Error)
+		assert.Equal(t, "readonly", admin.Role)
+	})
+}
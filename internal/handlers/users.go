@@ -1,25 +1,33 @@
 package handlers
 
 import (
+	"log"
+	"strings"
+	"time"
+
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
 
+	"matcha/internal/config"
+	"matcha/internal/database"
 	"matcha/internal/middleware"
 	"matcha/internal/models"
 )
 
 type UsersHandler struct {
-	db *gorm.DB
+	db  *gorm.DB
+	cfg *config.Config
 }
 
-func NewUsersHandler(db *gorm.DB) *UsersHandler {
-	return &UsersHandler{db: db}
+func NewUsersHandler(db *gorm.DB, cfg *config.Config) *UsersHandler {
+	return &UsersHandler{db: db, cfg: cfg}
 }
 
 func (h *UsersHandler) LoginPage(c *fiber.Ctx) error {
 	return SafeRender(c, "admin/users/login", fiber.Map{
-		"ShowNav": false,
-		"Title":   "Login",
+		"ShowNav":    false,
+		"Title":      "Login",
+		"SSOEnabled": h.cfg.OIDCEnabled(),
 	})
 }
 
@@ -30,37 +38,165 @@ func (h *UsersHandler) Login(c *fiber.Ctx) error {
 	// Validate input
 	if username == "" || password == "" {
 		return SafeRenderWithStatus(c, 200, "admin/users/login", fiber.Map{
-			"Error":   "Username and password are required",
-			"ShowNav": false,
-			"Title":   "Login",
+			"Error":      "Username and password are required",
+			"ShowNav":    false,
+			"Title":      "Login",
+			"SSOEnabled": h.cfg.OIDCEnabled(),
 		}, "Username and password are required")
 	}
 
+	// Lock out guessing per username and per IP. A locked-out login is refused
+	// even with the right password, so the response reveals nothing.
+	throttleKeys := models.LoginThrottleKeys(username, c.IP())
+	if locked, err := models.LoginLocked(h.db, throttleKeys, time.Now()); err != nil {
+		return c.Status(500).SendString("Login failed")
+	} else if locked {
+		return h.renderLoginLocked(c)
+	}
+
 	var admin models.AdminUser
-	if err := h.db.Where("username = ?", username).First(&admin).Error; err != nil {
-		return SafeRenderWithStatus(c, 200, "admin/users/login", fiber.Map{
-			"Error":   "Invalid username or password",
-			"ShowNav": false,
-			"Title":   "Login",
-		}, "Invalid username or password")
+	if err := h.db.Where("username = ?", username).First(&admin).Error; err != nil || !admin.CheckPassword(password) {
+		return h.loginFailed(c, throttleKeys)
 	}
 
-	if !admin.CheckPassword(password) {
-		return SafeRenderWithStatus(c, 200, "admin/users/login", fiber.Map{
-			"Error":   "Invalid username or password",
-			"ShowNav": false,
-			"Title":   "Login",
-		}, "Invalid username or password")
+	if err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+		return models.ResetLoginFailures(db, throttleKeys)
+	}); err != nil {
+		log.Printf("Failed to reset login failures for %q: %v", username, err)
 	}
 
 	if err := middleware.Login(c, admin.ID); err != nil {
 		return c.Status(500).SendString("Login failed")
 	}
 
-	return c.Redirect("/admin/")
+	return c.Redirect(middleware.AdminURL("/"))
+}
+
+// loginFailed counts a failed attempt and re-renders the login form, or the
+// lockout message once this attempt reaches the limit
+func (h *UsersHandler) loginFailed(c *fiber.Ctx, throttleKeys []string) error {
+	policy := models.LoginThrottlePolicy{
+		MaxFailures: h.cfg.LoginMaxAttempts,
+		Window:      h.cfg.LoginAttemptWindow,
+		Lockout:     h.cfg.LoginLockout,
+	}
+	var locked bool
+	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+		var err error
+		locked, err = models.RecordLoginFailure(db, throttleKeys, time.Now(), policy)
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to record login failure: %v", err)
+	}
+	if locked {
+		log.Printf("Login locked out for %v after %d failed attempts", throttleKeys, policy.MaxFailures)
+		return h.renderLoginLocked(c)
+	}
+
+	return SafeRenderWithStatus(c, 200, "admin/users/login", fiber.Map{
+		"Error":      "Invalid username or password",
+		"ShowNav":    false,
+		"Title":      "Login",
+		"SSOEnabled": h.cfg.OIDCEnabled(),
+	}, "Invalid username or password")
+}
+
+const loginLockedMessage = "Too many failed login attempts. Please try again later."
+
+func (h *UsersHandler) renderLoginLocked(c *fiber.Ctx) error {
+	return SafeRenderWithStatus(c, 429, "admin/users/login", fiber.Map{
+		"Error":      loginLockedMessage,
+		"ShowNav":    false,
+		"Title":      "Login",
+		"SSOEnabled": h.cfg.OIDCEnabled(),
+	}, loginLockedMessage)
 }
 
 func (h *UsersHandler) Logout(c *fiber.Ctx) error {
 	_ = middleware.Logout(c)
-	return c.Redirect("/admin/login")
+	return c.Redirect(middleware.AdminURL("/login"))
+}
+
+func (h *UsersHandler) ChangePasswordPage(c *fiber.Ctx) error {
+	return SafeRender(c, "admin/users/change_password", fiber.Map{
+		"ShowNav":  false,
+		"PageType": "change-password",
+		"Title":    "Change Password",
+	})
+}
+
+// ChangePassword replaces the current admin's password, which also lifts a
+// forced change for bootstrap admins
+func (h *UsersHandler) ChangePassword(c *fiber.Ctx) error {
+	admin := middleware.GetCurrentAdmin(c)
+	if admin == nil {
+		return c.Redirect(middleware.AdminURL("/login"))
+	}
+
+	renderError := func(msg string) error {
+		return SafeRenderWithStatus(c, 400, "admin/users/change_password", fiber.Map{
+			"Error":    msg,
+			"ShowNav":  false,
+			"PageType": "change-password",
+			"Title":    "Change Password",
+		}, msg)
+	}
+
+	current := c.FormValue("current_password")
+	password := c.FormValue("password")
+
+	if !admin.CheckPassword(current) {
+		return renderError("Current password is incorrect")
+	}
+	if len(password) < models.MinPasswordLength {
+		return renderError("New password must be at least 8 characters")
+	}
+	if password != c.FormValue("password_confirmation") {
+		return renderError("New passwords do not match")
+	}
+	if password == current {
+		return renderError("New password must differ from the current one")
+	}
+
+	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+		return admin.ChangePassword(db, password)
+	})
+	if err != nil {
+		return c.Status(500).SendString("Failed to change password")
+	}
+
+	return c.Redirect(middleware.AdminURL("/"))
+}
+
+// UpdateTheme saves the current admin's UI theme, so it follows them to
+// every device they sign in from
+func (h *UsersHandler) UpdateTheme(c *fiber.Ctx) error {
+	admin := middleware.GetCurrentAdmin(c)
+	if admin == nil {
+		return c.Redirect(middleware.AdminURL("/login"))
+	}
+
+	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+		return admin.SetTheme(db, c.FormValue("theme"))
+	})
+	if err != nil {
+		if wantsJSON(c) {
+			return jsonError(c, 400, err.Error())
+		}
+		middleware.SetFlash(c, middleware.FlashError, "Could not change theme: "+err.Error())
+	}
+	if wantsJSON(c) {
+		return c.JSON(fiber.Map{"theme": admin.UITheme()})
+	}
+	return c.Redirect(themeReturnPath(c.FormValue("return_to")))
+}
+
+// themeReturnPath sends the admin back to the page they changed the theme on,
+// but only within the admin panel
+func themeReturnPath(returnTo string) string {
+	if strings.HasPrefix(returnTo, middleware.AdminPath()) && !strings.HasPrefix(returnTo, "//") {
+		return returnTo
+	}
+	return middleware.AdminURL("/")
 }
@@ -1,12 +1,17 @@
 package handlers
 
 import (
+	"io"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"matcha/internal/config"
+	"matcha/internal/middleware"
 	"matcha/internal/models"
 	"matcha/internal/testutils"
 )
@@ -16,7 +21,7 @@ func TestUsersHandler_Integration(t *testing.T) {
 	t.Run("LoginPage - Display Login Form", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewUsersHandler(db)
+		handler := NewUsersHandler(db, config.New())
 
 		app.Get("/login", handler.LoginPage)
 
@@ -27,7 +32,7 @@ func TestUsersHandler_Integration(t *testing.T) {
 	t.Run("Login - Valid Credentials", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewUsersHandler(db)
+		handler := NewUsersHandler(db, config.New())
 
 		app.Post("/login", handler.Login)
 
@@ -51,7 +56,7 @@ func TestUsersHandler_Integration(t *testing.T) {
 	t.Run("Login - Invalid Username", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewUsersHandler(db)
+		handler := NewUsersHandler(db, config.New())
 
 		app.Post("/login", handler.Login)
 
@@ -68,7 +73,7 @@ func TestUsersHandler_Integration(t *testing.T) {
 	t.Run("Login - Invalid Password", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewUsersHandler(db)
+		handler := NewUsersHandler(db, config.New())
 
 		app.Post("/login", handler.Login)
 
@@ -89,10 +94,70 @@ func TestUsersHandler_Integration(t *testing.T) {
 		assert.True(t, resp.StatusCode == 200 || resp.StatusCode == 302)
 	})
 
+	t.Run("Login - Locks Out After Repeated Failures", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		cfg := config.New()
+		cfg.LoginMaxAttempts = 3
+		handler := NewUsersHandler(db, cfg)
+
+		app.Post("/login", handler.Login)
+
+		admin := models.AdminUser{Username: "testuser"}
+		require.NoError(t, admin.SetPassword("correctpass"))
+		require.NoError(t, db.Create(&admin).Error)
+
+		wrong := url.Values{"username": {"testuser"}, "password": {"wrongpass"}}.Encode()
+		for i := 1; i < cfg.LoginMaxAttempts; i++ {
+			resp := testutils.TestRequest(t, app, "POST", "/login", wrong)
+			assert.Equal(t, 200, resp.StatusCode, "attempt %d should only be rejected", i)
+		}
+
+		resp := testutils.TestRequest(t, app, "POST", "/login", wrong)
+		assert.Equal(t, 429, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Contains(t, string(body), "Too many failed login attempts")
+
+		// The right password is refused too until the lockout ends
+		right := url.Values{"username": {"TestUser"}, "password": {"correctpass"}}.Encode()
+		resp = testutils.TestRequest(t, app, "POST", "/login", right)
+		assert.Equal(t, 429, resp.StatusCode)
+	})
+
+	t.Run("Login - Success Resets Failures", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		cfg := config.New()
+		cfg.LoginMaxAttempts = 3
+		handler := NewUsersHandler(db, cfg)
+
+		app.Post("/login", handler.Login)
+
+		admin := models.AdminUser{Username: "testuser"}
+		require.NoError(t, admin.SetPassword("correctpass"))
+		require.NoError(t, db.Create(&admin).Error)
+
+		wrong := url.Values{"username": {"testuser"}, "password": {"wrongpass"}}.Encode()
+		right := url.Values{"username": {"testuser"}, "password": {"correctpass"}}.Encode()
+		for i := 1; i < cfg.LoginMaxAttempts; i++ {
+			testutils.TestRequest(t, app, "POST", "/login", wrong)
+		}
+		resp := testutils.TestRequest(t, app, "POST", "/login", right)
+		assert.Equal(t, 302, resp.StatusCode)
+
+		var count int64
+		db.Model(&models.LoginThrottle{}).Count(&count)
+		assert.Zero(t, count)
+
+		// The counter starts over, so another slip doesn't lock the account
+		resp = testutils.TestRequest(t, app, "POST", "/login", wrong)
+		assert.Equal(t, 200, resp.StatusCode)
+	})
+
 	t.Run("Login - Empty Credentials", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewUsersHandler(db)
+		handler := NewUsersHandler(db, config.New())
 
 		app.Post("/login", handler.Login)
 
@@ -109,7 +174,7 @@ func TestUsersHandler_Integration(t *testing.T) {
 	t.Run("Logout - Redirect to Login", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 		app := testutils.SetupTestAppWithDB(t, db)
-		handler := NewUsersHandler(db)
+		handler := NewUsersHandler(db, config.New())
 
 		app.Get("/logout", handler.Logout)
 
@@ -118,6 +183,87 @@ func TestUsersHandler_Integration(t *testing.T) {
 		assert.Equal(t, 302, resp.StatusCode)
 	})
 
+	t.Run("ChangePassword - Clears Forced Change", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewUsersHandler(db, config.New())
+
+		app.Post("/admin/password", middleware.RequireAuth, handler.ChangePassword)
+
+		_, err := models.CreateDefaultAdmin(db, "admin", "bootstrap-pass")
+		require.NoError(t, err)
+		var admin models.AdminUser
+		require.NoError(t, db.Where("username = ?", "admin").First(&admin).Error)
+
+		post := func(form url.Values) int {
+			req := httptest.NewRequest("POST", "/admin/password", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Cookie", middleware.SessionCookie(admin.ID))
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			return resp.StatusCode
+		}
+
+		assert.Equal(t, 400, post(url.Values{
+			"current_password":      {"bootstrap-pass"},
+			"password":              {"short"},
+			"password_confirmation": {"short"},
+		}))
+
+		assert.Equal(t, 302, post(url.Values{
+			"current_password":      {"bootstrap-pass"},
+			"password":              {"a-new-password"},
+			"password_confirmation": {"a-new-password"},
+		}))
+
+		require.NoError(t, db.First(&admin, admin.ID).Error)
+		assert.False(t, admin.MustChangePassword)
+		assert.True(t, admin.CheckPassword("a-new-password"))
+	})
+
+	t.Run("UpdateTheme - Stored And Rendered", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewUsersHandler(db, config.New())
+
+		app.Post("/admin/account/theme", middleware.RequireAuth, handler.UpdateTheme)
+		app.Get("/admin/password", middleware.RequireAuth, handler.ChangePasswordPage)
+
+		admin := models.AdminUser{Username: "themed"}
+		require.NoError(t, admin.SetPassword("testpass"))
+		require.NoError(t, db.Create(&admin).Error)
+		cookie := middleware.SessionCookie(admin.ID)
+
+		post := func(form url.Values) (int, string) {
+			req := httptest.NewRequest("POST", "/admin/account/theme", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Cookie", cookie)
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			return resp.StatusCode, resp.Header.Get("Location")
+		}
+
+		status, location := post(url.Values{"theme": {"dark"}, "return_to": {"/admin/products?page=2"}})
+		assert.Equal(t, 302, status)
+		assert.Equal(t, "/admin/products?page=2", location)
+		require.NoError(t, db.First(&admin, admin.ID).Error)
+		assert.Equal(t, models.ThemeDark, admin.Theme)
+
+		// The preference comes from the admin's row, so any device renders it
+		req := httptest.NewRequest("GET", "/admin/password", nil)
+		req.Header.Set("Cookie", cookie)
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), `data-theme="dark"`)
+
+		_, location = post(url.Values{"theme": {"sepia"}, "return_to": {"https://evil.example/admin"}})
+		assert.Equal(t, "/admin/", location)
+		require.NoError(t, db.First(&admin, admin.ID).Error)
+		assert.Equal(t, models.ThemeDark, admin.Theme, "an unknown theme is rejected")
+	})
+
 	t.Run("Database Verification - User Creation", func(t *testing.T) {
 		db := testutils.SetupTestDB(t)
 
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"sort"
+	"strings"
+)
+
+// ValidationErrors maps a form field name to what is wrong with its value.
+// Forms receive it as ValidationErrors and show each message under its field,
+// see the fieldError template func; JSON clients get the messages joined into
+// the usual error string.
+type ValidationErrors map[string]string
+
+// Add records a problem with field, keeping the first one reported so the
+// most basic complaint (e.g. "required") wins
+func (v ValidationErrors) Add(field, message string) {
+	if _, ok := v[field]; !ok {
+		v[field] = message
+	}
+}
+
+// Error lists every message, ordered by field name for a stable output
+func (v ValidationErrors) Error() string {
+	fields := make([]string, 0, len(v))
+	for field := range v {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	messages := make([]string, 0, len(fields))
+	for _, field := range fields {
+		messages = append(messages, v[field])
+	}
+	return strings.Join(messages, "; ")
+}
@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"matcha/internal/database"
+	"matcha/internal/middleware"
+	"matcha/internal/models"
+	"matcha/internal/services"
+)
+
+type WebhookEventsHandler struct {
+	db        *gorm.DB
+	processor *services.WebhookProcessor
+}
+
+func NewWebhookEventsHandler(db *gorm.DB, processor *services.WebhookProcessor) *WebhookEventsHandler {
+	return &WebhookEventsHandler{
+		db:        db,
+		processor: processor,
+	}
+}
+
+// Index lists recent webhook events, optionally filtered by status
+func (h *WebhookEventsHandler) Index(c *fiber.Ctx) error {
+	status := c.Query("status")
+
+	query := h.db.Order("created_at DESC").Limit(100)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var events []models.WebhookEvent
+	query.Find(&events)
+
+	return SafeRender(c, "admin/webhooks/index", fiber.Map{
+		"ShowNav":  true,
+		"PageType": "webhooks-index",
+		"Title":    "Webhooks",
+		"Events":   events,
+		"Status":   status,
+	})
+}
+
+// webhookField is one value read out of a stored payload for the detail page
+type webhookField struct {
+	Label string
+	Value string
+}
+
+// Show displays a stored event: its raw payload, the fields processing reads
+// from it, and its processing state. Buyer details are masked unless the
+// request asks to reveal them.
+func (h *WebhookEventsHandler) Show(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(400).SendString("Invalid webhook event ID")
+	}
+
+	var event models.WebhookEvent
+	if err := h.db.First(&event, uint(id)).Error; err != nil {
+		return c.Status(404).SendString("Webhook event not found")
+	}
+	reveal := c.Query("reveal") == "true"
+
+	var payload string
+	var fields []webhookField
+	var parseError string
+	var data interface{}
+	if err := json.Unmarshal([]byte(event.Payload), &data); err != nil {
+		parseError = "The stored payload is not valid JSON: " + err.Error()
+		if reveal {
+			payload = event.Payload
+		}
+	} else {
+		if !reveal {
+			data = redactPII(data)
+		}
+		pretty, _ := json.MarshalIndent(data, "", "  ")
+		payload = string(pretty)
+
+		object, _ := data.(map[string]interface{})
+		if fields, err = webhookFields(event.Provider, object); err != nil {
+			parseError = err.Error()
+		}
+	}
+
+	return SafeRender(c, "admin/webhooks/show", fiber.Map{
+		"ShowNav":    true,
+		"PageType":   "webhooks-show",
+		"Title":      "Webhook Event",
+		"Event":      event,
+		"Payload":    payload,
+		"Fields":     fields,
+		"ParseError": parseError,
+		"Reveal":     reveal,
+	})
+}
+
+// webhookFields reads a payload the way ProcessEvent does. The data has
+// already been redacted when buyer details are hidden.
+func webhookFields(provider string, data jsonObject) ([]webhookField, error) {
+	var details paymentDetails
+	var eventType string
+	var err error
+	switch provider {
+	case "stripe":
+		eventType, _ = data.str("type")
+		details, err = extractStripePayment(data)
+	case "gumroad":
+		eventType = "sale"
+		details = extractGumroadPayment(data)
+	case "paypal":
+		eventType, _ = data.str("event_type")
+		details, err = extractPayPalPayment(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	action := "Ignored"
+	if details.subscriptionEnded {
+		action = "Expire subscription keys"
+	} else if details.relevant {
+		action = "Issue license key"
+	}
+
+	return []webhookField{
+		{Label: "Event Type", Value: eventType},
+		{Label: "Action", Value: action},
+		{Label: "Email", Value: details.email},
+		{Label: "Name", Value: details.name},
+		{Label: "Product ID", Value: details.productID},
+		{Label: "Subscription ID", Value: details.subscriptionID},
+	}, nil
+}
+
+// Replay runs an event through processing again, whatever its status. A key
+// already issued for the event is reused, so replaying only resends its email.
+func (h *WebhookEventsHandler) Replay(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(400).SendString("Invalid webhook event ID")
+	}
+
+	var event models.WebhookEvent
+	if err := h.db.First(&event, uint(id)).Error; err != nil {
+		return c.Status(404).SendString("Webhook event not found")
+	}
+
+	if err := h.processor.Replay(event.ID); err != nil {
+		middleware.SetFlash(c, middleware.FlashError, "Replay failed: "+err.Error())
+	} else {
+		middleware.SetFlash(c, middleware.FlashSuccess, "Webhook event replayed")
+	}
+	return c.Redirect(middleware.AdminURL("/webhooks/") + c.Params("id"))
+}
+
+// Retry re-drives a failed or dead event immediately
+func (h *WebhookEventsHandler) Retry(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(400).SendString("Invalid webhook event ID")
+	}
+
+	var event models.WebhookEvent
+	if err := h.db.First(&event, uint(id)).Error; err != nil {
+		return c.Status(404).SendString("Webhook event not found")
+	}
+
+	// The outcome is recorded on the event and shown on the index page
+	if err := h.processor.Redrive(event.ID); errors.Is(err, services.ErrNotRedrivable) {
+		return c.Status(409).SendString("Only failed or dead webhook events can be retried")
+	}
+
+	return c.Redirect(middleware.AdminURL("/webhooks"))
+}
+
+// SimulateForm shows the webhook simulator, where an admin pastes a sample
+// provider payload to see how it would be processed
+func (h *WebhookEventsHandler) SimulateForm(c *fiber.Ctx) error {
+	return h.renderSimulate(c, 200, fiber.Map{"Provider": "stripe"})
+}
+
+// Simulate runs a pasted payload through the same processing as a delivered
+// webhook, without the provider's signature or secret check. The event is
+// stored marked as simulated, so a key is issued but the customer isn't
+// emailed.
+func (h *WebhookEventsHandler) Simulate(c *fiber.Ctx) error {
+	provider := c.FormValue("provider")
+	raw := strings.TrimSpace(c.FormValue("payload"))
+	data := fiber.Map{"Provider": provider, "RawPayload": raw}
+
+	if !slices.Contains(models.PaymentProviders, provider) {
+		data["Error"] = "Choose a provider"
+		return h.renderSimulate(c, 400, data)
+	}
+	payload, err := simulatedPayload(provider, raw)
+	if err != nil {
+		data["Error"] = err.Error()
+		return h.renderSimulate(c, 400, data)
+	}
+
+	event := models.WebhookEvent{
+		Provider:  provider,
+		Payload:   string(payload),
+		Status:    models.WebhookStatusPending,
+		Simulated: true,
+	}
+	err = database.PerformWrite(h.db, func(db *gorm.DB) error {
+		return db.Create(&event).Error
+	})
+	if err != nil {
+		return c.Status(500).SendString("Failed to store simulated webhook")
+	}
+
+	// The outcome is recorded on the event, which is reloaded below
+	_ = h.processor.Process(event.ID)
+	if err := h.db.First(&event, event.ID).Error; err != nil {
+		return c.Status(500).SendString("Failed to load simulated webhook")
+	}
+
+	var object map[string]interface{}
+	_ = json.Unmarshal(payload, &object)
+	fields, _ := webhookFields(provider, object)
+	data["Event"] = event
+	data["Fields"] = fields
+	if event.LicenseKeyID != nil {
+		var licenseKey models.LicenseKey
+		if err := h.db.Preload("Product").Preload("Customer").First(&licenseKey, *event.LicenseKeyID).Error; err == nil {
+			data["LicenseKey"] = licenseKey
+		}
+	}
+	return h.renderSimulate(c, 200, data)
+}
+
+// simulatedPayload validates a pasted payload and converts it to what the
+// provider's endpoint would store. Gumroad pings are form-encoded, so either
+// that or the JSON shown on an event's detail page is accepted.
+func simulatedPayload(provider, raw string) ([]byte, error) {
+	if raw == "" {
+		return nil, errors.New("Paste a payload to simulate")
+	}
+
+	var object map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &object); err != nil || object == nil {
+		if provider != "gumroad" {
+			return nil, errors.New("The payload is not a JSON object")
+		}
+		values, err := url.ParseQuery(raw)
+		if err != nil {
+			return nil, errors.New("The payload is neither JSON nor form-encoded")
+		}
+		object = map[string]interface{}{}
+		for key := range values {
+			object[key] = values.Get(key)
+		}
+	}
+	delete(object, "secret")
+
+	switch provider {
+	case "stripe":
+		if _, err := extractStripePayment(object); err != nil {
+			return nil, err
+		}
+	case "paypal":
+		if _, err := extractPayPalPayment(object); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(object)
+}
+
+func (h *WebhookEventsHandler) renderSimulate(c *fiber.Ctx, status int, data fiber.Map) error {
+	data["ShowNav"] = true
+	data["PageType"] = "webhooks-simulate"
+	data["Title"] = "Simulate Webhook"
+	data["Providers"] = models.PaymentProviders
+	return SafeRenderWithStatus(c, status, "admin/webhooks/simulate", data, "Failed to render webhook simulator")
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"io"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"matcha/internal/config"
+	"matcha/internal/models"
+	"matcha/internal/services"
+	"matcha/internal/testutils"
+)
+
+func TestWebhookEventsHandler_Show(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestAppWithDB(t, db)
+	handler := NewWebhookEventsHandler(db, nil)
+	app.Get("/webhooks/:id", handler.Show)
+
+	event := stripeEvent(t, "checkout.session.completed", map[string]interface{}{
+		"customer_details": map[string]interface{}{"email": "buyer@example.com", "name": "Jane Buyer"},
+		"metadata":         map[string]interface{}{"product_id": "42"},
+	})
+	event.Status = models.WebhookStatusFailed
+	event.LastError = "failed to send license key email: smtp down"
+	require.NoError(t, db.Create(event).Error)
+	path := "/webhooks/" + strconv.Itoa(int(event.ID))
+
+	t.Run("Show - Customer Details Redacted By Default", func(t *testing.T) {
+		resp := testutils.TestRequest(t, app, "GET", path, "")
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Contains(t, string(body), "checkout.session.completed")
+		assert.Contains(t, string(body), "smtp down")
+		assert.Contains(t, string(body), "b***@example.com")
+		assert.NotContains(t, string(body), "buyer@example.com")
+		assert.NotContains(t, string(body), "Jane Buyer")
+	})
+
+	t.Run("Show - Customer Details Revealed", func(t *testing.T) {
+		resp := testutils.TestRequest(t, app, "GET", path+"?reveal=true", "")
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		assert.Contains(t, string(body), "buyer@example.com")
+		assert.Contains(t, string(body), "Jane Buyer")
+	})
+
+	t.Run("Show - Non-existent Event", func(t *testing.T) {
+		resp := testutils.TestRequest(t, app, "GET", "/webhooks/99999", "")
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+}
+
+func TestWebhookEventsHandler_Replay(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestAppWithDB(t, db)
+
+	var processed []uint
+	processor := services.NewWebhookProcessor(db, func(event *models.WebhookEvent) error {
+		processed = append(processed, event.ID)
+		return nil
+	})
+	handler := NewWebhookEventsHandler(db, processor)
+	app.Post("/webhooks/:id/replay", handler.Replay)
+
+	event := stripeEvent(t, "checkout.session.completed", map[string]interface{}{})
+	event.Status = models.WebhookStatusProcessed
+	event.Attempts = 1
+	require.NoError(t, db.Create(event).Error)
+
+	resp := testutils.TestRequest(t, app, "POST", "/webhooks/"+strconv.Itoa(int(event.ID))+"/replay", "")
+	assert.Equal(t, 302, resp.StatusCode)
+	assert.Equal(t, "/admin/webhooks/"+strconv.Itoa(int(event.ID)), resp.Header.Get("Location"))
+
+	assert.Equal(t, []uint{event.ID}, processed, "a processed event is run again on replay")
+
+	var stored models.WebhookEvent
+	require.NoError(t, db.First(&stored, event.ID).Error)
+	assert.Equal(t, models.WebhookStatusProcessed, stored.Status)
+	assert.Equal(t, 1, stored.Attempts)
+}
+
+func TestWebhookEventsHandler_Simulate(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestAppWithDB(t, db)
+	webhooks := NewWebhookHandler(db, services.NewEmailService(&config.Config{}, db))
+	handler := NewWebhookEventsHandler(db, webhooks.Processor())
+	app.Post("/webhooks/simulate", handler.Simulate)
+
+	product := models.Product{Name: "Pro Plan"}
+	require.NoError(t, db.Create(&product).Error)
+	require.NoError(t, db.Create(&models.ProductMapping{Provider: "stripe", ExternalID: "price_pro", ProductID: product.ID}).Error)
+
+	t.Run("Simulate - Stripe Checkout Issues Key Without Email", func(t *testing.T) {
+		payload := stripeCheckoutEvent(t, "price_pro").Payload
+		form := url.Values{"provider": {"stripe"}, "payload": {payload}}
+		resp := testutils.TestRequest(t, app, "POST", "/webhooks/simulate", form.Encode())
+		require.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		var event models.WebhookEvent
+		require.NoError(t, db.Last(&event).Error)
+		assert.True(t, event.Simulated)
+		// No email settings are configured, so a real send would have failed
+		assert.Equal(t, models.WebhookStatusProcessed, event.Status)
+		require.NotNil(t, event.LicenseKeyID)
+
+		var licenseKey models.LicenseKey
+		require.NoError(t, db.First(&licenseKey, *event.LicenseKeyID).Error)
+		assert.Equal(t, product.ID, licenseKey.ProductID)
+		assert.Contains(t, string(body), licenseKey.Key)
+
+		var emails int64
+		db.Model(&models.EmailLog{}).Count(&emails)
+		assert.Zero(t, emails, "simulated events don't email the customer")
+	})
+
+	t.Run("Simulate - Invalid Payload", func(t *testing.T) {
+		form := url.Values{"provider": {"stripe"}, "payload": {`{"data": {}}`}}
+		resp := testutils.TestRequest(t, app, "POST", "/webhooks/simulate", form.Encode())
+		assert.Equal(t, 400, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "Missing event type")
+	})
+}
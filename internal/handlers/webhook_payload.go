@@ -0,0 +1,110 @@
+package handlers
+
+import "strings"
+
+// jsonObject is a decoded JSON object from a webhook payload. Providers add
+// and reshape fields freely, so lookups never assert types directly: each
+// accessor walks the path one key at a time and reports whether a value of
+// the expected type was found, instead of panicking or erroring.
+type jsonObject map[string]interface{}
+
+// lookup follows keys through nested objects
+func (o jsonObject) lookup(keys ...string) (interface{}, bool) {
+	var value interface{} = map[string]interface{}(o)
+	for _, key := range keys {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// object returns the nested object at keys
+func (o jsonObject) object(keys ...string) (jsonObject, bool) {
+	value, _ := o.lookup(keys...)
+	object, ok := value.(map[string]interface{})
+	return object, ok
+}
+
+// str returns the string at keys
+func (o jsonObject) str(keys ...string) (string, bool) {
+	value, _ := o.lookup(keys...)
+	s, ok := value.(string)
+	return s, ok
+}
+
+// num returns the number at keys
+func (o jsonObject) num(keys ...string) (float64, bool) {
+	value, _ := o.lookup(keys...)
+	n, ok := value.(float64)
+	return n, ok
+}
+
+// list returns the array at keys
+func (o jsonObject) list(keys ...string) ([]interface{}, bool) {
+	value, _ := o.lookup(keys...)
+	items, ok := value.([]interface{})
+	return items, ok
+}
+
+// piiKeys are payload fields that identify the buyer. They are masked when
+// an event is displayed unless the admin asks to reveal them.
+var piiKeys = map[string]bool{
+	"email":          true,
+	"receipt_email":  true,
+	"payer_email":    true,
+	"name":           true,
+	"full_name":      true,
+	"purchaser_name": true,
+	"first_name":     true,
+	"last_name":      true,
+	"phone":          true,
+	"address":        true,
+	"shipping":       true,
+	"ip_address":     true,
+	"ip_country":     true,
+}
+
+const redacted = "[redacted]"
+
+// redactPII returns a copy of a decoded JSON value with the piiKeys masked.
+// Emails keep their domain, which is usually enough to tell buyers apart.
+func redactPII(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		masked := make(map[string]interface{}, len(v))
+		for key, field := range v {
+			if !piiKeys[key] || field == nil {
+				masked[key] = redactPII(field)
+				continue
+			}
+			if s, ok := field.(string); ok && strings.HasSuffix(key, "email") {
+				masked[key] = maskEmail(s)
+			} else {
+				masked[key] = redacted
+			}
+		}
+		return masked
+	case []interface{}:
+		masked := make([]interface{}, len(v))
+		for i, item := range v {
+			masked[i] = redactPII(item)
+		}
+		return masked
+	default:
+		return value
+	}
+}
+
+// maskEmail keeps the first letter and the domain, e.g. j***@example.com
+func maskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		return redacted
+	}
+	return email[:1] + "***" + email[at:]
+}
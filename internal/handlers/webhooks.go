@@ -2,10 +2,14 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"matcha/internal/database"
 	"matcha/internal/models"
 	"matcha/internal/services"
 	"strconv"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
@@ -14,187 +18,482 @@ import (
 type WebhookHandler struct {
 	db           *gorm.DB
 	emailService *services.EmailService
+	processor    *services.WebhookProcessor
+	paypal       *services.PayPalVerifier
 }
 
 func NewWebhookHandler(db *gorm.DB, emailService *services.EmailService) *WebhookHandler {
-	return &WebhookHandler{
+	h := &WebhookHandler{
 		db:           db,
 		emailService: emailService,
+		paypal:       services.NewPayPalVerifier(),
 	}
+	h.processor = services.NewWebhookProcessor(db, h.ProcessEvent)
+	return h
+}
+
+// Processor returns the processor that runs and retries stored webhook events
+func (h *WebhookHandler) Processor() *services.WebhookProcessor {
+	return h.processor
+}
+
+// paymentDetails is what each provider's payload is reduced to before a
+// license key is issued
+type paymentDetails struct {
+	email     string
+	name      string
+	productID string
+	// subscriptionID is the provider subscription the payment belongs to, if any
+	subscriptionID string
+	// amount is in currency's minor unit; currency is empty when the payload
+	// carries no price
+	amount   int64
+	currency string
+	saleID   string
+	// relevant is false for event types that don't represent a completed payment
+	relevant bool
+	// subscriptionEnded marks a cancellation or expiry of subscriptionID
+	// rather than a payment
+	subscriptionEnded bool
+	// sendEmail is whether the buyer is emailed their key. It defaults to on;
+	// a send_email=false passed through the checkout turns it off.
+	sendEmail bool
 }
 
 func (h *WebhookHandler) StripeWebhook(c *fiber.Ctx) error {
+	settings, err := models.GetWebhookSettings(h.db, "stripe")
+	if err != nil {
+		log.Printf("Failed to load stripe webhook settings: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load webhook settings"})
+	}
+	verified := settings.VerifyWith(func(secret string) bool {
+		return services.VerifyStripeSignature(c.Body(), c.Get("Stripe-Signature"), secret, time.Now()) == nil
+	})
+	if !verified {
+		log.Printf("Rejected stripe webhook from %s: signature mismatch", c.IP())
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid webhook signature"})
+	}
+
 	var eventData map[string]interface{}
 	if err := json.Unmarshal(c.Body(), &eventData); err != nil {
 		log.Printf("Stripe webhook error parsing JSON: %v", err)
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON"})
 	}
 
-	eventType, ok := eventData["type"].(string)
-	if !ok {
-		return c.Status(400).JSON(fiber.Map{"error": "Missing event type"})
+	if _, err := extractStripePayment(eventData); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	if eventType == "checkout.session.completed" || eventType == "payment_intent.succeeded" {
-		data, ok := eventData["data"].(map[string]interface{})
-		if !ok {
-			return c.Status(400).JSON(fiber.Map{"error": "Invalid data structure"})
-		}
-
-		object, ok := data["object"].(map[string]interface{})
-		if !ok {
-			return c.Status(400).JSON(fiber.Map{"error": "Invalid object structure"})
-		}
-
-		var email, name, productID string
-
-		// Try to get email from customer_details
-		if customerDetails, ok := object["customer_details"].(map[string]interface{}); ok {
-			if e, ok := customerDetails["email"].(string); ok {
-				email = e
-			}
-			if n, ok := customerDetails["name"].(string); ok {
-				name = n
-			}
-		}
-
-		// Fallback to receipt_email
-		if email == "" {
-			if e, ok := object["receipt_email"].(string); ok {
-				email = e
-			}
-		}
-
-		// Get product ID from metadata
-		if metadata, ok := object["metadata"].(map[string]interface{}); ok {
-			if p, ok := metadata["product_id"].(string); ok {
-				productID = p
-			}
-		}
-
-		if err := h.processSuccessfulPayment(email, name, productID, eventData); err != nil {
-			log.Printf("Stripe webhook processing error: %v", err)
-			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
-		}
-	}
-
-	return c.JSON(fiber.Map{"received": true})
+	return h.storeAndEnqueue(c, "stripe", c.Body())
 }
 
 func (h *WebhookHandler) GumroadWebhook(c *fiber.Ctx) error {
-	email := c.FormValue("email")
-	name := c.FormValue("full_name")
-	if name == "" {
-		name = c.FormValue("purchaser_name")
+	settings, err := models.GetWebhookSettings(h.db, "gumroad")
+	if err != nil {
+		log.Printf("Failed to load gumroad webhook settings: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load webhook settings"})
+	}
+	if !settings.Verify(gumroadSecret(c)) {
+		log.Printf("Rejected gumroad webhook from %s: secret mismatch", c.IP())
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid webhook secret"})
 	}
-	productID := c.FormValue("product_id")
 
 	// Convert form data to map for storage
 	formData := make(map[string]interface{})
 	c.Request().PostArgs().VisitAll(func(key, value []byte) {
 		formData[string(key)] = string(value)
 	})
+	delete(formData, "secret")
 
-	if err := h.processSuccessfulPayment(email, name, productID, formData); err != nil {
-		log.Printf("Gumroad webhook processing error: %v", err)
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	payload, err := json.Marshal(formData)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid form data"})
 	}
 
-	return c.JSON(fiber.Map{"received": true})
+	return h.storeAndEnqueue(c, "gumroad", payload)
+}
+
+// gumroadSecret returns the shared secret sent with a Gumroad ping. Gumroad
+// has no signing of its own, so sellers append it to the ping URL
+// (?secret=...) or send it in the X-Webhook-Secret header.
+func gumroadSecret(c *fiber.Ctx) string {
+	if secret := c.Get("X-Webhook-Secret"); secret != "" {
+		return secret
+	}
+	if secret := c.Query("secret"); secret != "" {
+		return secret
+	}
+	return c.FormValue("secret")
 }
 
 func (h *WebhookHandler) PayPalWebhook(c *fiber.Ctx) error {
+	settings, err := models.GetWebhookSettings(h.db, "paypal")
+	if err != nil {
+		log.Printf("Failed to load paypal webhook settings: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load webhook settings"})
+	}
+	transmission := services.PayPalTransmission{
+		ID:        c.Get("PAYPAL-TRANSMISSION-ID"),
+		Time:      c.Get("PAYPAL-TRANSMISSION-TIME"),
+		Signature: c.Get("PAYPAL-TRANSMISSION-SIG"),
+		CertURL:   c.Get("PAYPAL-CERT-URL"),
+		AuthAlgo:  c.Get("PAYPAL-AUTH-ALGO"),
+	}
+	var verifyErr error
+	verified := settings.VerifyWith(func(webhookID string) bool {
+		verifyErr = h.paypal.Verify(c.Context(), c.Body(), transmission, webhookID)
+		return verifyErr == nil
+	})
+	if !verified {
+		log.Printf("Rejected paypal webhook from %s: %v", c.IP(), verifyErr)
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid webhook signature"})
+	}
+
 	var eventData map[string]interface{}
 	if err := json.Unmarshal(c.Body(), &eventData); err != nil {
 		log.Printf("PayPal webhook error parsing JSON: %v", err)
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON"})
 	}
 
-	eventType, ok := eventData["event_type"].(string)
+	if _, err := extractPayPalPayment(eventData); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return h.storeAndEnqueue(c, "paypal", c.Body())
+}
+
+// storeAndEnqueue persists the raw event and acknowledges it before any
+// processing happens, so a failure later on never loses the event
+func (h *WebhookHandler) storeAndEnqueue(c *fiber.Ctx, provider string, payload []byte) error {
+	event := models.WebhookEvent{
+		Provider: provider,
+		Payload:  string(payload),
+		Status:   models.WebhookStatusPending,
+	}
+
+	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+		return db.Create(&event).Error
+	})
+	if err != nil {
+		log.Printf("Failed to store %s webhook: %v", provider, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store webhook"})
+	}
+
+	h.processor.Enqueue(&event)
+
+	return c.JSON(fiber.Map{"received": true, "event_id": event.ID})
+}
+
+// ProcessEvent issues a license for a stored webhook event. It is safe to call
+// repeatedly: once a key has been created for the event, retries only resend
+// the email.
+func (h *WebhookHandler) ProcessEvent(event *models.WebhookEvent) error {
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(event.Payload), &data); err != nil {
+		return fmt.Errorf("invalid stored payload: %w", err)
+	}
+
+	var details paymentDetails
+	var err error
+	switch event.Provider {
+	case "stripe":
+		details, err = extractStripePayment(data)
+	case "gumroad":
+		details = extractGumroadPayment(data)
+	case "paypal":
+		details, err = extractPayPalPayment(data)
+	default:
+		return fmt.Errorf("unknown webhook provider: %s", event.Provider)
+	}
+	if err != nil {
+		return err
+	}
+
+	if details.subscriptionEnded {
+		return h.processSubscriptionEnded(event, details.subscriptionID)
+	}
+	if !details.relevant {
+		return nil
+	}
+
+	return h.processSuccessfulPayment(event, details)
+}
+
+// extractStripePayment reduces a Stripe event to payment details. Events of
+// types we don't act on are valid but not relevant; an error means the
+// payload is missing fields every handled event has.
+func extractStripePayment(eventData jsonObject) (paymentDetails, error) {
+	var details paymentDetails
+
+	eventType, ok := eventData.str("type")
 	if !ok {
-		return c.Status(400).JSON(fiber.Map{"error": "Missing event type"})
+		return details, errors.New("Missing event type")
 	}
 
-	if eventType == "PAYMENT.SALE.COMPLETED" {
-		resource, ok := eventData["resource"].(map[string]interface{})
-		if !ok {
-			return c.Status(400).JSON(fiber.Map{"error": "Invalid resource structure"})
-		}
+	if eventType != "checkout.session.completed" && eventType != "payment_intent.succeeded" &&
+		eventType != "customer.subscription.deleted" {
+		return details, nil
+	}
 
-		var email, name, productID string
-
-		if payer, ok := resource["payer"].(map[string]interface{}); ok {
-			if payerInfo, ok := payer["payer_info"].(map[string]interface{}); ok {
-				if e, ok := payerInfo["email"].(string); ok {
-					email = e
-				}
-				if fn, ok := payerInfo["first_name"].(string); ok {
-					if ln, ok := payerInfo["last_name"].(string); ok {
-						name = fn + " " + ln
-					} else {
-						name = fn
-					}
-				}
-			}
-		}
+	if _, ok := eventData.object("data"); !ok {
+		return details, errors.New("Invalid data structure")
+	}
+	object, ok := eventData.object("data", "object")
+	if !ok {
+		return details, errors.New("Invalid object structure")
+	}
+
+	if eventType == "customer.subscription.deleted" {
+		details.subscriptionID, _ = object.str("id")
+		details.subscriptionEnded = true
+		return details, nil
+	}
+
+	details.relevant = true
+	sendEmail, _ := object.str("metadata", "send_email")
+	details.sendEmail = sendEmailFlag(sendEmail, true)
+
+	// Checkout sessions in subscription mode carry the subscription ID
+	details.subscriptionID, _ = object.str("subscription")
+
+	// Checkout sessions carry amount_total, payment intents amount_received
+	details.currency, _ = object.str("currency")
+	if amount, ok := object.num("amount_total"); ok {
+		details.amount = int64(amount)
+	} else if amount, ok := object.num("amount_received"); ok {
+		details.amount = int64(amount)
+	}
+	details.saleID, _ = object.str("payment_intent")
+	if details.saleID == "" {
+		details.saleID, _ = object.str("id")
+	}
+
+	// Prefer customer_details, falling back to receipt_email
+	details.email, _ = object.str("customer_details", "email")
+	details.name, _ = object.str("customer_details", "name")
+	if details.email == "" {
+		details.email, _ = object.str("receipt_email")
+	}
+
+	// Get product ID from metadata, falling back to the purchased price so
+	// sessions can be mapped without custom metadata
+	details.productID, _ = object.str("metadata", "product_id")
+	if details.productID == "" {
+		details.productID = stripePriceID(object)
+	}
+
+	return details, nil
+}
+
+// stripePriceID returns the price of the first line item of an expanded
+// checkout session, or "" when the session doesn't carry one
+func stripePriceID(object jsonObject) string {
+	items, _ := object.list("line_items", "data")
+	if len(items) == 0 {
+		return ""
+	}
+	item, _ := items[0].(map[string]interface{})
+	id, _ := jsonObject(item).str("price", "id")
+	return id
+}
+
+func extractGumroadPayment(formData map[string]interface{}) paymentDetails {
+	field := func(key string) string {
+		value, _ := formData[key].(string)
+		return value
+	}
+
+	details := paymentDetails{
+		email:     field("email"),
+		name:      field("full_name"),
+		productID: field("product_id"),
+		// Set on pings for memberships and other recurring products
+		subscriptionID: field("subscription_id"),
+		relevant:       true,
+		sendEmail:      sendEmailFlag(field("send_email"), true),
+	}
+	if details.name == "" {
+		details.name = field("purchaser_name")
+	}
+
+	// Gumroad sends the price in cents, as a string like every other field
+	if price, err := strconv.ParseInt(field("price"), 10, 64); err == nil {
+		details.amount = price
+		details.currency = field("currency")
+	}
+	details.saleID = field("sale_id")
+
+	return details
+}
+
+func extractPayPalPayment(eventData jsonObject) (paymentDetails, error) {
+	var details paymentDetails
+
+	eventType, ok := eventData.str("event_type")
+	if !ok {
+		return details, errors.New("Missing event type")
+	}
+
+	if eventType != "PAYMENT.SALE.COMPLETED" && !isPayPalSubscriptionEnd(eventType) {
+		return details, nil
+	}
+
+	resource, ok := eventData.object("resource")
+	if !ok {
+		return details, errors.New("Invalid resource structure")
+	}
+
+	if isPayPalSubscriptionEnd(eventType) {
+		details.subscriptionID, _ = resource.str("id")
+		details.subscriptionEnded = true
+		return details, nil
+	}
 
-		if custom, ok := resource["custom"].(string); ok {
-			productID = custom
+	details.relevant = true
+	details.sendEmail = true
+
+	// Sales made under a subscription reference it as the billing agreement
+	details.subscriptionID, _ = resource.str("billing_agreement_id")
+
+	details.email, _ = resource.str("payer", "payer_info", "email")
+	if first, ok := resource.str("payer", "payer_info", "first_name"); ok {
+		details.name = first
+		if last, ok := resource.str("payer", "payer_info", "last_name"); ok {
+			details.name = first + " " + last
 		}
+	}
 
-		if err := h.processSuccessfulPayment(email, name, productID, eventData); err != nil {
-			log.Printf("PayPal webhook processing error: %v", err)
-			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	details.productID, _ = resource.str("custom")
+
+	// PayPal sends a decimal string such as "19.99"
+	details.saleID, _ = resource.str("id")
+	if total, ok := resource.str("amount", "total"); ok {
+		currency, _ := resource.str("amount", "currency")
+		if amount, err := models.ParseAmount(total, currency); err == nil {
+			details.amount, details.currency = amount, currency
+		} else {
+			log.Printf("Ignoring PayPal sale %s amount: %v", details.saleID, err)
 		}
 	}
 
-	return c.JSON(fiber.Map{"received": true})
+	return details, nil
 }
 
-func (h *WebhookHandler) processSuccessfulPayment(email, name, productIDStr string, paymentData interface{}) error {
-	if email == "" || productIDStr == "" {
-		log.Printf("Missing email or product ID: email=%s, productID=%s", email, productIDStr)
-		return nil // Don't error out, just log and continue
+func isPayPalSubscriptionEnd(eventType string) bool {
+	return eventType == "BILLING.SUBSCRIPTION.CANCELLED" || eventType == "BILLING.SUBSCRIPTION.EXPIRED"
+}
+
+// processSubscriptionEnded lets the keys paid for by a subscription lapse.
+// The subscription ended without a refund, so the keys are expired rather
+// than revoked.
+func (h *WebhookHandler) processSubscriptionEnded(event *models.WebhookEvent, subscriptionID string) error {
+	if subscriptionID == "" {
+		log.Printf("Missing subscription ID in %s event %d", event.Provider, event.ID)
+		return nil
 	}
 
-	productID, err := strconv.Atoi(productIDStr)
+	var expired int64
+	err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+		var err error
+		expired, err = models.ExpireSubscription(db, subscriptionID, time.Now())
+		return err
+	})
 	if err != nil {
-		log.Printf("Invalid product ID: %s", productIDStr)
-		return nil
+		return err
 	}
 
-	var product models.Product
-	if err := h.db.First(&product, productID).Error; err != nil {
-		log.Printf("Product not found: %d", productID)
+	if expired == 0 {
+		log.Printf("No active license keys for %s subscription %q, skipping event %d", event.Provider, subscriptionID, event.ID)
 		return nil
 	}
+	log.Printf("Expired %d license key(s) for ended %s subscription %q", expired, event.Provider, subscriptionID)
+	return nil
+}
 
-	// Find or create customer
-	customer, err := (&models.Customer{}).FindOrCreateByEmail(h.db, email, name)
-	if err != nil {
-		return err
+func (h *WebhookHandler) processSuccessfulPayment(event *models.WebhookEvent, details paymentDetails) error {
+	email, name, productIDStr := details.email, details.name, details.productID
+	if email == "" || productIDStr == "" {
+		log.Printf("Missing email or product ID: email=%s, productID=%s", email, productIDStr)
+		return nil // Don't error out, just log and continue
 	}
 
-	// Generate license key
-	licenseKey, err := product.GenerateLicenseKeyFor(h.db, customer)
+	product, err := models.ResolveProduct(h.db, event.Provider, productIDStr)
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("No product mapped for %s product %q, skipping event %d", event.Provider, productIDStr, event.ID)
+			return nil
+		}
 		return err
 	}
 
-	// Store payment metadata
-	if paymentData != nil {
-		if data, err := json.Marshal(paymentData); err == nil {
-			licenseKey.Metadata = string(data)
-			h.db.Save(licenseKey)
+	var licenseKey *models.LicenseKey
+	if event.LicenseKeyID != nil {
+		// A previous attempt already issued the key; only the email is outstanding
+		var existing models.LicenseKey
+		if err := h.db.Preload("Product").Preload("Customer").First(&existing, *event.LicenseKeyID).Error; err != nil {
+			return err
+		}
+		licenseKey = &existing
+	} else {
+		// Find or create customer
+		customer, err := (&models.Customer{}).FindOrCreateByEmail(h.db, email, name)
+		if err != nil {
+			return err
+		}
+
+		// Generate license key
+		licenseKey, err = product.GenerateLicenseKeyFor(h.db, customer)
+		if err != nil {
+			return err
+		}
+		licenseKey.Customer = *customer
+		licenseKey.Product = *product
+
+		// Store the sale for revenue reporting and the subscription so a later
+		// cancellation finds the key. The raw payload stays on the event: key
+		// metadata is returned to verify clients, so it only holds the
+		// product's defaults and what admins set.
+		licenseKey.SubscriptionID = details.subscriptionID
+		licenseKey.SaleID = details.saleID
+		if details.currency != "" {
+			licenseKey.Price = details.amount
+			licenseKey.Currency = models.NormalizeCurrency(details.currency)
+		}
+		if licenseKey.SubscriptionID != "" || licenseKey.SaleID != "" || licenseKey.Currency != "" {
+			err := database.PerformWrite(h.db, func(db *gorm.DB) error {
+				return db.Save(licenseKey).Error
+			})
+			if err != nil {
+				log.Printf("Failed to store payment details for license key %d: %v", licenseKey.ID, err)
+			}
+		}
+
+		// Remember the key on the event so retries don't issue a second one
+		event.LicenseKeyID = &licenseKey.ID
+		err = database.PerformWrite(h.db, func(db *gorm.DB) error {
+			return db.Model(event).Update("license_key_id", licenseKey.ID).Error
+		})
+		if err != nil {
+			return err
 		}
+
+		log.Printf("Generated license key %s for %s", licenseKey.Key, email)
+	}
+
+	if event.Simulated {
+		log.Printf("Not emailing license key %s for simulated %s event %d", licenseKey.Key, event.Provider, event.ID)
+		return nil
+	}
+	if !details.sendEmail {
+		log.Printf("Not emailing license key %s: %s event %d asked for no email", licenseKey.Key, event.Provider, event.ID)
+		return nil
 	}
 
-	// Send email with license key
-	if err := h.emailService.SendLicenseKey(customer.Email, licenseKey.Key, product.Name); err != nil {
-		log.Printf("Failed to send license key email: %v", err)
-		// Don't return error here - the license key was created successfully
+	// Send email with license key. With the email queue running this returns
+	// once the email is queued, and a failed delivery shows in the email log.
+	if err := h.emailService.SendLicenseKey(licenseKey); err != nil {
+		return fmt.Errorf("failed to send license key email: %w", err)
 	}
 
-	log.Printf("Generated license key %s for %s", licenseKey.Key, email)
 	return nil
 }
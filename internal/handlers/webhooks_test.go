@@ -0,0 +1,588 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"matcha/internal/config"
+	"matcha/internal/middleware"
+	"matcha/internal/models"
+	"matcha/internal/services"
+	"matcha/internal/testutils"
+)
+
+func gumroadPing(target string, headers map[string]string) *http.Request {
+	form := url.Values{
+		"email":      {"buyer@example.com"},
+		"full_name":  {"Buyer"},
+		"product_id": {"999999"}, // Unknown product, so processing is a no-op
+	}
+	req, _ := http.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	return req
+}
+
+func TestWebhookHandler_GumroadSecret(t *testing.T) {
+	t.Run("No Secret Configured - Accepted", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewWebhookHandler(db, nil)
+		app.Post("/webhooks/gumroad", handler.GumroadWebhook)
+
+		resp, err := app.Test(gumroadPing("/webhooks/gumroad", nil))
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var count int64
+		db.Model(&models.WebhookEvent{}).Count(&count)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("Secret Configured - Valid Secret Accepted", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewWebhookHandler(db, nil)
+		app.Post("/webhooks/gumroad", handler.GumroadWebhook)
+		require.NoError(t, models.SaveWebhookSecret(db, "gumroad", "s3cret"))
+
+		resp, err := app.Test(gumroadPing("/webhooks/gumroad?secret=s3cret", nil))
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		resp, err = app.Test(gumroadPing("/webhooks/gumroad", map[string]string{"X-Webhook-Secret": "s3cret"}))
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		// The secret must not end up in the stored payload
+		var event models.WebhookEvent
+		require.NoError(t, db.First(&event).Error)
+		assert.NotContains(t, event.Payload, "s3cret")
+	})
+
+	t.Run("Secret Configured - Invalid Or Missing Secret Rejected", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewWebhookHandler(db, nil)
+		app.Post("/webhooks/gumroad", handler.GumroadWebhook)
+		require.NoError(t, models.SaveWebhookSecret(db, "gumroad", "s3cret"))
+
+		resp, err := app.Test(gumroadPing("/webhooks/gumroad?secret=wrong", nil))
+		require.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+
+		resp, err = app.Test(gumroadPing("/webhooks/gumroad", nil))
+		require.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+
+		var count int64
+		db.Model(&models.WebhookEvent{}).Count(&count)
+		assert.Equal(t, int64(0), count)
+	})
+
+	t.Run("Secret Rotation - Either Secret Accepted Until Promoted", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewWebhookHandler(db, nil)
+		app.Post("/webhooks/gumroad", handler.GumroadWebhook)
+		require.NoError(t, models.SaveWebhookSecret(db, "gumroad", "old-secret"))
+		require.NoError(t, models.SaveWebhookSecondarySecret(db, "gumroad", "new-secret"))
+
+		for _, secret := range []string{"old-secret", "new-secret"} {
+			resp, err := app.Test(gumroadPing("/webhooks/gumroad", map[string]string{"X-Webhook-Secret": secret}))
+			require.NoError(t, err)
+			assert.Equal(t, 200, resp.StatusCode, "%s should be accepted during the rotation", secret)
+		}
+		resp, err := app.Test(gumroadPing("/webhooks/gumroad?secret=wrong", nil))
+		require.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+
+		require.NoError(t, models.PromoteWebhookSecondarySecret(db, "gumroad"))
+		resp, err = app.Test(gumroadPing("/webhooks/gumroad?secret=old-secret", nil))
+		require.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode, "the old secret stops working once the new one is promoted")
+		resp, err = app.Test(gumroadPing("/webhooks/gumroad?secret=new-secret", nil))
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+	})
+}
+
+// signedStripeRequest posts payload the way Stripe does, signed with secret
+func signedStripeRequest(payload []byte, secret string) *http.Request {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + string(payload)))
+
+	req, _ := http.NewRequest("POST", "/webhooks/stripe", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Stripe-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func TestWebhookHandler_Signatures(t *testing.T) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"type": "checkout.session.completed",
+		"data": map[string]interface{}{"object": map[string]interface{}{}},
+	})
+	require.NoError(t, err)
+
+	t.Run("Stripe - Signed Request Accepted", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewWebhookHandler(db, nil)
+		app.Post("/webhooks/stripe", handler.StripeWebhook)
+		require.NoError(t, models.SaveWebhookSecret(db, "stripe", "whsec_current"))
+		require.NoError(t, models.SaveWebhookSecondarySecret(db, "stripe", "whsec_next"))
+
+		for _, secret := range []string{"whsec_current", "whsec_next"} {
+			resp, err := app.Test(signedStripeRequest(payload, secret))
+			require.NoError(t, err)
+			assert.Equal(t, 200, resp.StatusCode, secret)
+		}
+	})
+
+	t.Run("Stripe - Unsigned Or Forged Request Rejected", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewWebhookHandler(db, nil)
+		app.Post("/webhooks/stripe", handler.StripeWebhook)
+		require.NoError(t, models.SaveWebhookSecret(db, "stripe", "whsec_current"))
+
+		resp, err := app.Test(signedStripeRequest(payload, "whsec_guessed"))
+		require.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+
+		req, _ := http.NewRequest("POST", "/webhooks/stripe", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err = app.Test(req)
+		require.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+
+		var count int64
+		db.Model(&models.WebhookEvent{}).Count(&count)
+		assert.Zero(t, count)
+	})
+
+	t.Run("PayPal - Unsigned Request Rejected Once Webhook ID Is Set", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewWebhookHandler(db, nil)
+		app.Post("/webhooks/paypal", handler.PayPalWebhook)
+
+		body := `{"event_type":"PAYMENT.SALE.COMPLETED","resource":{}}`
+		post := func(headers map[string]string) int {
+			req, _ := http.NewRequest("POST", "/webhooks/paypal", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			for name, value := range headers {
+				req.Header.Set(name, value)
+			}
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			return resp.StatusCode
+		}
+
+		assert.Equal(t, 200, post(nil), "accepted unchecked until a webhook ID is configured")
+
+		require.NoError(t, models.SaveWebhookSecret(db, "paypal", "WH-123"))
+		assert.Equal(t, 401, post(nil))
+		assert.Equal(t, 401, post(map[string]string{
+			"PAYPAL-TRANSMISSION-ID":   "tx-1",
+			"PAYPAL-TRANSMISSION-TIME": "2024-03-01T12:00:00Z",
+			"PAYPAL-TRANSMISSION-SIG":  "c2lnbmF0dXJl",
+			"PAYPAL-CERT-URL":          "https://attacker.example.com/cert.pem",
+			"PAYPAL-AUTH-ALGO":         "SHA256withRSA",
+		}), "a certificate from outside paypal.com is never trusted")
+	})
+}
+
+func stripeCheckoutEvent(t *testing.T, priceID string) *models.WebhookEvent {
+	payload, err := json.Marshal(map[string]interface{}{
+		"type": "checkout.session.completed",
+		"data": map[string]interface{}{
+			"object": map[string]interface{}{
+				"customer_details": map[string]interface{}{"email": "buyer@example.com", "name": "Buyer"},
+				"line_items": map[string]interface{}{
+					"data": []interface{}{
+						map[string]interface{}{"price": map[string]interface{}{"id": priceID}},
+					},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	return &models.WebhookEvent{Provider: "stripe", Payload: string(payload), Status: models.WebhookStatusPending}
+}
+
+func TestWebhookHandler_BodyLimit(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	app := testutils.SetupTestAppWithDB(t, db)
+	handler := NewWebhookHandler(db, nil)
+	app.Post("/webhooks/stripe", middleware.BodyLimit(config.DefaultWebhookBodyLimit), handler.StripeWebhook)
+
+	// A JSON string padded past the limit, the way a flood would arrive
+	payload := `{"type": "checkout.session.completed", "padding": "` + strings.Repeat("x", config.DefaultWebhookBodyLimit) + `"}`
+	req, _ := http.NewRequest("POST", "/webhooks/stripe", strings.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	require.NoError(t, err)
+	assert.Equal(t, 413, resp.StatusCode)
+
+	var count int64
+	db.Model(&models.WebhookEvent{}).Count(&count)
+	assert.Zero(t, count, "an oversized webhook must not be stored")
+}
+
+func TestWebhookHandler_MalformedPayloads(t *testing.T) {
+	post := func(t *testing.T, target, payload string) (int, map[string]interface{}) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewWebhookHandler(db, nil)
+		app.Post("/webhooks/stripe", handler.StripeWebhook)
+		app.Post("/webhooks/paypal", handler.PayPalWebhook)
+
+		req, _ := http.NewRequest("POST", target, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp.StatusCode, body
+	}
+
+	t.Run("Stripe - Missing data.object Rejected", func(t *testing.T) {
+		status, body := post(t, "/webhooks/stripe", `{"type": "checkout.session.completed", "data": {}}`)
+		assert.Equal(t, 400, status)
+		assert.Equal(t, "Invalid object structure", body["error"])
+	})
+
+	t.Run("Stripe - Wrongly Typed Fields Rejected", func(t *testing.T) {
+		status, _ := post(t, "/webhooks/stripe", `{"type": "checkout.session.completed", "data": "oops"}`)
+		assert.Equal(t, 400, status)
+
+		status, _ = post(t, "/webhooks/stripe", `{"type": 42}`)
+		assert.Equal(t, 400, status)
+
+		status, _ = post(t, "/webhooks/stripe", `[1, 2, 3]`)
+		assert.Equal(t, 400, status)
+	})
+
+	t.Run("Stripe - Unhandled Event Type Acknowledged", func(t *testing.T) {
+		status, body := post(t, "/webhooks/stripe", `{"type": "invoice.created", "data": "not inspected"}`)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, true, body["received"])
+	})
+
+	t.Run("Stripe - Odd Optional Fields Ignored", func(t *testing.T) {
+		payload := `{"type": "checkout.session.completed", "data": {"object": {
+			"customer_details": "not an object",
+			"metadata": {"product_id": 7},
+			"line_items": {"data": ["not an object"]}
+		}}}`
+		status, _ := post(t, "/webhooks/stripe", payload)
+		assert.Equal(t, 200, status)
+	})
+
+	t.Run("PayPal - Missing Resource Rejected", func(t *testing.T) {
+		status, body := post(t, "/webhooks/paypal", `{"event_type": "PAYMENT.SALE.COMPLETED"}`)
+		assert.Equal(t, 400, status)
+		assert.Equal(t, "Invalid resource structure", body["error"])
+	})
+
+	t.Run("PayPal - Unhandled Event Type Acknowledged", func(t *testing.T) {
+		status, _ := post(t, "/webhooks/paypal", `{"event_type": "CHECKOUT.ORDER.APPROVED"}`)
+		assert.Equal(t, 200, status)
+	})
+}
+
+func TestWebhookHandler_ProductMappings(t *testing.T) {
+	t.Run("Stripe Price ID Resolves To Mapped Product", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		handler := NewWebhookHandler(db, services.NewEmailService(&config.Config{}, db))
+
+		other := models.Product{Name: "Other Product"}
+		require.NoError(t, db.Create(&other).Error)
+		product := models.Product{Name: "Pro Plan"}
+		require.NoError(t, db.Create(&product).Error)
+		require.NoError(t, db.Create(&models.ProductMapping{Provider: "stripe", ExternalID: "price_pro", ProductID: product.ID}).Error)
+
+		event := stripeCheckoutEvent(t, "price_pro")
+		require.NoError(t, db.Create(event).Error)
+
+		// No email settings are configured, so only the send step fails
+		err := handler.ProcessEvent(event)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "email")
+
+		var keys []models.LicenseKey
+		require.NoError(t, db.Find(&keys).Error)
+		require.Len(t, keys, 1)
+		assert.Equal(t, product.ID, keys[0].ProductID)
+	})
+
+	t.Run("Unmapped ID Is Logged And Skipped", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		handler := NewWebhookHandler(db, services.NewEmailService(&config.Config{}, db))
+
+		product := models.Product{Name: "Pro Plan"}
+		require.NoError(t, db.Create(&product).Error)
+
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(os.Stderr)
+
+		event := stripeCheckoutEvent(t, "price_unknown")
+		require.NoError(t, db.Create(event).Error)
+		assert.NoError(t, handler.ProcessEvent(event))
+		assert.Contains(t, logs.String(), "price_unknown")
+
+		var count int64
+		db.Model(&models.LicenseKey{}).Count(&count)
+		assert.Equal(t, int64(0), count)
+	})
+}
+
+func stripeEvent(t *testing.T, eventType string, object map[string]interface{}) *models.WebhookEvent {
+	payload, err := json.Marshal(map[string]interface{}{
+		"type": eventType,
+		"data": map[string]interface{}{"object": object},
+	})
+	require.NoError(t, err)
+	return &models.WebhookEvent{Provider: "stripe", Payload: string(payload), Status: models.WebhookStatusPending}
+}
+
+func TestWebhookHandler_Subscriptions(t *testing.T) {
+	t.Run("Stripe Subscription Created Then Deleted", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		handler := NewWebhookHandler(db, services.NewEmailService(&config.Config{}, db))
+
+		product := models.Product{Name: "Monthly Plan", DefaultExpirationDays: 365}
+		require.NoError(t, db.Create(&product).Error)
+		require.NoError(t, db.Create(&models.ProductMapping{Provider: "stripe", ExternalID: "price_monthly", ProductID: product.ID}).Error)
+
+		created := stripeEvent(t, "checkout.session.completed", map[string]interface{}{
+			"mode":             "subscription",
+			"subscription":     "sub_123",
+			"customer_details": map[string]interface{}{"email": "buyer@example.com", "name": "Buyer"},
+			"line_items": map[string]interface{}{
+				"data": []interface{}{map[string]interface{}{"price": map[string]interface{}{"id": "price_monthly"}}},
+			},
+		})
+		require.NoError(t, db.Create(created).Error)
+		// No email settings are configured, so only the send step fails
+		require.Error(t, handler.ProcessEvent(created))
+
+		var key models.LicenseKey
+		require.NoError(t, db.First(&key).Error)
+		assert.Equal(t, "sub_123", key.SubscriptionID)
+		assert.Equal(t, "active", key.Status)
+
+		// A key on another subscription must be left alone
+		other := models.LicenseKey{Key: "OTHER-SUB", ProductID: product.ID, CustomerID: key.CustomerID, Status: "active", SubscriptionID: "sub_456"}
+		require.NoError(t, db.Create(&other).Error)
+
+		deleted := stripeEvent(t, "customer.subscription.deleted", map[string]interface{}{"id": "sub_123", "object": "subscription"})
+		require.NoError(t, db.Create(deleted).Error)
+		require.NoError(t, handler.ProcessEvent(deleted))
+
+		require.NoError(t, db.First(&key, key.ID).Error)
+		assert.Equal(t, "expired", key.Status)
+		assert.True(t, key.IsExpired())
+		assert.Equal(t, "expired", key.InvalidReason())
+
+		require.NoError(t, db.First(&other, other.ID).Error)
+		assert.Equal(t, "active", other.Status)
+	})
+
+	t.Run("PayPal Subscription Cancelled", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		handler := NewWebhookHandler(db, nil)
+
+		product := models.Product{Name: "Monthly Plan"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "Buyer", Email: "buyer@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+		key := models.LicenseKey{Key: "PAYPAL-SUB", ProductID: product.ID, CustomerID: customer.ID, Status: "active", SubscriptionID: "I-BW452GLLEP1G"}
+		require.NoError(t, db.Create(&key).Error)
+
+		payload, err := json.Marshal(map[string]interface{}{
+			"event_type": "BILLING.SUBSCRIPTION.CANCELLED",
+			"resource":   map[string]interface{}{"id": "I-BW452GLLEP1G", "status": "CANCELLED"},
+		})
+		require.NoError(t, err)
+		event := &models.WebhookEvent{Provider: "paypal", Payload: string(payload), Status: models.WebhookStatusPending}
+		require.NoError(t, db.Create(event).Error)
+		require.NoError(t, handler.ProcessEvent(event))
+
+		require.NoError(t, db.First(&key, key.ID).Error)
+		assert.Equal(t, "expired", key.Status)
+	})
+
+	t.Run("Forged Cancellations Rejected Once Signing Is Configured", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		app := testutils.SetupTestAppWithDB(t, db)
+		handler := NewWebhookHandler(db, nil)
+		app.Post("/webhooks/stripe", handler.StripeWebhook)
+		app.Post("/webhooks/paypal", handler.PayPalWebhook)
+		require.NoError(t, models.SaveWebhookSecret(db, "stripe", "whsec_current"))
+		require.NoError(t, models.SaveWebhookSecret(db, "paypal", "WH-123"))
+
+		product := models.Product{Name: "Monthly Plan"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "Buyer", Email: "buyer@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+		stripeKey := models.LicenseKey{Key: "STRIPE-SUB", ProductID: product.ID, CustomerID: customer.ID, Status: "active", SubscriptionID: "sub_123"}
+		require.NoError(t, db.Create(&stripeKey).Error)
+		paypalKey := models.LicenseKey{Key: "PAYPAL-SUB", ProductID: product.ID, CustomerID: customer.ID, Status: "active", SubscriptionID: "I-BW452GLLEP1G"}
+		require.NoError(t, db.Create(&paypalKey).Error)
+
+		stripePayload, err := json.Marshal(map[string]interface{}{
+			"type": "customer.subscription.deleted",
+			"data": map[string]interface{}{"object": map[string]interface{}{"id": "sub_123", "object": "subscription"}},
+		})
+		require.NoError(t, err)
+		resp, err := app.Test(signedStripeRequest(stripePayload, "whsec_guessed"))
+		require.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+
+		paypalPayload := `{"event_type":"BILLING.SUBSCRIPTION.CANCELLED","resource":{"id":"I-BW452GLLEP1G","status":"CANCELLED"}}`
+		req, _ := http.NewRequest("POST", "/webhooks/paypal", strings.NewReader(paypalPayload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err = app.Test(req)
+		require.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+
+		// Nothing was stored, so no retry can act on the forged events later
+		handler.Processor().Wait()
+		var count int64
+		db.Model(&models.WebhookEvent{}).Count(&count)
+		assert.Zero(t, count)
+		for _, key := range []models.LicenseKey{stripeKey, paypalKey} {
+			require.NoError(t, db.First(&key, key.ID).Error)
+			assert.Equal(t, "active", key.Status, key.Key)
+		}
+
+		// The genuine Stripe cancellation still goes through
+		resp, err = app.Test(signedStripeRequest(stripePayload, "whsec_current"))
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		handler.Processor().Wait()
+		require.NoError(t, db.First(&stripeKey, stripeKey.ID).Error)
+		assert.Equal(t, "expired", stripeKey.Status)
+	})
+}
+
+func TestWebhookHandler_RecordsSale(t *testing.T) {
+	t.Run("Stripe Checkout Stores Amount And Currency", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		handler := NewWebhookHandler(db, services.NewEmailService(&config.Config{}, db))
+
+		product := models.Product{Name: "Pro Plan"}
+		require.NoError(t, db.Create(&product).Error)
+		require.NoError(t, db.Create(&models.ProductMapping{Provider: "stripe", ExternalID: "price_pro", ProductID: product.ID}).Error)
+
+		event := stripeEvent(t, "checkout.session.completed", map[string]interface{}{
+			"id":               "cs_test_123",
+			"payment_intent":   "pi_123",
+			"amount_total":     4900,
+			"currency":         "eur",
+			"customer_details": map[string]interface{}{"email": "buyer@example.com", "name": "Buyer"},
+			"line_items": map[string]interface{}{
+				"data": []interface{}{map[string]interface{}{"price": map[string]interface{}{"id": "price_pro"}}},
+			},
+		})
+		require.NoError(t, db.Create(event).Error)
+		// No email settings are configured, so only the send step fails
+		require.Error(t, handler.ProcessEvent(event))
+
+		var key models.LicenseKey
+		require.NoError(t, db.First(&key).Error)
+		assert.Equal(t, int64(4900), key.Price)
+		assert.Equal(t, "EUR", key.Currency)
+		assert.Equal(t, "pi_123", key.SaleID)
+		assert.Empty(t, key.GetMetadataMap(), "key metadata is returned to verify clients, so the raw payload must stay out of it")
+	})
+
+	t.Run("PayPal Sale Amount Converted To Minor Units", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+		handler := NewWebhookHandler(db, services.NewEmailService(&config.Config{}, db))
+
+		product := models.Product{Name: "Pro Plan"}
+		require.NoError(t, db.Create(&product).Error)
+
+		payload, err := json.Marshal(map[string]interface{}{
+			"event_type": "PAYMENT.SALE.COMPLETED",
+			"resource": map[string]interface{}{
+				"id":     "SALE-1",
+				"custom": strconv.Itoa(int(product.ID)),
+				"amount": map[string]interface{}{"total": "19.99", "currency": "USD"},
+				"payer":  map[string]interface{}{"payer_info": map[string]interface{}{"email": "buyer@example.com"}},
+			},
+		})
+		require.NoError(t, err)
+		event := &models.WebhookEvent{Provider: "paypal", Payload: string(payload), Status: models.WebhookStatusPending}
+		require.NoError(t, db.Create(event).Error)
+		require.Error(t, handler.ProcessEvent(event))
+
+		var key models.LicenseKey
+		require.NoError(t, db.First(&key).Error)
+		assert.Equal(t, int64(1999), key.Price)
+		assert.Equal(t, "USD", key.Currency)
+		assert.Equal(t, "SALE-1", key.SaleID)
+	})
+}
+
+func TestWebhookHandler_SendEmailFlag(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	handler := NewWebhookHandler(db, services.NewEmailService(&config.Config{}, db))
+
+	product := models.Product{Name: "Pro Plan"}
+	require.NoError(t, db.Create(&product).Error)
+	productID := strconv.Itoa(int(product.ID))
+
+	checkout := func(metadata map[string]interface{}) *models.WebhookEvent {
+		metadata["product_id"] = productID
+		event := stripeEvent(t, "checkout.session.completed", map[string]interface{}{
+			"customer_details": map[string]interface{}{"email": "buyer@example.com"},
+			"metadata":         metadata,
+		})
+		require.NoError(t, db.Create(event).Error)
+		return event
+	}
+	emails := func() int64 {
+		var count int64
+		db.Model(&models.EmailLog{}).Count(&count)
+		return count
+	}
+
+	t.Run("Emailed By Default", func(t *testing.T) {
+		// No email settings are configured, so the attempt fails and is logged
+		err := handler.ProcessEvent(checkout(map[string]interface{}{}))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "email")
+		assert.Equal(t, int64(1), emails())
+	})
+
+	t.Run("Checkout Opts Out", func(t *testing.T) {
+		event := checkout(map[string]interface{}{"send_email": "false"})
+		require.NoError(t, handler.ProcessEvent(event))
+		assert.NotNil(t, event.LicenseKeyID, "the key is still issued")
+		assert.Equal(t, int64(1), emails())
+	})
+}
@@ -1,8 +1,12 @@
 package middleware
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	"matcha/internal/config"
@@ -12,45 +16,108 @@ import (
 	"gorm.io/gorm"
 )
 
+// adminPath is the prefix the admin panel is mounted under, set by InitAuth
+var adminPath = config.DefaultAdminPath
+
+// AdminPath returns the prefix the admin panel is mounted under
+func AdminPath() string {
+	return adminPath
+}
+
+// AdminURL returns path, e.g. "/login", below the admin prefix
+func AdminURL(path string) string {
+	return adminPath + path
+}
+
+// ChangePasswordPath is the only protected page reachable while an admin is
+// required to change their password
+func ChangePasswordPath() string {
+	return AdminURL("/password")
+}
+
+// Session cookie defaults, overridden from the config by InitAuth
+const (
+	defaultCookieSameSite = "Lax"
+	defaultSessionTTL     = 30 * 24 * time.Hour
+)
+
+var (
+	cookieSecure   = false
+	cookieSameSite = defaultCookieSameSite
+	sessionTTL     = defaultSessionTTL
+)
+
+// multiTenant scopes admins to their owner ID, set by InitAuth
+var multiTenant = false
+
 func InitAuth(cfg *config.Config) {
-	log.Printf("Initializing auth with SecretKey: %s", cfg.SecretKey)
-	// secretKey currently unused but kept for future JWT implementation
+	log.Printf("Initializing auth with SecretKey: %s, secure cookies: %v, session TTL: %s", config.Redact(cfg.SecretKey), cfg.CookieSecure, cfg.SessionTTL)
+	cookieKey = []byte(cfg.SecretKey)
+	cookieSecure = cfg.CookieSecure
+
+	cookieSameSite = cfg.CookieSameSite
+	if cookieSameSite == "" {
+		cookieSameSite = defaultCookieSameSite
+	}
+	sessionTTL = cfg.SessionTTL
+	if sessionTTL <= 0 {
+		sessionTTL = defaultSessionTTL
+	}
+	adminPath = cfg.AdminPath
+	if adminPath == "" {
+		adminPath = config.DefaultAdminPath
+	}
+	multiTenant = cfg.MultiTenant
 }
 
 func RequireAuth(c *fiber.Ctx) error {
 	log.Printf("RequireAuth: Checking authentication for path: %s, method: %s", c.Path(), c.Method())
 
 	// Get admin ID from cookie
-	adminIDStr := c.Cookies("admin_user_id")
-	if adminIDStr == "" {
-		log.Printf("RequireAuth: No admin_user_id cookie, redirecting to login")
-		return c.Redirect("/admin/login")
+	session := c.Cookies(sessionCookie)
+	if session == "" {
+		log.Printf("RequireAuth: No %s cookie, redirecting to login", sessionCookie)
+		return c.Redirect(AdminURL("/login"))
 	}
 
-	adminID, err := strconv.ParseUint(adminIDStr, 10, 32)
-	if err != nil {
-		log.Printf("RequireAuth: Invalid admin_user_id cookie: %v", err)
-		c.ClearCookie("admin_user_id")
-		return c.Redirect("/admin/login")
+	adminID, ok := parseSessionID(session)
+	if !ok {
+		log.Printf("RequireAuth: Invalid or unsigned %s cookie", sessionCookie)
+		c.ClearCookie(sessionCookie)
+		return c.Redirect(AdminURL("/login"))
 	}
 
 	// Get database from context
 	db, ok := c.Locals("db").(*gorm.DB)
 	if !ok {
 		log.Printf("RequireAuth: Could not get database from context")
-		return c.Redirect("/admin/login")
+		return c.Redirect(AdminURL("/login"))
 	}
 
 	// Verify admin still exists
 	var admin models.AdminUser
-	if err := db.First(&admin, uint(adminID)).Error; err != nil {
+	if err := db.First(&admin, adminID).Error; err != nil {
 		log.Printf("RequireAuth: Admin user not found in database: %v", err)
-		c.ClearCookie("admin_user_id")
-		return c.Redirect("/admin/login")
+		c.ClearCookie(sessionCookie)
+		return c.Redirect(AdminURL("/login"))
 	}
 
 	log.Printf("RequireAuth: Authentication successful for admin: %s", admin.Username)
 	c.Locals("current_admin", &admin)
+	_ = c.Bind(fiber.Map{"Theme": admin.UITheme(), "AdminRole": admin.AdminRole(), "TenantScoped": CurrentOwnerID(c) != nil})
+
+	// Admins still on a bootstrap password must replace it before anything else
+	if admin.MustChangePassword && c.Path() != ChangePasswordPath() {
+		log.Printf("RequireAuth: Admin %s must change password, redirecting", admin.Username)
+		return c.Redirect(ChangePasswordPath())
+	}
+
+	// Readonly admins can look at everything but change nothing except
+	// their own account
+	if admin.AdminRole() == models.RoleReadonly && !readonlyAllowed(c) {
+		return forbidden(c)
+	}
+
 	return c.Next()
 }
 
@@ -62,15 +129,76 @@ func GetCurrentAdmin(c *fiber.Ctx) *models.AdminUser {
 	return admin
 }
 
+// CurrentOwnerID returns the tenant the current admin is confined to, or nil
+// when they may see every record: multi-tenancy is off, or the admin has no
+// owner ID
+func CurrentOwnerID(c *fiber.Ctx) *uint {
+	if !multiTenant {
+		return nil
+	}
+	if admin := GetCurrentAdmin(c); admin != nil {
+		return admin.OwnerID
+	}
+	return nil
+}
+
+// RequireUnscoped refuses tenant admins, see CurrentOwnerID, with a 403. It
+// guards instance-wide pages whose records belong to no tenant, such as
+// webhook events and secrets. It goes after RequireAuth.
+func RequireUnscoped(c *fiber.Ctx) error {
+	if CurrentOwnerID(c) != nil {
+		log.Printf("Forbidden: tenant admin may not %s %s", c.Method(), c.Path())
+		return c.Status(fiber.StatusForbidden).SendString("This page is not available to tenant admins")
+	}
+	return c.Next()
+}
+
+// sessionCookie holds the signed-in admin's ID, see SignedSessionID
+const sessionCookie = "admin_user_id"
+
+// SignedSessionID is the session cookie's value for adminID: the ID and an
+// HMAC of it, so editing the cookie can't sign a client in as another admin
+func SignedSessionID(adminID uint) string {
+	id := strconv.FormatUint(uint64(adminID), 10)
+	return id + "." + signSession(id)
+}
+
+// SessionCookie is a Cookie header signing adminID in, for tests that call
+// admin pages directly
+func SessionCookie(adminID uint) string {
+	return sessionCookie + "=" + SignedSessionID(adminID)
+}
+
+func parseSessionID(value string) (uint, bool) {
+	id, signature, found := strings.Cut(value, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(signSession(id))) {
+		return 0, false
+	}
+	adminID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint(adminID), true
+}
+
+// signSession signs with the flash cookies' key; the prefix keeps a flash
+// signature from passing as a session one
+func signSession(id string) string {
+	mac := hmac.New(sha256.New, cookieKey)
+	mac.Write([]byte("session\n" + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
 func Login(c *fiber.Ctx, adminID uint) error {
 	// Set persistent cookie
 	c.Cookie(&fiber.Cookie{
-		Name:     "admin_user_id",
-		Value:    strconv.FormatUint(uint64(adminID), 10),
-		Expires:  time.Now().Add(30 * 24 * time.Hour), // 30 days
+		Name:     sessionCookie,
+		Value:    SignedSessionID(adminID),
+		Expires:  time.Now().Add(sessionTTL),
+		MaxAge:   int(sessionTTL.Seconds()),
 		HTTPOnly: true,
-		Secure:   false, // Set to true in production with HTTPS
-		SameSite: "Lax",
+		Secure:   cookieSecure,
+		SameSite: cookieSameSite,
 		Path:     "/",
 	})
 
@@ -80,6 +208,6 @@ func Login(c *fiber.Ctx, adminID uint) error {
 
 func Logout(c *fiber.Ctx) error {
 	// Clear the cookie
-	c.ClearCookie("admin_user_id")
+	c.ClearCookie(sessionCookie)
 	return nil
 }
@@ -0,0 +1,221 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"matcha/internal/config"
+	"matcha/internal/models"
+	"matcha/internal/testutils"
+)
+
+func TestRequireAuth_ForcesPasswordChange(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+
+	_, err := models.CreateDefaultAdmin(db, "admin", "bootstrap-pass")
+	require.NoError(t, err)
+	var admin models.AdminUser
+	require.NoError(t, db.Where("username = ?", "admin").First(&admin).Error)
+	require.True(t, admin.MustChangePassword, "fresh admin should be flagged")
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("db", db)
+		return c.Next()
+	})
+	ok := func(c *fiber.Ctx) error { return c.SendString("OK") }
+	app.Get("/admin/products", RequireAuth, ok)
+	app.Get(ChangePasswordPath(), RequireAuth, ok)
+
+	get := func(path string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Cookie", SessionCookie(admin.ID))
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode, resp.Header.Get("Location")
+	}
+
+	status, location := get("/admin/products")
+	assert.Equal(t, 302, status)
+	assert.Equal(t, ChangePasswordPath(), location)
+
+	status, _ = get(ChangePasswordPath())
+	assert.Equal(t, 200, status, "change-password page must stay reachable")
+
+	require.NoError(t, admin.ChangePassword(db, "a-new-password"))
+
+	status, _ = get("/admin/products")
+	assert.Equal(t, 200, status, "protected pages load once the password is changed")
+}
+
+func TestRequireAuth_EnforcesRoles(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("db", db)
+		return c.Next()
+	})
+	ok := func(c *fiber.Ctx) error { return c.SendString("OK") }
+	app.Get("/admin/license-keys", RequireAuth, ok)
+	app.Post("/admin/license-keys/:id/revoke", RequireAuth, ok)
+	app.Post(ChangePasswordPath(), RequireAuth, ok)
+	app.Get("/admin/settings/email", RequireAuth, RequireOwner, ok)
+
+	request := func(admin models.AdminUser, method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Cookie", SessionCookie(admin.ID))
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+	adminWithRole := func(username, role string) models.AdminUser {
+		admin := models.AdminUser{Username: username, PasswordHash: "x", Role: role}
+		require.NoError(t, db.Create(&admin).Error)
+		return admin
+	}
+
+	t.Run("Readonly - Can Read But Not Change", func(t *testing.T) {
+		readonly := adminWithRole("auditor", models.RoleReadonly)
+		assert.Equal(t, 200, request(readonly, "GET", "/admin/license-keys"))
+		assert.Equal(t, 403, request(readonly, "POST", "/admin/license-keys/1/revoke"))
+		assert.Equal(t, 200, request(readonly, "POST", ChangePasswordPath()), "own password stays changeable")
+	})
+
+	t.Run("Support - Cannot Manage Email Settings", func(t *testing.T) {
+		support := adminWithRole("helpdesk", models.RoleSupport)
+		assert.Equal(t, 200, request(support, "POST", "/admin/license-keys/1/revoke"))
+		assert.Equal(t, 403, request(support, "GET", "/admin/settings/email"))
+	})
+
+	t.Run("Owner - Full Access", func(t *testing.T) {
+		owner := adminWithRole("boss", models.RoleOwner)
+		assert.Equal(t, 200, request(owner, "POST", "/admin/license-keys/1/revoke"))
+		assert.Equal(t, 200, request(owner, "GET", "/admin/settings/email"))
+
+		legacy := adminWithRole("old-admin", "admin")
+		assert.Equal(t, 200, request(legacy, "GET", "/admin/settings/email"), "admins from before roles keep full access")
+	})
+}
+
+func TestRequireUnscoped(t *testing.T) {
+	defer InitAuth(&config.Config{})
+	db := testutils.SetupTestDB(t)
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("db", db)
+		return c.Next()
+	})
+	app.Get("/admin/webhooks", RequireAuth, RequireUnscoped, func(c *fiber.Ctx) error { return c.SendString("OK") })
+
+	acme := uint(1)
+	tenant := models.AdminUser{Username: "acme-reseller", PasswordHash: "x", OwnerID: &acme}
+	require.NoError(t, db.Create(&tenant).Error)
+	unscoped := models.AdminUser{Username: "boss", PasswordHash: "x"}
+	require.NoError(t, db.Create(&unscoped).Error)
+
+	request := func(admin models.AdminUser) int {
+		req := httptest.NewRequest("GET", "/admin/webhooks", nil)
+		req.Header.Set("Cookie", SessionCookie(admin.ID))
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	InitAuth(&config.Config{MultiTenant: true})
+	assert.Equal(t, 403, request(tenant))
+	assert.Equal(t, 200, request(unscoped))
+
+	InitAuth(&config.Config{})
+	assert.Equal(t, 200, request(tenant), "owner IDs are ignored when multi-tenancy is off")
+}
+
+func TestRequireAuth_RejectsUnsignedSession(t *testing.T) {
+	defer InitAuth(&config.Config{})
+	InitAuth(&config.Config{SecretKey: "session-signing-secret"})
+	db := testutils.SetupTestDB(t)
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("db", db)
+		return c.Next()
+	})
+	app.Get("/admin/products", RequireAuth, func(c *fiber.Ctx) error { return c.SendString("OK") })
+
+	admin := models.AdminUser{Username: "boss", PasswordHash: "x"}
+	require.NoError(t, db.Create(&admin).Error)
+
+	get := func(cookie string) int {
+		req := httptest.NewRequest("GET", "/admin/products", nil)
+		req.Header.Set("Cookie", cookie)
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	signed := SessionCookie(admin.ID)
+	assert.Equal(t, 200, get(signed))
+
+	_, signature, _ := strings.Cut(SignedSessionID(admin.ID), ".")
+	for name, cookie := range map[string]string{
+		"bare ID":            "admin_user_id=" + strconv.Itoa(int(admin.ID)),
+		"another admin's ID": "admin_user_id=" + strconv.Itoa(int(admin.ID)+1) + "." + signature,
+		"bad signature":      "admin_user_id=" + strconv.Itoa(int(admin.ID)) + ".forged",
+	} {
+		assert.Equal(t, 302, get(cookie), name)
+	}
+
+	// Rotating SECRET_KEY signs everyone out
+	InitAuth(&config.Config{SecretKey: "rotated-secret"})
+	assert.Equal(t, 302, get(signed))
+}
+
+func TestLogin_CookieFlagsFollowConfig(t *testing.T) {
+	defer InitAuth(&config.Config{})
+
+	setCookie := func(cfg *config.Config) string {
+		InitAuth(cfg)
+		app := fiber.New()
+		app.Get("/login", func(c *fiber.Ctx) error {
+			return Login(c, 1)
+		})
+		resp, err := app.Test(httptest.NewRequest("GET", "/login", nil))
+		require.NoError(t, err)
+		return strings.ToLower(resp.Header.Get("Set-Cookie"))
+	}
+
+	production := setCookie(&config.Config{Environment: "production", CookieSecure: true, CookieSameSite: "Strict"})
+	assert.Contains(t, production, strings.ToLower(SessionCookie(1)))
+	assert.Contains(t, production, "secure")
+	assert.Contains(t, production, "samesite=strict")
+
+	development := setCookie(&config.Config{Environment: "development"})
+	assert.Contains(t, development, strings.ToLower(SessionCookie(1)))
+	assert.NotContains(t, development, "secure")
+	assert.Contains(t, development, "samesite=lax")
+}
+
+func TestLogin_CookieLifetimeFollowsSessionTTL(t *testing.T) {
+	defer InitAuth(&config.Config{})
+	InitAuth(&config.Config{SessionTTL: 90 * time.Minute})
+
+	app := fiber.New()
+	app.Get("/login", func(c *fiber.Ctx) error {
+		return Login(c, 1)
+	})
+	resp, err := app.Test(httptest.NewRequest("GET", "/login", nil))
+	require.NoError(t, err)
+
+	cookies := resp.Cookies()
+	require.Len(t, cookies, 1)
+	// fasthttp sends Max-Age in place of Expires when both are set
+	assert.Equal(t, 5400, cookies[0].MaxAge)
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBodyLimit(t *testing.T) {
+	app := fiber.New()
+	app.Post("/", BodyLimit(16), func(c *fiber.Ctx) error {
+		return c.SendString("OK")
+	})
+
+	post := func(body string) int {
+		resp, err := app.Test(httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, 200, post("small body"))
+	assert.Equal(t, 200, post(strings.Repeat("x", 16)), "a body at the limit is accepted")
+	assert.Equal(t, 413, post(strings.Repeat("x", 17)))
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+
+	"matcha/internal/config"
+)
+
+// CORS applies the cross-origin policy from cfg.AllowedOrigins. A wildcard
+// answers every origin without credentials; an explicit list reflects only the
+// matching origin and allows cookies. With no origins configured, cross-origin
+// requests get no CORS headers at all.
+func CORS(cfg *config.Config) fiber.Handler {
+	corsConfig := cors.Config{
+		AllowHeaders: "Origin, Content-Type, Accept, Authorization, X-API-Key",
+		AllowMethods: "GET, POST, PUT, DELETE, OPTIONS",
+	}
+
+	switch {
+	case cfg.AllowsAnyOrigin():
+		corsConfig.AllowOrigins = "*"
+	case len(cfg.AllowedOrigins) > 0:
+		corsConfig.AllowOrigins = strings.Join(cfg.AllowedOrigins, ",")
+		corsConfig.AllowCredentials = true
+	default:
+		// An empty AllowOrigins would fall back to "*", so reject explicitly
+		corsConfig.AllowOriginsFunc = func(string) bool { return false }
+	}
+
+	return cors.New(corsConfig)
+}
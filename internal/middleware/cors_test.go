@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"matcha/internal/config"
+)
+
+func TestCORS(t *testing.T) {
+	request := func(cfg *config.Config, origin string) (string, string) {
+		app := fiber.New()
+		app.Use(CORS(cfg))
+		app.Get("/", func(c *fiber.Ctx) error {
+			return c.SendString("OK")
+		})
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Origin", origin)
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.Header.Get("Access-Control-Allow-Origin"), resp.Header.Get("Access-Control-Allow-Credentials")
+	}
+
+	allowlist := &config.Config{AllowedOrigins: []string{"https://app.example.com"}}
+
+	origin, credentials := request(allowlist, "https://app.example.com")
+	assert.Equal(t, "https://app.example.com", origin, "allowed origin should be reflected")
+	assert.Equal(t, "true", credentials)
+
+	origin, _ = request(allowlist, "https://evil.example.com")
+	assert.Empty(t, origin, "disallowed origin must not be reflected")
+
+	origin, _ = request(&config.Config{}, "https://app.example.com")
+	assert.Empty(t, origin, "no configured origins means no CORS")
+
+	origin, credentials = request(&config.Config{AllowedOrigins: []string{"*"}}, "https://anywhere.example.com")
+	assert.Equal(t, "*", origin)
+	assert.Empty(t, credentials, "wildcard must not allow credentials")
+}
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const flashCookie = "flash"
+
+// Flash message types, used by the layout to pick the alert style
+const (
+	FlashSuccess = "success"
+	FlashError   = "error"
+)
+
+// FlashMessage is a one-shot message carried across a redirect
+type FlashMessage struct {
+	Type    string
+	Message string
+}
+
+// cookieKey signs flash and session cookies, set from the config's SecretKey
+// by InitAuth
+var cookieKey []byte
+
+// SetFlash stores a one-shot message shown on the next rendered page, typically
+// right before a redirect
+func SetFlash(c *fiber.Ctx, kind, msg string) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(kind + "\n" + msg))
+	c.Cookie(&fiber.Cookie{
+		Name:     flashCookie,
+		Value:    payload + "." + signFlash(payload),
+		HTTPOnly: true,
+		Secure:   cookieSecure,
+		SameSite: cookieSameSite,
+		Path:     "/",
+	})
+}
+
+// Flash consumes a pending flash message and binds it to the views as Alert and
+// AlertType, so it renders once and is gone on the next request
+func Flash(c *fiber.Ctx) error {
+	value := c.Cookies(flashCookie)
+	if value == "" {
+		return c.Next()
+	}
+	c.ClearCookie(flashCookie)
+
+	if kind, msg, ok := parseFlash(value); ok {
+		c.Locals("flash", &FlashMessage{Type: kind, Message: msg})
+		_ = c.Bind(fiber.Map{
+			"Alert":     msg,
+			"AlertType": kind,
+		})
+	}
+	return c.Next()
+}
+
+// GetFlash returns the flash message consumed for this request, if any
+func GetFlash(c *fiber.Ctx) *FlashMessage {
+	flash, ok := c.Locals("flash").(*FlashMessage)
+	if !ok {
+		return nil
+	}
+	return flash
+}
+
+func parseFlash(value string) (string, string, bool) {
+	payload, signature, found := strings.Cut(value, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(signFlash(payload))) {
+		return "", "", false
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", "", false
+	}
+	kind, msg, found := strings.Cut(string(decoded), "\n")
+	return kind, msg, found
+}
+
+func signFlash(payload string) string {
+	mac := hmac.New(sha256.New, cookieKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
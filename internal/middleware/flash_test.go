@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlash_ShownOnce(t *testing.T) {
+	app := fiber.New()
+	app.Use(Flash)
+	app.Post("/products", func(c *fiber.Ctx) error {
+		SetFlash(c, FlashSuccess, "Product created")
+		return c.Redirect("/products")
+	})
+	app.Get("/products", func(c *fiber.Ctx) error {
+		if flash := GetFlash(c); flash != nil {
+			return c.SendString(flash.Type + ": " + flash.Message)
+		}
+		return c.SendString("no flash")
+	})
+
+	get := func(cookie string) (string, string) {
+		req := httptest.NewRequest("GET", "/products", nil)
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body), resp.Header.Get("Set-Cookie")
+	}
+
+	resp, err := app.Test(httptest.NewRequest("POST", "/products", nil))
+	require.NoError(t, err)
+	setCookie := resp.Header.Get("Set-Cookie")
+	require.True(t, strings.HasPrefix(setCookie, flashCookie+"="), "redirect should carry a flash cookie")
+	cookie := strings.SplitN(setCookie, ";", 2)[0]
+
+	body, cleared := get(cookie)
+	assert.Equal(t, "success: Product created", body)
+	assert.Contains(t, cleared, "expires=", "reading the flash should clear its cookie")
+
+	body, _ = get("")
+	assert.Equal(t, "no flash", body, "flash must not survive a second request")
+
+	body, _ = get(cookie + "tampered")
+	assert.Equal(t, "no flash", body, "tampered flash cookies are ignored")
+}
@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"github.com/gofiber/fiber/v2"
+
+	"matcha/internal/config"
+)
+
+// RedirectHTTPS sends plain HTTP requests to the same URL over HTTPS in
+// production when cfg.ForceHTTPS is set. Behind a TLS-terminating proxy the scheme comes from
+// X-Forwarded-Proto, see fiber.Ctx.Protocol. GETs get a 301; other methods get
+// a 308 so clients repeat them with their body instead of switching to GET.
+func RedirectHTTPS(cfg *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !cfg.IsProduction() || !cfg.ForceHTTPS || c.Protocol() == "https" {
+			return c.Next()
+		}
+		status := fiber.StatusMovedPermanently
+		if c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead {
+			status = fiber.StatusPermanentRedirect
+		}
+		return c.Redirect("https://"+c.Hostname()+string(c.Request().URI().RequestURI()), status)
+	}
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"matcha/internal/config"
+)
+
+func TestRedirectHTTPS(t *testing.T) {
+	request := func(cfg *config.Config, method, proto string) (int, string) {
+		app := fiber.New()
+		app.Use(RedirectHTTPS(cfg))
+		app.All("/*", func(c *fiber.Ctx) error {
+			return c.SendString("OK")
+		})
+
+		req := httptest.NewRequest(method, "http://licenses.example.com/admin/login?next=%2Fadmin", nil)
+		if proto != "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode, resp.Header.Get("Location")
+	}
+
+	t.Setenv("GO_ENV", "production")
+	production := config.New()
+
+	status, location := request(production, "GET", "http")
+	assert.Equal(t, fiber.StatusMovedPermanently, status)
+	assert.Equal(t, "https://licenses.example.com/admin/login?next=%2Fadmin", location)
+
+	status, _ = request(production, "POST", "http")
+	assert.Equal(t, fiber.StatusPermanentRedirect, status, "non-GET requests must keep their method")
+
+	status, location = request(production, "GET", "https")
+	assert.Equal(t, fiber.StatusOK, status)
+	assert.Empty(t, location)
+
+	production.ForceHTTPS = false
+	status, _ = request(production, "GET", "http")
+	assert.Equal(t, fiber.StatusOK, status, "FORCE_HTTPS=false leaves HTTP alone for proxy setups")
+
+	status, _ = request(&config.Config{Environment: "development", ForceHTTPS: true}, "GET", "")
+	assert.Equal(t, fiber.StatusOK, status)
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"matcha/internal/config"
+)
+
+// TrustProxy sets up fc so c.IP() returns the client's address from
+// cfg.ProxyHeader instead of the proxy's, which the rate limiters, login
+// throttling and request log all key on. The header is only believed from
+// cfg.TrustedProxies, since anyone reaching the app directly could otherwise
+// pick their own IP; Validate refuses PROXY_HEADER without them. Register
+// ForwardedClientIP first so a list like X-Forwarded-For is read from the
+// right, where the trusted proxies append.
+func TrustProxy(fc fiber.Config, cfg *config.Config) fiber.Config {
+	if cfg.ProxyHeader == "" || len(cfg.TrustedProxies) == 0 {
+		return fc
+	}
+	fc.ProxyHeader = cfg.ProxyHeader
+	fc.EnableIPValidation = true
+	fc.EnableTrustedProxyCheck = true
+	fc.TrustedProxies = cfg.TrustedProxies
+	return fc
+}
+
+// ForwardedClientIP narrows cfg.ProxyHeader down to the client's address
+// before anything reads c.IP(). Each proxy appends the address it was
+// connected from, so the rightmost hop that isn't a trusted proxy is the one
+// vouched for; everything left of it came from the client and may be forged.
+// Fiber on its own would take the leftmost address.
+func ForwardedClientIP(cfg *config.Config) fiber.Handler {
+	trusted := trustedNetworks(cfg.TrustedProxies)
+	return func(c *fiber.Ctx) error {
+		if cfg.ProxyHeader == "" || len(trusted) == 0 || !c.IsProxyTrusted() {
+			return c.Next()
+		}
+		if header := c.Get(cfg.ProxyHeader); header != "" {
+			if ip := rightmostUntrustedHop(header, trusted); ip != "" {
+				c.Request().Header.Set(cfg.ProxyHeader, ip)
+			} else {
+				// Fiber falls back to the peer's address
+				c.Request().Header.Del(cfg.ProxyHeader)
+			}
+		}
+		return c.Next()
+	}
+}
+
+// rightmostUntrustedHop walks a comma-separated hop list from the right. A
+// hop that doesn't parse ends the walk with no answer, as nothing left of it
+// can be vouched for. A list made up of trusted proxies only yields the
+// leftmost.
+func rightmostUntrustedHop(header string, trusted []netip.Prefix) string {
+	hops := strings.Split(header, ",")
+	var addr netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		var ok bool
+		if addr, ok = parseHop(hops[i]); !ok {
+			return ""
+		}
+		if !isTrusted(addr, trusted) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+// parseHop reads one hop, which some proxies write with a port
+func parseHop(hop string) (netip.Addr, bool) {
+	hop = strings.TrimSpace(hop)
+	if addr, err := netip.ParseAddr(hop); err == nil {
+		return addr.Unmap(), true
+	}
+	if addrPort, err := netip.ParseAddrPort(hop); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+func isTrusted(addr netip.Addr, trusted []netip.Prefix) bool {
+	for _, network := range trusted {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedNetworks parses TRUSTED_PROXIES, whose IPs and CIDR ranges Validate
+// has already checked
+func trustedNetworks(proxies []string) []netip.Prefix {
+	var networks []netip.Prefix
+	for _, proxy := range proxies {
+		if prefix, err := netip.ParsePrefix(proxy); err == nil {
+			networks = append(networks, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(proxy); err == nil {
+			addr = addr.Unmap()
+			networks = append(networks, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return networks
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRightmostUntrustedHop(t *testing.T) {
+	trusted := trustedNetworks([]string{"10.0.0.0/8", "192.0.2.1"})
+
+	for header, want := range map[string]string{
+		"203.0.113.7":                         "203.0.113.7",
+		"203.0.113.7, 10.0.0.1":               "203.0.113.7",
+		"198.51.100.1, 203.0.113.7, 10.0.0.1": "203.0.113.7",
+		"203.0.113.7, 10.0.0.2, 192.0.2.1":    "203.0.113.7",
+		"203.0.113.7:51234, 10.0.0.1":         "203.0.113.7",
+		"10.0.0.3, 10.0.0.1":                  "10.0.0.3",
+		"not-an-ip, 10.0.0.1":                 "",
+		"203.0.113.7, garbage":                "",
+	} {
+		assert.Equal(t, want, rightmostUntrustedHop(header, trusted), header)
+	}
+}
+
+func TestTrustedNetworks(t *testing.T) {
+	networks := trustedNetworks([]string{"10.0.0.1", "172.16.0.0/12", "::1"})
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.1/32"),
+		netip.MustParsePrefix("172.16.0.0/12"),
+		netip.MustParsePrefix("::1/128"),
+	}, networks)
+}
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"gorm.io/gorm"
+
+	"matcha/internal/config"
+	"matcha/internal/models"
+)
+
+// APIKeyFromRequest extracts the API key from either an "Authorization: Bearer"
+// or an "X-API-Key" header
+func APIKeyFromRequest(c *fiber.Ctx) string {
+	if auth := c.Get(fiber.HeaderAuthorization); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return c.Get("X-API-Key")
+}
+
+// NewRateLimitStorage returns the shared store selected by RATE_LIMIT_STORE,
+// or nil for the limiter's own in-process memory
+func NewRateLimitStorage(cfg *config.Config) (fiber.Storage, error) {
+	if cfg.RateLimitStore != "redis" {
+		return nil, nil
+	}
+	storage, err := NewRedisStorage(cfg.RedisURL)
+	if err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+// VerifyRateLimiter limits license verification requests per IP. Callers
+// presenting the API key of a product marked exempt, or coming from an IP
+// listed in the config, are not limited. A nil storage keeps counters in
+// memory.
+func VerifyRateLimiter(cfg *config.Config, storage fiber.Storage) fiber.Handler {
+	return limiter.New(limiter.Config{
+		Next: func(c *fiber.Ctx) bool {
+			return IsRateLimitExempt(cfg, c)
+		},
+		Max:        orDefault(cfg.VerifyRateLimit, config.DefaultVerifyRateLimit),
+		Expiration: rateLimitWindow(cfg),
+		KeyGenerator: func(c *fiber.Ctx) string {
+			// Rate limit by IP address; the prefix keeps counters apart in a shared store
+			return "verify:" + c.IP()
+		},
+		Storage: storage,
+		LimitReached: func(c *fiber.Ctx) error {
+			return c.Status(429).JSON(fiber.Map{
+				"error":   "Rate limit exceeded",
+				"message": "Too many license verification requests. Please try again later.",
+			})
+		},
+	})
+}
+
+// APIRateLimiter is the more lenient limit applied to every API request
+func APIRateLimiter(cfg *config.Config, storage fiber.Storage) fiber.Handler {
+	return limiter.New(limiter.Config{
+		Next: func(c *fiber.Ctx) bool {
+			return IsRateLimitExempt(cfg, c)
+		},
+		Max:        orDefault(cfg.APIRateLimit, config.DefaultAPIRateLimit),
+		Expiration: rateLimitWindow(cfg),
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return "api:" + c.IP()
+		},
+		Storage: storage,
+	})
+}
+
+func rateLimitWindow(cfg *config.Config) time.Duration {
+	if cfg.RateLimitWindow <= 0 {
+		return config.DefaultRateLimitWindow
+	}
+	return cfg.RateLimitWindow
+}
+
+func orDefault(value, defaultValue int) int {
+	if value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// IsRateLimitExempt reports whether the request comes from a trusted caller:
+// an exempt IP, or the API key of a product with RateLimitExempt set
+func IsRateLimitExempt(cfg *config.Config, c *fiber.Ctx) bool {
+	ip := c.IP()
+	for _, trusted := range cfg.RateLimitExemptIPs {
+		if ip == trusted {
+			return true
+		}
+	}
+
+	key := APIKeyFromRequest(c)
+	if key == "" {
+		return false
+	}
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		return false
+	}
+	return models.IsRateLimitExemptAPIKey(db, key)
+}
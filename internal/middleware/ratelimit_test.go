@@ -0,0 +1,231 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"matcha/internal/config"
+	"matcha/internal/models"
+	"matcha/internal/testutils"
+)
+
+func TestVerifyRateLimiter(t *testing.T) {
+	cfg := &config.Config{}
+	db := testutils.SetupTestDB(t)
+	require.NoError(t, db.Create(&models.Product{Name: "Trusted", APIKey: "trusted-key", RateLimitExempt: true}).Error)
+	require.NoError(t, db.Create(&models.Product{Name: "Other", APIKey: "untrusted-key"}).Error)
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("db", db)
+		return c.Next()
+	})
+	app.Use("/verify", VerifyRateLimiter(cfg, nil))
+	app.Post("/verify", func(c *fiber.Ctx) error {
+		return c.SendString("OK")
+	})
+
+	send := func(headers map[string]string) int {
+		req := httptest.NewRequest("POST", "/verify", nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	// Both callers share an IP, so only the API key tells them apart
+	for i := 0; i < 60; i++ {
+		require.Equal(t, 200, send(nil))
+	}
+	assert.Equal(t, 429, send(nil), "anonymous caller should be throttled")
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, 200, send(map[string]string{"X-API-Key": "trusted-key"}))
+	}
+	assert.Equal(t, 200, send(map[string]string{"Authorization": "Bearer trusted-key"}))
+	assert.Equal(t, 429, send(map[string]string{"X-API-Key": "untrusted-key"}))
+}
+
+func TestVerifyRateLimiter_ConfiguredLimit(t *testing.T) {
+	cfg := &config.Config{VerifyRateLimit: 3, RateLimitWindow: time.Minute}
+
+	app := fiber.New()
+	app.Use("/verify", VerifyRateLimiter(cfg, nil))
+	app.Post("/verify", func(c *fiber.Ctx) error {
+		return c.SendString("OK")
+	})
+
+	for i := 0; i < 3; i++ {
+		resp, err := app.Test(httptest.NewRequest("POST", "/verify", nil))
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+	}
+	resp, err := app.Test(httptest.NewRequest("POST", "/verify", nil))
+	require.NoError(t, err)
+	assert.Equal(t, 429, resp.StatusCode, "a low configured limit should throttle sooner")
+}
+
+func TestAPIRateLimiter_ConfiguredLimit(t *testing.T) {
+	cfg := &config.Config{APIRateLimit: 2}
+
+	app := fiber.New()
+	app.Use("/api", APIRateLimiter(cfg, nil))
+	app.Get("/api/ping", func(c *fiber.Ctx) error {
+		return c.SendString("OK")
+	})
+
+	for i := 0; i < 2; i++ {
+		resp, err := app.Test(httptest.NewRequest("GET", "/api/ping", nil))
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+	}
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/ping", nil))
+	require.NoError(t, err)
+	assert.Equal(t, 429, resp.StatusCode)
+}
+
+// memoryStore is a fake shared store standing in for Redis
+type memoryStore struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func (s *memoryStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data[key], nil
+}
+
+func (s *memoryStore) Set(key string, val []byte, _ time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = append([]byte(nil), val...)
+	return nil
+}
+
+func (s *memoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, key)
+	return nil
+}
+
+func (s *memoryStore) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = map[string][]byte{}
+	return nil
+}
+
+func (s *memoryStore) Close() error { return nil }
+
+func TestVerifyRateLimiter_SharedStorage(t *testing.T) {
+	cfg := &config.Config{VerifyRateLimit: 4, RateLimitWindow: time.Minute}
+	store := &memoryStore{data: map[string][]byte{}}
+
+	// Two app instances behind a load balancer sharing one store
+	newInstance := func() *fiber.App {
+		app := fiber.New()
+		app.Use("/verify", VerifyRateLimiter(cfg, store))
+		app.Post("/verify", func(c *fiber.Ctx) error {
+			return c.SendString("OK")
+		})
+		return app
+	}
+	first, second := newInstance(), newInstance()
+
+	for i := 0; i < 4; i++ {
+		instance := first
+		if i%2 == 1 {
+			instance = second
+		}
+		resp, err := instance.Test(httptest.NewRequest("POST", "/verify", nil))
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+	}
+
+	// Each instance has only served two requests, but the shared count is spent
+	for _, instance := range []*fiber.App{first, second} {
+		resp, err := instance.Test(httptest.NewRequest("POST", "/verify", nil))
+		require.NoError(t, err)
+		assert.Equal(t, 429, resp.StatusCode)
+	}
+
+	// A fresh instance picks up the persisted count too
+	resp, err := newInstance().Test(httptest.NewRequest("POST", "/verify", nil))
+	require.NoError(t, err)
+	assert.Equal(t, 429, resp.StatusCode)
+}
+
+func TestNewRateLimitStorage_MemoryByDefault(t *testing.T) {
+	storage, err := NewRateLimitStorage(&config.Config{RateLimitStore: "memory"})
+	require.NoError(t, err)
+	assert.Nil(t, storage)
+}
+
+func TestVerifyRateLimiter_TrustedProxy(t *testing.T) {
+	newApp := func(cfg *config.Config) *fiber.App {
+		app := fiber.New(TrustProxy(fiber.Config{}, cfg))
+		app.Use(ForwardedClientIP(cfg))
+		app.Use("/verify", VerifyRateLimiter(cfg, nil))
+		app.Post("/verify", func(c *fiber.Ctx) error {
+			return c.SendString("OK")
+		})
+		return app
+	}
+	send := func(app *fiber.App, forwardedFor string) int {
+		req := httptest.NewRequest("POST", "/verify", nil)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	t.Run("TrustProxy - Keys On Forwarded IP", func(t *testing.T) {
+		// app.Test connects from 0.0.0.0, standing in for the proxy
+		app := newApp(&config.Config{VerifyRateLimit: 2, ProxyHeader: "X-Forwarded-For", TrustedProxies: []string{"0.0.0.0", "10.0.0.0/8"}})
+
+		for i := 0; i < 2; i++ {
+			require.Equal(t, 200, send(app, "203.0.113.7, 10.0.0.1"))
+		}
+		assert.Equal(t, 429, send(app, "203.0.113.7"), "the client behind the proxy should be throttled")
+		assert.Equal(t, 429, send(app, "198.51.100.99, 203.0.113.7"), "a client can't escape by prepending a forged hop")
+		assert.Equal(t, 200, send(app, "198.51.100.4, 10.0.0.1"), "other clients of the same proxy get their own bucket")
+	})
+
+	t.Run("TrustProxy - Disabled", func(t *testing.T) {
+		app := newApp(&config.Config{VerifyRateLimit: 2})
+
+		require.Equal(t, 200, send(app, "203.0.113.7"))
+		require.Equal(t, 200, send(app, "198.51.100.4"))
+		assert.Equal(t, 429, send(app, "192.0.2.9"), "without PROXY_HEADER every request shares the proxy's bucket")
+	})
+
+	t.Run("TrustProxy - Untrusted Peer", func(t *testing.T) {
+		// app.Test connects from 0.0.0.0, which is not the listed proxy
+		app := newApp(&config.Config{VerifyRateLimit: 2, ProxyHeader: "X-Forwarded-For", TrustedProxies: []string{"10.0.0.1"}})
+
+		require.Equal(t, 200, send(app, "203.0.113.7"))
+		require.Equal(t, 200, send(app, "198.51.100.4"))
+		assert.Equal(t, 429, send(app, "192.0.2.9"), "a forwarded IP from an untrusted peer must be ignored")
+	})
+}
+
+func TestNewRateLimitStorage(t *testing.T) {
+	storage, err := NewRateLimitStorage(&config.Config{RateLimitStore: "memory"})
+	require.NoError(t, err)
+	assert.Nil(t, storage, "the in-memory store is the limiter's own")
+
+	for _, rawURL := range []string{"http://localhost:6379", "redis://localhost:6379/not-a-db"} {
+		_, err := NewRateLimitStorage(&config.Config{RateLimitStore: "redis", RedisURL: rawURL})
+		assert.Error(t, err, rawURL)
+	}
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisDialTimeout    = 5 * time.Second
+	redisCommandTimeout = 2 * time.Second
+	redisKeyPrefix      = "matcha:ratelimit:"
+)
+
+// RedisStorage is a fiber.Storage backed by Redis, so rate limit counters are
+// shared between instances. Keys are prefixed, leaving the rest of the
+// database alone.
+type RedisStorage struct {
+	client *redis.Client
+}
+
+// NewRedisStorage connects to a redis:// or rediss:// URL such as
+// redis://:password@localhost:6379/0
+func NewRedisStorage(rawURL string) (*RedisStorage, error) {
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	opts.DialTimeout = redisDialTimeout
+	opts.ReadTimeout = redisCommandTimeout
+	opts.WriteTimeout = redisCommandTimeout
+
+	// Connect eagerly so a misconfigured URL fails at boot rather than on the first request
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), redisDialTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	return &RedisStorage{client: client}, nil
+}
+
+func (s *RedisStorage) Get(key string) ([]byte, error) {
+	value, err := s.client.Get(context.Background(), redisKeyPrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (s *RedisStorage) Set(key string, val []byte, exp time.Duration) error {
+	if key == "" || len(val) == 0 {
+		return nil
+	}
+	return s.client.Set(context.Background(), redisKeyPrefix+key, val, exp).Err()
+}
+
+func (s *RedisStorage) Delete(key string) error {
+	return s.client.Del(context.Background(), redisKeyPrefix+key).Err()
+}
+
+// Reset deletes the limiter's keys only
+func (s *RedisStorage) Reset() error {
+	ctx := context.Background()
+	iter := s.client.Scan(ctx, 0, redisKeyPrefix+"*", 100).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == 100 {
+			if err := s.client.Del(ctx, keys...).Err(); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return s.client.Del(ctx, keys...).Err()
+	}
+	return nil
+}
+
+func (s *RedisStorage) Close() error {
+	return s.client.Close()
+}
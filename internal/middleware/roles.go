@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"log"
+
+	"matcha/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequireRole refuses admins whose role isn't one of roles with a 403. It
+// goes after RequireAuth.
+func RequireRole(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if admin := GetCurrentAdmin(c); admin != nil {
+			for _, role := range roles {
+				if admin.AdminRole() == role {
+					return c.Next()
+				}
+			}
+		}
+		return forbidden(c)
+	}
+}
+
+// RequireOwner lets only owners through, for managing admins and
+// instance-wide settings such as email
+var RequireOwner = RequireRole(models.RoleOwner)
+
+// readonlyAllowed reports whether a readonly admin may make the request:
+// anything that only reads, plus changes to their own account
+func readonlyAllowed(c *fiber.Ctx) bool {
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		return true
+	}
+	path := c.Path()
+	return path == ChangePasswordPath() || path == AdminURL("/account/theme")
+}
+
+func forbidden(c *fiber.Ctx) error {
+	username := "unknown"
+	if admin := GetCurrentAdmin(c); admin != nil {
+		username = admin.Username
+	}
+	log.Printf("Forbidden: admin %q may not %s %s", username, c.Method(), c.Path())
+	return c.Status(fiber.StatusForbidden).SendString("Your admin role does not allow this")
+}
@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// QueryTimeout gives each request a context that expires after timeout.
+// Handlers pass c.UserContext() to GORM with WithContext, so a query stuck on
+// a lock or a slow disk is cancelled instead of holding the connection.
+func QueryTimeout(timeout time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithTimeout(c.UserContext(), timeout)
+		defer cancel()
+
+		c.SetUserContext(ctx)
+		return c.Next()
+	}
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"matcha/internal/testutils"
+)
+
+func TestQueryTimeout(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+
+	app := fiber.New()
+	app.Use(QueryTimeout(100 * time.Millisecond))
+	app.Get("/slow", func(c *fiber.Ctx) error {
+		// Counts to a billion, far longer than the timeout allows
+		var count int64
+		err := db.WithContext(c.UserContext()).
+			Raw("WITH RECURSIVE n(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM n WHERE x < 1000000000) SELECT count(*) FROM n").
+			Scan(&count).Error
+		if err != nil {
+			return c.Status(503).SendString(err.Error())
+		}
+		return c.SendString("finished")
+	})
+
+	start := time.Now()
+	resp, err := app.Test(httptest.NewRequest("GET", "/slow", nil), 10000)
+	require.NoError(t, err)
+	assert.Equal(t, 503, resp.StatusCode, "the query should be cancelled, not finish")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,101 @@
+// Package migrations brings the database schema and data up to date at
+// startup. AutoMigrate adds new tables and columns on every run; changes it
+// can't express, such as dropping an index or backfilling rows, are versioned
+// migrations that run once each, in order, and are recorded in the
+// schema_migrations table.
+package migrations
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+
+	"matcha/internal/models"
+)
+
+// Migration is one versioned change. Up runs in a transaction together with
+// recording the version, so a failed migration leaves no trace and is
+// retried on the next start.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+}
+
+// SchemaMigration records an applied migration
+type SchemaMigration struct {
+	Version   int    `gorm:"primaryKey;autoIncrement:false"`
+	Name      string `gorm:"not null"`
+	AppliedAt time.Time
+}
+
+// Models are the tables AutoMigrate keeps in step with their structs
+var Models = []interface{}{
+	&models.Product{}, &models.Customer{}, &models.LicenseKey{}, &models.AdminUser{}, &models.EmailSettings{},
+	&models.WebhookEvent{}, &models.EmailTemplate{}, &models.VerificationStat{}, &models.SeatCheckout{},
+	&models.WebhookSettings{}, &models.ProductMapping{}, &models.EmailLog{}, &models.LoginThrottle{},
+	&models.LicenseKeyNote{}, &models.LicenseKeyRotation{},
+}
+
+// All lists the versioned migrations, oldest first. Append new ones with the
+// next version; never edit or reorder one that has shipped. The first four
+// used to run on every start, so they are safe to apply to databases that
+// already had them done.
+var All = []Migration{
+	{Version: 1, Name: "drop global license key index", Up: models.DropGlobalKeyIndex},
+	{Version: 2, Name: "drop global email template index", Up: models.DropGlobalTemplateIndex},
+	{Version: 3, Name: "encrypt stored secrets", Up: models.EncryptStoredSecrets},
+	{Version: 4, Name: "backfill product permalinks", Up: models.BackfillPermalinks},
+	{Version: 5, Name: "make legacy admins owners", Up: promoteLegacyAdmins},
+	{Version: 6, Name: "hash product API keys", Up: models.HashStoredAPIKeys},
+	{Version: 7, Name: "backfill license key lookup keys", Up: models.BackfillLookupKeys},
+}
+
+// Run auto-migrates Models, then applies the migrations that haven't been yet
+func Run(db *gorm.DB, migrations []Migration) error {
+	if err := db.AutoMigrate(append([]interface{}{&SchemaMigration{}}, Models...)...); err != nil {
+		return fmt.Errorf("auto-migrate: %w", err)
+	}
+
+	var applied []SchemaMigration
+	if err := db.Find(&applied).Error; err != nil {
+		return fmt.Errorf("load applied migrations: %w", err)
+	}
+	done := make(map[int]bool, len(applied))
+	for _, migration := range applied {
+		done[migration.Version] = true
+	}
+
+	previous := 0
+	for _, migration := range migrations {
+		if migration.Version <= previous {
+			return fmt.Errorf("migration %d %q is out of order", migration.Version, migration.Name)
+		}
+		previous = migration.Version
+		if done[migration.Version] {
+			continue
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now().UTC()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d %q: %w", migration.Version, migration.Name, err)
+		}
+		log.Printf("Applied migration %d: %s", migration.Version, migration.Name)
+	}
+	return nil
+}
+
+// promoteLegacyAdmins stores the owner role on admins from before roles were
+// enforced, which models.AdminUser.AdminRole already treats as owners
+func promoteLegacyAdmins(tx *gorm.DB) error {
+	return tx.Model(&models.AdminUser{}).
+		Where("role = ? OR role = ?", "admin", "").
+		Update("role", models.RoleOwner).Error
+}
@@ -0,0 +1,106 @@
+package migrations
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"matcha/internal/database"
+	"matcha/internal/models"
+)
+
+func setupTempDB(t *testing.T) *gorm.DB {
+	models.SetEncryptionKey("test-secret-key")
+	db, err := database.New(filepath.Join(t.TempDir(), "matcha.db"), database.Pragmas{}, database.Pool{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			_ = sqlDB.Close()
+		}
+	})
+	return db
+}
+
+func appliedVersions(t *testing.T, db *gorm.DB) []int {
+	var versions []int
+	require.NoError(t, db.Model(&SchemaMigration{}).Order("version").Pluck("version", &versions).Error)
+	return versions
+}
+
+func TestRun_Idempotent(t *testing.T) {
+	db := setupTempDB(t)
+
+	require.NoError(t, Run(db, All))
+	first := appliedVersions(t, db)
+	require.Len(t, first, len(All))
+
+	require.NoError(t, Run(db, All), "a second run finds nothing to do")
+	assert.Equal(t, first, appliedVersions(t, db))
+}
+
+func TestRun_BackfillRunsOnce(t *testing.T) {
+	db := setupTempDB(t)
+
+	runs := 0
+	backfill := Migration{Version: 1, Name: "count backfill", Up: func(tx *gorm.DB) error {
+		runs++
+		return tx.Model(&models.AdminUser{}).Where("role = ?", "admin").Update("role", models.RoleOwner).Error
+	}}
+
+	require.NoError(t, Run(db, nil))
+	legacy := models.AdminUser{Username: "legacy", PasswordHash: "x", Role: "admin"}
+	require.NoError(t, db.Create(&legacy).Error)
+
+	require.NoError(t, Run(db, []Migration{backfill}))
+	require.NoError(t, Run(db, []Migration{backfill}))
+	assert.Equal(t, 1, runs)
+
+	var reloaded models.AdminUser
+	require.NoError(t, db.First(&reloaded, legacy.ID).Error)
+	assert.Equal(t, models.RoleOwner, reloaded.Role)
+
+	t.Run("Run - Appended Migration Runs Later", func(t *testing.T) {
+		later := 0
+		next := Migration{Version: 2, Name: "later", Up: func(tx *gorm.DB) error { later++; return nil }}
+		require.NoError(t, Run(db, []Migration{backfill, next}))
+		assert.Equal(t, 1, runs)
+		assert.Equal(t, 1, later)
+	})
+}
+
+func TestRun_FailedMigrationIsRetried(t *testing.T) {
+	db := setupTempDB(t)
+
+	fail := true
+	flaky := Migration{Version: 1, Name: "flaky", Up: func(tx *gorm.DB) error {
+		if err := tx.Create(&models.Customer{Name: "Ada", Email: "ada@example.com"}).Error; err != nil {
+			return err
+		}
+		if fail {
+			return errors.New("boom")
+		}
+		return nil
+	}}
+
+	assert.ErrorContains(t, Run(db, []Migration{flaky}), "boom")
+	assert.Empty(t, appliedVersions(t, db))
+	var count int64
+	db.Model(&models.Customer{}).Count(&count)
+	assert.Equal(t, int64(0), count, "the failed migration's writes are rolled back")
+
+	fail = false
+	require.NoError(t, Run(db, []Migration{flaky}))
+	assert.Equal(t, []int{1}, appliedVersions(t, db))
+}
+
+func TestRun_RejectsOutOfOrderVersions(t *testing.T) {
+	db := setupTempDB(t)
+	noop := func(tx *gorm.DB) error { return nil }
+
+	err := Run(db, []Migration{{Version: 2, Name: "b", Up: noop}, {Version: 1, Name: "a", Up: noop}})
+	assert.ErrorContains(t, err, "out of order")
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Activity feed event types
+const (
+	ActivityCreated     = "created"     // Key added by an admin or through the API
+	ActivityProvisioned = "provisioned" // Key issued for a payment webhook
+	ActivityRevoked     = "revoked"
+)
+
+// ActivityTypes lists the event types the feed can be filtered by
+var ActivityTypes = []string{ActivityCreated, ActivityProvisioned, ActivityRevoked}
+
+// ActivityEvent is one entry of the dashboard's activity feed
+type ActivityEvent struct {
+	Type       string
+	At         time.Time
+	LicenseKey LicenseKey // With Product and Customer loaded
+}
+
+// ActivityFilter narrows the activity feed. Zero values don't filter.
+type ActivityFilter struct {
+	Type    string    // One of ActivityTypes
+	Since   time.Time // Inclusive
+	Until   time.Time // Exclusive
+	Limit   int       // Most recent events to return
+	OwnerID *uint     // Tenant, see OwnedBy
+}
+
+// RecentActivity merges key creations, webhook provisions and revocations into
+// one feed, newest first. Each kind is read from the license key rows it left
+// behind, so the feed needs no separate event table.
+func RecentActivity(db *gorm.DB, filter ActivityFilter) ([]ActivityEvent, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = 10
+	}
+	provisioned := db.Model(&WebhookEvent{}).Select("license_key_id").Where("license_key_id IS NOT NULL")
+
+	queries := map[string]func() *gorm.DB{
+		ActivityCreated: func() *gorm.DB {
+			return within(db.Where("id NOT IN (?)", provisioned), "created_at", filter)
+		},
+		ActivityProvisioned: func() *gorm.DB {
+			return within(db.Where("id IN (?)", provisioned), "created_at", filter)
+		},
+		ActivityRevoked: func() *gorm.DB {
+			return within(db.Where("revoked_at IS NOT NULL"), "revoked_at", filter)
+		},
+	}
+
+	var events []ActivityEvent
+	for _, kind := range ActivityTypes {
+		if filter.Type != "" && filter.Type != kind {
+			continue
+		}
+		var keys []LicenseKey
+		if err := queries[kind]().Preload("Product").Preload("Customer").Limit(filter.Limit).Find(&keys).Error; err != nil {
+			return nil, fmt.Errorf("failed to load %s activity: %w", kind, err)
+		}
+		for _, key := range keys {
+			at := key.CreatedAt
+			if kind == ActivityRevoked {
+				at = *key.RevokedAt
+			}
+			events = append(events, ActivityEvent{Type: kind, At: at, LicenseKey: key})
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At.After(events[j].At) })
+	if len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+// within restricts query to the filter's tenant and to rows whose column falls
+// in its date range, newest first
+func within(query *gorm.DB, column string, filter ActivityFilter) *gorm.DB {
+	query = query.Scopes(OwnedBy(filter.OwnerID))
+	if !filter.Since.IsZero() {
+		query = query.Where(column+" >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where(column+" < ?", filter.Until)
+	}
+	return query.Order(column + " DESC")
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// VerificationStat counts successful license verifications for a product per
+// UTC day. One row per product and day keeps the table small no matter how
+// often clients verify.
+type VerificationStat struct {
+	ID        uint   `gorm:"primaryKey" json:"id"`
+	ProductID uint   `gorm:"not null;uniqueIndex:idx_verification_stats_product_day" json:"product_id"`
+	Day       string `gorm:"not null;size:10;uniqueIndex:idx_verification_stats_product_day" json:"day"` // YYYY-MM-DD
+	Count     int    `gorm:"not null;default:0" json:"count"`
+}
+
+// DailyVerifications is one point in a product's verification series
+type DailyVerifications struct {
+	Day   string `json:"day"`
+	Count int    `json:"count"`
+}
+
+// ProductAnalytics summarizes how a product's licenses are being used
+type ProductAnalytics struct {
+	TotalKeys        int64                `json:"total_keys"`
+	ActiveKeys       int64                `json:"active_keys"`
+	ExpiredKeys      int64                `json:"expired_keys"`
+	RevokedKeys      int64                `json:"revoked_keys"`
+	TotalUsage       int64                `json:"total_usage"`
+	TotalActivations int64                `json:"total_activations"`
+	Verifications    []DailyVerifications `json:"verifications"`
+}
+
+const verificationDayLayout = "2006-01-02"
+
+// RecordVerification increments the verification counter for the product on the day of at
+func RecordVerification(db *gorm.DB, productID uint, at time.Time) error {
+	stat := VerificationStat{
+		ProductID: productID,
+		Day:       at.UTC().Format(verificationDayLayout),
+		Count:     1,
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "product_id"}, {Name: "day"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"count": gorm.Expr("verification_stats.count + 1")}),
+	}).Create(&stat).Error
+}
+
+// Analytics computes key status breakdowns, usage totals and the daily
+// verification counts for the last days days (including today)
+func (p *Product) Analytics(db *gorm.DB, now time.Time, days int) (*ProductAnalytics, error) {
+	analytics := &ProductAnalytics{}
+	keys := func() *gorm.DB {
+		return db.Model(&LicenseKey{}).Where("product_id = ?", p.ID)
+	}
+
+	if err := keys().Count(&analytics.TotalKeys).Error; err != nil {
+		return nil, err
+	}
+	if err := keys().Where("status = ? AND (expires_at IS NULL OR expires_at >= ?)", "active", now).
+		Count(&analytics.ActiveKeys).Error; err != nil {
+		return nil, err
+	}
+	// Keys past their expiry date still carry the "active" status until touched
+	if err := keys().Where("status = ? OR (status = ? AND expires_at < ?)", "expired", "active", now).
+		Count(&analytics.ExpiredKeys).Error; err != nil {
+		return nil, err
+	}
+	if err := keys().Where("status = ?", "revoked").Count(&analytics.RevokedKeys).Error; err != nil {
+		return nil, err
+	}
+
+	var totals struct {
+		Usage       int64
+		Activations int64
+	}
+	if err := keys().Select("COALESCE(SUM(usage_count), 0) AS usage, COALESCE(SUM(current_activations), 0) AS activations").
+		Scan(&totals).Error; err != nil {
+		return nil, err
+	}
+	analytics.TotalUsage = totals.Usage
+	analytics.TotalActivations = totals.Activations
+
+	start := now.UTC().AddDate(0, 0, -(days - 1))
+	var stats []VerificationStat
+	if err := db.Where("product_id = ? AND day >= ?", p.ID, start.Format(verificationDayLayout)).
+		Find(&stats).Error; err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(stats))
+	for _, stat := range stats {
+		counts[stat.Day] = stat.Count
+	}
+
+	// Fill in days without verifications so the series has no gaps
+	analytics.Verifications = make([]DailyVerifications, 0, days)
+	for i := 0; i < days; i++ {
+		day := start.AddDate(0, 0, i).Format(verificationDayLayout)
+		analytics.Verifications = append(analytics.Verifications, DailyVerifications{Day: day, Count: counts[day]})
+	}
+
+	return analytics, nil
+}
+
+// VerificationTotal sums the verification series
+func (pa *ProductAnalytics) VerificationTotal() int {
+	total := 0
+	for _, v := range pa.Verifications {
+		total += v.Count
+	}
+	return total
+}
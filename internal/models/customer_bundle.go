@@ -0,0 +1,310 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// CustomerBundleVersion is bumped whenever the bundle format changes
+// incompatibly
+const CustomerBundleVersion = 1
+
+// CustomerBundle is a self-contained copy of a customer and their license
+// keys, for handing to the customer or moving them to another instance.
+// Records are referenced by email and product permalink rather than by ID,
+// since IDs mean nothing outside this database. ImportLicenseBundle reads the
+// same format, where keys may name their own customer instead.
+type CustomerBundle struct {
+	Version     int                `json:"version"`
+	ExportedAt  time.Time          `json:"exported_at"`
+	Customer    BundleCustomer     `json:"customer"`
+	LicenseKeys []BundleLicenseKey `json:"license_keys"`
+}
+
+// BundleCustomer is the customer record in a CustomerBundle
+type BundleCustomer struct {
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	Company   string    `json:"company"`
+	Notes     string    `json:"notes"`
+	Tags      string    `json:"tags"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BundleProduct identifies the product a bundled key belongs to
+type BundleProduct struct {
+	Name      string `json:"name"`
+	Permalink string `json:"permalink"`
+	Version   string `json:"version"`
+}
+
+// BundleLicenseKey is one license key in a CustomerBundle. A nil ExpiresAt is
+// exported as null, meaning the key never expires.
+type BundleLicenseKey struct {
+	Key                string                 `json:"key"`
+	CustomerEmail      string                 `json:"customer_email,omitempty"` // Overrides the bundle's customer on import
+	CustomerName       string                 `json:"customer_name,omitempty"`
+	Product            BundleProduct          `json:"product"`
+	Status             string                 `json:"status"`
+	LicenseType        string                 `json:"license_type"`
+	ExpiresAt          *time.Time             `json:"expires_at"`
+	MaxActivations     int                    `json:"max_activations"`
+	CurrentActivations int                    `json:"current_activations"`
+	UsageLimit         int                    `json:"usage_limit"`
+	UsageCount         int                    `json:"usage_count"`
+	Metadata           map[string]interface{} `json:"metadata,omitempty"`
+	PurchasedVersion   string                 `json:"purchased_version,omitempty"`
+	SubscriptionID     string                 `json:"subscription_id,omitempty"`
+	Price              int64                  `json:"price,omitempty"`
+	Currency           string                 `json:"currency,omitempty"`
+	SaleID             string                 `json:"sale_id,omitempty"`
+	IsTrial            bool                   `json:"is_trial"`
+	RevokedAt          *time.Time             `json:"revoked_at,omitempty"`
+	RevokedReason      string                 `json:"revoked_reason,omitempty"`
+	Labels             string                 `json:"labels,omitempty"`
+	CreatedAt          time.Time              `json:"created_at"`
+}
+
+// ExportCustomer builds the bundle for a customer, keys oldest first
+func ExportCustomer(db *gorm.DB, customerID uint) (*CustomerBundle, error) {
+	var customer Customer
+	err := db.Preload("LicenseKeys", func(db *gorm.DB) *gorm.DB {
+		return db.Order("created_at ASC, id ASC")
+	}).Preload("LicenseKeys.Product").First(&customer, customerID).Error
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &CustomerBundle{
+		Version:    CustomerBundleVersion,
+		ExportedAt: time.Now().UTC(),
+		Customer: BundleCustomer{
+			Email:     customer.Email,
+			Name:      customer.Name,
+			FirstName: customer.FirstName,
+			LastName:  customer.LastName,
+			Company:   customer.Company,
+			Notes:     customer.Notes,
+			Tags:      customer.Tags,
+			CreatedAt: customer.CreatedAt,
+		},
+		LicenseKeys: make([]BundleLicenseKey, 0, len(customer.LicenseKeys)),
+	}
+	for _, lk := range customer.LicenseKeys {
+		var metadata map[string]interface{}
+		if m := lk.GetMetadataMap(); len(m) > 0 {
+			metadata = m
+		}
+		bundle.LicenseKeys = append(bundle.LicenseKeys, BundleLicenseKey{
+			Key: lk.Key,
+			Product: BundleProduct{
+				Name:      lk.Product.Name,
+				Permalink: lk.Product.Permalink,
+				Version:   lk.Product.Version,
+			},
+			Status:             lk.Status,
+			LicenseType:        lk.LicenseType,
+			ExpiresAt:          lk.ExpiresAt,
+			MaxActivations:     lk.MaxActivations,
+			CurrentActivations: lk.CurrentActivations,
+			UsageLimit:         lk.UsageLimit,
+			UsageCount:         lk.UsageCount,
+			Metadata:           metadata,
+			PurchasedVersion:   lk.PurchasedVersion,
+			SubscriptionID:     lk.SubscriptionID,
+			Price:              lk.Price,
+			Currency:           lk.Currency,
+			SaleID:             lk.SaleID,
+			IsTrial:            lk.IsTrial,
+			RevokedAt:          lk.RevokedAt,
+			RevokedReason:      lk.RevokedReason,
+			Labels:             lk.Labels,
+			CreatedAt:          lk.CreatedAt,
+		})
+	}
+	return bundle, nil
+}
+
+// BundleImportFailure is a key ImportLicenseBundle could not import
+type BundleImportFailure struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// BundleImportSummary reports what ImportLicenseBundle did
+type BundleImportSummary struct {
+	Imported         int                   `json:"imported"`
+	ImportedIDs      []uint                `json:"imported_ids"`
+	Skipped          []string              `json:"skipped"` // Keys that already exist
+	Failed           []BundleImportFailure `json:"failed"`
+	CustomersCreated int                   `json:"customers_created"`
+	ProductsCreated  int                   `json:"products_created"`
+}
+
+// ImportLicenseBundle inserts a bundle's keys with their original key strings
+// and expiry. Customers are matched by email and created when missing;
+// products are matched by permalink or name and created when missing. A key
+// whose string already exists, under any product, is skipped so re-running an
+// import is harmless. Keys that can't be imported are reported in Failed
+// without stopping the rest.
+func ImportLicenseBundle(db *gorm.DB, bundle *CustomerBundle) (*BundleImportSummary, error) {
+	summary := &BundleImportSummary{ImportedIDs: []uint{}, Skipped: []string{}, Failed: []BundleImportFailure{}}
+	customers := map[string]*Customer{}
+	products := map[string]*Product{}
+
+	for _, bk := range bundle.LicenseKeys {
+		key := strings.TrimSpace(bk.Key)
+		if key == "" {
+			summary.Failed = append(summary.Failed, BundleImportFailure{Error: "key is blank"})
+			continue
+		}
+
+		var existing int64
+		if err := db.Model(&LicenseKey{}).Where("key = ?", key).Count(&existing).Error; err != nil {
+			return nil, err
+		}
+		if existing > 0 {
+			summary.Skipped = append(summary.Skipped, key)
+			continue
+		}
+
+		customer, err := importBundleCustomer(db, bundle.Customer, bk, customers, summary)
+		if err != nil {
+			summary.Failed = append(summary.Failed, BundleImportFailure{Key: key, Error: err.Error()})
+			continue
+		}
+		product, err := importBundleProduct(db, bk.Product, products, summary)
+		if err != nil {
+			summary.Failed = append(summary.Failed, BundleImportFailure{Key: key, Error: err.Error()})
+			continue
+		}
+
+		licenseKey := &LicenseKey{
+			Key:                key,
+			ProductID:          product.ID,
+			CustomerID:         customer.ID,
+			ExpiresAt:          bk.ExpiresAt,
+			MaxActivations:     bk.MaxActivations,
+			CurrentActivations: bk.CurrentActivations,
+			UsageLimit:         bk.UsageLimit,
+			UsageCount:         bk.UsageCount,
+			PurchasedVersion:   bk.PurchasedVersion,
+			LicenseType:        NormalizeLicenseType(bk.LicenseType),
+			SubscriptionID:     bk.SubscriptionID,
+			Price:              bk.Price,
+			Currency:           bk.Currency,
+			SaleID:             bk.SaleID,
+			Status:             bk.Status,
+			IsTrial:            bk.IsTrial,
+			RevokedAt:          bk.RevokedAt,
+			RevokedReason:      bk.RevokedReason,
+			Labels:             bk.Labels,
+			CreatedAt:          bk.CreatedAt,
+		}
+		if licenseKey.Status == "" {
+			licenseKey.Status = "active"
+		}
+		if licenseKey.MaxActivations == 0 {
+			licenseKey.MaxActivations = product.DefaultUsageLimit
+		}
+		if err := licenseKey.SetMetadataMap(bk.Metadata); err != nil {
+			summary.Failed = append(summary.Failed, BundleImportFailure{Key: key, Error: err.Error()})
+			continue
+		}
+		if err := db.Create(licenseKey).Error; err != nil {
+			if IsUniqueViolation(err) {
+				summary.Skipped = append(summary.Skipped, key)
+				continue
+			}
+			return nil, err
+		}
+		summary.Imported++
+		summary.ImportedIDs = append(summary.ImportedIDs, licenseKey.ID)
+	}
+	return summary, nil
+}
+
+// importBundleCustomer finds or creates the customer a bundled key belongs
+// to. Details beyond email and name are only copied onto new customers, so an
+// import never overwrites what an admin has edited here.
+func importBundleCustomer(db *gorm.DB, fallback BundleCustomer, bk BundleLicenseKey, seen map[string]*Customer, summary *BundleImportSummary) (*Customer, error) {
+	details := fallback
+	if bk.CustomerEmail != "" {
+		details = BundleCustomer{Email: bk.CustomerEmail, Name: bk.CustomerName}
+	}
+	email, err := NormalizeEmail(details.Email)
+	if err != nil {
+		return nil, fmt.Errorf("customer email: %w", err)
+	}
+	if customer, ok := seen[email]; ok {
+		return customer, nil
+	}
+
+	var existing int64
+	if err := db.Model(&Customer{}).Where("LOWER(email) = ?", email).Count(&existing).Error; err != nil {
+		return nil, err
+	}
+	customer, err := (&Customer{}).FindOrCreateByEmail(db, email, details.Name)
+	if err != nil {
+		return nil, err
+	}
+	if existing == 0 {
+		summary.CustomersCreated++
+		customer.FirstName = details.FirstName
+		customer.LastName = details.LastName
+		customer.Company = details.Company
+		customer.Notes = details.Notes
+		customer.Tags = details.Tags
+		if err := db.Save(customer).Error; err != nil {
+			return nil, err
+		}
+	}
+	seen[email] = customer
+	return customer, nil
+}
+
+// importBundleProduct maps a bundled product onto one here by permalink, then
+// name, creating it when neither matches
+func importBundleProduct(db *gorm.DB, bp BundleProduct, seen map[string]*Product, summary *BundleImportSummary) (*Product, error) {
+	lookup := strings.TrimSpace(bp.Permalink)
+	if lookup == "" {
+		lookup = strings.TrimSpace(bp.Name)
+	}
+	if lookup == "" {
+		return nil, errors.New("product permalink or name is required")
+	}
+	if product, ok := seen[lookup]; ok {
+		return product, nil
+	}
+
+	product, err := FindProductByPermalink(db, lookup)
+	if errors.Is(err, gorm.ErrRecordNotFound) && bp.Name != "" {
+		product, err = FindProductByPermalink(db, bp.Name)
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		name := bp.Name
+		if name == "" {
+			name = bp.Permalink
+		}
+		product = &Product{Name: name, Version: bp.Version}
+		if err := product.SetPermalink(db, bp.Permalink); err != nil {
+			return nil, err
+		}
+		if err := db.Create(product).Error; err != nil {
+			return nil, err
+		}
+		summary.ProductsCreated++
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seen[lookup] = product
+	return product, nil
+}
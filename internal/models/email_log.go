@@ -0,0 +1,55 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Email delivery statuses
+const (
+	EmailStatusSent    = "sent"
+	EmailStatusFailed  = "failed"
+	EmailStatusSkipped = "skipped" // Duplicate of a recent successful send
+)
+
+// EmailLog records one attempt to send an email, successful or not
+type EmailLog struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	To           string     `gorm:"column:recipient;not null;index" json:"to"` // "to" is an SQL keyword
+	Subject      string     `json:"subject"`
+	Type         string     `gorm:"not null" json:"type"` // One of EmailTemplateTypes
+	LicenseKeyID *uint      `gorm:"index" json:"license_key_id"`
+	Status       string     `gorm:"not null" json:"status"`
+	SentAt       *time.Time `json:"sent_at"`
+	Error        string     `json:"error"`
+	CreatedAt    time.Time
+}
+
+// SentRecently reports whether an identical email (same recipient, type,
+// subject and license key) was delivered successfully since the given time
+func SentRecently(db *gorm.DB, entry EmailLog, since time.Time) (bool, error) {
+	query := db.Model(&EmailLog{}).
+		Where("status = ? AND sent_at >= ?", EmailStatusSent, since).
+		Where("recipient = ? AND type = ? AND subject = ?", entry.To, entry.Type, entry.Subject)
+	if entry.LicenseKeyID != nil {
+		query = query.Where("license_key_id = ?", *entry.LicenseKeyID)
+	} else {
+		query = query.Where("license_key_id IS NULL")
+	}
+
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// EmailLogsForLicenseKey returns the delivery log for a key, newest first
+func EmailLogsForLicenseKey(db *gorm.DB, licenseKeyID uint) ([]EmailLog, error) {
+	var logs []EmailLog
+	err := db.Where("license_key_id = ?", licenseKeyID).
+		Order("created_at DESC, id DESC").
+		Find(&logs).Error
+	return logs, err
+}
@@ -0,0 +1,212 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Email template types
+const (
+	EmailTemplateLicenseKey = "license_key"
+	EmailTemplateTest       = "test"
+	EmailTemplateReminder   = "reminder"
+)
+
+// EmailTemplateTypes lists the editable templates in display order
+var EmailTemplateTypes = []string{EmailTemplateLicenseKey, EmailTemplateTest, EmailTemplateReminder}
+
+// EmailTemplate stores an admin-editable subject and body for one kind of email.
+// Both are Go text/template strings rendered with EmailTemplateData.
+type EmailTemplate struct {
+	ID        uint   `gorm:"primaryKey" json:"id"`
+	Type      string `gorm:"not null;uniqueIndex:idx_email_templates_type_product,priority:1" json:"type"`
+	ProductID *uint  `gorm:"uniqueIndex:idx_email_templates_type_product,priority:2" json:"product_id"` // Nil for the global template, see GetProductEmailTemplate
+	Subject   string `gorm:"not null" json:"subject"`
+	Body      string `gorm:"not null" json:"body"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// EmailTemplateData holds the variables available to email templates
+type EmailTemplateData struct {
+	ProductName   string
+	LicenseKey    string
+	CustomerName  string
+	CustomerEmail string
+	ExpiresAt     string
+}
+
+var defaultEmailTemplates = map[string]EmailTemplate{
+	EmailTemplateLicenseKey: {
+		Subject: "Your License Key for {{.ProductName}}",
+		Body: `
+<html>
+<body>
+	<h2>Your License Key</h2>
+	<p>Thank you for your purchase! Here are your license details:</p>
+
+	<div style="background-color: #f5f5f5; padding: 20px; margin: 20px 0; border-radius: 5px;">
+		<h3>Product: {{.ProductName}}</h3>
+		<p><strong>License Key:</strong> <code style="background-color: #e8e8e8; padding: 4px 8px; border-radius: 3px;">{{.LicenseKey}}</code></p>
+	</div>
+
+	<p>Please keep this license key safe and secure. You'll need it to activate your software.</p>
+
+	<p>If you have any questions or need support, please don't hesitate to contact us.</p>
+
+	<p>Best regards,<br>
+	The Matcha Team</p>
+</body>
+</html>`,
+	},
+	EmailTemplateTest: {
+		Subject: "Test Email from Matcha",
+		Body: `
+<html>
+<body>
+	<h2>Test Email</h2>
+	<p>This is a test email to verify your email configuration is working correctly.</p>
+	<p>If you received this email, your SMTP settings are properly configured.</p>
+</body>
+</html>`,
+	},
+	EmailTemplateReminder: {
+		Subject: "Your {{.ProductName}} license expires soon",
+		Body: `
+<html>
+<body>
+	<h2>License Expiring Soon</h2>
+	<p>Hi {{.CustomerName}},</p>
+	<p>Your license <code>{{.LicenseKey}}</code> for {{.ProductName}} expires on {{.ExpiresAt}}.</p>
+	<p>Renew before then to keep using the software without interruption.</p>
+</body>
+</html>`,
+	},
+}
+
+// DefaultEmailTemplate returns the built-in template used when none is stored
+func DefaultEmailTemplate(templateType string) EmailTemplate {
+	tmpl := defaultEmailTemplates[templateType]
+	tmpl.Type = templateType
+	return tmpl
+}
+
+// GetEmailTemplate loads the stored global template for a type, falling back
+// to the default
+func GetEmailTemplate(db *gorm.DB, templateType string) EmailTemplate {
+	var tmpl EmailTemplate
+	if err := db.Where("type = ? AND product_id IS NULL", templateType).First(&tmpl).Error; err != nil {
+		return DefaultEmailTemplate(templateType)
+	}
+	return tmpl
+}
+
+// ProductEmailTemplate loads the template a product overrides a type with. It
+// returns gorm.ErrRecordNotFound when the product uses the global one.
+func ProductEmailTemplate(db *gorm.DB, productID uint, templateType string) (*EmailTemplate, error) {
+	var tmpl EmailTemplate
+	if err := db.Where("type = ? AND product_id = ?", templateType, productID).First(&tmpl).Error; err != nil {
+		return nil, err
+	}
+	return &tmpl, nil
+}
+
+// GetProductEmailTemplate loads the product's own template for a type, falling
+// back to the global template and then to the default. A zero productID
+// skips straight to the global template.
+func GetProductEmailTemplate(db *gorm.DB, productID uint, templateType string) EmailTemplate {
+	if productID != 0 {
+		if tmpl, err := ProductEmailTemplate(db, productID, templateType); err == nil {
+			return *tmpl
+		}
+	}
+	return GetEmailTemplate(db, templateType)
+}
+
+// DeleteProductEmailTemplate removes a product's override so it goes back to
+// the global template
+func DeleteProductEmailTemplate(db *gorm.DB, productID uint, templateType string) error {
+	return db.Where("type = ? AND product_id = ?", templateType, productID).Delete(&EmailTemplate{}).Error
+}
+
+// legacyTemplateTypeIndex made a type unique across all templates, before
+// products could override them
+const legacyTemplateTypeIndex = "idx_email_templates_type"
+
+// DropGlobalTemplateIndex removes legacyTemplateTypeIndex so a product's
+// template can share a type with the global one. It runs at boot after
+// migrating and is a no-op once the index is gone.
+func DropGlobalTemplateIndex(db *gorm.DB) error {
+	if !db.Migrator().HasIndex(&EmailTemplate{}, legacyTemplateTypeIndex) {
+		return nil
+	}
+	return db.Migrator().DropIndex(&EmailTemplate{}, legacyTemplateTypeIndex)
+}
+
+// Validate checks that both subject and body parse as templates
+func (et *EmailTemplate) Validate() error {
+	if _, ok := defaultEmailTemplates[et.Type]; !ok {
+		return fmt.Errorf("unknown email template type: %s", et.Type)
+	}
+	if _, err := template.New("subject").Parse(et.Subject); err != nil {
+		return fmt.Errorf("invalid subject template: %w", err)
+	}
+	if _, err := template.New("body").Parse(et.Body); err != nil {
+		return fmt.Errorf("invalid body template: %w", err)
+	}
+	// A trial render catches references to variables that don't exist
+	if _, _, err := et.Render(EmailTemplateData{}); err != nil {
+		return fmt.Errorf("invalid template variable: %w", err)
+	}
+	return nil
+}
+
+// Render executes the subject and body templates with data
+func (et *EmailTemplate) Render(data EmailTemplateData) (string, string, error) {
+	subject, err := renderTemplate("subject", et.Subject, data)
+	if err != nil {
+		return "", "", err
+	}
+	body, err := renderTemplate("body", et.Body, data)
+	if err != nil {
+		return "", "", err
+	}
+	return subject, body, nil
+}
+
+// SaveEmailTemplate validates and upserts the template for its type and
+// product, the global one when ProductID is nil
+func SaveEmailTemplate(db *gorm.DB, tmpl *EmailTemplate) error {
+	if err := tmpl.Validate(); err != nil {
+		return err
+	}
+
+	query := db.Where("type = ?", tmpl.Type)
+	if tmpl.ProductID == nil {
+		query = query.Where("product_id IS NULL")
+	} else {
+		query = query.Where("product_id = ?", *tmpl.ProductID)
+	}
+	var existing EmailTemplate
+	if err := query.First(&existing).Error; err == nil {
+		tmpl.ID = existing.ID
+		tmpl.CreatedAt = existing.CreatedAt
+	}
+	return db.Save(tmpl).Error
+}
+
+func renderTemplate(name, text string, data EmailTemplateData) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,142 @@
+package models
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Character sets for generated license keys, see Product.KeyCharset
+const (
+	KeyCharsetAlphanumeric = "alphanumeric"
+	// Crockford's base32 leaves out I, L, O and U, so a key read off a
+	// screen or over the phone can't be mistyped as a similar character
+	KeyCharsetCrockford = "crockford"
+)
+
+const (
+	alphanumericChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	crockfordChars    = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+// Bounds on Product.KeyLength. Sixteen base32 characters still carry 80 bits
+// of randomness, plenty against guessing through the rate-limited API.
+const (
+	DefaultKeyLength = 32
+	MinKeyLength     = 16
+	MaxKeyLength     = 128
+)
+
+// NormalizeKeyCharset maps form input to a known key charset, defaulting to alphanumeric
+func NormalizeKeyCharset(charset string) string {
+	if charset == KeyCharsetCrockford {
+		return charset
+	}
+	return KeyCharsetAlphanumeric
+}
+
+// ValidateKeyLength rejects lengths too short to be unguessable, or too long to type
+func ValidateKeyLength(length int) error {
+	if length < MinKeyLength || length > MaxKeyLength {
+		return fmt.Errorf("key length must be between %d and %d characters", MinKeyLength, MaxKeyLength)
+	}
+	return nil
+}
+
+// NewKey draws a random license key in the product's configured format.
+// Products saved before the format was configurable get 32 alphanumerics.
+func (p *Product) NewKey() string {
+	length := p.KeyLength
+	if length == 0 {
+		length = DefaultKeyLength
+	}
+	if NormalizeKeyCharset(p.KeyCharset) == KeyCharsetCrockford {
+		return randomString(length, crockfordChars)
+	}
+	return randomString(length, alphanumericChars)
+}
+
+// NormalizeKey is the stored form of a license key: upper case without
+// whitespace, so a key pasted with a trailing newline or typed in lower case
+// still matches. Dashes are kept since hand-entered keys may use them.
+func NormalizeKey(key string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(key), ""))
+}
+
+// LookupKey is the indexed form verification matches a key by: normalized
+// and without dashes, since generated keys have none and customers add them
+// to group the characters.
+func LookupKey(key string) string {
+	return strings.ReplaceAll(NormalizeKey(key), "-", "")
+}
+
+// KeyLookupCandidates lists the lookup keys a submitted key may match.
+// Crockford keys also forgive look-alike letters.
+func (p *Product) KeyLookupCandidates(submitted string) []string {
+	candidates := []string{LookupKey(submitted)}
+	if NormalizeKeyCharset(p.KeyCharset) == KeyCharsetCrockford {
+		if crockford := NormalizeCrockfordKey(candidates[0]); crockford != candidates[0] {
+			candidates = append(candidates, crockford)
+		}
+	}
+	return candidates
+}
+
+// FindLicenseKeysByKey looks a key up across every product, for when only the
+// key string is known. It forgives what verification forgives: case,
+// whitespace, dashes and, for products with Crockford keys, look-alike
+// letters. Keys are only unique within a product, so several may match.
+func FindLicenseKeysByKey(db *gorm.DB, submitted string) ([]LicenseKey, error) {
+	candidates := (&Product{KeyCharset: KeyCharsetCrockford}).KeyLookupCandidates(submitted)
+
+	var matches []LicenseKey
+	err := db.Preload("Product").Preload("Customer").
+		Where("lookup_key IN ?", candidates).
+		Order("id").
+		Find(&matches).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// The Crockford reading only counts for keys of Crockford products
+	found := matches[:0]
+	for _, lk := range matches {
+		if slices.Contains(lk.Product.KeyLookupCandidates(submitted), lk.LookupKey) {
+			found = append(found, lk)
+		}
+	}
+	return found, nil
+}
+
+// BackfillLookupKeys fills in the lookup key of keys stored before the
+// column existed
+func BackfillLookupKeys(db *gorm.DB) error {
+	var rows []struct {
+		ID  uint
+		Key string
+	}
+	err := db.Model(&LicenseKey{}).
+		Select("id, key").
+		Where("lookup_key IS NULL OR lookup_key = ''").
+		Find(&rows).Error
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		// UpdateColumn skips hooks and leaves updated_at alone
+		err := db.Model(&LicenseKey{}).Where("id = ?", row.ID).UpdateColumn("lookup_key", LookupKey(row.Key)).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NormalizeCrockfordKey reads a typed key the way Crockford's base32 intends:
+// case-insensitive, with O taken as 0 and I or L as 1.
+func NormalizeCrockfordKey(key string) string {
+	return strings.NewReplacer("O", "0", "I", "1", "L", "1").Replace(strings.ToUpper(key))
+}
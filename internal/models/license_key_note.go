@@ -0,0 +1,60 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// maxNoteLength caps a support note; anything longer belongs in a ticket
+const maxNoteLength = 4000
+
+// LicenseKeyNote is an internal support note on a license key, such as
+// "customer reported a crash on 2.1, comped an extra seat". Unlike metadata it
+// is never returned by the API.
+type LicenseKeyNote struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	LicenseKeyID uint      `gorm:"not null;index" json:"license_key_id"`
+	AdminUserID  uint      `gorm:"not null;index" json:"admin_user_id"`
+	AdminUser    AdminUser `gorm:"foreignKey:AdminUserID" json:"-"`
+	Body         string    `gorm:"type:text;not null" json:"body"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Author names the admin who wrote the note
+func (n LicenseKeyNote) Author() string {
+	if n.AdminUser.Username == "" {
+		return "Deleted admin"
+	}
+	return n.AdminUser.Username
+}
+
+// AddLicenseKeyNote attaches a note by admin to a license key
+func AddLicenseKeyNote(db *gorm.DB, licenseKeyID uint, admin *AdminUser, body string) (*LicenseKeyNote, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return nil, errors.New("note cannot be empty")
+	}
+	if len(body) > maxNoteLength {
+		return nil, errors.New("note is too long")
+	}
+
+	note := &LicenseKeyNote{LicenseKeyID: licenseKeyID, AdminUserID: admin.ID, Body: body}
+	if err := db.Create(note).Error; err != nil {
+		return nil, err
+	}
+	note.AdminUser = *admin
+	return note, nil
+}
+
+// NotesForLicenseKey returns a key's notes with their authors, newest first
+func NotesForLicenseKey(db *gorm.DB, licenseKeyID uint) ([]LicenseKeyNote, error) {
+	var notes []LicenseKeyNote
+	err := db.Preload("AdminUser").
+		Where("license_key_id = ?", licenseKeyID).
+		Order("created_at DESC, id DESC").
+		Find(&notes).Error
+	return notes, err
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LicenseKeyRotation records a license key's string being replaced, e.g.
+// after it leaked. Only a hash of the old string is kept, so the history can
+// show which key a customer had without handing out a working one.
+type LicenseKeyRotation struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	LicenseKeyID uint      `gorm:"not null;index" json:"license_key_id"`
+	OldKeyHash   string    `gorm:"not null" json:"old_key_hash"` // Hex SHA-256 of the normalized old key
+	RotatedBy    string    `json:"rotated_by"`                   // Username of the admin who rotated it
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// HashKey is the hex SHA-256 of a normalized license key, for matching a key
+// reported by a customer against LicenseKeyRotation.OldKeyHash
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(NormalizeKey(key)))
+	return hex.EncodeToString(sum[:])
+}
+
+// RotateKey gives the key a freshly generated string in the format of its
+// product, keeping product, customer, expiry and activations, and records a
+// hash of the old string. The old string stops verifying as soon as this
+// returns, and an edit form opened before the rotation goes stale. rotatedBy
+// names who asked for it.
+func (lk *LicenseKey) RotateKey(db *gorm.DB, rotatedBy string) error {
+	product := lk.Product
+	if product.ID != lk.ProductID {
+		if err := db.First(&product, lk.ProductID).Error; err != nil {
+			return err
+		}
+	}
+
+	oldKey := lk.Key
+	var err error
+	for attempt := 0; attempt < maxKeyGenerationAttempts; attempt++ {
+		newKey := newLicenseKey(&product)
+		err = db.Transaction(func(tx *gorm.DB) error {
+			rotation := &LicenseKeyRotation{LicenseKeyID: lk.ID, OldKeyHash: HashKey(oldKey), RotatedBy: rotatedBy}
+			if err := tx.Create(rotation).Error; err != nil {
+				return err
+			}
+			return tx.Model(&LicenseKey{}).Where("id = ?", lk.ID).Updates(map[string]interface{}{
+				"key":          NormalizeKey(newKey),
+				"lookup_key":   LookupKey(newKey),
+				"lock_version": gorm.Expr("lock_version + 1"),
+			}).Error
+		})
+		if err == nil {
+			lk.Key = NormalizeKey(newKey)
+			lk.LookupKey = LookupKey(newKey)
+			lk.LockVersion++
+			return nil
+		}
+		if !IsUniqueViolation(err) {
+			break
+		}
+	}
+	return err
+}
+
+// RotationsForLicenseKey returns a key's rotations, newest first
+func RotationsForLicenseKey(db *gorm.DB, licenseKeyID uint) ([]LicenseKeyRotation, error) {
+	var rotations []LicenseKeyRotation
+	err := db.Where("license_key_id = ?", licenseKeyID).
+		Order("created_at DESC, id DESC").
+		Find(&rotations).Error
+	return rotations, err
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrStaleRecord is returned when a record changed after it was loaded for editing
+var ErrStaleRecord = errors.New("record was changed by someone else")
+
+// Lockable is a record with a lock_version column, see SaveIfUnchanged
+type Lockable interface {
+	lockVersion() *int
+}
+
+func (p *Product) lockVersion() *int     { return &p.LockVersion }
+func (c *Customer) lockVersion() *int    { return &c.LockVersion }
+func (lk *LicenseKey) lockVersion() *int { return &lk.LockVersion }
+
+// SaveIfUnchanged saves every column of record, like Save, but only while the
+// stored lock_version still equals expected, the version the editor started
+// from. The version is bumped on success; ErrStaleRecord means someone else
+// saved in between and nothing was written.
+func SaveIfUnchanged(db *gorm.DB, record Lockable, expected int) error {
+	version := record.lockVersion()
+	*version = expected + 1
+
+	result := db.Model(record).
+		Where("lock_version = ?", expected).
+		Select("*").
+		Omit(clause.Associations).
+		Updates(record)
+	if result.Error == nil && result.RowsAffected == 0 {
+		result.Error = ErrStaleRecord
+	}
+	if result.Error != nil {
+		*version = expected
+		return result.Error
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LoginThrottle counts recent failed admin logins for one username or client
+// IP. It lives in the database so a lockout survives a restart.
+type LoginThrottle struct {
+	ID          uint       `gorm:"primaryKey"`
+	Key         string     `gorm:"not null;uniqueIndex"` // "user:<name>" or "ip:<address>", see LoginThrottleKeys
+	Failures    int        `gorm:"not null;default:0"`
+	WindowStart time.Time  `gorm:"not null"`
+	LockedUntil *time.Time // Set once Failures reaches the limit
+	UpdatedAt   time.Time
+}
+
+// LoginThrottlePolicy is how many failures within Window lock a username or
+// IP out, and for how long
+type LoginThrottlePolicy struct {
+	MaxFailures int
+	Window      time.Duration
+	Lockout     time.Duration
+}
+
+// LoginThrottleKeys are the counters a login attempt is tracked under.
+// Usernames are case-insensitive so varying the case doesn't reset them.
+func LoginThrottleKeys(username, ip string) []string {
+	return []string{"user:" + strings.ToLower(strings.TrimSpace(username)), "ip:" + ip}
+}
+
+// LoginLocked reports whether any of the keys is locked out at now
+func LoginLocked(db *gorm.DB, keys []string, now time.Time) (bool, error) {
+	var count int64
+	err := db.Model(&LoginThrottle{}).
+		Where("key IN ? AND locked_until > ?", keys, now.UTC()).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// RecordLoginFailure counts a failed login against every key, locking a key
+// out when it reaches the policy's limit. It reports whether any key is now locked.
+func RecordLoginFailure(db *gorm.DB, keys []string, now time.Time, policy LoginThrottlePolicy) (bool, error) {
+	now = now.UTC() // LoginLocked compares locked_until in SQL
+	locked := false
+	for _, key := range keys {
+		var throttle LoginThrottle
+		err := db.Where("key = ?", key).First(&throttle).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			throttle = LoginThrottle{Key: key, WindowStart: now}
+		} else if err != nil {
+			return false, err
+		}
+
+		// Failures older than the window, or from before a lockout ended, no longer count
+		expired := throttle.LockedUntil != nil && !throttle.LockedUntil.After(now)
+		if expired || now.Sub(throttle.WindowStart) > policy.Window {
+			throttle.Failures = 0
+			throttle.WindowStart = now
+			throttle.LockedUntil = nil
+		}
+
+		throttle.Failures++
+		if throttle.Failures >= policy.MaxFailures {
+			until := now.Add(policy.Lockout)
+			throttle.LockedUntil = &until
+			locked = true
+		}
+		if err := db.Save(&throttle).Error; err != nil {
+			return false, err
+		}
+	}
+	return locked, nil
+}
+
+// ResetLoginFailures clears the counters after a successful login
+func ResetLoginFailures(db *gorm.DB, keys []string) error {
+	return db.Where("key IN ?", keys).Delete(&LoginThrottle{}).Error
+}
@@ -2,22 +2,46 @@ package models
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+
+	"matcha/internal/clock"
+	"matcha/internal/database"
 )
 
 type Product struct {
 	ID                    uint   `gorm:"primaryKey" json:"id"`
 	Name                  string `gorm:"not null" json:"name"`
+	Permalink             string `gorm:"uniqueIndex" json:"permalink"` // Public slug, see SetPermalink
 	Description           string `json:"description"`
 	Version               string `gorm:"default:1.0.0" json:"version"`
-	DefaultExpirationDays int    `gorm:"not null;default:365" json:"default_expiration_days"`
+	DefaultExpirationDays int    `gorm:"not null;default:365" json:"default_expiration_days"`  // Counted in DefaultExpirationUnit
+	DefaultExpirationUnit string `gorm:"not null;default:days" json:"default_expiration_unit"` // See ExpirationUnitDays
 	DefaultUsageLimit     int    `gorm:"not null;default:1" json:"default_usage_limit"`
+	APIKey                string `gorm:"index" json:"-"`                                   // SHA-256 digest, see HashAPIKey
+	APIKeyHint            string `json:"-"`                                                // Last characters of the key, to tell it apart
+	RateLimitExempt       bool   `gorm:"not null;default:false" json:"rate_limit_exempt"`  // Requests carrying APIKey skip rate limits
+	LicenseType           string `gorm:"not null;default:node_locked" json:"license_type"` // Default for new keys, see LicenseTypeNodeLocked
+	Perpetual             bool   `gorm:"not null;default:false" json:"perpetual"`          // New keys never expire, DefaultExpirationDays is ignored
+	IncrementOnVerify     *bool  `gorm:"not null;default:true" json:"increment_on_verify"` // Nil means true, see IncrementsOnVerify
+	KeyLength             int    `gorm:"not null;default:32" json:"key_length"`            // Generated key length, see ValidateKeyLength
+	KeyCharset            string `gorm:"not null;default:alphanumeric" json:"key_charset"` // See KeyCharsetCrockford
+	DefaultMetadata       string `json:"default_metadata"`                                 // JSON object new keys start their metadata from
+	LockVersion           int    `gorm:"not null;default:0" json:"lock_version"`           // See SaveIfUnchanged
+	OwnerID               *uint  `gorm:"index" json:"owner_id,omitempty"`                  // Tenant, see OwnedBy
 	CreatedAt             time.Time
 	UpdatedAt             time.Time
 	LicenseKeys           []LicenseKey `gorm:"foreignKey:ProductID"`
@@ -26,10 +50,14 @@ type Product struct {
 type Customer struct {
 	ID          uint   `gorm:"primaryKey" json:"id"`
 	Email       string `gorm:"not null;uniqueIndex" json:"email"`
-	Name        string `gorm:"not null" json:"name"`
+	Name        string `gorm:"not null;index" json:"name"`
 	FirstName   string `json:"first_name"`
 	LastName    string `json:"last_name"`
 	Company     string `json:"company"`
+	Notes       string `gorm:"type:text" json:"notes"`
+	Tags        string `json:"tags"`                                   // Normalized comma-separated list, see SetTags
+	LockVersion int    `gorm:"not null;default:0" json:"lock_version"` // See SaveIfUnchanged
+	OwnerID     *uint  `gorm:"index" json:"owner_id,omitempty"`        // Tenant, see OwnedBy
 	CreatedAt   time.Time
 	UpdatedAt   time.Time
 	LicenseKeys []LicenseKey `gorm:"foreignKey:CustomerID"`
@@ -37,8 +65,9 @@ type Customer struct {
 
 type LicenseKey struct {
 	ID                 uint       `gorm:"primaryKey" json:"id"`
-	Key                string     `gorm:"not null;uniqueIndex" json:"key"`
-	ProductID          uint       `gorm:"not null" json:"product_id"`
+	Key                string     `gorm:"not null;uniqueIndex:idx_license_keys_product_key,priority:2" json:"key"` // Unique per product, see DropGlobalKeyIndex
+	ProductID          uint       `gorm:"not null;uniqueIndex:idx_license_keys_product_key,priority:1" json:"product_id"`
+	LookupKey          string     `gorm:"index" json:"-"` // Key without dashes, matched exactly by verification, see LookupKey
 	CustomerID         uint       `gorm:"not null" json:"customer_id"`
 	ExpiresAt          *time.Time `json:"expires_at"`
 	MaxActivations     int        `gorm:"not null;default:1" json:"max_activations"`
@@ -46,9 +75,20 @@ type LicenseKey struct {
 	UsageLimit         int        `gorm:"not null;default:1" json:"usage_limit"`
 	UsageCount         int        `gorm:"not null;default:0" json:"usage_count"`
 	Metadata           string     `json:"metadata"`
+	PurchasedVersion   string     `json:"purchased_version"` // Product version at the time of sale
+	LicenseType        string     `gorm:"not null;default:node_locked" json:"license_type"`
+	SubscriptionID     string     `gorm:"index" json:"subscription_id"` // Provider subscription that pays for the key, if any
+	Price              int64      `json:"price"`                        // Sale amount in Currency's minor unit, e.g. cents
+	Currency           string     `json:"currency"`                     // ISO 4217 code, empty when the key wasn't sold through a webhook
+	SaleID             string     `gorm:"index" json:"sale_id"`         // Provider's payment or sale ID
 	Status             string     `gorm:"not null;default:active" json:"status"`
 	IsTrial            bool       `gorm:"not null;default:false" json:"is_trial"`
 	LastValidatedAt    *time.Time `json:"last_validated_at"`
+	RevokedAt          *time.Time `json:"revoked_at"`
+	RevokedReason      string     `json:"revoked_reason"`
+	Labels             string     `json:"labels"`                                 // Normalized comma-separated list, see SetLabels
+	LockVersion        int        `gorm:"not null;default:0" json:"lock_version"` // See SaveIfUnchanged
+	OwnerID            *uint      `gorm:"index" json:"owner_id,omitempty"`        // Tenant, the product's; see OwnedBy
 	CreatedAt          time.Time
 	UpdatedAt          time.Time
 	Product            Product  `gorm:"foreignKey:ProductID"`
@@ -58,60 +98,398 @@ type LicenseKey struct {
 type AdminUser struct {
 	ID           uint   `gorm:"primaryKey"`
 	Username     string `gorm:"not null;uniqueIndex"`
+	Email        string `gorm:"index"`
 	PasswordHash string `gorm:"not null"`
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
+	Role         string `gorm:"not null;default:owner"` // See RoleOwner
+	// Set on bootstrap admins; RequireAuth holds them on the change-password page
+	MustChangePassword bool   `gorm:"not null;default:false"`
+	Theme              string `gorm:"not null;default:system"` // See ThemeSystem
+	// Tenant the admin is confined to when multi-tenancy is on; nil sees everything
+	OwnerID   *uint `gorm:"index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Admin roles. Owners can do everything. Support admins work with products,
+// customers and license keys but can't manage admins or email settings.
+// Readonly admins can look at everything but change nothing.
+const (
+	RoleOwner    = "owner"
+	RoleSupport  = "support"
+	RoleReadonly = "readonly"
+)
+
+// AdminRoles lists the roles an admin can have
+var AdminRoles = []string{RoleOwner, RoleSupport, RoleReadonly}
+
+// roleLegacyAdmin is the role every admin had before roles were enforced
+const roleLegacyAdmin = "admin"
+
+// IsAdminRole reports whether role is one of AdminRoles
+func IsAdminRole(role string) bool {
+	for _, r := range AdminRoles {
+		if role == r {
+			return true
+		}
+	}
+	return false
 }
 
+// Admin UI themes. System follows the browser's light or dark preference.
+const (
+	ThemeLight  = "light"
+	ThemeDark   = "dark"
+	ThemeSystem = "system"
+)
+
 type EmailSettings struct {
 	ID             uint   `gorm:"primaryKey" json:"id"`
 	Provider       string `gorm:"not null;default:smtp" json:"provider"`
 	SMTPHost       string `json:"smtp_host"`
 	SMTPPort       int    `json:"smtp_port"`
 	SMTPUsername   string `json:"smtp_username"`
-	SMTPPassword   string `json:"smtp_password"`
-	SMTPEncryption string `gorm:"default:tls" json:"smtp_encryption"`
+	SMTPPassword   string `json:"-"`                                              // Encrypted at rest, see secrets.go
+	SMTPEncryption string `gorm:"default:tls" json:"smtp_encryption"`             // See SMTPEncryptionTLS
+	SMTPRootCA     string `gorm:"type:text" json:"smtp_root_ca"`                  // PEM bundle for servers signed by a private CA
+	SMTPSkipVerify bool   `gorm:"not null;default:false" json:"smtp_skip_verify"` // Accept any certificate; prefer SMTPRootCA
 	FromEmail      string `gorm:"not null" json:"from_email"`
 	FromName       string `json:"from_name"`
+	ReplyTo        string `json:"reply_to"` // Where customer replies go; blank sends them to FromEmail
 	IsActive       bool   `gorm:"default:false" json:"is_active"`
 	CreatedAt      time.Time
 	UpdatedAt      time.Time
 }
 
+// SMTP encryption modes
+const (
+	// SMTPEncryptionTLS upgrades with STARTTLS, except on port 465 where the
+	// connection is TLS from the start. It is the default.
+	SMTPEncryptionTLS = "tls"
+	// SMTPEncryptionSTARTTLS connects in plaintext and refuses to continue
+	// unless the server upgrades with STARTTLS
+	SMTPEncryptionSTARTTLS = "starttls"
+	// SMTPEncryptionSSL is TLS from the first byte, usually on port 465
+	SMTPEncryptionSSL = "ssl"
+	// SMTPEncryptionNone never encrypts, for local relays only
+	SMTPEncryptionNone = "none"
+)
+
+// Webhook event statuses. An event is claimed as processing while an attempt
+// runs, so only one worker can act on it at a time.
+const (
+	WebhookStatusPending    = "pending"
+	WebhookStatusProcessing = "processing"
+	WebhookStatusProcessed  = "processed"
+	WebhookStatusFailed     = "failed"
+	WebhookStatusDead       = "dead"
+)
+
+// WebhookEvent is an incoming payment provider webhook, persisted before it is
+// processed so failures can be retried and inspected.
+type WebhookEvent struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	Provider      string     `gorm:"not null;index" json:"provider"`
+	Payload       string     `gorm:"not null" json:"payload"`
+	Status        string     `gorm:"not null;default:pending;index" json:"status"`
+	Attempts      int        `gorm:"not null;default:0" json:"attempts"`
+	LastError     string     `json:"last_error"`
+	LicenseKeyID  *uint      `json:"license_key_id"`
+	NextAttemptAt *time.Time `gorm:"index" json:"next_attempt_at"`
+	ProcessedAt   *time.Time `json:"processed_at"`
+	// Simulated events come from the admin webhook simulator: they skip
+	// signature checks and issue keys without emailing the customer
+	Simulated bool `gorm:"not null;default:false" json:"simulated"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// maxKeyGenerationAttempts bounds how often a colliding license key is regenerated
+const maxKeyGenerationAttempts = 5
+
+// newLicenseKey produces candidate license keys; tests swap it to force collisions
+var newLicenseKey = (*Product).NewKey
+
+// clk is where models read the current time, see UseClock
+var clk clock.Clock = clock.Real{}
+
+// UseClock makes models read the time from c, typically a clock.Fake in
+// tests, and returns a function restoring the previous clock
+func UseClock(c clock.Clock) (restore func()) {
+	previous := clk
+	clk = c
+	return func() { clk = previous }
+}
+
 // Product methods
 func (p *Product) GenerateLicenseKeyFor(db *gorm.DB, customer *Customer) (*LicenseKey, error) {
-	key := generateRandomKey(32)
-	expiresAt := time.Now().AddDate(0, 0, p.DefaultExpirationDays)
-
 	licenseKey := &LicenseKey{
-		Key:                key,
 		ProductID:          p.ID,
 		CustomerID:         customer.ID,
-		ExpiresAt:          &expiresAt,
+		ExpiresAt:          p.DefaultExpiry(clk.Now()),
 		MaxActivations:     p.DefaultUsageLimit,
 		CurrentActivations: 0,
+		PurchasedVersion:   p.Version,
+		LicenseType:        NormalizeLicenseType(p.LicenseType),
+		Metadata:           p.DefaultMetadata,
 		Status:             "active",
 		IsTrial:            false,
+		OwnerID:            p.OwnerID,
 	}
 
-	if err := db.Create(licenseKey).Error; err != nil {
+	// Keys are unique per product and concurrent inserts can race on the
+	// index, so draw a fresh key on collision
+	var err error
+	for attempt := 0; attempt < maxKeyGenerationAttempts; attempt++ {
+		licenseKey.ID = 0
+		licenseKey.Key = newLicenseKey(p)
+		err = database.PerformWrite(db, func(db *gorm.DB) error {
+			return db.Create(licenseKey).Error
+		})
+		if !IsUniqueViolation(err) {
+			break
+		}
+	}
+	if err != nil {
 		return nil, err
 	}
 
 	return licenseKey, nil
 }
 
+// IsUniqueViolation reports whether err comes from a unique index rejecting an insert
+func IsUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, gorm.ErrDuplicatedKey) || strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// legacyGlobalKeyIndex is the index that once made license keys unique across
+// all products
+const legacyGlobalKeyIndex = "idx_license_keys_key"
+
+// DropGlobalKeyIndex removes legacyGlobalKeyIndex. Keys are only ever looked
+// up together with their product, so they only need to be unique within one.
+// It runs at boot after migrating and is a no-op once the index is gone.
+func DropGlobalKeyIndex(db *gorm.DB) error {
+	if !db.Migrator().HasIndex(&LicenseKey{}, legacyGlobalKeyIndex) {
+		return nil
+	}
+	return db.Migrator().DropIndex(&LicenseKey{}, legacyGlobalKeyIndex)
+}
+
+// IncrementsOnVerify reports whether a verification activates the device when
+// the client doesn't say. It is a pointer so an explicit false survives GORM's
+// column default on insert.
+func (p *Product) IncrementsOnVerify() bool {
+	return p.IncrementOnVerify == nil || *p.IncrementOnVerify
+}
+
+// RequiresAPIKey reports whether verification requests for this product must
+// present its API key. Products without a key stay open for existing integrations.
+func (p *Product) RequiresAPIKey() bool {
+	return p.APIKey != ""
+}
+
+// CheckAPIKey compares the given key against the product's key in constant time
+func (p *Product) CheckAPIKey(key string) bool {
+	if !p.RequiresAPIKey() {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(p.APIKey), []byte(HashAPIKey(key))) == 1
+}
+
+// RegenerateAPIKey replaces the product's API key with a new random one. Only
+// its digest is stored, so the returned key is the one chance to show it.
+func (p *Product) RegenerateAPIKey(db *gorm.DB) (string, error) {
+	key := "mk_" + generateRandomKey(40)
+	p.APIKey = key
+	if err := db.Save(p).Error; err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// RemoveAPIKey clears the product's API key, making verification open again
+func (p *Product) RemoveAPIKey(db *gorm.DB) error {
+	p.APIKey = ""
+	p.APIKeyHint = ""
+	p.RateLimitExempt = false
+	return db.Save(p).Error
+}
+
+// IsRateLimitExemptAPIKey reports whether key is the API key of a product
+// marked exempt from rate limits
+func IsRateLimitExemptAPIKey(db *gorm.DB, key string) bool {
+	if key == "" {
+		return false
+	}
+	var count int64
+	db.Model(&Product{}).Where("api_key = ? AND rate_limit_exempt = ?", HashAPIKey(key), true).Count(&count)
+	return count > 0
+}
+
+// ErrProductHasLicenseKeys is returned when deleting a product that still has
+// license keys without asking for a cascade
+var ErrProductHasLicenseKeys = errors.New("cannot delete product with associated license keys")
+
+// CanDelete reports whether the product can be deleted without a cascade,
+// i.e. no license keys reference it
+func (p *Product) CanDelete(db *gorm.DB) (bool, error) {
+	var count int64
+	if err := db.Model(&LicenseKey{}).Where("product_id = ?", p.ID).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count == 0, nil
+}
+
+// DeleteWithGuard deletes the product, refusing with ErrProductHasLicenseKeys
+// while license keys reference it. With cascade the keys are deleted first,
+// in the same transaction.
+func (p *Product) DeleteWithGuard(db *gorm.DB, cascade bool) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		ok, err := p.CanDelete(tx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if !cascade {
+				return ErrProductHasLicenseKeys
+			}
+			if err := tx.Where("product_id = ?", p.ID).Delete(&LicenseKey{}).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("product_id = ?", p.ID).Delete(&ProductMapping{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("product_id = ?", p.ID).Delete(&EmailTemplate{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(p).Error
+	})
+}
+
 // Customer methods
+// SearchCustomers scopes a query to customers whose name, email or company
+// contains q, ignoring case. An empty q matches everyone.
+func SearchCustomers(q string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		q = strings.TrimSpace(q)
+		if q == "" {
+			return db
+		}
+		pattern := "%" + escapeLike(strings.ToLower(q)) + "%"
+		return db.Where(
+			"LOWER(name) LIKE ? ESCAPE '\\' OR LOWER(email) LIKE ? ESCAPE '\\' OR LOWER(company) LIKE ? ESCAPE '\\'",
+			pattern, pattern, pattern,
+		)
+	}
+}
+
+// CustomersTagged scopes a query to customers carrying tag. An empty tag
+// matches everyone.
+func CustomersTagged(tag string) func(*gorm.DB) *gorm.DB {
+	return taggedWith("tags", tag)
+}
+
+// taggedWith scopes a query to rows whose comma-separated column holds tag.
+// An empty tag matches every row.
+func taggedWith(column, tag string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		tag = normalizeTag(tag)
+		if tag == "" {
+			return db
+		}
+		// Wrapping in commas lets a single LIKE match whole tags only
+		return db.Where("(',' || "+column+" || ',') LIKE ? ESCAPE '\\'", "%,"+escapeLike(tag)+",%")
+	}
+}
+
+// SetTags replaces the customer's tags from a comma-separated list, dropping
+// blanks and duplicates
+func (c *Customer) SetTags(input string) {
+	c.Tags = joinTags(input)
+}
+
+// TagList returns the customer's tags in the order they were entered
+func (c Customer) TagList() []string {
+	return splitTags(c.Tags)
+}
+
+// HasTag reports whether the customer carries tag
+func (c Customer) HasTag(tag string) bool {
+	tag = normalizeTag(tag)
+	for _, t := range c.TagList() {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// joinTags normalizes a comma-separated list for storage, dropping blanks
+// and duplicates
+func joinTags(input string) string {
+	var tags []string
+	seen := map[string]bool{}
+	for _, tag := range strings.Split(input, ",") {
+		tag = normalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return strings.Join(tags, ",")
+}
+
+func splitTags(stored string) []string {
+	if stored == "" {
+		return nil
+	}
+	return strings.Split(stored, ",")
+}
+
+// escapeLike escapes LIKE wildcards so user input is matched literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// ErrInvalidEmail is returned when an email address cannot be parsed
+var ErrInvalidEmail = errors.New("invalid email address")
+
+// NormalizeEmail trims and lowercases an email address so case variants share
+// the unique index, rejecting anything that isn't a bare address
+func NormalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || !strings.Contains(email[strings.LastIndex(email, "@")+1:], ".") {
+		return "", ErrInvalidEmail
+	}
+	return email, nil
+}
+
 func (c *Customer) FindOrCreateByEmail(db *gorm.DB, email, name string) (*Customer, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
+	// LOWER() also matches customers stored before emails were normalized
 	var customer Customer
-	err := db.Where("email = ?", email).First(&customer).Error
+	err = db.Where("LOWER(email) = ?", email).First(&customer).Error
 	if err == nil {
 		return &customer, nil
 	}
 
 	if name == "" {
-		// Extract name from email
-		name = email[:len(email)-len("@domain.com")]
+		// Extract name from email (get part before @)
+		name = email[:strings.Index(email, "@")]
 	}
 
 	customer = Customer{
@@ -127,12 +505,193 @@ func (c *Customer) FindOrCreateByEmail(db *gorm.DB, email, name string) (*Custom
 }
 
 // LicenseKey methods
+// IsValidForUse reports whether the key may be verified: it is active and not
+// past its expiry. Running out of activations or usage only stops further
+// activations or metered uses, see RegisterActivation and IncrementUsage.
 func (lk *LicenseKey) IsValidForUse() bool {
-	return lk.Status == "active" && !lk.IsExpired() && lk.CurrentActivations < lk.MaxActivations
+	return lk.Status == "active" && !lk.IsExpired()
+}
+
+// HasFreeActivation reports whether another device may be activated.
+// MaxActivations of 0 means unlimited.
+func (lk *LicenseKey) HasFreeActivation() bool {
+	return lk.MaxActivations == 0 || lk.CurrentActivations < lk.MaxActivations
+}
+
+// UsageExhausted reports whether metered usage has reached UsageLimit.
+// A UsageLimit of 0 means unlimited.
+func (lk *LicenseKey) UsageExhausted() bool {
+	return lk.UsageLimit > 0 && lk.UsageCount >= lk.UsageLimit
+}
+
+// InvalidReason explains why IsValidForUse is false, for API clients. It
+// returns "" for keys that are valid.
+func (lk *LicenseKey) InvalidReason() string {
+	switch {
+	case lk.IsValidForUse():
+		return ""
+	case lk.IsRevoked():
+		return "revoked"
+	case lk.IsExpired():
+		return "expired"
+	case lk.Status == "expired":
+		// Older versions marked keys expired when their activations ran out
+		return "activation_limit_reached"
+	default:
+		return "inactive"
+	}
 }
 
+// Units for Product.DefaultExpirationDays
+const (
+	ExpirationUnitDays   = "days"
+	ExpirationUnitMonths = "months"
+	ExpirationUnitYears  = "years"
+)
+
+// NormalizeExpirationUnit maps form input to a known expiration unit, defaulting to days
+func NormalizeExpirationUnit(unit string) string {
+	switch unit {
+	case ExpirationUnitMonths, ExpirationUnitYears:
+		return unit
+	}
+	return ExpirationUnitDays
+}
+
+// DefaultExpiry is the expiry for a key issued at now, or nil for perpetual
+// products. Months and years land on the same day of the month, or the last
+// day of a shorter month, so a year from Feb 29 is Feb 28.
+func (p *Product) DefaultExpiry(now time.Time) *time.Time {
+	if p.Perpetual {
+		return nil
+	}
+
+	var expiresAt time.Time
+	switch NormalizeExpirationUnit(p.DefaultExpirationUnit) {
+	case ExpirationUnitMonths:
+		expiresAt = addMonths(now, p.DefaultExpirationDays)
+	case ExpirationUnitYears:
+		expiresAt = addMonths(now, 12*p.DefaultExpirationDays)
+	default:
+		expiresAt = now.AddDate(0, 0, p.DefaultExpirationDays)
+	}
+	return &expiresAt
+}
+
+// addMonths is AddDate for whole months, clamped to the end of the target
+// month instead of overflowing into the next one as AddDate does
+func addMonths(t time.Time, months int) time.Time {
+	shifted := t.AddDate(0, months, 0)
+	if shifted.Day() != t.Day() {
+		// Day 0 of a month is the last day of the previous one
+		shifted = shifted.AddDate(0, 0, -shifted.Day())
+	}
+	return shifted
+}
+
+// LicenseKeysLabeled scopes a query to keys carrying label. An empty label
+// matches every key.
+func LicenseKeysLabeled(label string) func(*gorm.DB) *gorm.DB {
+	return taggedWith("labels", label)
+}
+
+// SetLabels replaces the key's labels from a comma-separated list, normalized
+// the same way as customer tags
+func (lk *LicenseKey) SetLabels(input string) {
+	lk.Labels = joinTags(input)
+}
+
+// LabelList returns the key's labels in the order they were entered
+func (lk LicenseKey) LabelList() []string {
+	return splitTags(lk.Labels)
+}
+
+// IsExpired reports whether the expiry date has passed. Keys without one are
+// perpetual and never expire.
 func (lk *LicenseKey) IsExpired() bool {
-	return lk.ExpiresAt != nil && lk.ExpiresAt.Before(time.Now())
+	return lk.IsExpiredAt(clk.Now())
+}
+
+// IsExpiredAt reports whether the key had expired at now. Expiry is an
+// instant, so the answer doesn't depend on the zone either time is in; this
+// is the same comparison CountExpiredLicenseKeys makes in SQL.
+func (lk *LicenseKey) IsExpiredAt(now time.Time) bool {
+	return lk.ExpiresAt != nil && lk.ExpiresAt.Before(now)
+}
+
+// BeforeSave stores the key normalized, see NormalizeKey, along with its
+// lookup form, and the expiry in
+// UTC. SQLite compares times as text, so mixing offsets in the column would
+// break the range queries below.
+func (lk *LicenseKey) BeforeSave(tx *gorm.DB) error {
+	lk.Key = NormalizeKey(lk.Key)
+	lk.LookupKey = LookupKey(lk.Key)
+	if lk.ExpiresAt != nil {
+		utc := lk.ExpiresAt.UTC()
+		lk.ExpiresAt = &utc
+	}
+	return nil
+}
+
+// IsPerpetual reports whether the key has no expiry date
+func (lk *LicenseKey) IsPerpetual() bool {
+	return lk.ExpiresAt == nil
+}
+
+// ExpiringSoonWindow is how far ahead the dashboard looks for keys about to expire
+const ExpiringSoonWindow = 30 * 24 * time.Hour
+
+// CountExpiredLicenseKeys counts keys whose expiry date has passed. Perpetual
+// keys (NULL expiry) and revoked keys are excluded so the figure doesn't
+// depend on how the driver compares NULLs.
+func CountExpiredLicenseKeys(db *gorm.DB, now time.Time) (int64, error) {
+	var count int64
+	err := db.Model(&LicenseKey{}).
+		Where("expires_at IS NOT NULL AND expires_at < ? AND status != ?", now.UTC(), "revoked").
+		Count(&count).Error
+	return count, err
+}
+
+// CountExpiringSoon counts active keys that expire within the next window
+func CountExpiringSoon(db *gorm.DB, now time.Time, window time.Duration) (int64, error) {
+	var count int64
+	err := db.Model(&LicenseKey{}).
+		Where("expires_at IS NOT NULL AND expires_at >= ? AND expires_at < ? AND status = ?", now.UTC(), now.Add(window).UTC(), "active").
+		Count(&count).Error
+	return count, err
+}
+
+// LicenseKeysExpiringBetween returns the active keys whose expiry falls in
+// [from, to), the candidates for an expiry reminder. Perpetual keys have no
+// expiry and are never included.
+func LicenseKeysExpiringBetween(db *gorm.DB, from, to time.Time) ([]LicenseKey, error) {
+	var keys []LicenseKey
+	err := db.Preload("Product").Preload("Customer").
+		Where("status = ? AND expires_at IS NOT NULL AND expires_at >= ? AND expires_at < ?", "active", from.UTC(), to.UTC()).
+		Order("expires_at").
+		Find(&keys).Error
+	return keys, err
+}
+
+// ExpiresToday reports whether the key expires on the same calendar day as now,
+// with the day boundaries taken from loc rather than the server's zone.
+func (lk *LicenseKey) ExpiresToday(now time.Time, loc *time.Location) bool {
+	if lk.ExpiresAt == nil {
+		return false
+	}
+	start, end := DayBounds(now, loc)
+	return !lk.ExpiresAt.Before(start) && lk.ExpiresAt.Before(end)
+}
+
+// DaysRemaining is how many whole days are left before the key expires, or
+// nil for a perpetual key. It never goes below zero; why an expired key is no
+// longer valid is reported by InvalidReason instead.
+func (lk *LicenseKey) DaysRemaining() *int {
+	if lk.ExpiresAt == nil {
+		return nil
+	}
+	days := max(int(lk.ExpiresAt.Sub(clk.Now())/(24*time.Hour)), 0)
+	return &days
 }
 
 func (lk *LicenseKey) IsActive() bool {
@@ -143,37 +702,131 @@ func (lk *LicenseKey) IsRevoked() bool {
 	return lk.Status == "revoked"
 }
 
-func (lk *LicenseKey) IncrementUsage(db *gorm.DB) error {
+var (
+	ErrActivationLimitReached = errors.New("license key has no activations left")
+	ErrUsageLimitReached      = errors.New("license key has no usage left")
+)
+
+// RegisterActivation takes up one of the key's activations for a new
+// node-locked device. Node-locked keys don't record which devices hold them,
+// so once every activation is taken further activating verifications are
+// refused; the key itself stays active and still verifies when the client
+// skips the activation. The seat is claimed with a conditional UPDATE so
+// concurrent verifications can't overshoot MaxActivations.
+func (lk *LicenseKey) RegisterActivation(db *gorm.DB) error {
 	if !lk.IsValidForUse() {
 		return fmt.Errorf("license key is not valid for use")
 	}
 
-	lk.CurrentActivations++
-	if lk.MaxActivations > 0 && lk.CurrentActivations >= lk.MaxActivations {
-		lk.Status = "expired"
+	now := clk.Now()
+	result := db.Model(&LicenseKey{}).
+		Where("id = ? AND (max_activations = 0 OR current_activations < max_activations)", lk.ID).
+		UpdateColumns(map[string]interface{}{
+			"current_activations": gorm.Expr("current_activations + 1"),
+			"last_validated_at":   now,
+		})
+	if result.Error != nil {
+		return result.Error
 	}
 
-	// Update validation timestamp
-	now := time.Now()
+	// Pick up activations taken by other requests since lk was loaded
+	if err := db.Model(&LicenseKey{}).Where("id = ?", lk.ID).Pluck("current_activations", &lk.CurrentActivations).Error; err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return ErrActivationLimitReached
+	}
+	lk.LastValidatedAt = &now
+	return nil
+}
+
+// IncrementUsage meters one use of the key against UsageLimit, independently
+// of how many devices are activated
+func (lk *LicenseKey) IncrementUsage(db *gorm.DB) error {
+	if !lk.IsValidForUse() {
+		return fmt.Errorf("license key is not valid for use")
+	}
+	if lk.UsageExhausted() {
+		return ErrUsageLimitReached
+	}
+
+	lk.UsageCount++
+	now := clk.Now()
 	lk.LastValidatedAt = &now
 
 	return db.Save(lk).Error
 }
 
-func (lk *LicenseKey) Revoke(db *gorm.DB) error {
+// Revoke disables the key for good, recording when and why, e.g. "Refunded"
+func (lk *LicenseKey) Revoke(db *gorm.DB, reason string) error {
+	now := clk.Now()
 	lk.Status = "revoked"
+	lk.RevokedAt = &now
+	lk.RevokedReason = strings.TrimSpace(reason)
 	return db.Save(lk).Error
 }
 
-func (lk *LicenseKey) Reactivate(db *gorm.DB) error {
-	if !lk.IsExpired() {
-		lk.Status = "active"
-		return db.Save(lk).Error
+// ErrReactivationNeedsOverride is returned when reactivating a key whose
+// payment was reversed without explicitly overriding the check
+var ErrReactivationNeedsOverride = errors.New("license key was revoked for a refund or chargeback")
+
+// RevokedForPaymentReversal reports whether the key was revoked because the
+// customer got their money back, judging by the revoke reason
+func (lk *LicenseKey) RevokedForPaymentReversal() bool {
+	if !lk.IsRevoked() {
+		return false
 	}
-	return fmt.Errorf("cannot reactivate expired license key")
+	reason := strings.ToLower(lk.RevokedReason)
+	return strings.Contains(reason, "refund") || strings.Contains(reason, "chargeback")
 }
 
-func (lk *LicenseKey) UsageRemaining() int {
+// Reactivate makes a revoked key usable again. Keys revoked for a refund or
+// chargeback are only reactivated with override, so an unpaid key isn't
+// handed back by accident.
+func (lk *LicenseKey) Reactivate(db *gorm.DB, override bool) error {
+	if lk.IsExpired() {
+		return fmt.Errorf("cannot reactivate expired license key")
+	}
+	if lk.RevokedForPaymentReversal() && !override {
+		return ErrReactivationNeedsOverride
+	}
+	lk.Status = "active"
+	lk.RevokedAt = nil
+	lk.RevokedReason = ""
+	return db.Save(lk).Error
+}
+
+// ExpireSubscription lapses the keys paid for by a subscription that has
+// ended: they are marked expired as of now, unless already revoked or past
+// their expiry. It returns the number of keys changed.
+func ExpireSubscription(db *gorm.DB, subscriptionID string, now time.Time) (int64, error) {
+	if subscriptionID == "" {
+		return 0, nil
+	}
+	result := db.Model(&LicenseKey{}).
+		Where("subscription_id = ? AND status != ? AND (expires_at IS NULL OR expires_at > ?)", subscriptionID, "revoked", now).
+		Updates(map[string]interface{}{"status": "expired", "expires_at": now})
+	return result.RowsAffected, result.Error
+}
+
+// ResetActivations frees every seat on the key. A key that older versions
+// marked expired only because it hit MaxActivations becomes active again;
+// revoked keys and keys past their expiry date keep their status.
+func (lk *LicenseKey) ResetActivations(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := lk.ReleaseSeats(tx); err != nil {
+			return err
+		}
+		lk.CurrentActivations = 0
+		if lk.Status == "expired" && !lk.IsExpired() {
+			lk.Status = "active"
+		}
+		return tx.Save(lk).Error
+	})
+}
+
+// ActivationsRemaining is how many more devices may be activated, or -1 for unlimited
+func (lk *LicenseKey) ActivationsRemaining() int {
 	if lk.MaxActivations == 0 {
 		return -1 // Unlimited
 	}
@@ -184,46 +837,162 @@ func (lk *LicenseKey) UsageRemaining() int {
 	return remaining
 }
 
-func (lk *LicenseKey) ToAPIResponse() map[string]interface{} {
+// UsageRemaining is how many more metered uses are left, or -1 for unlimited
+func (lk *LicenseKey) UsageRemaining() int {
+	if lk.UsageLimit == 0 {
+		return -1 // Unlimited
+	}
+	remaining := lk.UsageLimit - lk.UsageCount
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// RequiresUpgrade reports whether an app at the requested version is beyond the
+// major version the key was bought for. Missing or unparseable versions on
+// either side are allowed so older keys and clients keep verifying.
+func (lk *LicenseKey) RequiresUpgrade(requestedVersion string) bool {
+	requested, ok := MajorVersion(requestedVersion)
+	if !ok {
+		return false
+	}
+	purchased, ok := MajorVersion(lk.PurchasedVersion)
+	if !ok {
+		return false
+	}
+	return requested > purchased
+}
+
+// MajorVersion extracts the major component of versions like "2", "v2.1" or "2.1.0-beta"
+func MajorVersion(version string) (int, bool) {
+	version = strings.TrimPrefix(strings.TrimSpace(strings.ToLower(version)), "v")
+	if i := strings.IndexAny(version, ".-+"); i >= 0 {
+		version = version[:i]
+	}
+	major, err := strconv.Atoi(version)
+	if err != nil || major < 0 {
+		return 0, false
+	}
+	return major, true
+}
+
+// Purchase is the Gumroad-compatible purchase object of a verify response.
+// Besides Gumroad's fields it carries custom_fields, expires_at (null and
+// perpetual for keys that never expire), status and usage_remaining so
+// clients can read entitlements without a second lookup.
+type Purchase struct {
+	SellerID                string                 `json:"seller_id"`
+	ProductID               string                 `json:"product_id"`
+	ProductName             string                 `json:"product_name"`
+	Permalink               string                 `json:"permalink"`
+	ProductPermalink        string                 `json:"product_permalink"`
+	Email                   string                 `json:"email"`
+	Price                   int                    `json:"price"`
+	GumroadFee              int                    `json:"gumroad_fee"`
+	Currency                string                 `json:"currency"`
+	Quantity                int                    `json:"quantity"`
+	DiscoverFeeCharged      bool                   `json:"discover_fee_charged"`
+	CanContact              bool                   `json:"can_contact"`
+	Referrer                string                 `json:"referrer"`
+	Card                    map[string]interface{} `json:"card"`
+	OrderNumber             uint                   `json:"order_number"`
+	SaleID                  string                 `json:"sale_id"`
+	SaleTimestamp           string                 `json:"sale_timestamp"`
+	URL                     string                 `json:"url"`
+	Variants                map[string]interface{} `json:"variants"`
+	LicenseKey              string                 `json:"license_key"`
+	IPCountry               string                 `json:"ip_country"`
+	IsRecurringBilling      bool                   `json:"is_recurring_billing"`
+	IsPreorderAuthorization bool                   `json:"is_preorder_authorization"`
+	IsGiftReceiverPurchase  bool                   `json:"is_gift_receiver_purchase"`
+	Refunded                bool                   `json:"refunded"`
+	Disputed                bool                   `json:"disputed"`
+	DisputeWon              bool                   `json:"dispute_won"`
+	SubscriptionID          *string                `json:"subscription_id"`
+	Cancelled               bool                   `json:"cancelled" doc:"The key has been revoked"`
+	Ended                   bool                   `json:"ended"`
+	Uses                    int                    `json:"uses" doc:"Activations used"`
+	Test                    bool                   `json:"test"`
+	CustomFields            map[string]interface{} `json:"custom_fields" doc:"The key's metadata"`
+	ExpiresAt               *string                `json:"expires_at" doc:"Expiry timestamp, null for perpetual keys"`
+	Perpetual               bool                   `json:"perpetual"`
+	Status                  string                 `json:"status"`
+	UsageRemaining          int                    `json:"usage_remaining"`
+	ActivationsRemaining    int                    `json:"activations_remaining"`
+	PurchasedVersion        string                 `json:"purchased_version"`
+	LicenseType             string                 `json:"license_type"`
+}
+
+// ToPurchase builds the purchase object of the verify response. Price,
+// currency and sale ID are the ones recorded with the sale, empty for keys
+// issued by hand.
+func (lk *LicenseKey) ToPurchase() Purchase {
+	return Purchase{
+		SellerID:             "self-hosted",
+		ProductID:            fmt.Sprintf("%d", lk.ProductID),
+		ProductName:          lk.Product.Name,
+		Permalink:            lk.Product.Permalink,
+		ProductPermalink:     lk.Product.Permalink,
+		Email:                lk.Customer.Email,
+		Price:                int(lk.Price),
+		Currency:             lk.Currency,
+		Quantity:             1,
+		CanContact:           true,
+		Referrer:             "direct",
+		Card:                 map[string]interface{}{},
+		OrderNumber:          lk.ID,
+		SaleID:               lk.SaleID,
+		SaleTimestamp:        lk.CreatedAt.Format("2006-01-02T15:04:05Z"),
+		Variants:             map[string]interface{}{},
+		LicenseKey:           lk.Key,
+		IPCountry:            "Unknown",
+		Cancelled:            lk.IsRevoked(),
+		Ended:                !lk.IsActive(),
+		Uses:                 lk.CurrentActivations,
+		CustomFields:         lk.GetMetadataMap(),
+		ExpiresAt:            lk.apiExpiresAt(),
+		Perpetual:            lk.IsPerpetual(),
+		Status:               lk.Status,
+		UsageRemaining:       lk.UsageRemaining(),
+		ActivationsRemaining: lk.ActivationsRemaining(),
+		PurchasedVersion:     lk.PurchasedVersion,
+		LicenseType:          lk.LicenseType,
+	}
+}
+
+// ToInfoResponse summarizes the key's state for the read-only info endpoint
+func (lk *LicenseKey) ToInfoResponse() map[string]interface{} {
 	return map[string]interface{}{
 		"success": true,
-		"purchase": map[string]interface{}{
-			"seller_id":                 "self-hosted",
-			"product_id":                fmt.Sprintf("%d", lk.ProductID),
-			"product_name":              lk.Product.Name,
-			"permalink":                 lk.Product.Name,
-			"product_permalink":         fmt.Sprintf("https://localhost/products/%d", lk.ProductID),
-			"email":                     lk.Customer.Email,
-			"price":                     0,
-			"gumroad_fee":               0,
-			"currency":                  "usd",
-			"quantity":                  1,
-			"discover_fee_charged":      false,
-			"can_contact":               true,
-			"referrer":                  "direct",
-			"card":                      map[string]interface{}{},
-			"order_number":              lk.ID,
-			"sale_id":                   fmt.Sprintf("sale_%d", lk.ID),
-			"sale_timestamp":            lk.CreatedAt.Format("2006-01-02T15:04:05Z"),
-			"url":                       "",
-			"variants":                  map[string]interface{}{},
-			"license_key":               lk.Key,
-			"ip_country":                "Unknown",
-			"is_recurring_billing":      false,
-			"is_preorder_authorization": false,
-			"is_gift_receiver_purchase": false,
-			"refunded":                  false,
-			"disputed":                  false,
-			"dispute_won":               false,
-			"subscription_id":           nil,
-			"cancelled":                 lk.IsRevoked(),
-			"ended":                     !lk.IsActive(),
-			"uses":                      lk.CurrentActivations,
-			"test":                      true,
+		"license": map[string]interface{}{
+			"license_key":           lk.Key,
+			"product_id":            lk.ProductID,
+			"product_name":          lk.Product.Name,
+			"license_type":          lk.LicenseType,
+			"status":                lk.Status,
+			"valid":                 lk.IsValidForUse(),
+			"reason":                lk.InvalidReason(),
+			"expires_at":            lk.apiExpiresAt(),
+			"perpetual":             lk.IsPerpetual(),
+			"activations_used":      lk.CurrentActivations,
+			"activations_remaining": lk.ActivationsRemaining(),
+			"max_activations":       lk.MaxActivations,
+			"usage_count":           lk.UsageCount,
+			"usage_remaining":       lk.UsageRemaining(),
 		},
 	}
 }
 
+// apiExpiresAt formats the expiry for API responses, nil for perpetual keys
+func (lk *LicenseKey) apiExpiresAt() *string {
+	if lk.ExpiresAt == nil {
+		return nil
+	}
+	formatted := lk.ExpiresAt.UTC().Format("2006-01-02T15:04:05Z")
+	return &formatted
+}
+
 // AdminUser methods
 func (au *AdminUser) SetPassword(password string) error {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -239,26 +1008,216 @@ func (au *AdminUser) CheckPassword(password string) bool {
 	return err == nil
 }
 
-func CreateDefaultAdmin(db *gorm.DB, username, password string) error {
+// ChangePassword sets a new password chosen by the admin, lifting any forced change
+func (au *AdminUser) ChangePassword(db *gorm.DB, password string) error {
+	if err := au.SetPassword(password); err != nil {
+		return err
+	}
+	au.MustChangePassword = false
+	return db.Save(au).Error
+}
+
+// SetTheme stores the admin's UI theme, one of ThemeLight, ThemeDark or ThemeSystem
+func (au *AdminUser) SetTheme(db *gorm.DB, theme string) error {
+	switch theme {
+	case ThemeLight, ThemeDark, ThemeSystem:
+	default:
+		return fmt.Errorf("unknown theme %q", theme)
+	}
+	if err := db.Model(au).Update("theme", theme).Error; err != nil {
+		return err
+	}
+	au.Theme = theme
+	return nil
+}
+
+// UITheme is the theme to render for the admin; rows from before themes
+// existed fall back to ThemeSystem
+func (au *AdminUser) UITheme() string {
+	if au.Theme == "" {
+		return ThemeSystem
+	}
+	return au.Theme
+}
+
+// AdminRole is the role to enforce for the admin. Rows from before roles were
+// enforced keep the full access they had as owners; any other unknown role
+// is treated as readonly.
+func (au *AdminUser) AdminRole() string {
+	switch {
+	case au.Role == "" || au.Role == roleLegacyAdmin:
+		return RoleOwner
+	case IsAdminRole(au.Role):
+		return au.Role
+	default:
+		return RoleReadonly
+	}
+}
+
+// MinPasswordLength is the shortest password an admin may choose
+const MinPasswordLength = 8
+
+// ErrAdminExists is returned when creating an admin whose username is taken
+var ErrAdminExists = errors.New("an admin with that username already exists")
+
+// CreateDefaultAdmin creates the bootstrap admin unless it already exists. When
+// password is empty a random one is generated and returned so the caller can
+// show it once. The admin must change the password on first login either way.
+func CreateDefaultAdmin(db *gorm.DB, username, password string) (string, error) {
+	generated := ""
+	if password == "" {
+		generated = generateRandomKey(20)
+		password = generated
+	}
+
+	_, err := createAdmin(db, username, password, RoleOwner, true)
+	if errors.Is(err, ErrAdminExists) {
+		return "", nil // Admin already exists
+	}
+	if err != nil {
+		return "", err
+	}
+	return generated, nil
+}
+
+// CreateAdmin adds an admin with role, one of AdminRoles. When password is
+// empty a random one is generated and returned, and the admin must change it
+// on first login; a password given here is kept.
+func CreateAdmin(db *gorm.DB, username, password, role string) (*AdminUser, string, error) {
+	if !IsAdminRole(role) {
+		return nil, "", fmt.Errorf("unknown role %q, use one of %s", role, strings.Join(AdminRoles, ", "))
+	}
+	password, generated, err := adminPassword(password)
+	if err != nil {
+		return nil, "", err
+	}
+	admin, err := createAdmin(db, username, password, role, generated != "")
+	return admin, generated, err
+}
+
+// createAdmin stores a new admin unless the username is taken
+func createAdmin(db *gorm.DB, username, password, role string, mustChange bool) (*AdminUser, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, errors.New("username is required")
+	}
 	var count int64
-	db.Model(&AdminUser{}).Where("username = ?", username).Count(&count)
+	if err := db.Model(&AdminUser{}).Where("username = ?", username).Count(&count).Error; err != nil {
+		return nil, err
+	}
 	if count > 0 {
-		return nil // Admin already exists
+		return nil, ErrAdminExists
 	}
 
 	admin := &AdminUser{
-		Username: username,
+		Username:           username,
+		Role:               role,
+		MustChangePassword: mustChange,
 	}
 	if err := admin.SetPassword(password); err != nil {
-		return err
+		return nil, err
+	}
+
+	if err := db.Create(admin).Error; err != nil {
+		return nil, err
+	}
+	return admin, nil
+}
+
+// ResetAdminPassword replaces a locked-out admin's password and clears the
+// failed logins counted against their username. When password is empty a
+// random one is generated and returned, and the admin must change it on
+// first login.
+func ResetAdminPassword(db *gorm.DB, username, password string) (string, error) {
+	var admin AdminUser
+	if err := db.Where("username = ?", strings.TrimSpace(username)).First(&admin).Error; err != nil {
+		return "", err
+	}
+
+	password, generated, err := adminPassword(password)
+	if err != nil {
+		return "", err
+	}
+	if err := admin.SetPassword(password); err != nil {
+		return "", err
+	}
+	admin.MustChangePassword = generated != ""
+	if err := db.Save(&admin).Error; err != nil {
+		return "", err
 	}
 
-	return db.Create(admin).Error
+	// Only the username's counter; the IPs the lockout came from aren't known here
+	return generated, ResetLoginFailures(db, LoginThrottleKeys(admin.Username, "")[:1])
+}
+
+// adminPassword checks a chosen password, or generates one when it's empty
+func adminPassword(password string) (string, string, error) {
+	if password == "" {
+		generated := generateRandomKey(20)
+		return generated, generated, nil
+	}
+	if len(password) < MinPasswordLength {
+		return "", "", fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	}
+	return password, "", nil
+}
+
+// ErrAdminNotProvisioned is returned when an external identity has no matching
+// admin and auto-provisioning is disabled
+var ErrAdminNotProvisioned = errors.New("no admin user matches this identity")
+
+// FindOrProvisionAdminByEmail maps an externally authenticated email address to
+// the admin with that email, creating one with the given role when
+// autoProvision is set. Usernames are never matched: anyone could pick one
+// that looks like someone else's email. Provisioned admins get a random
+// password so they can only sign in via SSO.
+func FindOrProvisionAdminByEmail(db *gorm.DB, email string, autoProvision bool, role string) (*AdminUser, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return nil, ErrAdminNotProvisioned
+	}
+
+	var admin AdminUser
+	err := db.Where("LOWER(email) = ?", email).First(&admin).Error
+	if err == nil {
+		return &admin, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if !autoProvision {
+		return nil, ErrAdminNotProvisioned
+	}
+
+	admin = AdminUser{
+		Username: email,
+		Email:    email,
+		Role:     role,
+	}
+	if err := admin.SetPassword(generateRandomKey(32)); err != nil {
+		return nil, err
+	}
+	if err := db.Create(&admin).Error; err != nil {
+		return nil, err
+	}
+
+	return &admin, nil
 }
 
 // Helper functions
+
+// DayBounds returns the UTC start and end of the calendar day containing t in loc.
+func DayBounds(t time.Time, loc *time.Location) (time.Time, time.Time) {
+	local := t.In(loc)
+	start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	return start.UTC(), start.AddDate(0, 0, 1).UTC()
+}
+
 func generateRandomKey(length int) string {
-	const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	return randomString(length, alphanumericChars)
+}
+
+func randomString(length int, charset string) string {
 	result := make([]byte, length)
 	for i := range result {
 		num, _ := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
@@ -274,11 +1233,18 @@ func (lk *LicenseKey) GetMetadataMap() map[string]interface{} {
 	}
 
 	var metadata map[string]interface{}
-	_ = json.Unmarshal([]byte(lk.Metadata), &metadata)
+	if err := json.Unmarshal([]byte(lk.Metadata), &metadata); err != nil || metadata == nil {
+		return map[string]interface{}{}
+	}
 	return metadata
 }
 
 func (lk *LicenseKey) SetMetadataMap(data map[string]interface{}) error {
+	if len(data) == 0 {
+		lk.Metadata = ""
+		return nil
+	}
+
 	bytes, err := json.Marshal(data)
 	if err != nil {
 		return err
@@ -287,6 +1253,151 @@ func (lk *LicenseKey) SetMetadataMap(data map[string]interface{}) error {
 	return nil
 }
 
+// MergeMetadata sets the given entries on top of the key's metadata, e.g.
+// per-key values over the product defaults a key was generated with
+func (lk *LicenseKey) MergeMetadata(overrides map[string]interface{}) error {
+	metadata := lk.GetMetadataMap()
+	for key, value := range overrides {
+		metadata[key] = value
+	}
+	return lk.SetMetadataMap(metadata)
+}
+
+// ValidateMetadataJSON checks that raw metadata is blank or a JSON object
+func ValidateMetadataJSON(raw string) error {
+	if strings.TrimSpace(raw) == "" {
+		return nil
+	}
+	var metadata map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &metadata); err != nil || metadata == nil {
+		return errors.New("metadata must be a JSON object, e.g. {\"tier\": \"standard\"}")
+	}
+	return nil
+}
+
+// DefaultMetadataMap returns the metadata every new key of the product starts with
+func (p *Product) DefaultMetadataMap() map[string]interface{} {
+	lk := LicenseKey{Metadata: p.DefaultMetadata}
+	return lk.GetMetadataMap()
+}
+
+// BeforeSave refuses default metadata that new keys couldn't use, and hashes
+// a newly set API key
+func (p *Product) BeforeSave(tx *gorm.DB) error {
+	if strings.TrimSpace(p.DefaultMetadata) == "" {
+		p.DefaultMetadata = ""
+	}
+	if p.APIKey != "" && !strings.HasPrefix(p.APIKey, apiKeyHashPrefix) {
+		p.APIKeyHint = apiKeyHint(p.APIKey)
+		p.APIKey = HashAPIKey(p.APIKey)
+	}
+	return ValidateMetadataJSON(p.DefaultMetadata)
+}
+
+// MetadataEntry is one key/value row of license key metadata. Key is kept as
+// stored so the edit form saves it back unchanged; show it with DisplayKey.
+type MetadataEntry struct {
+	Key   string
+	Value string
+}
+
+// DisplayKey is the key cleaned with DisplayText
+func (e MetadataEntry) DisplayKey() string {
+	return DisplayText(e.Key)
+}
+
+// DisplayText cleans text for showing in the admin UI: invalid UTF-8 is
+// replaced and control and invisible formatting characters, such as bidi
+// overrides, are dropped so a stored value can't disguise itself or break the
+// layout. HTML escaping is left to the templates.
+func DisplayText(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\t':
+			return r
+		case unicode.IsSpace(r):
+			return ' '
+		case unicode.IsPrint(r):
+			return r
+		}
+		return -1
+	}, strings.ToValidUTF8(text, "\uFFFD"))
+}
+
+// MetadataText is the raw stored metadata cleaned for display, for keys whose
+// metadata isn't a JSON object
+func (lk LicenseKey) MetadataText() string {
+	return DisplayText(lk.Metadata)
+}
+
+// MetadataEntries returns the metadata as rows sorted by key, with values
+// cleaned with DisplayText. Values that aren't strings, such as nested payment
+// data, are shown as JSON.
+func (lk LicenseKey) MetadataEntries() []MetadataEntry {
+	metadata := lk.GetMetadataMap()
+	entries := make([]MetadataEntry, 0, len(metadata))
+	for key, value := range metadata {
+		text, ok := value.(string)
+		if !ok {
+			encoded, _ := json.Marshal(value)
+			text = string(encoded)
+		}
+		entries = append(entries, MetadataEntry{Key: key, Value: DisplayText(text)})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+// MetadataMalformed reports whether stored metadata is set but isn't a JSON object
+func (lk LicenseKey) MetadataMalformed() bool {
+	if lk.Metadata == "" {
+		return false
+	}
+	var metadata map[string]interface{}
+	return json.Unmarshal([]byte(lk.Metadata), &metadata) != nil || metadata == nil
+}
+
+// MetadataFromPairs builds metadata from parallel key and value form fields,
+// skipping blank rows. Keys must be unique and values plain text.
+func MetadataFromPairs(keys, values []string) (map[string]interface{}, error) {
+	metadata := map[string]interface{}{}
+	for i, key := range keys {
+		key = strings.TrimSpace(key)
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+
+		if key == "" {
+			if strings.TrimSpace(value) == "" {
+				continue
+			}
+			return nil, fmt.Errorf("metadata value %q is missing a key", value)
+		}
+		if _, exists := metadata[key]; exists {
+			return nil, fmt.Errorf("metadata key %q is used more than once", key)
+		}
+		if !isPlainText(value) {
+			return nil, fmt.Errorf("metadata value for %q must be plain text", key)
+		}
+		metadata[key] = value
+	}
+	return metadata, nil
+}
+
+// isPlainText rejects invalid UTF-8 and control characters other than whitespace
+func isPlainText(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
 // EmailSettings methods
 func GetActiveEmailSettings(db *gorm.DB) (*EmailSettings, error) {
 	var settings EmailSettings
@@ -297,26 +1408,40 @@ func GetActiveEmailSettings(db *gorm.DB) (*EmailSettings, error) {
 	return &settings, nil
 }
 
+// Save stores the settings; saving them as active deactivates every other
+// configuration so only one is ever active
 func (es *EmailSettings) Save(db *gorm.DB) error {
-	if es.IsActive {
-		db.Model(&EmailSettings{}).Where("id != ?", es.ID).Update("is_active", false)
-	}
-	return db.Save(es).Error
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(es).Error; err != nil {
+			return err
+		}
+		if !es.IsActive {
+			return nil
+		}
+		return tx.Model(&EmailSettings{}).Where("id <> ? AND is_active = ?", es.ID, true).Update("is_active", false).Error
+	})
 }
 
+// Activate makes these the active settings, see ActivateEmailSettings
 func (es *EmailSettings) Activate(db *gorm.DB) error {
-	tx := db.Begin()
-
-	if err := tx.Model(&EmailSettings{}).Where("id != ?", es.ID).Update("is_active", false).Error; err != nil {
-		tx.Rollback()
+	if err := ActivateEmailSettings(db, es.ID); err != nil {
 		return err
 	}
-
 	es.IsActive = true
-	if err := tx.Save(es).Error; err != nil {
-		tx.Rollback()
-		return err
-	}
+	return nil
+}
 
-	return tx.Commit().Error
+// ActivateEmailSettings makes the settings with id the only active
+// configuration, returning gorm.ErrRecordNotFound when there are none
+func ActivateEmailSettings(db *gorm.DB, id uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&EmailSettings{}).Where("id = ?", id).Update("is_active", true)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return tx.Model(&EmailSettings{}).Where("id <> ? AND is_active = ?", id, true).Update("is_active", false).Error
+	})
 }
@@ -1,14 +1,22 @@
 package models
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
+
+	"matcha/internal/clock"
 )
 
 func setupTestDB(t *testing.T) *gorm.DB {
+	SetEncryptionKey("test-secret-key")
+
 	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Silent),
 	})
@@ -16,7 +24,7 @@ func setupTestDB(t *testing.T) *gorm.DB {
 		t.Fatalf("Failed to connect to test database: %v", err)
 	}
 
-	err = db.AutoMigrate(&Product{}, &Customer{}, &LicenseKey{}, &AdminUser{}, &EmailSettings{})
+	err = db.AutoMigrate(&Product{}, &Customer{}, &LicenseKey{}, &AdminUser{}, &EmailSettings{}, &WebhookEvent{}, &EmailTemplate{}, &VerificationStat{}, &SeatCheckout{}, &WebhookSettings{}, &ProductMapping{}, &EmailLog{}, &LoginThrottle{}, &LicenseKeyNote{}, &LicenseKeyRotation{})
 	if err != nil {
 		t.Fatalf("Failed to migrate test database: %v", err)
 	}
@@ -145,3 +153,1206 @@ func TestEmailSettings_Activate(t *testing.T) {
 		t.Error("Second settings should be active after activation")
 	}
 }
+
+func TestLicenseKey_ExpiresToday(t *testing.T) {
+	// 23:30 UTC on Jan 10 is still 18:30 on Jan 10 in UTC-5
+	now := time.Date(2026, 1, 10, 23, 30, 0, 0, time.UTC)
+	expiresAt := time.Date(2026, 1, 11, 2, 0, 0, 0, time.UTC)
+	lk := &LicenseKey{ExpiresAt: &expiresAt}
+
+	if lk.ExpiresToday(now, time.UTC) {
+		t.Error("Key should not expire today in UTC, it expires on Jan 11")
+	}
+
+	eastern := time.FixedZone("UTC-5", -5*60*60)
+	if !lk.ExpiresToday(now, eastern) {
+		t.Error("Key should expire today in UTC-5, it expires at 21:00 local on Jan 10")
+	}
+
+	if (&LicenseKey{}).ExpiresToday(now, eastern) {
+		t.Error("Key without expiry should never expire today")
+	}
+}
+
+func TestLicenseKey_ExpiryStoredInUTC(t *testing.T) {
+	db := setupTestDB(t)
+
+	product := &Product{Name: "Zoned Product"}
+	db.Create(product)
+	customer := &Customer{Name: "Test Customer", Email: "test@example.com"}
+	db.Create(customer)
+
+	// Midnight on Jan 11 in UTC+9 is 15:00 on Jan 10 in UTC
+	tokyo := time.FixedZone("UTC+9", 9*60*60)
+	expiresAt := time.Date(2026, 1, 11, 0, 0, 0, 0, tokyo)
+	lk := &LicenseKey{Key: "ZONED-KEY", ProductID: product.ID, CustomerID: customer.ID, Status: "active", ExpiresAt: &expiresAt}
+	if err := db.Create(lk).Error; err != nil {
+		t.Fatalf("Failed to create license key: %v", err)
+	}
+
+	var stored LicenseKey
+	db.First(&stored, lk.ID)
+	if stored.ExpiresAt == nil || !stored.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("Expected expiry stored as %v, got %v", expiresAt.UTC(), stored.ExpiresAt)
+	}
+
+	// The SQL count and IsExpiredAt agree whichever zone now is given in
+	for _, now := range []time.Time{
+		time.Date(2026, 1, 10, 14, 0, 0, 0, time.UTC),
+		time.Date(2026, 1, 10, 16, 0, 0, 0, time.UTC),
+	} {
+		local := now.In(tokyo)
+		count, err := CountExpiredLicenseKeys(db, local)
+		if err != nil {
+			t.Fatalf("CountExpiredLicenseKeys failed: %v", err)
+		}
+		if expired := stored.IsExpiredAt(local); expired != (count == 1) {
+			t.Errorf("At %v IsExpiredAt=%v but the query counted %d", now, expired, count)
+		}
+	}
+}
+
+func TestProduct_DeleteWithGuard(t *testing.T) {
+	db := setupTestDB(t)
+
+	product := &Product{Name: "Guarded Product"}
+	db.Create(product)
+	customer := &Customer{Name: "Test Customer", Email: "test@example.com"}
+	db.Create(customer)
+	db.Create(&LicenseKey{Key: "GUARD-KEY", ProductID: product.ID, CustomerID: customer.ID})
+
+	if ok, err := product.CanDelete(db); err != nil || ok {
+		t.Fatalf("Product with license keys should not be deletable, got ok=%v err=%v", ok, err)
+	}
+
+	if err := product.DeleteWithGuard(db, false); !errors.Is(err, ErrProductHasLicenseKeys) {
+		t.Fatalf("Expected ErrProductHasLicenseKeys, got %v", err)
+	}
+	var count int64
+	db.Model(&Product{}).Where("id = ?", product.ID).Count(&count)
+	if count != 1 {
+		t.Error("Blocked delete should keep the product")
+	}
+
+	if err := product.DeleteWithGuard(db, true); err != nil {
+		t.Fatalf("Cascade delete failed: %v", err)
+	}
+	db.Model(&Product{}).Where("id = ?", product.ID).Count(&count)
+	if count != 0 {
+		t.Error("Cascade delete should remove the product")
+	}
+	db.Model(&LicenseKey{}).Where("product_id = ?", product.ID).Count(&count)
+	if count != 0 {
+		t.Error("Cascade delete should remove the product's license keys")
+	}
+}
+
+func TestProduct_GenerateLicenseKeyForRetriesOnCollision(t *testing.T) {
+	db := setupTestDB(t)
+
+	product := &Product{Name: "Collision Product", DefaultExpirationDays: 30, DefaultUsageLimit: 1}
+	db.Create(product)
+	customer := &Customer{Name: "Test Customer", Email: "test@example.com"}
+	db.Create(customer)
+
+	existing, err := product.GenerateLicenseKeyFor(db, customer)
+	if err != nil {
+		t.Fatalf("Failed to generate first key: %v", err)
+	}
+
+	// Hand back the existing key first so the insert hits the unique index
+	original := newLicenseKey
+	defer func() { newLicenseKey = original }()
+	candidates := []string{existing.Key, "FRESH-KEY"}
+	newLicenseKey = func(*Product) string {
+		key := candidates[0]
+		candidates = candidates[1:]
+		return key
+	}
+
+	licenseKey, err := product.GenerateLicenseKeyFor(db, customer)
+	if err != nil {
+		t.Fatalf("Expected retry to succeed, got %v", err)
+	}
+	if licenseKey.Key != "FRESH-KEY" {
+		t.Errorf("Expected the retried key, got %q", licenseKey.Key)
+	}
+	if licenseKey.ID == existing.ID {
+		t.Error("Retried key should be a new row")
+	}
+
+	// A generator that keeps colliding eventually gives up
+	newLicenseKey = func(*Product) string { return existing.Key }
+	if _, err := product.GenerateLicenseKeyFor(db, customer); err == nil {
+		t.Error("Expected an error once retries are exhausted")
+	}
+}
+
+func TestProduct_DefaultMetadata(t *testing.T) {
+	db := setupTestDB(t)
+
+	product := &Product{Name: "Tiered Product", DefaultMetadata: `{"tier": "standard", "seats": 1}`}
+	if err := db.Create(product).Error; err != nil {
+		t.Fatalf("Failed to create product: %v", err)
+	}
+	customer := &Customer{Name: "Test Customer", Email: "test@example.com"}
+	db.Create(customer)
+
+	licenseKey, err := product.GenerateLicenseKeyFor(db, customer)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	var stored LicenseKey
+	db.First(&stored, licenseKey.ID)
+	metadata := stored.GetMetadataMap()
+	if metadata["tier"] != "standard" || metadata["seats"] != float64(1) {
+		t.Errorf("Expected the key to inherit the product defaults, got %v", metadata)
+	}
+
+	// Per-key values win and the remaining defaults are kept
+	if err := stored.MergeMetadata(map[string]interface{}{"tier": "pro", "order_id": "ORD-1"}); err != nil {
+		t.Fatalf("Failed to merge metadata: %v", err)
+	}
+	metadata = stored.GetMetadataMap()
+	if len(metadata) != 3 || metadata["tier"] != "pro" || metadata["seats"] != float64(1) || metadata["order_id"] != "ORD-1" {
+		t.Errorf("Unexpected merged metadata: %v", metadata)
+	}
+	if product.DefaultMetadataMap()["tier"] != "standard" {
+		t.Error("Merging into a key should leave the product defaults alone")
+	}
+
+	for _, raw := range []string{"{not json", `["tier"]`, "null", `"standard"`} {
+		invalid := &Product{Name: "Invalid Defaults", DefaultMetadata: raw}
+		if err := db.Create(invalid).Error; err == nil {
+			t.Errorf("Expected default metadata %q to be rejected on save", raw)
+		}
+	}
+}
+
+func TestLicenseKey_ExpiresOnFakeClock(t *testing.T) {
+	db := setupTestDB(t)
+
+	fake := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	defer UseClock(fake)()
+
+	product := Product{Name: "Trial Product", DefaultExpirationDays: 14}
+	db.Create(&product)
+	customer := Customer{Name: "Jane", Email: "jane@example.com"}
+	db.Create(&customer)
+
+	lk, err := product.GenerateLicenseKeyFor(db, &customer)
+	if err != nil {
+		t.Fatalf("GenerateLicenseKeyFor failed: %v", err)
+	}
+	want := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	if lk.ExpiresAt == nil || !lk.ExpiresAt.Equal(want) {
+		t.Fatalf("Expected expiry %v from the fake clock, got %v", want, lk.ExpiresAt)
+	}
+
+	fake.Advance(14 * 24 * time.Hour)
+	if lk.IsExpired() {
+		t.Error("Key should still be valid at the exact expiry instant")
+	}
+
+	fake.Advance(time.Second)
+	if !lk.IsExpired() {
+		t.Error("Key should be expired once the clock passes its expiry")
+	}
+}
+
+func TestCustomer_FindOrCreateByEmail(t *testing.T) {
+	db := setupTestDB(t)
+
+	first, err := (&Customer{}).FindOrCreateByEmail(db, "  John@Example.com ", "")
+	if err != nil {
+		t.Fatalf("Failed to create customer: %v", err)
+	}
+	if first.Email != "john@example.com" {
+		t.Errorf("Expected normalized email, got %q", first.Email)
+	}
+	if first.Name != "john" {
+		t.Errorf("Expected name derived from email, got %q", first.Name)
+	}
+
+	second, err := (&Customer{}).FindOrCreateByEmail(db, "JOHN@example.COM", "John")
+	if err != nil {
+		t.Fatalf("Failed to find customer: %v", err)
+	}
+	if second.ID != first.ID {
+		t.Errorf("Case variant should map to customer %d, got %d", first.ID, second.ID)
+	}
+
+	if _, err := (&Customer{}).FindOrCreateByEmail(db, "john at example", ""); !errors.Is(err, ErrInvalidEmail) {
+		t.Errorf("Expected ErrInvalidEmail, got %v", err)
+	}
+}
+
+func TestCreateDefaultAdmin(t *testing.T) {
+	db := setupTestDB(t)
+
+	generated, err := CreateDefaultAdmin(db, "admin", "")
+	if err != nil {
+		t.Fatalf("Failed to create default admin: %v", err)
+	}
+	if generated == "" {
+		t.Fatal("Expected a generated password when none is configured")
+	}
+
+	var admin AdminUser
+	if err := db.Where("username = ?", "admin").First(&admin).Error; err != nil {
+		t.Fatalf("Failed to load admin: %v", err)
+	}
+	if !admin.MustChangePassword {
+		t.Error("Fresh admin should be required to change their password")
+	}
+	if admin.Role != RoleOwner {
+		t.Errorf("Bootstrap admin should be an owner, got role %q", admin.Role)
+	}
+	if !admin.CheckPassword(generated) {
+		t.Error("Generated password should sign the admin in")
+	}
+
+	again, err := CreateDefaultAdmin(db, "admin", "")
+	if err != nil || again != "" {
+		t.Errorf("Existing admin should be left alone, got password %q err %v", again, err)
+	}
+
+	if err := admin.ChangePassword(db, "a-new-password"); err != nil {
+		t.Fatalf("Failed to change password: %v", err)
+	}
+	db.First(&admin, admin.ID)
+	if admin.MustChangePassword || !admin.CheckPassword("a-new-password") {
+		t.Error("Changing the password should store it and clear the flag")
+	}
+}
+
+func TestAdminUser_AdminRole(t *testing.T) {
+	cases := map[string]string{
+		"":           RoleOwner, // Rows from before roles existed
+		"admin":      RoleOwner,
+		RoleOwner:    RoleOwner,
+		RoleSupport:  RoleSupport,
+		RoleReadonly: RoleReadonly,
+		"superuser":  RoleReadonly,
+	}
+	for role, want := range cases {
+		admin := AdminUser{Role: role}
+		if got := admin.AdminRole(); got != want {
+			t.Errorf("Role %q should be enforced as %q, got %q", role, want, got)
+		}
+	}
+}
+
+func TestLicenseKey_RequiresUpgrade(t *testing.T) {
+	lk := &LicenseKey{PurchasedVersion: "v1.2.0"}
+	cases := map[string]bool{
+		"":           false,
+		"1.0.0":      false,
+		"1.9.9":      false,
+		"2.0.0":      true,
+		"v3":         true,
+		"2.0.0-beta": true,
+		"latest":     false,
+	}
+	for version, want := range cases {
+		if got := lk.RequiresUpgrade(version); got != want {
+			t.Errorf("RequiresUpgrade(%q) = %v, want %v", version, got, want)
+		}
+	}
+
+	legacy := &LicenseKey{}
+	if legacy.RequiresUpgrade("5.0.0") {
+		t.Error("Keys without a purchased version should not require an upgrade")
+	}
+}
+
+func TestLicenseKey_FloatingSeatsReclaimedAfterTimeout(t *testing.T) {
+	db := setupTestDB(t)
+
+	product := Product{Name: "Floating Product", LicenseType: LicenseTypeFloating}
+	db.Create(&product)
+	customer := Customer{Name: "Jane", Email: "jane@example.com"}
+	db.Create(&customer)
+	lk := LicenseKey{Key: "FLOAT-1", ProductID: product.ID, CustomerID: customer.ID, MaxActivations: 1, LicenseType: LicenseTypeFloating}
+	db.Create(&lk)
+
+	start := time.Now()
+	if err := lk.CheckoutSeat(db, "device-a", "", start); err != nil {
+		t.Fatalf("First checkout failed: %v", err)
+	}
+	if err := lk.CheckoutSeat(db, "device-b", "", start.Add(time.Minute)); !errors.Is(err, ErrNoSeatsAvailable) {
+		t.Fatalf("Expected ErrNoSeatsAvailable while device-a holds the seat, got %v", err)
+	}
+	if err := lk.Heartbeat(db, "device-a", start.Add(10*time.Minute)); err != nil {
+		t.Fatalf("Heartbeat failed: %v", err)
+	}
+
+	// device-a goes quiet; once the timeout passes its seat is handed to device-b
+	later := start.Add(10*time.Minute + FloatingSeatTimeout + time.Second)
+	if err := lk.CheckoutSeat(db, "device-b", "", later); err != nil {
+		t.Fatalf("Expected stale seat to be reclaimed, got %v", err)
+	}
+	if err := lk.Heartbeat(db, "device-a", later); !errors.Is(err, ErrSeatNotCheckedOut) {
+		t.Errorf("Expected reclaimed device to get ErrSeatNotCheckedOut, got %v", err)
+	}
+
+	var stored LicenseKey
+	db.First(&stored, lk.ID)
+	if stored.CurrentActivations != 1 || stored.Status != "active" {
+		t.Errorf("Expected one active seat, got %d (%s)", stored.CurrentActivations, stored.Status)
+	}
+}
+
+func TestLicenseKey_NodeLockedActivationsDoNotTimeOut(t *testing.T) {
+	db := setupTestDB(t)
+
+	product := Product{Name: "Node Product"}
+	db.Create(&product)
+	customer := Customer{Name: "Jane", Email: "jane@example.com"}
+	db.Create(&customer)
+
+	lk, err := product.GenerateLicenseKeyFor(db, &customer)
+	if err != nil {
+		t.Fatalf("GenerateLicenseKeyFor failed: %v", err)
+	}
+	if lk.LicenseType != LicenseTypeNodeLocked {
+		t.Fatalf("Expected node-locked key, got %q", lk.LicenseType)
+	}
+	if err := lk.RegisterActivation(db); err != nil {
+		t.Fatalf("RegisterActivation failed: %v", err)
+	}
+
+	if err := lk.ReclaimStaleSeats(db, time.Now().Add(24*time.Hour)); err != nil {
+		t.Fatalf("ReclaimStaleSeats failed: %v", err)
+	}
+	var stored LicenseKey
+	db.First(&stored, lk.ID)
+	if stored.CurrentActivations != 1 {
+		t.Errorf("Node-locked activation should persist, got %d", stored.CurrentActivations)
+	}
+}
+
+func TestMetadataFromPairs(t *testing.T) {
+	metadata, err := MetadataFromPairs([]string{" order_id ", "", "seats"}, []string{"ORD-1", "", "5"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(metadata) != 2 || metadata["order_id"] != "ORD-1" || metadata["seats"] != "5" {
+		t.Errorf("Unexpected metadata: %v", metadata)
+	}
+
+	invalid := map[string][2][]string{
+		"duplicate key": {{"plan", "plan"}, {"a", "b"}},
+		"missing key":   {{""}, {"orphan"}},
+		"binary value":  {{"blob"}, {"\x00\x01\x02"}},
+		"invalid utf-8": {{"blob"}, {string([]byte{0xff, 0xfe})}},
+	}
+	for name, pairs := range invalid {
+		if _, err := MetadataFromPairs(pairs[0], pairs[1]); err == nil {
+			t.Errorf("Expected %s to be rejected", name)
+		}
+	}
+
+	lk := &LicenseKey{Metadata: "{not json"}
+	if !lk.MetadataMalformed() || len(lk.MetadataEntries()) != 0 {
+		t.Error("Malformed metadata should be flagged and yield no entries")
+	}
+
+	lk = &LicenseKey{Metadata: `{"plan\u202e": "pro"}`}
+	entries := lk.MetadataEntries()
+	if len(entries) != 1 || entries[0].Key != "plan\u202e" || entries[0].DisplayKey() != "plan" {
+		t.Errorf("Expected the raw key kept for editing and cleaned for display, got %+v", entries)
+	}
+
+	if got := DisplayText("a\u202eb\x00c\td\u00a0e"); got != "abc\td e" {
+		t.Errorf("Expected control and formatting characters to be dropped, got %q", got)
+	}
+}
+
+func TestEmailTemplate_CustomTemplateRendered(t *testing.T) {
+	db := setupTestDB(t)
+
+	// Without a stored template the built-in default is used
+	fallback := GetEmailTemplate(db, EmailTemplateLicenseKey)
+	if fallback.Subject != "Your License Key for {{.ProductName}}" {
+		t.Errorf("Expected default subject, got %q", fallback.Subject)
+	}
+
+	custom := EmailTemplate{
+		Type:    EmailTemplateLicenseKey,
+		Subject: "{{.ProductName}} is ready",
+		Body:    "Hi {{.CustomerName}}, your key is {{.LicenseKey}}",
+	}
+	if err := SaveEmailTemplate(db, &custom); err != nil {
+		t.Fatalf("Failed to save template: %v", err)
+	}
+
+	stored := GetEmailTemplate(db, EmailTemplateLicenseKey)
+	subject, body, err := stored.Render(EmailTemplateData{
+		ProductName:  "Matcha Pro",
+		LicenseKey:   "ABCD-1234",
+		CustomerName: "Ada",
+	})
+	if err != nil {
+		t.Fatalf("Failed to render template: %v", err)
+	}
+	if subject != "Matcha Pro is ready" {
+		t.Errorf("Unexpected subject: %q", subject)
+	}
+	if body != "Hi Ada, your key is ABCD-1234" {
+		t.Errorf("Unexpected body: %q", body)
+	}
+}
+
+func TestEmailTemplate_ProductOverride(t *testing.T) {
+	db := setupTestDB(t)
+
+	branded := Product{Name: "Branded"}
+	plain := Product{Name: "Plain"}
+	for _, p := range []*Product{&branded, &plain} {
+		if err := db.Create(p).Error; err != nil {
+			t.Fatalf("Failed to create product: %v", err)
+		}
+	}
+
+	// Neither products nor the global template are customized yet
+	if got := GetProductEmailTemplate(db, plain.ID, EmailTemplateLicenseKey); got.Subject != DefaultEmailTemplate(EmailTemplateLicenseKey).Subject {
+		t.Errorf("Expected the built-in default, got %q", got.Subject)
+	}
+
+	global := EmailTemplate{Type: EmailTemplateLicenseKey, Subject: "Global subject", Body: "Global body"}
+	if err := SaveEmailTemplate(db, &global); err != nil {
+		t.Fatalf("Failed to save global template: %v", err)
+	}
+	override := EmailTemplate{Type: EmailTemplateLicenseKey, ProductID: &branded.ID, Subject: "Branded subject", Body: "Branded body"}
+	if err := SaveEmailTemplate(db, &override); err != nil {
+		t.Fatalf("Failed to save product template: %v", err)
+	}
+
+	if got := GetProductEmailTemplate(db, branded.ID, EmailTemplateLicenseKey); got.Subject != "Branded subject" {
+		t.Errorf("Expected the product's template, got %q", got.Subject)
+	}
+	if got := GetProductEmailTemplate(db, plain.ID, EmailTemplateLicenseKey); got.Subject != "Global subject" {
+		t.Errorf("Expected the global template for a product without one, got %q", got.Subject)
+	}
+	if got := GetEmailTemplate(db, EmailTemplateLicenseKey); got.Subject != "Global subject" {
+		t.Errorf("A product's template must not replace the global one, got %q", got.Subject)
+	}
+
+	if err := DeleteProductEmailTemplate(db, branded.ID, EmailTemplateLicenseKey); err != nil {
+		t.Fatalf("Failed to delete product template: %v", err)
+	}
+	if got := GetProductEmailTemplate(db, branded.ID, EmailTemplateLicenseKey); got.Subject != "Global subject" {
+		t.Errorf("Expected the global template after reset, got %q", got.Subject)
+	}
+}
+
+func TestEmailTemplate_MalformedTemplateRejected(t *testing.T) {
+	db := setupTestDB(t)
+
+	cases := []EmailTemplate{
+		{Type: EmailTemplateLicenseKey, Subject: "{{.ProductName", Body: "ok"},
+		{Type: EmailTemplateLicenseKey, Subject: "ok", Body: "{{if .LicenseKey}}unclosed"},
+		{Type: EmailTemplateLicenseKey, Subject: "ok", Body: "{{.UnknownField}}"},
+		{Type: "newsletter", Subject: "ok", Body: "ok"},
+	}
+	for _, tmpl := range cases {
+		if err := SaveEmailTemplate(db, &tmpl); err == nil {
+			t.Errorf("Expected template %+v to be rejected", tmpl)
+		}
+	}
+
+	var count int64
+	db.Model(&EmailTemplate{}).Count(&count)
+	if count != 0 {
+		t.Errorf("Expected no templates to be saved, got %d", count)
+	}
+}
+
+func TestEmailSettings_PasswordEncryptedAtRest(t *testing.T) {
+	db := setupTestDB(t)
+
+	settings := EmailSettings{
+		Provider:     "smtp",
+		SMTPHost:     "smtp.example.com",
+		SMTPPassword: "hunter2",
+		FromEmail:    "noreply@example.com",
+		IsActive:     true,
+	}
+	if err := settings.Save(db); err != nil {
+		t.Fatalf("Failed to save settings: %v", err)
+	}
+	if settings.SMTPPassword != "hunter2" {
+		t.Errorf("Expected in-memory password to stay plaintext after save, got %q", settings.SMTPPassword)
+	}
+
+	var stored string
+	db.Model(&EmailSettings{}).Select("smtp_password").Where("id = ?", settings.ID).Scan(&stored)
+	if stored == "hunter2" || !strings.HasPrefix(stored, encryptedPrefix) {
+		t.Errorf("Expected stored password to be encrypted, got %q", stored)
+	}
+
+	loaded, err := GetActiveEmailSettings(db)
+	if err != nil {
+		t.Fatalf("Failed to load settings: %v", err)
+	}
+	if loaded.SMTPPassword != "hunter2" {
+		t.Errorf("Expected decrypted password to round-trip, got %q", loaded.SMTPPassword)
+	}
+}
+
+func TestEncryptStoredSecrets(t *testing.T) {
+	db := setupTestDB(t)
+
+	// Simulate a row written in plaintext before encryption existed
+	db.Exec("INSERT INTO email_settings (provider, smtp_password, from_email, is_active) VALUES (?, ?, ?, ?)",
+		"smtp", "legacy-password", "noreply@example.com", true)
+
+	if err := EncryptStoredSecrets(db); err != nil {
+		t.Fatalf("Failed to encrypt stored secrets: %v", err)
+	}
+
+	var stored string
+	db.Model(&EmailSettings{}).Select("smtp_password").Scan(&stored)
+	if !strings.HasPrefix(stored, encryptedPrefix) {
+		t.Errorf("Expected legacy password to be encrypted, got %q", stored)
+	}
+
+	loaded, err := GetActiveEmailSettings(db)
+	if err != nil {
+		t.Fatalf("Failed to load settings: %v", err)
+	}
+	if loaded.SMTPPassword != "legacy-password" {
+		t.Errorf("Expected migrated password to decrypt, got %q", loaded.SMTPPassword)
+	}
+}
+
+func TestProduct_APIKeyHashedAtRest(t *testing.T) {
+	db := setupTestDB(t)
+
+	product := Product{Name: "Hashed"}
+	if err := db.Create(&product).Error; err != nil {
+		t.Fatalf("Failed to create product: %v", err)
+	}
+	key, err := product.RegenerateAPIKey(db)
+	if err != nil {
+		t.Fatalf("Failed to generate API key: %v", err)
+	}
+
+	var stored Product
+	db.First(&stored, product.ID)
+	if stored.APIKey == key || !strings.HasPrefix(stored.APIKey, apiKeyHashPrefix) {
+		t.Errorf("Expected stored API key to be hashed, got %q", stored.APIKey)
+	}
+	if !strings.HasSuffix(key, stored.APIKeyHint) || len(stored.APIKeyHint) != 4 {
+		t.Errorf("Expected the hint to be the key's last characters, got %q", stored.APIKeyHint)
+	}
+	if !stored.CheckAPIKey(key) || stored.CheckAPIKey(stored.APIKey) {
+		t.Error("Expected only the plaintext key to be accepted")
+	}
+
+	// Saving the product again must not hash the digest a second time
+	stored.Description = "updated"
+	db.Save(&stored)
+	db.First(&stored, product.ID)
+	if !stored.CheckAPIKey(key) {
+		t.Error("Expected the key to keep working after the product is saved")
+	}
+}
+
+func TestHashStoredAPIKeys(t *testing.T) {
+	db := setupTestDB(t)
+
+	// Simulate a key written in plaintext before hashing existed
+	db.Exec("INSERT INTO products (name, permalink, api_key) VALUES (?, ?, ?)", "Legacy", "legacy", "mk_legacykey1234")
+
+	if err := HashStoredAPIKeys(db); err != nil {
+		t.Fatalf("Failed to hash stored API keys: %v", err)
+	}
+
+	var product Product
+	db.Where("name = ?", "Legacy").First(&product)
+	if !strings.HasPrefix(product.APIKey, apiKeyHashPrefix) || product.APIKeyHint != "1234" {
+		t.Errorf("Expected legacy key to be hashed with a hint, got %q and %q", product.APIKey, product.APIKeyHint)
+	}
+	if !product.CheckAPIKey("mk_legacykey1234") {
+		t.Error("Expected the legacy key to keep verifying")
+	}
+}
+
+func TestBackfillLookupKeys(t *testing.T) {
+	db := setupTestDB(t)
+
+	product := Product{Name: "Test Product"}
+	db.Create(&product)
+	customer := Customer{Name: "Jane", Email: "jane@example.com"}
+	db.Create(&customer)
+
+	// Simulate a key stored before the lookup column existed
+	db.Exec("INSERT INTO license_keys (key, product_id, customer_id, status) VALUES (?, ?, ?, ?)", "ABCD-EFGH", product.ID, customer.ID, "active")
+
+	if err := BackfillLookupKeys(db); err != nil {
+		t.Fatalf("Failed to backfill lookup keys: %v", err)
+	}
+
+	matches, err := FindLicenseKeysByKey(db, "abcdefgh")
+	if err != nil {
+		t.Fatalf("FindLicenseKeysByKey failed: %v", err)
+	}
+	if len(matches) != 1 || matches[0].LookupKey != "ABCDEFGH" {
+		t.Errorf("Expected the legacy key to be found by its lookup key, got %+v", matches)
+	}
+}
+
+func TestEmailSettings_Redacted(t *testing.T) {
+	settings := EmailSettings{SMTPHost: "smtp.example.com", SMTPPassword: "smtp-password-value"}
+
+	redacted := settings.Redacted()
+	if strings.Contains(fmt.Sprintf("%+v", redacted), "smtp-password-value") {
+		t.Error("Redacted settings should not contain the SMTP password")
+	}
+	if redacted.SMTPPassword == "" {
+		t.Error("Redacted settings should still indicate that a password is set")
+	}
+	if settings.SMTPPassword != "smtp-password-value" {
+		t.Error("Redacted should not modify the original settings")
+	}
+}
+
+func TestLicenseKey_ToPurchaseReportsTheSale(t *testing.T) {
+	lk := LicenseKey{
+		ID:       7,
+		Key:      "SOLD",
+		Price:    4900,
+		Currency: "eur",
+		SaleID:   "pi_3Nabc",
+		Status:   "active",
+		Product:  Product{Name: "Pro", Permalink: "pro"},
+	}
+
+	purchase := lk.ToPurchase()
+	if purchase.Price != 4900 || purchase.Currency != "eur" || purchase.SaleID != "pi_3Nabc" {
+		t.Errorf("Expected the recorded sale, got %d %q %q", purchase.Price, purchase.Currency, purchase.SaleID)
+	}
+	if purchase.ProductPermalink != "pro" || purchase.Test {
+		t.Errorf("Expected the product's permalink and a live purchase, got %q and %v", purchase.ProductPermalink, purchase.Test)
+	}
+}
+
+func TestLicenseKey_PerpetualNeverExpires(t *testing.T) {
+	db := setupTestDB(t)
+
+	product := Product{Name: "Lifetime Product", DefaultExpirationDays: 30, Perpetual: true}
+	db.Create(&product)
+	customer := Customer{Name: "Jane", Email: "jane@example.com"}
+	db.Create(&customer)
+
+	lk, err := product.GenerateLicenseKeyFor(db, &customer)
+	if err != nil {
+		t.Fatalf("GenerateLicenseKeyFor failed: %v", err)
+	}
+	if !lk.IsPerpetual() || lk.IsExpired() {
+		t.Errorf("Expected a perpetual key with no expiry, got %v", lk.ExpiresAt)
+	}
+	if !lk.ToPurchase().Perpetual {
+		t.Error("Expected the verify response to flag the key as perpetual")
+	}
+
+	var expired int64
+	db.Model(&LicenseKey{}).Where("expires_at IS NOT NULL AND expires_at < ?", time.Now().AddDate(10, 0, 0)).Count(&expired)
+	if expired != 0 {
+		t.Errorf("Perpetual key should never count as expired, got %d", expired)
+	}
+}
+
+func TestLicenseKeysExpiringBetween_SkipsPerpetual(t *testing.T) {
+	db := setupTestDB(t)
+
+	customer := Customer{Name: "Jane", Email: "jane@example.com"}
+	db.Create(&customer)
+	dated := Product{Name: "Yearly", DefaultExpirationDays: 7}
+	db.Create(&dated)
+	lifetime := Product{Name: "Lifetime", Perpetual: true}
+	db.Create(&lifetime)
+
+	expiring, err := dated.GenerateLicenseKeyFor(db, &customer)
+	if err != nil {
+		t.Fatalf("GenerateLicenseKeyFor failed: %v", err)
+	}
+	if _, err := lifetime.GenerateLicenseKeyFor(db, &customer); err != nil {
+		t.Fatalf("GenerateLicenseKeyFor failed: %v", err)
+	}
+
+	now := time.Now()
+	keys, err := LicenseKeysExpiringBetween(db, now, now.AddDate(0, 0, 30))
+	if err != nil {
+		t.Fatalf("LicenseKeysExpiringBetween failed: %v", err)
+	}
+	if len(keys) != 1 || keys[0].ID != expiring.ID {
+		t.Errorf("Expected only the dated key to be due a reminder, got %d keys", len(keys))
+	}
+}
+
+func TestCountExpiredLicenseKeys(t *testing.T) {
+	db := setupTestDB(t)
+
+	product := Product{Name: "Test Product"}
+	db.Create(&product)
+	customer := Customer{Name: "Jane", Email: "jane@example.com"}
+	db.Create(&customer)
+
+	now := time.Now()
+	past := now.AddDate(0, 0, -1)
+	soon := now.AddDate(0, 0, 5)
+	later := now.AddDate(1, 0, 0)
+	keys := []LicenseKey{
+		{Key: "EXPIRED", ExpiresAt: &past, Status: "active"},
+		{Key: "EXPIRED-STATUS", ExpiresAt: &past, Status: "expired"},
+		{Key: "REVOKED", ExpiresAt: &past, Status: "revoked"},
+		{Key: "PERPETUAL", Status: "active"},
+		{Key: "SOON", ExpiresAt: &soon, Status: "active"},
+		{Key: "LATER", ExpiresAt: &later, Status: "active"},
+	}
+	for i := range keys {
+		keys[i].ProductID = product.ID
+		keys[i].CustomerID = customer.ID
+		db.Create(&keys[i])
+	}
+
+	expired, err := CountExpiredLicenseKeys(db, now)
+	if err != nil {
+		t.Fatalf("CountExpiredLicenseKeys failed: %v", err)
+	}
+	if expired != 2 {
+		t.Errorf("Expected 2 expired keys (perpetual and revoked excluded), got %d", expired)
+	}
+
+	soonCount, err := CountExpiringSoon(db, now, ExpiringSoonWindow)
+	if err != nil {
+		t.Fatalf("CountExpiringSoon failed: %v", err)
+	}
+	if soonCount != 1 {
+		t.Errorf("Expected 1 key expiring soon, got %d", soonCount)
+	}
+}
+
+func TestLicenseKey_ActivationsAndUsageAreSeparate(t *testing.T) {
+	db := setupTestDB(t)
+
+	product := Product{Name: "Test Product"}
+	db.Create(&product)
+	customer := Customer{Name: "Jane", Email: "jane@example.com"}
+	db.Create(&customer)
+	lk := LicenseKey{Key: "COUNTERS", ProductID: product.ID, CustomerID: customer.ID, MaxActivations: 2, UsageLimit: 3, Status: "active"}
+	db.Create(&lk)
+
+	// Activations fill up without touching usage, and a full key stays valid
+	for i := 0; i < 2; i++ {
+		if err := lk.RegisterActivation(db); err != nil {
+			t.Fatalf("RegisterActivation %d failed: %v", i+1, err)
+		}
+	}
+	if err := lk.RegisterActivation(db); !errors.Is(err, ErrActivationLimitReached) {
+		t.Errorf("Expected ErrActivationLimitReached, got %v", err)
+	}
+	if lk.CurrentActivations != 2 || lk.UsageCount != 0 {
+		t.Errorf("Expected 2 activations and no usage, got %d and %d", lk.CurrentActivations, lk.UsageCount)
+	}
+	if lk.Status != "active" || !lk.IsValidForUse() {
+		t.Errorf("A key with every activation taken should stay active and valid, got %q", lk.Status)
+	}
+
+	// A stale copy can't take an activation another request already claimed
+	stale := LicenseKey{Key: "STALE", ProductID: product.ID, CustomerID: customer.ID, MaxActivations: 1, Status: "active"}
+	db.Create(&stale)
+	other := stale
+	if err := other.RegisterActivation(db); err != nil {
+		t.Fatalf("RegisterActivation failed: %v", err)
+	}
+	if err := stale.RegisterActivation(db); !errors.Is(err, ErrActivationLimitReached) {
+		t.Errorf("Expected ErrActivationLimitReached from a stale copy, got %v", err)
+	}
+	if stale.CurrentActivations != 1 {
+		t.Errorf("Expected the stale copy to pick up 1 activation, got %d", stale.CurrentActivations)
+	}
+
+	// Usage is metered against UsageLimit without touching activations
+	for i := 0; i < 3; i++ {
+		if err := lk.IncrementUsage(db); err != nil {
+			t.Fatalf("IncrementUsage %d failed: %v", i+1, err)
+		}
+	}
+	if err := lk.IncrementUsage(db); !errors.Is(err, ErrUsageLimitReached) {
+		t.Errorf("Expected ErrUsageLimitReached, got %v", err)
+	}
+
+	var stored LicenseKey
+	db.First(&stored, lk.ID)
+	if stored.CurrentActivations != 2 || stored.UsageCount != 3 {
+		t.Errorf("Expected 2 activations and 3 uses, got %d and %d", stored.CurrentActivations, stored.UsageCount)
+	}
+	if !stored.UsageExhausted() || !stored.IsValidForUse() {
+		t.Error("Exhausted usage should stop metering but not verification")
+	}
+	if stored.ActivationsRemaining() != 0 || stored.UsageRemaining() != 0 {
+		t.Errorf("Expected nothing remaining, got %d activations and %d uses", stored.ActivationsRemaining(), stored.UsageRemaining())
+	}
+}
+
+func TestSaveIfUnchanged(t *testing.T) {
+	db := setupTestDB(t)
+
+	product := Product{Name: "Locked", Perpetual: true}
+	db.Create(&product)
+
+	// An editor that loaded version 0 saves, including a zero value
+	product.Perpetual = false
+	if err := SaveIfUnchanged(db, &product, 0); err != nil {
+		t.Fatalf("SaveIfUnchanged failed: %v", err)
+	}
+	var stored Product
+	db.First(&stored, product.ID)
+	if stored.LockVersion != 1 || stored.Perpetual {
+		t.Errorf("Expected version 1 and perpetual false, got %d and %v", stored.LockVersion, stored.Perpetual)
+	}
+
+	// A second editor that also loaded version 0 is rejected
+	stale := stored
+	stale.Name = "Overwritten"
+	if err := SaveIfUnchanged(db, &stale, 0); !errors.Is(err, ErrStaleRecord) {
+		t.Errorf("Expected ErrStaleRecord, got %v", err)
+	}
+	if stale.LockVersion != 0 {
+		t.Errorf("Expected a rejected save to restore the version, got %d", stale.LockVersion)
+	}
+	db.First(&stored, product.ID)
+	if stored.Name != "Locked" {
+		t.Errorf("Expected the stale save to write nothing, got name %q", stored.Name)
+	}
+}
+
+func TestProduct_DefaultExpiryUnits(t *testing.T) {
+	leapDay := time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)
+	jan31 := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		product Product
+		issued  time.Time
+		want    time.Time
+	}{
+		{"1 year from Feb 29", Product{DefaultExpirationDays: 1, DefaultExpirationUnit: ExpirationUnitYears}, leapDay, time.Date(2025, 2, 28, 12, 0, 0, 0, time.UTC)},
+		{"4 years from Feb 29", Product{DefaultExpirationDays: 4, DefaultExpirationUnit: ExpirationUnitYears}, leapDay, time.Date(2028, 2, 29, 12, 0, 0, 0, time.UTC)},
+		{"1 month from Jan 31", Product{DefaultExpirationDays: 1, DefaultExpirationUnit: ExpirationUnitMonths}, jan31, time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)},
+		{"365 days from Feb 29", Product{DefaultExpirationDays: 365, DefaultExpirationUnit: ExpirationUnitDays}, leapDay, leapDay.AddDate(0, 0, 365)},
+		{"Legacy products count days", Product{DefaultExpirationDays: 30}, jan31, jan31.AddDate(0, 0, 30)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.product.DefaultExpiry(tt.issued)
+			if got == nil || !got.Equal(tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	if got := NormalizeExpirationUnit("fortnights"); got != ExpirationUnitDays {
+		t.Errorf("Expected unknown units to fall back to days, got %q", got)
+	}
+}
+
+func TestLicenseKey_ReactivateAfterRefund(t *testing.T) {
+	db := setupTestDB(t)
+
+	product := &Product{Name: "Refund Product"}
+	db.Create(product)
+	customer := &Customer{Name: "Test Customer", Email: "test@example.com"}
+	db.Create(customer)
+
+	for _, reason := range []string{"Refunded", "Stripe chargeback"} {
+		lk := &LicenseKey{Key: "REFUND-" + reason, ProductID: product.ID, CustomerID: customer.ID, Status: "active"}
+		db.Create(lk)
+		if err := lk.Revoke(db, reason); err != nil {
+			t.Fatalf("Revoke failed: %v", err)
+		}
+
+		if err := lk.Reactivate(db, false); !errors.Is(err, ErrReactivationNeedsOverride) {
+			t.Errorf("%q: expected ErrReactivationNeedsOverride, got %v", reason, err)
+		}
+		if !lk.IsRevoked() {
+			t.Errorf("%q: key should stay revoked without the override", reason)
+		}
+		if err := lk.Reactivate(db, true); err != nil || !lk.IsActive() {
+			t.Errorf("%q: override should reactivate the key, got err=%v status=%s", reason, err, lk.Status)
+		}
+	}
+
+	lk := &LicenseKey{Key: "ABUSE-KEY", ProductID: product.ID, CustomerID: customer.ID, Status: "active"}
+	db.Create(lk)
+	lk.Revoke(db, "Key shared publicly")
+	if err := lk.Reactivate(db, false); err != nil || !lk.IsActive() {
+		t.Errorf("Key revoked for other reasons should reactivate, got err=%v status=%s", err, lk.Status)
+	}
+}
+
+func TestProduct_NewKeyFormat(t *testing.T) {
+	if key := (&Product{}).NewKey(); len(key) != DefaultKeyLength {
+		t.Errorf("Expected products without a format to get %d characters, got %q", DefaultKeyLength, key)
+	}
+
+	alphanumeric := &Product{KeyLength: 20, KeyCharset: KeyCharsetAlphanumeric}
+	if key := alphanumeric.NewKey(); len(key) != 20 {
+		t.Errorf("Expected a 20 character key, got %q", key)
+	}
+
+	crockford := &Product{KeyLength: 24, KeyCharset: KeyCharsetCrockford}
+	for i := 0; i < 200; i++ {
+		key := crockford.NewKey()
+		if len(key) != 24 {
+			t.Fatalf("Expected a 24 character key, got %q", key)
+		}
+		if strings.ContainsAny(key, "ILOU") {
+			t.Fatalf("Crockford key contains an ambiguous character: %q", key)
+		}
+	}
+
+	if NormalizeCrockfordKey("abc-o1l") != "ABC-011" {
+		t.Errorf("Expected look-alike letters to normalize, got %q", NormalizeCrockfordKey("abc-o1l"))
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	if got := NormalizeKey(" abcd-efgh\t1234\n"); got != "ABCD-EFGH1234" {
+		t.Errorf("Expected upper case without whitespace, got %q", got)
+	}
+	crockford := &Product{KeyCharset: KeyCharsetCrockford}
+	candidates := crockford.KeyLookupCandidates("abco il")
+	if candidates[len(candidates)-1] != "ABC011" {
+		t.Errorf("Expected a Crockford reading of the key, got %v", candidates)
+	}
+}
+
+func TestFindLicenseKeysByKey(t *testing.T) {
+	db := setupTestDB(t)
+
+	customer := Customer{Name: "Ada", Email: "ada@example.com"}
+	db.Create(&customer)
+	desktop := Product{Name: "Desktop"}
+	mobile := Product{Name: "Mobile"}
+	readable := Product{Name: "Readable", KeyCharset: KeyCharsetCrockford}
+	db.Create(&desktop)
+	db.Create(&mobile)
+	db.Create(&readable)
+	for _, lk := range []LicenseKey{
+		{Key: "SHARED-KEY-1", ProductID: desktop.ID, CustomerID: customer.ID},
+		{Key: "SHARED-KEY-1", ProductID: mobile.ID, CustomerID: customer.ID},
+		{Key: "ABC011", ProductID: readable.ID, CustomerID: customer.ID},
+		{Key: "XYZ011", ProductID: desktop.ID, CustomerID: customer.ID},
+	} {
+		if err := db.Create(&lk).Error; err != nil {
+			t.Fatalf("Failed to create license key: %v", err)
+		}
+	}
+
+	found, err := FindLicenseKeysByKey(db, " shared key1 ")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(found) != 2 || found[0].Product.Name != "Desktop" || found[1].Product.Name != "Mobile" {
+		t.Errorf("Expected the key under both products, got %+v", found)
+	}
+
+	if found, _ := FindLicenseKeysByKey(db, "abc-oil"); len(found) != 1 || found[0].ProductID != readable.ID {
+		t.Errorf("Expected look-alike letters to find the Crockford key, got %+v", found)
+	}
+	if found, _ := FindLicenseKeysByKey(db, "xyzoil"); len(found) != 0 {
+		t.Errorf("Look-alike letters must not match keys of other products, got %+v", found)
+	}
+	if found, _ := FindLicenseKeysByKey(db, "NO-SUCH-KEY"); len(found) != 0 {
+		t.Errorf("Expected no match for an unknown key, got %+v", found)
+	}
+}
+
+func TestValidateKeyLength(t *testing.T) {
+	for _, length := range []int{0, 8, MinKeyLength - 1, MaxKeyLength + 1} {
+		if ValidateKeyLength(length) == nil {
+			t.Errorf("Expected length %d to be rejected", length)
+		}
+	}
+	for _, length := range []int{MinKeyLength, DefaultKeyLength, MaxKeyLength} {
+		if err := ValidateKeyLength(length); err != nil {
+			t.Errorf("Expected length %d to be accepted, got %v", length, err)
+		}
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	db := setupTestDB(t)
+	policy := LoginThrottlePolicy{MaxFailures: 3, Window: 10 * time.Minute, Lockout: 15 * time.Minute}
+	keys := LoginThrottleKeys("Admin", "10.0.0.1")
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// Failures spread wider than the window never add up to a lockout
+	for i := 0; i < 4; i++ {
+		locked, err := RecordLoginFailure(db, keys, start.Add(time.Duration(i)*6*time.Minute), policy)
+		if err != nil || locked {
+			t.Fatalf("Failure %d: expected no lockout, got locked=%v err=%v", i, locked, err)
+		}
+	}
+
+	now := start.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if _, err := RecordLoginFailure(db, keys, now, policy); err != nil {
+			t.Fatalf("RecordLoginFailure failed: %v", err)
+		}
+	}
+	if locked, _ := LoginLocked(db, LoginThrottleKeys("admin", "10.0.0.2"), now); !locked {
+		t.Error("Username should be locked whatever its case or the IP")
+	}
+	if locked, _ := LoginLocked(db, LoginThrottleKeys("someone", "10.0.0.1"), now); !locked {
+		t.Error("IP should be locked for every username")
+	}
+	if locked, _ := LoginLocked(db, keys, now.Add(policy.Lockout)); locked {
+		t.Error("Lockout should end after the lockout duration")
+	}
+
+	if err := ResetLoginFailures(db, keys); err != nil {
+		t.Fatalf("ResetLoginFailures failed: %v", err)
+	}
+	if locked, _ := LoginLocked(db, keys, now); locked {
+		t.Error("Reset should lift the lockout")
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	tests := map[string]string{
+		"Pro Plan":          "pro-plan",
+		"Pro Plan (2024)":   "pro-plan-2024",
+		"  --Matcha--  ":    "matcha",
+		"Café Édition":      "caf-dition",
+		"!!!":               "product",
+		"already-a-slug-42": "already-a-slug-42",
+	}
+	for input, want := range tests {
+		if got := Slugify(input); got != want {
+			t.Errorf("Slugify(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestProduct_Permalink(t *testing.T) {
+	db := setupTestDB(t)
+
+	first := Product{Name: "Pro Plan"}
+	second := Product{Name: "Pro Plan"}
+	third := Product{Name: "pro plan!"}
+	for _, product := range []*Product{&first, &second, &third} {
+		if err := db.Create(product).Error; err != nil {
+			t.Fatalf("Failed to create product: %v", err)
+		}
+	}
+	if first.Permalink != "pro-plan" || second.Permalink != "pro-plan-2" || third.Permalink != "pro-plan-3" {
+		t.Errorf("Expected numbered permalinks on collision, got %q, %q, %q", first.Permalink, second.Permalink, third.Permalink)
+	}
+
+	if err := second.SetPermalink(db, "pro-plan"); err != ErrPermalinkTaken {
+		t.Errorf("Expected ErrPermalinkTaken for another product's permalink, got %v", err)
+	}
+	if err := second.SetPermalink(db, "Pro Plan Annual"); err != nil || second.Permalink != "pro-plan-annual" {
+		t.Errorf("Expected a chosen permalink to be slugified, got %q (%v)", second.Permalink, err)
+	}
+	if err := db.Save(&second).Error; err != nil {
+		t.Fatalf("Failed to save product: %v", err)
+	}
+	if err := first.SetPermalink(db, "pro-plan"); err != nil {
+		t.Errorf("Expected a product to keep its own permalink, got %v", err)
+	}
+
+	// Products from before permalinks existed have none until the backfill
+	if err := db.Model(&Product{}).Where("id = ?", third.ID).UpdateColumn("permalink", nil).Error; err != nil {
+		t.Fatalf("Failed to clear permalink: %v", err)
+	}
+	if err := BackfillPermalinks(db); err != nil {
+		t.Fatalf("BackfillPermalinks failed: %v", err)
+	}
+	var backfilled Product
+	db.First(&backfilled, third.ID)
+	if backfilled.Permalink != "pro-plan-2" {
+		t.Errorf("Expected the backfill to take the first free permalink, got %q", backfilled.Permalink)
+	}
+
+	found, err := FindProductByPermalink(db, "Pro Plan")
+	if err != nil || found.ID != first.ID {
+		t.Errorf("Expected a product name to still resolve, got %v (%v)", found, err)
+	}
+}
+
+func TestLicenseKey_UniquePerProduct(t *testing.T) {
+	db := setupTestDB(t)
+
+	// Databases from earlier versions still have the global index
+	if err := db.Exec("CREATE UNIQUE INDEX " + legacyGlobalKeyIndex + " ON license_keys(key)").Error; err != nil {
+		t.Fatalf("Failed to create legacy index: %v", err)
+	}
+	if err := DropGlobalKeyIndex(db); err != nil {
+		t.Fatalf("DropGlobalKeyIndex failed: %v", err)
+	}
+	if err := DropGlobalKeyIndex(db); err != nil {
+		t.Errorf("Expected dropping again to be a no-op, got %v", err)
+	}
+
+	first := &Product{Name: "First"}
+	second := &Product{Name: "Second"}
+	db.Create(first)
+	db.Create(second)
+	customer := &Customer{Name: "Test Customer", Email: "test@example.com"}
+	db.Create(customer)
+
+	if err := db.Create(&LicenseKey{Key: "SHARED-KEY", ProductID: first.ID, CustomerID: customer.ID}).Error; err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	if err := db.Create(&LicenseKey{Key: "SHARED-KEY", ProductID: second.ID, CustomerID: customer.ID}).Error; err != nil {
+		t.Errorf("Expected another product to reuse the key, got %v", err)
+	}
+
+	err := db.Create(&LicenseKey{Key: "SHARED-KEY", ProductID: first.ID, CustomerID: customer.ID}).Error
+	if !IsUniqueViolation(err) {
+		t.Errorf("Expected a duplicate key within a product to be rejected, got %v", err)
+	}
+}
+
+func TestParseAndFormatAmount(t *testing.T) {
+	tests := []struct {
+		amount   string
+		currency string
+		minor    int64
+		display  string
+	}{
+		{"19.99", "USD", 1999, "19.99 USD"},
+		{"5", "eur", 500, "5.00 EUR"},
+		{"0.5", "GBP", 50, "0.50 GBP"},
+		{"1200", "JPY", 1200, "1200 JPY"},
+	}
+	for _, tt := range tests {
+		minor, err := ParseAmount(tt.amount, tt.currency)
+		if err != nil {
+			t.Errorf("ParseAmount(%q, %q) failed: %v", tt.amount, tt.currency, err)
+			continue
+		}
+		if minor != tt.minor {
+			t.Errorf("ParseAmount(%q, %q) = %d, want %d", tt.amount, tt.currency, minor, tt.minor)
+		}
+		if got := FormatAmount(minor, tt.currency); got != tt.display {
+			t.Errorf("FormatAmount(%d, %q) = %q, want %q", minor, tt.currency, got, tt.display)
+		}
+	}
+
+	for _, bad := range []string{"", "abc", "1.234", "-5.00"} {
+		if _, err := ParseAmount(bad, "USD"); err == nil {
+			t.Errorf("Expected ParseAmount(%q) to fail", bad)
+		}
+	}
+	if _, err := ParseAmount("10.50", "JPY"); err == nil {
+		t.Error("Expected decimals to be rejected for a zero-decimal currency")
+	}
+}
@@ -0,0 +1,165 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+// ErrPermalinkTaken is returned when an admin picks a permalink another
+// product already uses
+var ErrPermalinkTaken = errors.New("permalink is already used by another product")
+
+// maxPermalinkSuffix bounds the search for a free numbered permalink
+const maxPermalinkSuffix = 1000
+
+// Slugify turns a product name into a permalink: lowercase letters and digits
+// separated by single hyphens, e.g. "Pro Plan (2024)" becomes "pro-plan-2024"
+func Slugify(name string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(name) {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+	if b.Len() == 0 {
+		return "product"
+	}
+	return b.String()
+}
+
+// SetPermalink gives the product an admin-chosen permalink, normalized with
+// Slugify. A blank value generates one from the name instead.
+func (p *Product) SetPermalink(db *gorm.DB, requested string) error {
+	if strings.TrimSpace(requested) == "" {
+		permalink, err := uniquePermalink(db, Slugify(p.Name), p.ID)
+		if err != nil {
+			return err
+		}
+		p.Permalink = permalink
+		return nil
+	}
+
+	permalink := Slugify(requested)
+	taken, err := permalinkTaken(db, permalink, p.ID)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrPermalinkTaken
+	}
+	p.Permalink = permalink
+	return nil
+}
+
+// BeforeCreate generates a permalink from the name unless one was set
+func (p *Product) BeforeCreate(tx *gorm.DB) error {
+	if p.Permalink != "" {
+		return nil
+	}
+	permalink, err := uniquePermalink(tx.Session(&gorm.Session{NewDB: true}), Slugify(p.Name), p.ID)
+	if err != nil {
+		return err
+	}
+	p.Permalink = permalink
+	return nil
+}
+
+// uniquePermalink returns base, or base-2, base-3 and so on when it is taken
+func uniquePermalink(db *gorm.DB, base string, exceptID uint) (string, error) {
+	for n := 1; n <= maxPermalinkSuffix; n++ {
+		candidate := base
+		if n > 1 {
+			candidate = fmt.Sprintf("%s-%d", base, n)
+		}
+		taken, err := permalinkTaken(db, candidate, exceptID)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no free permalink for %q", base)
+}
+
+func permalinkTaken(db *gorm.DB, permalink string, exceptID uint) (bool, error) {
+	var count int64
+	err := db.Model(&Product{}).Where("permalink = ? AND id <> ?", permalink, exceptID).Count(&count).Error
+	return count > 0, err
+}
+
+// BackfillPermalinks gives products created before permalinks existed one
+// generated from their name. It runs at boot and is a no-op once every
+// product has one.
+func BackfillPermalinks(db *gorm.DB) error {
+	var products []Product
+	if err := db.Where("permalink IS NULL OR permalink = ''").Order("id").Find(&products).Error; err != nil {
+		return err
+	}
+
+	for _, product := range products {
+		if err := product.SetPermalink(db, ""); err != nil {
+			return err
+		}
+		// UpdateColumn leaves updated_at and lock_version alone
+		if err := db.Model(&Product{}).Where("id = ?", product.ID).UpdateColumn("permalink", product.Permalink).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindProductByPermalink looks a product up by permalink. Before products had
+// permalinks, integrations were told to send the product name, so a name is
+// still accepted when no permalink matches.
+func FindProductByPermalink(db *gorm.DB, permalink string) (*Product, error) {
+	var product Product
+	err := db.Where("permalink = ?", permalink).First(&product).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = db.Where("name = ?", permalink).First(&product).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+// PublicProduct is what anyone may read about a product, enough to build a
+// buy button or pricing page
+type PublicProduct struct {
+	Permalink             string `json:"permalink"`
+	Name                  string `json:"name"`
+	Description           string `json:"description"`
+	Version               string `json:"version"`
+	LicenseType           string `json:"license_type"`
+	Perpetual             bool   `json:"perpetual"`
+	DefaultExpirationDays int    `json:"default_expiration_days" doc:"Counted in default_expiration_unit; ignored for perpetual products"`
+	DefaultExpirationUnit string `json:"default_expiration_unit"`
+	DefaultUsageLimit     int    `json:"default_usage_limit" doc:"Activations per key, 0 for unlimited"`
+}
+
+// ToPublic leaves out the API key and other admin-only settings
+func (p *Product) ToPublic() PublicProduct {
+	return PublicProduct{
+		Permalink:             p.Permalink,
+		Name:                  p.Name,
+		Description:           p.Description,
+		Version:               p.Version,
+		LicenseType:           p.LicenseType,
+		Perpetual:             p.Perpetual,
+		DefaultExpirationDays: p.DefaultExpirationDays,
+		DefaultExpirationUnit: p.DefaultExpirationUnit,
+		DefaultUsageLimit:     p.DefaultUsageLimit,
+	}
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PaymentProviders lists the webhook providers that can carry product identifiers
+var PaymentProviders = []string{"stripe", "gumroad", "paypal"}
+
+// ProductMapping ties a payment provider's own product identifier (a Stripe
+// price ID, a Gumroad product ID, a PayPal custom field) to a local product
+type ProductMapping struct {
+	ID         uint    `gorm:"primaryKey" json:"id"`
+	Provider   string  `gorm:"not null;uniqueIndex:idx_product_mappings_provider_external" json:"provider"`
+	ExternalID string  `gorm:"not null;uniqueIndex:idx_product_mappings_provider_external" json:"external_id"`
+	ProductID  uint    `gorm:"not null;index" json:"product_id"`
+	Product    Product `gorm:"foreignKey:ProductID"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// Validate checks the provider is known, the external ID is present and the product exists
+func (pm *ProductMapping) Validate(db *gorm.DB) error {
+	pm.ExternalID = strings.TrimSpace(pm.ExternalID)
+	if !isPaymentProvider(pm.Provider) {
+		return fmt.Errorf("unknown provider: %s", pm.Provider)
+	}
+	if pm.ExternalID == "" {
+		return fmt.Errorf("external ID is required")
+	}
+	var count int64
+	if err := db.Model(&Product{}).Where("id = ?", pm.ProductID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("product %d does not exist", pm.ProductID)
+	}
+	return nil
+}
+
+// ResolveProduct finds the local product for a provider's product identifier.
+// Mappings take precedence; without one a numeric identifier is treated as a
+// local product ID, as webhooks did before mappings existed. It returns
+// gorm.ErrRecordNotFound when nothing matches.
+func ResolveProduct(db *gorm.DB, provider, externalID string) (*Product, error) {
+	var mapping ProductMapping
+	err := db.Preload("Product").
+		Where("provider = ? AND external_id = ?", provider, externalID).
+		First(&mapping).Error
+	if err == nil {
+		if mapping.Product.ID == 0 {
+			return nil, gorm.ErrRecordNotFound // Mapped product was deleted
+		}
+		return &mapping.Product, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	productID, convErr := strconv.Atoi(externalID)
+	if convErr != nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	var product Product
+	if err := db.First(&product, productID).Error; err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+func isPaymentProvider(provider string) bool {
+	for _, p := range PaymentProviders {
+		if p == provider {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// zeroDecimalCurrencies have no minor unit, so providers report whole units
+var zeroDecimalCurrencies = map[string]bool{
+	"BIF": true, "CLP": true, "DJF": true, "GNF": true, "JPY": true, "KMF": true,
+	"KRW": true, "MGA": true, "PYG": true, "RWF": true, "UGX": true, "VND": true,
+	"VUV": true, "XAF": true, "XOF": true, "XPF": true,
+}
+
+// NormalizeCurrency uppercases an ISO 4217 code; Stripe and Gumroad send
+// lowercase ones
+func NormalizeCurrency(currency string) string {
+	return strings.ToUpper(strings.TrimSpace(currency))
+}
+
+func currencyDecimals(currency string) int {
+	if zeroDecimalCurrencies[NormalizeCurrency(currency)] {
+		return 0
+	}
+	return 2
+}
+
+// ParseAmount converts a decimal amount such as PayPal's "19.99" into the
+// currency's minor unit, the way Stripe and Gumroad report prices
+func ParseAmount(amount, currency string) (int64, error) {
+	whole, fraction, _ := strings.Cut(strings.TrimSpace(amount), ".")
+	decimals := currencyDecimals(currency)
+	if whole == "" {
+		return 0, fmt.Errorf("invalid amount %q", amount)
+	}
+	if len(fraction) > decimals {
+		return 0, fmt.Errorf("amount %q has too many decimals for %s", amount, NormalizeCurrency(currency))
+	}
+	minor, err := strconv.ParseInt(whole+fraction+strings.Repeat("0", decimals-len(fraction)), 10, 64)
+	if err != nil || minor < 0 {
+		return 0, fmt.Errorf("invalid amount %q", amount)
+	}
+	return minor, nil
+}
+
+// FormatAmount renders an amount in minor units, e.g. 1999 USD as "19.99 USD"
+func FormatAmount(minor int64, currency string) string {
+	currency = NormalizeCurrency(currency)
+	decimals := currencyDecimals(currency)
+	if decimals == 0 {
+		return fmt.Sprintf("%d %s", minor, currency)
+	}
+	return fmt.Sprintf("%d.%02d %s", minor/100, minor%100, currency)
+}
+
+// RevenueTotal sums the sales recorded in one currency, optionally for one
+// product. Amounts in different currencies are never added together.
+type RevenueTotal struct {
+	ProductID   uint   `json:"product_id,omitempty"`
+	ProductName string `json:"product_name,omitempty"`
+	Currency    string `json:"currency"`
+	Amount      int64  `json:"amount"` // In the currency's minor unit
+	Sales       int64  `json:"sales"`
+}
+
+// Formatted renders the total for display
+func (r RevenueTotal) Formatted() string {
+	return FormatAmount(r.Amount, r.Currency)
+}
+
+// RevenueByCurrency sums every recorded sale per currency
+func RevenueByCurrency(db *gorm.DB) ([]RevenueTotal, error) {
+	var totals []RevenueTotal
+	err := db.Model(&LicenseKey{}).
+		Select("currency, SUM(price) AS amount, COUNT(*) AS sales").
+		Where("currency <> ''").
+		Group("currency").
+		Order("currency").
+		Scan(&totals).Error
+	return totals, err
+}
+
+// RevenueByProduct sums recorded sales per product and currency
+func RevenueByProduct(db *gorm.DB) ([]RevenueTotal, error) {
+	var totals []RevenueTotal
+	err := db.Model(&LicenseKey{}).
+		Select("license_keys.product_id, products.name AS product_name, license_keys.currency, SUM(license_keys.price) AS amount, COUNT(*) AS sales").
+		Joins("JOIN products ON products.id = license_keys.product_id").
+		Where("license_keys.currency <> ''").
+		Group("license_keys.product_id, products.name, license_keys.currency").
+		Order("products.name, license_keys.currency").
+		Scan(&totals).Error
+	return totals, err
+}
@@ -0,0 +1,163 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// License types. Node-locked keys consume an activation for good, floating keys
+// check a seat out per device and get it back once the device stops heartbeating.
+const (
+	LicenseTypeNodeLocked = "node_locked"
+	LicenseTypeFloating   = "floating"
+)
+
+// FloatingSeatTimeout is how long a floating checkout survives without a heartbeat
+const FloatingSeatTimeout = 15 * time.Minute
+
+var (
+	ErrNoSeatsAvailable  = errors.New("no floating seats available")
+	ErrSeatNotCheckedOut = errors.New("no seat is checked out for this device")
+)
+
+// SeatCheckout is a floating seat held by one device. CurrentActivations on the
+// license key mirrors the number of live checkouts.
+type SeatCheckout struct {
+	ID              uint      `gorm:"primaryKey" json:"id"`
+	LicenseKeyID    uint      `gorm:"not null;uniqueIndex:idx_seat_checkouts_key_device" json:"license_key_id"`
+	DeviceID        string    `gorm:"not null;uniqueIndex:idx_seat_checkouts_key_device" json:"device_id"`
+	Hostname        string    `json:"hostname"` // As last reported by the device, if it sends one
+	LastHeartbeatAt time.Time `gorm:"not null;index" json:"last_heartbeat_at"`
+	CreatedAt       time.Time `json:"created_at"` // When the device first checked out this seat
+}
+
+// NormalizeLicenseType maps form input to a known license type, defaulting to node-locked
+func NormalizeLicenseType(licenseType string) string {
+	if licenseType == LicenseTypeFloating {
+		return LicenseTypeFloating
+	}
+	return LicenseTypeNodeLocked
+}
+
+func (lk *LicenseKey) IsFloating() bool {
+	return lk.LicenseType == LicenseTypeFloating
+}
+
+// CheckoutSeat hands deviceID a floating seat, or refreshes the one it already
+// holds. Stale checkouts are reclaimed first so abandoned devices free up seats.
+// hostname is optional and only shown to admins.
+func (lk *LicenseKey) CheckoutSeat(db *gorm.DB, deviceID, hostname string, now time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := lk.ReclaimStaleSeats(tx, now); err != nil {
+			return err
+		}
+
+		var checkout SeatCheckout
+		err := tx.Where("license_key_id = ? AND device_id = ?", lk.ID, deviceID).First(&checkout).Error
+		if err == nil {
+			if hostname != "" && hostname != checkout.Hostname {
+				if err := tx.Model(&checkout).Update("hostname", hostname).Error; err != nil {
+					return err
+				}
+			}
+			return lk.touchSeat(tx, &checkout, now)
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if lk.MaxActivations > 0 && lk.CurrentActivations >= lk.MaxActivations {
+			return ErrNoSeatsAvailable
+		}
+		checkout = SeatCheckout{LicenseKeyID: lk.ID, DeviceID: deviceID, Hostname: hostname, LastHeartbeatAt: now}
+		if err := tx.Create(&checkout).Error; err != nil {
+			return err
+		}
+		lk.LastValidatedAt = &now
+		return lk.syncSeatCount(tx)
+	})
+}
+
+// Heartbeat keeps the device's checkout alive. It fails with ErrSeatNotCheckedOut
+// once the checkout has been reclaimed, and the client has to check out again.
+func (lk *LicenseKey) Heartbeat(db *gorm.DB, deviceID string, now time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := lk.ReclaimStaleSeats(tx, now); err != nil {
+			return err
+		}
+
+		var checkout SeatCheckout
+		if err := tx.Where("license_key_id = ? AND device_id = ?", lk.ID, deviceID).First(&checkout).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrSeatNotCheckedOut
+			}
+			return err
+		}
+		return lk.touchSeat(tx, &checkout, now)
+	})
+}
+
+// ReclaimStaleSeats releases checkouts that missed their heartbeat window.
+// Node-locked keys are left alone since their activations never time out.
+func (lk *LicenseKey) ReclaimStaleSeats(db *gorm.DB, now time.Time) error {
+	if !lk.IsFloating() {
+		return nil
+	}
+	if err := db.Where("license_key_id = ? AND last_heartbeat_at < ?", lk.ID, now.Add(-FloatingSeatTimeout)).
+		Delete(&SeatCheckout{}).Error; err != nil {
+		return err
+	}
+	return lk.syncSeatCount(db)
+}
+
+// ReleaseSeat frees the seat deviceID holds, e.g. when an admin deactivates
+// a lost machine. It fails with ErrSeatNotCheckedOut when there is none.
+func (lk *LicenseKey) ReleaseSeat(db *gorm.DB, deviceID string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("license_key_id = ? AND device_id = ?", lk.ID, deviceID).Delete(&SeatCheckout{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrSeatNotCheckedOut
+		}
+		return lk.syncSeatCount(tx)
+	})
+}
+
+// SeatsForLicenseKey lists the devices holding seats on a key, in the order
+// they checked out
+func SeatsForLicenseKey(db *gorm.DB, licenseKeyID uint) ([]SeatCheckout, error) {
+	var seats []SeatCheckout
+	err := db.Where("license_key_id = ?", licenseKeyID).
+		Order("created_at ASC, id ASC").
+		Find(&seats).Error
+	return seats, err
+}
+
+// ReleaseSeats drops every checkout held against the key
+func (lk *LicenseKey) ReleaseSeats(db *gorm.DB) error {
+	return db.Where("license_key_id = ?", lk.ID).Delete(&SeatCheckout{}).Error
+}
+
+func (lk *LicenseKey) touchSeat(db *gorm.DB, checkout *SeatCheckout, now time.Time) error {
+	if err := db.Model(checkout).Update("last_heartbeat_at", now).Error; err != nil {
+		return err
+	}
+	lk.LastValidatedAt = &now
+	return db.Model(lk).UpdateColumn("last_validated_at", now).Error
+}
+
+func (lk *LicenseKey) syncSeatCount(db *gorm.DB) error {
+	var count int64
+	if err := db.Model(&SeatCheckout{}).Where("license_key_id = ?", lk.ID).Count(&count).Error; err != nil {
+		return err
+	}
+	lk.CurrentActivations = int(count)
+	return db.Model(lk).UpdateColumns(map[string]interface{}{
+		"current_activations": lk.CurrentActivations,
+		"last_validated_at":   lk.LastValidatedAt,
+	}).Error
+}
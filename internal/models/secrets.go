@@ -0,0 +1,211 @@
+package models
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"matcha/internal/config"
+)
+
+// encryptedPrefix marks values that have been encrypted at rest, so plaintext
+// left over from before encryption can be told apart and migrated
+const encryptedPrefix = "enc:v1:"
+
+var errNoEncryptionKey = errors.New("secret encryption key not configured")
+
+var secretsKey []byte
+
+// SetEncryptionKey derives the AES-256 key used to encrypt secrets at rest
+// from the application secret. It must be called before secrets are read or
+// written.
+func SetEncryptionKey(secret string) {
+	key := sha256.Sum256([]byte("matcha-secrets:" + secret))
+	secretsKey = key[:]
+}
+
+func encryptSecret(plaintext string) (string, error) {
+	if plaintext == "" || strings.HasPrefix(plaintext, encryptedPrefix) {
+		return plaintext, nil
+	}
+
+	gcm, err := secretsCipher()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedPrefix) {
+		// Plaintext from before encryption was introduced
+		return stored, nil
+	}
+
+	gcm, err := secretsCipher()
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted secret: %w", err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("malformed encrypted secret")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret (was SECRET_KEY changed?): %w", err)
+	}
+	return string(plaintext), nil
+}
+
+func secretsCipher() (cipher.AEAD, error) {
+	if secretsKey == nil {
+		return nil, errNoEncryptionKey
+	}
+	block, err := aes.NewCipher(secretsKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// BeforeSave encrypts the SMTP password before it is written. For SendGrid and
+// Mailgun the field holds the provider's API key, which is encrypted the same way.
+func (es *EmailSettings) BeforeSave(tx *gorm.DB) error {
+	encrypted, err := encryptSecret(es.SMTPPassword)
+	if err != nil {
+		return err
+	}
+	es.SMTPPassword = encrypted
+	return nil
+}
+
+// AfterSave restores the plaintext password on the in-memory struct
+func (es *EmailSettings) AfterSave(tx *gorm.DB) error {
+	return es.AfterFind(tx)
+}
+
+// AfterFind decrypts the SMTP password when settings are loaded
+func (es *EmailSettings) AfterFind(tx *gorm.DB) error {
+	plaintext, err := decryptSecret(es.SMTPPassword)
+	if err != nil {
+		return err
+	}
+	es.SMTPPassword = plaintext
+	return nil
+}
+
+// Redacted returns a copy of the settings that is safe to hand to templates
+// or logs: the password is replaced by a mask, so checks for whether one is
+// set still work but the secret itself never leaves the model
+func (es EmailSettings) Redacted() EmailSettings {
+	if es.SMTPPassword != "" {
+		es.SMTPPassword = config.Redact(es.SMTPPassword)
+	}
+	return es
+}
+
+// RedactEmailSettings applies Redacted to every entry of a list
+func RedactEmailSettings(settings []EmailSettings) []EmailSettings {
+	redacted := make([]EmailSettings, len(settings))
+	for i, s := range settings {
+		redacted[i] = s.Redacted()
+	}
+	return redacted
+}
+
+// EncryptStoredSecrets encrypts any SMTP passwords still stored in plaintext.
+// It runs at boot and is a no-op once every row has been migrated.
+func EncryptStoredSecrets(db *gorm.DB) error {
+	var rows []struct {
+		ID           uint
+		SMTPPassword string
+	}
+	err := db.Model(&EmailSettings{}).
+		Select("id, smtp_password").
+		Where("smtp_password <> '' AND smtp_password NOT LIKE ?", encryptedPrefix+"%").
+		Find(&rows).Error
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		encrypted, err := encryptSecret(row.SMTPPassword)
+		if err != nil {
+			return err
+		}
+		// UpdateColumn skips hooks so the value isn't processed twice
+		if err := db.Model(&EmailSettings{}).Where("id = ?", row.ID).UpdateColumn("smtp_password", encrypted).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apiKeyHashPrefix marks a product API key stored as its SHA-256 digest. Keys
+// are only ever compared, so unlike SMTP passwords they are hashed rather than
+// encrypted.
+const apiKeyHashPrefix = "sha256:"
+
+// HashAPIKey returns the digest a product API key is stored and looked up by.
+// The keys are long and random, so a plain SHA-256 is enough.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return apiKeyHashPrefix + hex.EncodeToString(sum[:])
+}
+
+func apiKeyHint(key string) string {
+	if len(key) <= 4 {
+		return key
+	}
+	return key[len(key)-4:]
+}
+
+// HashStoredAPIKeys hashes product API keys still stored in plaintext. It is
+// a no-op once every key has been migrated.
+func HashStoredAPIKeys(db *gorm.DB) error {
+	var rows []struct {
+		ID     uint
+		APIKey string
+	}
+	err := db.Model(&Product{}).
+		Select("id, api_key").
+		Where("api_key <> '' AND api_key NOT LIKE ?", apiKeyHashPrefix+"%").
+		Find(&rows).Error
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		// UpdateColumns skips hooks and leaves updated_at alone
+		err := db.Model(&Product{}).Where("id = ?", row.ID).UpdateColumns(map[string]interface{}{
+			"api_key":      HashAPIKey(row.APIKey),
+			"api_key_hint": apiKeyHint(row.APIKey),
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OwnedBy scopes a query to the rows of one tenant. A nil ownerID matches
+// every row, which is what single-tenant installs and unscoped admins get.
+// The column is qualified with the query's own table so the scope still works
+// on queries that join products or customers.
+func OwnedBy(ownerID *uint) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if ownerID == nil {
+			return db
+		}
+		return db.Where(clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: "owner_id"}, Value: *ownerID})
+	}
+}
+
+// SameOwner reports whether a record owned by owner is visible to a tenant.
+// A nil tenant sees everything.
+func SameOwner(tenant, owner *uint) bool {
+	return tenant == nil || (owner != nil && *owner == *tenant)
+}
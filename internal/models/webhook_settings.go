@@ -0,0 +1,160 @@
+package models
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// WebhookSecretProviders lists the providers whose webhooks can be checked
+// against a secret, in display order
+var WebhookSecretProviders = []string{"gumroad", "stripe", "paypal"}
+
+// WebhookSettings holds the webhook secret for one payment provider: the
+// shared secret for Gumroad, the endpoint's signing secret for Stripe, and the
+// webhook ID PayPal signs with. Without a row (or with an empty secret) the
+// provider's webhooks are accepted unchecked, so existing setups keep working
+// until a secret is configured.
+//
+// SecondarySecret is the next secret during a rotation. Webhooks carrying
+// either secret are accepted until it is promoted, so the provider can be
+// switched over without rejecting anything in between.
+type WebhookSettings struct {
+	ID              uint   `gorm:"primaryKey" json:"id"`
+	Provider        string `gorm:"not null;uniqueIndex" json:"provider"`
+	Secret          string `json:"-"` // Encrypted at rest
+	SecondarySecret string `json:"-"` // Encrypted at rest
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// Errors from rotating a provider's webhook secret
+var (
+	ErrNoWebhookSecret          = errors.New("no webhook secret is set to rotate")
+	ErrNoSecondaryWebhookSecret = errors.New("no secondary webhook secret to promote")
+)
+
+// GetWebhookSettings loads the settings for provider, returning an empty
+// unsaved value when none have been stored yet
+func GetWebhookSettings(db *gorm.DB, provider string) (WebhookSettings, error) {
+	var settings WebhookSettings
+	err := db.Where("provider = ?", provider).First(&settings).Error
+	if err == gorm.ErrRecordNotFound {
+		return WebhookSettings{Provider: provider}, nil
+	}
+	return settings, err
+}
+
+// SaveWebhookSecret stores (or, with an empty secret, clears) the provider's secret
+func SaveWebhookSecret(db *gorm.DB, provider, secret string) error {
+	if !isWebhookSecretProvider(provider) {
+		return fmt.Errorf("unknown webhook provider: %s", provider)
+	}
+
+	settings, err := GetWebhookSettings(db, provider)
+	if err != nil {
+		return err
+	}
+	settings.Secret = secret
+	if secret == "" {
+		// A secondary secret alone would check nothing, see Verify
+		settings.SecondarySecret = ""
+	}
+	return db.Save(&settings).Error
+}
+
+// SaveWebhookSecondarySecret starts a rotation by accepting secret alongside
+// the provider's current one, or with an empty secret cancels it
+func SaveWebhookSecondarySecret(db *gorm.DB, provider, secret string) error {
+	if !isWebhookSecretProvider(provider) {
+		return fmt.Errorf("unknown webhook provider: %s", provider)
+	}
+
+	settings, err := GetWebhookSettings(db, provider)
+	if err != nil {
+		return err
+	}
+	if settings.Secret == "" && secret != "" {
+		return ErrNoWebhookSecret
+	}
+	settings.SecondarySecret = secret
+	return db.Save(&settings).Error
+}
+
+// PromoteWebhookSecondarySecret ends a rotation: the secondary secret becomes
+// the provider's only secret and the old one stops being accepted
+func PromoteWebhookSecondarySecret(db *gorm.DB, provider string) error {
+	settings, err := GetWebhookSettings(db, provider)
+	if err != nil {
+		return err
+	}
+	if settings.SecondarySecret == "" {
+		return ErrNoSecondaryWebhookSecret
+	}
+	settings.Secret = settings.SecondarySecret
+	settings.SecondarySecret = ""
+	return db.Save(&settings).Error
+}
+
+// Verify reports whether provided matches the configured secret, or the
+// secondary one during a rotation. It always passes when no secret is
+// configured.
+func (ws *WebhookSettings) Verify(provided string) bool {
+	return ws.VerifyWith(func(secret string) bool {
+		return subtle.ConstantTimeCompare([]byte(secret), []byte(provided)) == 1
+	})
+}
+
+// VerifyWith is Verify for providers that sign their webhooks: check is asked
+// whether the request is signed with the configured secret or, during a
+// rotation, the secondary one
+func (ws *WebhookSettings) VerifyWith(check func(secret string) bool) bool {
+	if ws.Secret == "" {
+		return true
+	}
+	if check(ws.Secret) {
+		return true
+	}
+	return ws.SecondarySecret != "" && check(ws.SecondarySecret)
+}
+
+// BeforeSave encrypts the secrets before they are written
+func (ws *WebhookSettings) BeforeSave(tx *gorm.DB) error {
+	for _, secret := range []*string{&ws.Secret, &ws.SecondarySecret} {
+		encrypted, err := encryptSecret(*secret)
+		if err != nil {
+			return err
+		}
+		*secret = encrypted
+	}
+	return nil
+}
+
+// AfterSave restores the plaintext secret on the in-memory struct
+func (ws *WebhookSettings) AfterSave(tx *gorm.DB) error {
+	return ws.AfterFind(tx)
+}
+
+// AfterFind decrypts the secrets when settings are loaded
+func (ws *WebhookSettings) AfterFind(tx *gorm.DB) error {
+	for _, secret := range []*string{&ws.Secret, &ws.SecondarySecret} {
+		plaintext, err := decryptSecret(*secret)
+		if err != nil {
+			return err
+		}
+		*secret = plaintext
+	}
+	return nil
+}
+
+func isWebhookSecretProvider(provider string) bool {
+	for _, p := range WebhookSecretProviders {
+		if p == provider {
+			return true
+		}
+	}
+	return false
+}
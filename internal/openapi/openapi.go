@@ -0,0 +1,292 @@
+// Package openapi builds an OpenAPI 3 document from Go request and response
+// types, so the published spec follows the structs instead of drifting from
+// a hand-written copy.
+package openapi
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operation describes one endpoint. Request is a struct whose `form` tags
+// name the form fields the endpoint reads, or its query parameters for a GET;
+// response bodies are described by their `json` tags. Both may carry `doc`
+// tags for descriptions and `required:"true"` on mandatory request fields.
+type Operation struct {
+	Method      string
+	Path        string
+	Summary     string
+	Description string
+	Tags        []string
+	Request     interface{}
+	// AcceptsJSON documents a JSON body alongside the form encoding
+	AcceptsJSON bool
+	Responses   map[int]Response
+	// Secured marks endpoints that take the product API key
+	Secured bool
+}
+
+// Response is one documented status code of an Operation
+type Response struct {
+	Description string
+	Body        interface{}
+}
+
+// Info is the document's title block
+type Info struct {
+	Title       string
+	Version     string
+	Description string
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Document assembles the OpenAPI document for the given operations
+func Document(info Info, operations []Operation) map[string]interface{} {
+	g := &generator{schemas: map[string]interface{}{}}
+
+	paths := map[string]interface{}{}
+	for _, op := range operations {
+		item, _ := paths[op.Path].(map[string]interface{})
+		if item == nil {
+			item = map[string]interface{}{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = g.operation(op)
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       info.Title,
+			"version":     info.Version,
+			"description": info.Description,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"apiKeyHeader": map[string]interface{}{
+					"type": "apiKey",
+					"in":   "header",
+					"name": "X-API-Key",
+				},
+			},
+		},
+	}
+}
+
+type generator struct {
+	schemas map[string]interface{}
+}
+
+func (g *generator) operation(op Operation) map[string]interface{} {
+	result := map[string]interface{}{
+		"summary":     op.Summary,
+		"operationId": operationID(op),
+	}
+	if op.Description != "" {
+		result["description"] = op.Description
+	}
+	if len(op.Tags) > 0 {
+		result["tags"] = op.Tags
+	}
+	if op.Secured {
+		result["security"] = []interface{}{
+			map[string]interface{}{"bearerAuth": []string{}},
+			map[string]interface{}{"apiKeyHeader": []string{}},
+		}
+	}
+
+	if op.Request != nil && op.Method == "GET" {
+		result["parameters"] = queryParameters(g.formSchema(reflect.TypeOf(op.Request)))
+	} else if op.Request != nil {
+		schema := g.formSchema(reflect.TypeOf(op.Request))
+		content := map[string]interface{}{
+			"application/x-www-form-urlencoded": map[string]interface{}{"schema": schema},
+		}
+		if op.AcceptsJSON {
+			content["application/json"] = map[string]interface{}{"schema": schema}
+		}
+		result["requestBody"] = map[string]interface{}{"required": true, "content": content}
+	}
+
+	responses := map[string]interface{}{}
+	for status, response := range op.Responses {
+		description := response.Description
+		if description == "" {
+			description = http.StatusText(status)
+		}
+		entry := map[string]interface{}{"description": description}
+		if response.Body != nil {
+			entry["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(response.Body))},
+			}
+		}
+		responses[strconv.Itoa(status)] = entry
+	}
+	result["responses"] = responses
+
+	return result
+}
+
+// formSchema describes a request struct inline, named by its form tags
+func (g *generator) formSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return g.objectSchema(t, "form")
+}
+
+// queryParameters turns a form schema into query parameters, for GET
+// endpoints that read the same fields from the URL
+func queryParameters(form map[string]interface{}) []interface{} {
+	properties, _ := form["properties"].(map[string]interface{})
+	required := map[string]bool{}
+	if names, ok := form["required"].([]string); ok {
+		for _, name := range names {
+			required[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parameters := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		schema, _ := properties[name].(map[string]interface{})
+		parameter := map[string]interface{}{"name": name, "in": "query", "required": required[name]}
+		if description, ok := schema["description"]; ok {
+			parameter["description"] = description
+			schema = copyWithout(schema, "description")
+		}
+		parameter["schema"] = schema
+		parameters = append(parameters, parameter)
+	}
+	return parameters
+}
+
+// copyWithout returns a copy of m without key
+func copyWithout(m map[string]interface{}, key string) map[string]interface{} {
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if k != key {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// schema returns the schema for t, registering named structs as components
+func (g *generator) schema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		inner := g.schema(t.Elem())
+		if _, isRef := inner["$ref"]; isRef {
+			// OpenAPI 3.0 ignores siblings of $ref, so wrap it to mark it nullable
+			return map[string]interface{}{"nullable": true, "allOf": []interface{}{inner}}
+		}
+		nullable := make(map[string]interface{}, len(inner)+1)
+		for k, v := range inner {
+			nullable[k] = v
+		}
+		nullable["nullable"] = true
+		return nullable
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Struct:
+		if t == timeType {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		if t.Name() == "" {
+			return g.objectSchema(t, "json")
+		}
+		name := t.Name()
+		if _, seen := g.schemas[name]; !seen {
+			g.schemas[name] = nil // Placeholder so self-references terminate
+			g.schemas[name] = g.objectSchema(t, "json")
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// objectSchema lists the fields of t under the names given by tagKey,
+// falling back to the Go field name as encoding/json does
+func (g *generator) objectSchema(t reflect.Type, tagKey string) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	g.collectFields(t, tagKey, properties, &required)
+
+	result := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		result["required"] = required
+	}
+	return result
+}
+
+// collectFields adds t's fields to properties, flattening embedded structs
+func (g *generator) collectFields(t reflect.Type, tagKey string, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get(tagKey), ",")[0]
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			g.collectFields(field.Type, tagKey, properties, required)
+			continue
+		}
+		if field.PkgPath != "" || name == "-" {
+			continue // Unexported or skipped
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		property := g.schema(field.Type)
+		if doc := field.Tag.Get("doc"); doc != "" {
+			if _, isRef := property["$ref"]; isRef {
+				property = map[string]interface{}{"allOf": []interface{}{property}}
+			}
+			property["description"] = doc
+		}
+		properties[name] = property
+
+		if field.Tag.Get("required") == "true" {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// operationID derives a stable identifier such as postApiV1LicensesVerify
+func operationID(op Operation) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(op.Method))
+	for _, part := range strings.FieldsFunc(op.Path, func(r rune) bool {
+		return r == '/' || r == '.' || r == '-' || r == '{' || r == '}'
+	}) {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
@@ -0,0 +1,142 @@
+package openapi
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type lookup struct {
+	ID string `form:"id" required:"true"`
+}
+
+type createRequest struct {
+	lookup
+	Name string `form:"name" doc:"Display name"`
+}
+
+type node struct {
+	Name      string     `json:"name"`
+	Children  []node     `json:"children"`
+	Parent    *node      `json:"parent"`
+	CreatedAt time.Time  `json:"created_at"`
+	DeletedAt *time.Time `json:"deleted_at"`
+	Secret    string     `json:"-"`
+}
+
+func TestDocument(t *testing.T) {
+	doc := Document(Info{Title: "Test", Version: "1"}, []Operation{{
+		Method:    "POST",
+		Path:      "/nodes",
+		Request:   createRequest{},
+		Responses: map[int]Response{201: {Body: node{}}},
+		Secured:   true,
+	}})
+
+	// Round-trip through JSON so the assertions see what clients see
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatalf("Failed to marshal document: %v", err)
+	}
+	var spec struct {
+		Paths map[string]map[string]struct {
+			OperationID string `json:"operationId"`
+			RequestBody struct {
+				Content map[string]struct {
+					Schema struct {
+						Properties map[string]interface{} `json:"properties"`
+						Required   []string               `json:"required"`
+					} `json:"schema"`
+				} `json:"content"`
+			} `json:"requestBody"`
+			Responses map[string]struct {
+				Description string `json:"description"`
+			} `json:"responses"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]map[string]interface{} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(raw, &spec); err != nil {
+		t.Fatalf("Failed to parse document: %v", err)
+	}
+
+	op := spec.Paths["/nodes"]["post"]
+	if op.OperationID != "postNodes" {
+		t.Errorf("Expected operationId postNodes, got %q", op.OperationID)
+	}
+	if op.Responses["201"].Description != "Created" {
+		t.Errorf("Expected default description Created, got %q", op.Responses["201"].Description)
+	}
+
+	form := op.RequestBody.Content["application/x-www-form-urlencoded"].Schema
+	if _, ok := form.Properties["id"]; !ok {
+		t.Error("Expected embedded struct fields to be flattened into the form")
+	}
+	if len(form.Required) != 1 || form.Required[0] != "id" {
+		t.Errorf("Expected id to be required, got %v", form.Required)
+	}
+
+	schema, ok := spec.Components.Schemas["node"]
+	if !ok {
+		t.Fatal("Expected the response struct to be registered as a component")
+	}
+	if _, ok := schema.Properties["Secret"]; ok {
+		t.Error("Expected json:\"-\" fields to be skipped")
+	}
+	if schema.Properties["created_at"]["format"] != "date-time" {
+		t.Errorf("Expected time.Time to be a date-time, got %v", schema.Properties["created_at"])
+	}
+	if schema.Properties["deleted_at"]["nullable"] != true {
+		t.Errorf("Expected pointers to be nullable, got %v", schema.Properties["deleted_at"])
+	}
+	if schema.Properties["children"]["type"] != "array" {
+		t.Errorf("Expected slices to be arrays, got %v", schema.Properties["children"])
+	}
+}
+
+func TestDocument_GetReadsQuery(t *testing.T) {
+	doc := Document(Info{Title: "Test", Version: "1"}, []Operation{{
+		Method:    "GET",
+		Path:      "/nodes",
+		Request:   createRequest{},
+		Responses: map[int]Response{200: {Body: node{}}},
+	}})
+
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatalf("Failed to marshal document: %v", err)
+	}
+	var spec struct {
+		Paths map[string]map[string]struct {
+			Parameters []struct {
+				Name        string                 `json:"name"`
+				In          string                 `json:"in"`
+				Required    bool                   `json:"required"`
+				Description string                 `json:"description"`
+				Schema      map[string]interface{} `json:"schema"`
+			} `json:"parameters"`
+			RequestBody interface{} `json:"requestBody"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(raw, &spec); err != nil {
+		t.Fatalf("Failed to parse document: %v", err)
+	}
+
+	op := spec.Paths["/nodes"]["get"]
+	if op.RequestBody != nil {
+		t.Errorf("Expected a GET to have no request body, got %v", op.RequestBody)
+	}
+	if len(op.Parameters) != 2 {
+		t.Fatalf("Expected two query parameters, got %+v", op.Parameters)
+	}
+	id, name := op.Parameters[0], op.Parameters[1]
+	if id.Name != "id" || id.In != "query" || !id.Required {
+		t.Errorf("Expected a required id query parameter, got %+v", id)
+	}
+	if name.Name != "name" || name.Required || name.Description != "Display name" || name.Schema["type"] != "string" {
+		t.Errorf("Expected an optional, described name query parameter, got %+v", name)
+	}
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"sync"
+
+	"matcha/internal/models"
+)
+
+// BulkEmailWorkers bounds how many license emails are sent at once, so a
+// large batch finishes quickly without overwhelming the SMTP server
+const BulkEmailWorkers = 4
+
+// LicenseKeySender emails a license key to its customer. EmailService is the
+// real implementation and records every attempt in the email log.
+type LicenseKeySender interface {
+	SendLicenseKey(licenseKey *models.LicenseKey) error
+}
+
+// BulkEmailFailure is one license key that could not be emailed
+type BulkEmailFailure struct {
+	LicenseKeyID uint   `json:"license_key_id"`
+	Email        string `json:"email"`
+	Error        string `json:"error"`
+}
+
+// BulkEmailResult summarizes a bulk send, in the order the keys were given
+type BulkEmailResult struct {
+	Sent   []uint             `json:"sent"`
+	Failed []BulkEmailFailure `json:"failed"`
+}
+
+// SendLicenseKeys emails every key using at most workers concurrent sends.
+// A failed send is collected and the rest of the batch carries on. The keys'
+// Product and Customer associations must be loaded.
+func SendLicenseKeys(sender LicenseKeySender, licenseKeys []models.LicenseKey, workers int) BulkEmailResult {
+	if workers < 1 {
+		workers = 1
+	}
+
+	errs := make([]error, len(licenseKeys))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(licenseKeys); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				errs[i] = sender.SendLicenseKey(&licenseKeys[i])
+			}
+		}()
+	}
+	for i := range licenseKeys {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	result := BulkEmailResult{Sent: []uint{}, Failed: []BulkEmailFailure{}}
+	for i, err := range errs {
+		if err != nil {
+			result.Failed = append(result.Failed, BulkEmailFailure{
+				LicenseKeyID: licenseKeys[i].ID,
+				Email:        licenseKeys[i].Customer.Email,
+				Error:        err.Error(),
+			})
+		} else {
+			result.Sent = append(result.Sent, licenseKeys[i].ID)
+		}
+	}
+	return result
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"matcha/internal/config"
+	"matcha/internal/models"
+	"matcha/internal/testutils"
+)
+
+// slowSender tracks how many sends run at once
+type slowSender struct {
+	inFlight, peak int32
+	mu             sync.Mutex
+}
+
+func (s *slowSender) SendLicenseKey(*models.LicenseKey) error {
+	n := atomic.AddInt32(&s.inFlight, 1)
+	s.mu.Lock()
+	if n > s.peak {
+		s.peak = n
+	}
+	s.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	atomic.AddInt32(&s.inFlight, -1)
+	return nil
+}
+
+func TestSendLicenseKeys_BoundedConcurrency(t *testing.T) {
+	keys := make([]models.LicenseKey, 20)
+	for i := range keys {
+		keys[i].ID = uint(i + 1)
+	}
+
+	sender := &slowSender{}
+	result := SendLicenseKeys(sender, keys, 3)
+	assert.Len(t, result.Sent, 20)
+	assert.Empty(t, result.Failed)
+	assert.Equal(t, uint(1), result.Sent[0], "results keep the input order")
+	assert.LessOrEqual(t, sender.peak, int32(3))
+	assert.Greater(t, sender.peak, int32(1), "sends should overlap")
+}
+
+func TestSendLicenseKeys_RecordsEmailLog(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	es := NewEmailService(config.New(), db)
+
+	product := models.Product{Name: "Matcha Pro"}
+	require.NoError(t, db.Create(&product).Error)
+	customer := models.Customer{Name: "Jane", Email: "jane@example.com"}
+	require.NoError(t, db.Create(&customer).Error)
+	var keys []models.LicenseKey
+	for _, key := range []string{"BULK-LOG-1", "BULK-LOG-2"} {
+		lk := models.LicenseKey{Key: key, ProductID: product.ID, CustomerID: customer.ID, Product: product, Customer: customer}
+		require.NoError(t, db.Omit("Product", "Customer").Create(&lk).Error)
+		keys = append(keys, lk)
+	}
+
+	// No email settings exist, so every send fails and is logged as failed
+	result := SendLicenseKeys(es, keys, BulkEmailWorkers)
+	assert.Empty(t, result.Sent)
+	assert.Len(t, result.Failed, 2)
+
+	for _, lk := range keys {
+		logs, err := models.EmailLogsForLicenseKey(db, lk.ID)
+		require.NoError(t, err)
+		require.Len(t, logs, 1)
+		assert.Equal(t, models.EmailStatusFailed, logs[0].Status)
+	}
+}
@@ -1,12 +1,21 @@
 package services
 
 import (
-	"crypto/tls"
+	"bytes"
 	"fmt"
-	"net/smtp"
+	"html"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"regexp"
 	"strings"
+	"time"
 
+	"matcha/internal/clock"
 	"matcha/internal/config"
+	"matcha/internal/database"
 	"matcha/internal/models"
 
 	"gorm.io/gorm"
@@ -15,181 +24,286 @@ import (
 type EmailService struct {
 	config *config.Config
 	db     *gorm.DB
+	Clock  clock.Clock // Stamps the email log and the resend window
+	queue  chan emailJob
 }
 
 func NewEmailService(cfg *config.Config, db *gorm.DB) *EmailService {
 	return &EmailService{
 		config: cfg,
 		db:     db,
+		Clock:  clock.Real{},
 	}
 }
 
+// SendTestEmail emails the test template to toEmail with the active settings
 func (es *EmailService) SendTestEmail(toEmail string) error {
+	return es.dispatch(func() error { return es.sendTestEmail(toEmail) })
+}
+
+func (es *EmailService) sendTestEmail(toEmail string) error {
 	settings, err := models.GetActiveEmailSettings(es.db)
 	if err != nil {
 		return fmt.Errorf("no active email settings found: %w", err)
 	}
 
-	subject := "Test Email from Matcha"
-	body := `
-<html>
-<body>
-	<h2>Test Email</h2>
-	<p>This is a test email to verify your email configuration is working correctly.</p>
-	<p>If you received this email, your SMTP settings are properly configured.</p>
-</body>
-</html>`
-
-	return es.sendEmail(settings, toEmail, subject, body)
-}
-
-func (es *EmailService) SendLicenseKey(toEmail, licenseKey, productName string) error {
-	settings, err := models.GetActiveEmailSettings(es.db)
+	subject, body, err := es.render(models.EmailTemplateTest, 0, models.EmailTemplateData{CustomerEmail: toEmail})
 	if err != nil {
-		return fmt.Errorf("no active email settings found: %w", err)
+		return err
 	}
 
-	subject := fmt.Sprintf("Your License Key for %s", productName)
-	body := fmt.Sprintf(`
-<html>
-<body>
-	<h2>Your License Key</h2>
-	<p>Thank you for your purchase! Here are your license details:</p>
-	
-	<div style="background-color: #f5f5f5; padding: 20px; margin: 20px 0; border-radius: 5px;">
-		<h3>Product: %s</h3>
-		<p><strong>License Key:</strong> <code style="background-color: #e8e8e8; padding: 4px 8px; border-radius: 3px;">%s</code></p>
-	</div>
-	
-	<p>Please keep this license key safe and secure. You'll need it to activate your software.</p>
-	
-	<p>If you have any questions or need support, please don't hesitate to contact us.</p>
-	
-	<p>Best regards,<br>
-	The Matcha Team</p>
-</body>
-</html>`, productName, licenseKey)
-
-	return es.sendEmail(settings, toEmail, subject, body)
+	err = es.sendEmail(settings, toEmail, subject, body)
+	es.logDelivery(models.EmailLog{To: toEmail, Subject: subject, Type: models.EmailTemplateTest}, err)
+	return err
 }
 
-func (es *EmailService) sendEmail(settings *models.EmailSettings, to, subject, body string) error {
-	if settings.Provider != "smtp" {
-		return fmt.Errorf("unsupported email provider: %s", settings.Provider)
-	}
-
-	auth := smtp.PlainAuth("", settings.SMTPUsername, settings.SMTPPassword, settings.SMTPHost)
+// SendLicenseKey emails a license key to its customer. The key's Product and
+// Customer associations must be loaded. If the same email already went out
+// within the configured resend window it is skipped, so webhook retries and
+// repeated resend clicks don't flood the customer.
+func (es *EmailService) SendLicenseKey(licenseKey *models.LicenseKey) error {
+	// A queued send may run after the caller has moved on; it gets its own copy
+	key := *licenseKey
+	return es.dispatch(func() error { return es.sendLicenseKey(&key) })
+}
 
-	fromName := settings.FromName
-	if fromName == "" {
-		fromName = "Matcha"
+func (es *EmailService) sendLicenseKey(licenseKey *models.LicenseKey) error {
+	subject, body, err := es.render(models.EmailTemplateLicenseKey, licenseKey.ProductID, es.licenseEmailData(licenseKey))
+	if err != nil {
+		return err
 	}
 
-	msg := []string{
-		fmt.Sprintf("To: %s", to),
-		fmt.Sprintf("From: %s <%s>", fromName, settings.FromEmail),
-		fmt.Sprintf("Subject: %s", subject),
-		"MIME-Version: 1.0",
-		"Content-Type: text/html; charset=UTF-8",
-		"",
-		body,
+	entry := models.EmailLog{
+		To:           licenseKey.Customer.Email,
+		Subject:      subject,
+		Type:         models.EmailTemplateLicenseKey,
+		LicenseKeyID: &licenseKey.ID,
+	}
+	if window := es.config.EmailResendWindow; window > 0 {
+		sent, err := models.SentRecently(es.db, entry, es.Clock.Now().Add(-window))
+		if err != nil {
+			return fmt.Errorf("failed to check email log: %w", err)
+		}
+		if sent {
+			log.Printf("Skipping license key email for key %d: already sent to %s within %s", licenseKey.ID, entry.To, window)
+			entry.Status = models.EmailStatusSkipped
+			es.writeLog(entry)
+			return nil
+		}
 	}
 
-	message := []byte(strings.Join(msg, "\r\n"))
-
-	addr := fmt.Sprintf("%s:%d", settings.SMTPHost, settings.SMTPPort)
+	settings, err := models.GetActiveEmailSettings(es.db)
+	if err != nil {
+		err = fmt.Errorf("no active email settings found: %w", err)
+	} else {
+		err = es.sendEmail(settings, entry.To, subject, body)
+	}
+	es.logDelivery(entry, err)
+	return err
+}
 
-	switch settings.SMTPEncryption {
-	case "tls", "starttls":
-		return es.sendWithTLS(addr, auth, settings.FromEmail, []string{to}, message)
-	case "ssl":
-		return es.sendWithSSL(addr, auth, settings.FromEmail, []string{to}, message)
-	default:
-		return smtp.SendMail(addr, auth, settings.FromEmail, []string{to}, message)
+// logDelivery records the outcome of a send attempt in the email log
+func (es *EmailService) logDelivery(entry models.EmailLog, sendErr error) {
+	if sendErr != nil {
+		entry.Status = models.EmailStatusFailed
+		entry.Error = sendErr.Error()
+	} else {
+		now := es.Clock.Now()
+		entry.Status = models.EmailStatusSent
+		entry.SentAt = &now
 	}
+	es.writeLog(entry)
 }
 
-func (es *EmailService) sendWithTLS(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
-	client, err := smtp.Dial(addr)
+// writeLog stores a log entry. Logging is best effort and never fails the send.
+func (es *EmailService) writeLog(entry models.EmailLog) {
+	if es.db == nil {
+		return
+	}
+	err := database.PerformWrite(es.db, func(db *gorm.DB) error {
+		return db.Create(&entry).Error
+	})
 	if err != nil {
-		return err
+		log.Printf("Failed to record email log for %s: %v", entry.To, err)
 	}
-	defer func() { _ = client.Close() }()
+}
 
-	if err = client.StartTLS(&tls.Config{ServerName: strings.Split(addr, ":")[0]}); err != nil {
-		return err
+// licenseEmailData builds the template variables for a license key email
+func (es *EmailService) licenseEmailData(licenseKey *models.LicenseKey) models.EmailTemplateData {
+	data := models.EmailTemplateData{
+		ProductName:   licenseKey.Product.Name,
+		LicenseKey:    licenseKey.Key,
+		CustomerName:  licenseKey.Customer.Name,
+		CustomerEmail: licenseKey.Customer.Email,
 	}
-
-	if err = client.Auth(auth); err != nil {
-		return err
+	if licenseKey.ExpiresAt != nil {
+		data.ExpiresAt = licenseKey.ExpiresAt.In(es.config.Location()).Format("January 2, 2006")
 	}
+	return data
+}
 
-	if err = client.Mail(from); err != nil {
-		return err
+// render loads the stored template for templateType (or the built-in default)
+// and executes it with data. A product's own template wins when productID is set.
+func (es *EmailService) render(templateType string, productID uint, data models.EmailTemplateData) (string, string, error) {
+	tmpl := models.GetProductEmailTemplate(es.db, productID, templateType)
+	subject, body, err := tmpl.Render(data)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to render %s email template: %w", templateType, err)
 	}
+	return subject, body, nil
+}
 
-	for _, recipient := range to {
-		if err = client.Rcpt(recipient); err != nil {
-			return err
-		}
+// VerifySettings connects and signs in with settings, without sending
+// anything, so broken settings are caught before they are activated
+func (es *EmailService) VerifySettings(settings *models.EmailSettings) error {
+	if settings.Provider != "smtp" {
+		return fmt.Errorf("unsupported email provider: %s", settings.Provider)
 	}
+	return verifySMTP(settings, es.smtpTimeout())
+}
 
-	writer, err := client.Data()
-	if err != nil {
-		return err
+// smtpTimeout is the configured SMTP timeout, or the default when unset
+func (es *EmailService) smtpTimeout() time.Duration {
+	if es.config.SMTPTimeout <= 0 {
+		return config.DefaultSMTPTimeout
 	}
-	defer func() { _ = writer.Close() }()
-
-	_, err = writer.Write(msg)
-	return err
+	return es.config.SMTPTimeout
 }
 
-func (es *EmailService) sendWithSSL(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: false,
-		ServerName:         strings.Split(addr, ":")[0],
+func (es *EmailService) sendEmail(settings *models.EmailSettings, to, subject, body string) error {
+	if settings.Provider != "smtp" {
+		return fmt.Errorf("unsupported email provider: %s", settings.Provider)
 	}
 
-	conn, err := tls.Dial("tcp", addr, tlsConfig)
+	message, err := es.composeMessage(settings, to, subject, body)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to build email: %w", err)
 	}
-	defer func() { _ = conn.Close() }()
 
-	client, err := smtp.NewClient(conn, strings.Split(addr, ":")[0])
-	if err != nil {
-		return err
+	timeout := es.smtpTimeout()
+	delay := es.config.SMTPRetryDelay
+	for attempt := 1; ; attempt++ {
+		err = deliverSMTP(settings, to, message, timeout)
+		if err == nil || !transientSMTPError(err) {
+			return err
+		}
+		if attempt > es.config.SMTPRetries {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		log.Printf("Email to %s failed (attempt %d), retrying in %s: %v", to, attempt, delay, err)
+		time.Sleep(delay)
+		delay *= 2
 	}
-	defer func() { _ = client.Close() }()
+}
 
-	if err = client.Auth(auth); err != nil {
-		return err
+// composeMessage checks the sender addresses in settings and builds the
+// message. A blank From Name falls back to the configured EmailFromName.
+func (es *EmailService) composeMessage(settings *models.EmailSettings, to, subject, body string) ([]byte, error) {
+	if _, err := models.NormalizeEmail(settings.FromEmail); err != nil {
+		return nil, fmt.Errorf("from email %q: %w", settings.FromEmail, err)
+	}
+	replyTo := strings.TrimSpace(settings.ReplyTo)
+	if replyTo != "" {
+		if _, err := models.NormalizeEmail(replyTo); err != nil {
+			return nil, fmt.Errorf("reply-to %q: %w", replyTo, err)
+		}
 	}
 
-	if err = client.Mail(from); err != nil {
-		return err
+	fromName := settings.FromName
+	if fromName == "" {
+		fromName = es.config.EmailFromName
+	}
+	if fromName == "" {
+		fromName = config.DefaultEmailFromName
 	}
 
-	for _, recipient := range to {
-		if err = client.Rcpt(recipient); err != nil {
-			return err
+	from := fmt.Sprintf("%s <%s>", mime.QEncoding.Encode("UTF-8", fromName), settings.FromEmail)
+	return buildMessage(from, replyTo, to, subject, body)
+}
+
+// buildMessage assembles a multipart/alternative message carrying both a
+// plaintext version of htmlBody and the HTML itself, so text-only clients
+// and spam filters see a well-formed email. replyTo may be blank.
+func buildMessage(from, replyTo, to, subject, htmlBody string) ([]byte, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		// Clients pick the last part they can display, so plaintext goes first
+		{"text/plain; charset=UTF-8", htmlToText(htmlBody)},
+		{"text/html; charset=UTF-8", htmlBody},
+	}
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+
+		partWriter, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(partWriter)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
 		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
 	}
 
-	writer, err := client.Data()
-	if err != nil {
-		return err
+	headers := []string{
+		fmt.Sprintf("To: %s", to),
+		fmt.Sprintf("From: %s", from),
 	}
-	defer func() { _ = writer.Close() }()
+	if replyTo != "" {
+		headers = append(headers, fmt.Sprintf("Reply-To: %s", replyTo))
+	}
+	headers = append(headers,
+		fmt.Sprintf("Subject: %s", mime.QEncoding.Encode("UTF-8", subject)),
+		"MIME-Version: 1.0",
+		fmt.Sprintf("Content-Type: multipart/alternative; boundary=%q", writer.Boundary()),
+		"",
+		"",
+	)
 
-	_, err = writer.Write(msg)
-	return err
+	return append([]byte(strings.Join(headers, "\r\n")), body.Bytes()...), nil
+}
+
+var (
+	htmlBlockEnd   = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|h[1-6]|li|tr)>`)
+	htmlDropBlocks = regexp.MustCompile(`(?is)<(head|style|script)[^>]*>.*?</(head|style|script)>`)
+	htmlTag        = regexp.MustCompile(`<[^>]*>`)
+	blankLines     = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText derives a readable plaintext body from an HTML email by
+// turning block-level elements into line breaks and stripping the rest
+func htmlToText(htmlBody string) string {
+	text := htmlDropBlocks.ReplaceAllString(htmlBody, "")
+	text = htmlBlockEnd.ReplaceAllString(text, "\n")
+	text = htmlTag.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	text = blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+
+	return strings.TrimSpace(text) + "\n"
 }
 
 // Legacy compatibility functions for existing config-based approach
 func NewEmailServiceWithConfig(cfg *config.Config) *EmailService {
 	return &EmailService{
 		config: cfg,
+		Clock:  clock.Real{},
 	}
 }
 
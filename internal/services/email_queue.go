@@ -0,0 +1,66 @@
+package services
+
+import (
+	"context"
+	"log"
+)
+
+// EmailQueueSize is how many emails may wait for the queue worker. When it is
+// full a send goes out inline instead, as it would without a queue.
+const EmailQueueSize = 256
+
+// emailJob renders and sends one email and records the outcome in the email log
+type emailJob func() error
+
+// UseQueue makes SendLicenseKey and SendTestEmail return as soon as the email
+// is queued, leaving SMTP latency and retries to RunQueue. Outcomes, including
+// failures, are only recorded in the email log. Without a queue, as in tests,
+// emails are sent synchronously and failures are returned.
+func (es *EmailService) UseQueue(size int) {
+	es.queue = make(chan emailJob, size)
+}
+
+// Queued reports whether sends are handed to the queue worker
+func (es *EmailService) Queued() bool {
+	return es.queue != nil
+}
+
+// RunQueue delivers queued emails one at a time until ctx is cancelled, then
+// sends whatever is still waiting before returning
+func (es *EmailService) RunQueue(ctx context.Context) {
+	for {
+		select {
+		case job := <-es.queue:
+			es.runJob(job)
+		case <-ctx.Done():
+			for {
+				select {
+				case job := <-es.queue:
+					es.runJob(job)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (es *EmailService) runJob(job emailJob) {
+	if err := job(); err != nil {
+		log.Printf("Queued email failed: %v", err)
+	}
+}
+
+// dispatch queues job, or runs it right away when there is no queue
+func (es *EmailService) dispatch(job emailJob) error {
+	if es.queue == nil {
+		return job()
+	}
+	select {
+	case es.queue <- job:
+		return nil
+	default:
+		log.Printf("Email queue is full, sending inline")
+		return job()
+	}
+}
@@ -0,0 +1,552 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"matcha/internal/config"
+	"matcha/internal/models"
+	"matcha/internal/testutils"
+)
+
+func TestRender_ProductTemplate(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	es := NewEmailService(config.New(), db)
+
+	branded := models.Product{Name: "Branded"}
+	require.NoError(t, db.Create(&branded).Error)
+	plain := models.Product{Name: "Plain"}
+	require.NoError(t, db.Create(&plain).Error)
+	require.NoError(t, models.SaveEmailTemplate(db, &models.EmailTemplate{
+		Type:      models.EmailTemplateLicenseKey,
+		ProductID: &branded.ID,
+		Subject:   "Welcome to {{.ProductName}}",
+		Body:      "Your branded key: {{.LicenseKey}}",
+	}))
+
+	render := func(product models.Product) (string, string) {
+		licenseKey := &models.LicenseKey{Key: "KEY-1", ProductID: product.ID, Product: product}
+		subject, body, err := es.render(models.EmailTemplateLicenseKey, licenseKey.ProductID, es.licenseEmailData(licenseKey))
+		require.NoError(t, err)
+		return subject, body
+	}
+
+	subject, body := render(branded)
+	assert.Equal(t, "Welcome to Branded", subject)
+	assert.Equal(t, "Your branded key: KEY-1", body)
+
+	subject, _ = render(plain)
+	assert.Equal(t, "Your License Key for Plain", subject)
+}
+
+func TestBuildMessage_MultipartAlternative(t *testing.T) {
+	db := testutils.SetupTestDB(t)
+	es := NewEmailService(config.New(), db)
+
+	licenseKey := &models.LicenseKey{
+		Key:      "MATCHA-TEST-KEY-1234",
+		Product:  models.Product{Name: "Matcha Pro"},
+		Customer: models.Customer{Name: "Ada", Email: "ada@example.com"},
+	}
+	subject, body, err := es.render(models.EmailTemplateLicenseKey, licenseKey.ProductID, es.licenseEmailData(licenseKey))
+	require.NoError(t, err)
+
+	raw, err := buildMessage("Matcha <noreply@example.com>", "", "ada@example.com", subject, body)
+	require.NoError(t, err)
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	require.NoError(t, err)
+
+	decodedSubject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, "Your License Key for Matcha Pro", decodedSubject)
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/alternative", mediaType)
+
+	parts := map[string]string{}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		assert.Equal(t, "quoted-printable", part.Header.Get("Content-Transfer-Encoding"))
+		content, err := io.ReadAll(quotedprintable.NewReader(part))
+		require.NoError(t, err)
+
+		partType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		require.NoError(t, err)
+		parts[partType] = string(content)
+	}
+
+	require.Contains(t, parts, "text/plain")
+	require.Contains(t, parts, "text/html")
+	assert.Contains(t, parts["text/plain"], "MATCHA-TEST-KEY-1234")
+	assert.Contains(t, parts["text/html"], "MATCHA-TEST-KEY-1234")
+	assert.NotContains(t, parts["text/plain"], "<")
+}
+
+func TestComposeMessage_SenderHeaders(t *testing.T) {
+	cfg := config.New()
+	cfg.EmailFromName = "Acme Licensing"
+	es := NewEmailService(cfg, nil)
+
+	compose := func(t *testing.T, settings models.EmailSettings) *mail.Message {
+		raw, err := es.composeMessage(&settings, "ada@example.com", "Hello", "<p>Hi</p>")
+		require.NoError(t, err)
+		msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+		require.NoError(t, err)
+		return msg
+	}
+
+	t.Run("Reply-To Present When Configured", func(t *testing.T) {
+		msg := compose(t, models.EmailSettings{FromEmail: "noreply@example.com", FromName: "Matcha", ReplyTo: "support@example.com"})
+		assert.Equal(t, "support@example.com", msg.Header.Get("Reply-To"))
+	})
+
+	t.Run("Reply-To Absent Otherwise", func(t *testing.T) {
+		msg := compose(t, models.EmailSettings{FromEmail: "noreply@example.com"})
+		_, present := msg.Header["Reply-To"]
+		assert.False(t, present)
+	})
+
+	t.Run("Blank From Name Uses Configured Fallback", func(t *testing.T) {
+		msg := compose(t, models.EmailSettings{FromEmail: "noreply@example.com"})
+		from, err := msg.Header.AddressList("From")
+		require.NoError(t, err)
+		require.Len(t, from, 1)
+		assert.Equal(t, "Acme Licensing", from[0].Name)
+		assert.Equal(t, "noreply@example.com", from[0].Address)
+	})
+
+	t.Run("Malformed Addresses Rejected", func(t *testing.T) {
+		_, err := es.composeMessage(&models.EmailSettings{FromEmail: "not-an-address"}, "ada@example.com", "Hello", "<p>Hi</p>")
+		assert.Error(t, err)
+
+		_, err = es.composeMessage(&models.EmailSettings{FromEmail: "noreply@example.com", ReplyTo: "support@example.com\r\nBcc: x@example.com"}, "ada@example.com", "Hello", "<p>Hi</p>")
+		assert.Error(t, err)
+	})
+}
+
+// startFakeSMTP accepts mail on a local port and counts delivered messages
+func startFakeSMTP(t *testing.T) (string, *int32) {
+	return startFakeSMTPWith(t, nil, nil)
+}
+
+// startFakeSMTPWith is startFakeSMTP over TLS: implicit wraps every
+// connection in TLS from the start, starttls is offered as an upgrade
+func startFakeSMTPWith(t *testing.T, implicit, starttls *tls.Config) (string, *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	if implicit != nil {
+		listener = tls.NewListener(listener, implicit)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var delivered int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer func() { conn.Close() }()
+				rd := bufio.NewReader(conn)
+				reply := func(line string) { _, _ = io.WriteString(conn, line+"\r\n") }
+				reply("220 localhost ready")
+				for {
+					line, err := rd.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+					case "EHLO", "HELO":
+						reply("250-localhost")
+						if _, upgraded := conn.(*tls.Conn); starttls != nil && !upgraded {
+							reply("250-STARTTLS")
+						}
+						reply("250 AUTH PLAIN")
+					case "STARTTLS":
+						reply("220 go ahead")
+						tlsConn := tls.Server(conn, starttls)
+						if err := tlsConn.Handshake(); err != nil {
+							return
+						}
+						conn = tlsConn
+						rd = bufio.NewReader(conn)
+					case "AUTH":
+						reply("235 authenticated")
+					case "DATA":
+						reply("354 go ahead")
+						for {
+							data, err := rd.ReadString('\n')
+							if err != nil {
+								return
+							}
+							if data == ".\r\n" {
+								break
+							}
+						}
+						atomic.AddInt32(&delivered, 1)
+						reply("250 queued")
+					case "QUIT":
+						reply("221 bye")
+						return
+					default:
+						reply("250 ok")
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String(), &delivered
+}
+
+// testServerCert returns a self-signed certificate for 127.0.0.1 and its PEM
+// encoding, to be trusted as a private CA
+func testServerCert(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "matcha test smtp"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestDeliverSMTP_EncryptionModes(t *testing.T) {
+	cert, caPEM := testServerCert(t)
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{cert}}
+	message := []byte("Subject: test\r\n\r\nhello\r\n")
+
+	settingsFor := func(t *testing.T, addr, encryption string) *models.EmailSettings {
+		host, portStr, err := net.SplitHostPort(addr)
+		require.NoError(t, err)
+		port, err := net.LookupPort("tcp", portStr)
+		require.NoError(t, err)
+		return &models.EmailSettings{
+			Provider: "smtp", SMTPHost: host, SMTPPort: port, SMTPUsername: "user", SMTPPassword: "pass",
+			SMTPEncryption: encryption, FromEmail: "noreply@example.com",
+		}
+	}
+
+	t.Run("STARTTLS With Private CA", func(t *testing.T) {
+		addr, delivered := startFakeSMTPWith(t, nil, serverTLS)
+		settings := settingsFor(t, addr, models.SMTPEncryptionSTARTTLS)
+		settings.SMTPRootCA = caPEM
+
+		require.NoError(t, deliverSMTP(settings, "ada@example.com", message, 5*time.Second))
+		assert.Equal(t, int32(1), atomic.LoadInt32(delivered))
+	})
+
+	t.Run("STARTTLS Verifies Certificate", func(t *testing.T) {
+		addr, delivered := startFakeSMTPWith(t, nil, serverTLS)
+		settings := settingsFor(t, addr, models.SMTPEncryptionSTARTTLS)
+
+		err := deliverSMTP(settings, "ada@example.com", message, 5*time.Second)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "certificate")
+		assert.Equal(t, int32(0), atomic.LoadInt32(delivered))
+
+		settings.SMTPSkipVerify = true
+		require.NoError(t, deliverSMTP(settings, "ada@example.com", message, 5*time.Second))
+		assert.Equal(t, int32(1), atomic.LoadInt32(delivered))
+	})
+
+	t.Run("STARTTLS Required", func(t *testing.T) {
+		addr, delivered := startFakeSMTPWith(t, nil, nil)
+		settings := settingsFor(t, addr, models.SMTPEncryptionSTARTTLS)
+
+		err := deliverSMTP(settings, "ada@example.com", message, 5*time.Second)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "STARTTLS")
+		assert.Equal(t, int32(0), atomic.LoadInt32(delivered))
+	})
+
+	t.Run("Implicit TLS", func(t *testing.T) {
+		addr, delivered := startFakeSMTPWith(t, serverTLS, nil)
+		settings := settingsFor(t, addr, models.SMTPEncryptionSSL)
+		settings.SMTPRootCA = caPEM
+
+		require.NoError(t, deliverSMTP(settings, "ada@example.com", message, 5*time.Second))
+		assert.Equal(t, int32(1), atomic.LoadInt32(delivered))
+	})
+
+	t.Run("None Skips The Upgrade", func(t *testing.T) {
+		addr, delivered := startFakeSMTPWith(t, nil, serverTLS)
+		settings := settingsFor(t, addr, models.SMTPEncryptionNone)
+
+		// The certificate isn't trusted, so this only works without STARTTLS
+		require.NoError(t, deliverSMTP(settings, "ada@example.com", message, 5*time.Second))
+		assert.Equal(t, int32(1), atomic.LoadInt32(delivered))
+	})
+
+	t.Run("Invalid Root CA", func(t *testing.T) {
+		settings := settingsFor(t, "127.0.0.1:25", models.SMTPEncryptionSTARTTLS)
+		settings.SMTPRootCA = "not a certificate"
+		assert.Error(t, deliverSMTP(settings, "ada@example.com", message, 5*time.Second))
+	})
+}
+
+func TestSMTPSettings_ModeAndAddress(t *testing.T) {
+	modes := []struct {
+		encryption string
+		port       int
+		want       smtpTLSMode
+	}{
+		{models.SMTPEncryptionTLS, 587, smtpSTARTTLS},
+		{models.SMTPEncryptionTLS, 465, smtpImplicitTLS},
+		{"", 587, smtpSTARTTLS},
+		{models.SMTPEncryptionSTARTTLS, 465, smtpSTARTTLS},
+		{models.SMTPEncryptionSSL, 2465, smtpImplicitTLS},
+		{models.SMTPEncryptionNone, 25, smtpPlaintext},
+	}
+	for _, tt := range modes {
+		settings := &models.EmailSettings{SMTPEncryption: tt.encryption, SMTPPort: tt.port}
+		assert.Equal(t, tt.want, tlsMode(settings), "%q on port %d", tt.encryption, tt.port)
+	}
+
+	for host, want := range map[string]string{
+		"smtp.example.com": "smtp.example.com:587",
+		"::1":              "[::1]:587",
+		"[2001:db8::25]":   "[2001:db8::25]:587",
+	} {
+		settings := &models.EmailSettings{SMTPHost: host, SMTPPort: 587}
+		assert.Equal(t, want, smtpAddress(settings))
+	}
+	assert.Equal(t, "2001:db8::25", smtpHost(&models.EmailSettings{SMTPHost: "[2001:db8::25]"}))
+}
+
+// startSilentSMTP accepts connections but never sends a greeting, like a
+// server that is up but stuck
+func startSilentSMTP(t *testing.T) (string, *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	var accepted int32
+	var conns []net.Conn
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conns = append(conns, conn)
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		<-done
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return listener.Addr().String(), &accepted
+}
+
+func TestDeliverSMTP_Timeout(t *testing.T) {
+	addr, _ := startSilentSMTP(t)
+	host, portStr, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	port, err := net.LookupPort("tcp", portStr)
+	require.NoError(t, err)
+	settings := &models.EmailSettings{Provider: "smtp", SMTPHost: host, SMTPPort: port, SMTPEncryption: models.SMTPEncryptionNone, FromEmail: "noreply@example.com"}
+
+	t.Run("Stalled Server Times Out", func(t *testing.T) {
+		started := time.Now()
+		err := deliverSMTP(settings, "ada@example.com", []byte("hello"), 200*time.Millisecond)
+		elapsed := time.Since(started)
+
+		require.Error(t, err)
+		var netErr net.Error
+		require.ErrorAs(t, err, &netErr)
+		assert.True(t, netErr.Timeout())
+		assert.Contains(t, err.Error(), "did not respond within 200ms")
+		assert.Less(t, elapsed, 2*time.Second, "the call must give up near the timeout")
+		assert.True(t, transientSMTPError(err))
+	})
+
+	t.Run("Send Retries Then Gives Up", func(t *testing.T) {
+		addr, accepted := startSilentSMTP(t)
+		_, portStr, err := net.SplitHostPort(addr)
+		require.NoError(t, err)
+		stalled := *settings
+		stalled.SMTPPort, err = net.LookupPort("tcp", portStr)
+		require.NoError(t, err)
+
+		cfg := config.New()
+		cfg.SMTPTimeout = 100 * time.Millisecond
+		cfg.SMTPRetries = 2
+		cfg.SMTPRetryDelay = time.Millisecond
+		es := NewEmailService(cfg, nil)
+
+		err = es.sendEmail(&stalled, "ada@example.com", "Hello", "<p>Hello</p>")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "giving up after 3 attempts")
+		assert.Equal(t, int32(3), atomic.LoadInt32(accepted))
+	})
+}
+
+func TestTransientSMTPError(t *testing.T) {
+	assert.True(t, transientSMTPError(&textproto.Error{Code: 421, Msg: "try again later"}))
+	assert.False(t, transientSMTPError(&textproto.Error{Code: 550, Msg: "no such user"}))
+	assert.False(t, transientSMTPError(errors.New("does not offer STARTTLS")))
+	assert.True(t, transientSMTPError(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+}
+
+func TestSendLicenseKey_EmailLog(t *testing.T) {
+	setup := func(t *testing.T) (*EmailService, *models.LicenseKey) {
+		db := testutils.SetupTestDB(t)
+		cfg := config.New()
+		cfg.EmailResendWindow = 10 * time.Minute
+
+		product := models.Product{Name: "Matcha Pro"}
+		require.NoError(t, db.Create(&product).Error)
+		customer := models.Customer{Name: "Ada", Email: "ada@example.com"}
+		require.NoError(t, db.Create(&customer).Error)
+		licenseKey := &models.LicenseKey{Key: "MATCHA-LOG-KEY", ProductID: product.ID, CustomerID: customer.ID, Product: product, Customer: customer}
+		require.NoError(t, db.Create(licenseKey).Error)
+
+		return NewEmailService(cfg, db), licenseKey
+	}
+
+	t.Run("Duplicate Send Within Window Is Skipped", func(t *testing.T) {
+		es, licenseKey := setup(t)
+		addr, delivered := startFakeSMTP(t)
+		host, portStr, err := net.SplitHostPort(addr)
+		require.NoError(t, err)
+		port, err := net.LookupPort("tcp", portStr)
+		require.NoError(t, err)
+		require.NoError(t, es.db.Create(&models.EmailSettings{
+			Provider: "smtp", SMTPHost: host, SMTPPort: port, SMTPUsername: "user", SMTPPassword: "pass",
+			SMTPEncryption: "none", FromEmail: "noreply@example.com", IsActive: true,
+		}).Error)
+
+		require.NoError(t, es.SendLicenseKey(licenseKey))
+		require.NoError(t, es.SendLicenseKey(licenseKey))
+		assert.Equal(t, int32(1), atomic.LoadInt32(delivered), "the second send should be skipped")
+
+		logs, err := models.EmailLogsForLicenseKey(es.db, licenseKey.ID)
+		require.NoError(t, err)
+		require.Len(t, logs, 2)
+		assert.Equal(t, models.EmailStatusSkipped, logs[0].Status)
+		assert.Equal(t, models.EmailStatusSent, logs[1].Status)
+		assert.NotNil(t, logs[1].SentAt)
+		assert.Equal(t, "ada@example.com", logs[1].To)
+		assert.Equal(t, "Your License Key for Matcha Pro", logs[1].Subject)
+
+		// With the check disabled the email goes out again
+		es.config.EmailResendWindow = 0
+		require.NoError(t, es.SendLicenseKey(licenseKey))
+		assert.Equal(t, int32(2), atomic.LoadInt32(delivered))
+	})
+
+	t.Run("Queued Send Returns Before Delivery", func(t *testing.T) {
+		es, licenseKey := setup(t)
+		addr, delivered := startFakeSMTP(t)
+		host, portStr, err := net.SplitHostPort(addr)
+		require.NoError(t, err)
+		port, err := net.LookupPort("tcp", portStr)
+		require.NoError(t, err)
+		require.NoError(t, es.db.Create(&models.EmailSettings{
+			Provider: "smtp", SMTPHost: host, SMTPPort: port, SMTPEncryption: "none",
+			FromEmail: "noreply@example.com", IsActive: true,
+		}).Error)
+
+		es.UseQueue(4)
+		require.NoError(t, es.SendLicenseKey(licenseKey))
+		require.NoError(t, es.SendTestEmail("ops@example.com"))
+		assert.Equal(t, int32(0), atomic.LoadInt32(delivered), "nothing is sent until the worker runs")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			es.RunQueue(ctx)
+		}()
+		assert.Eventually(t, func() bool {
+			logs, err := models.EmailLogsForLicenseKey(es.db, licenseKey.ID)
+			return err == nil && len(logs) == 1 && logs[0].Status == models.EmailStatusSent
+		}, 5*time.Second, 10*time.Millisecond)
+
+		cancel()
+		<-done
+		assert.Equal(t, int32(2), atomic.LoadInt32(delivered))
+	})
+
+	t.Run("Queue Drains On Shutdown", func(t *testing.T) {
+		es, licenseKey := setup(t)
+		es.UseQueue(4)
+
+		// No email settings, so the queued send fails and is logged as such
+		require.NoError(t, es.SendLicenseKey(licenseKey))
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		es.RunQueue(ctx)
+
+		logs, err := models.EmailLogsForLicenseKey(es.db, licenseKey.ID)
+		require.NoError(t, err)
+		require.Len(t, logs, 1)
+		assert.Equal(t, models.EmailStatusFailed, logs[0].Status)
+	})
+
+	t.Run("Failure Is Recorded With Error", func(t *testing.T) {
+		es, licenseKey := setup(t)
+
+		// No email settings are configured
+		err := es.SendLicenseKey(licenseKey)
+		require.Error(t, err)
+
+		logs, err := models.EmailLogsForLicenseKey(es.db, licenseKey.ID)
+		require.NoError(t, err)
+		require.Len(t, logs, 1)
+		assert.Equal(t, models.EmailStatusFailed, logs[0].Status)
+		assert.Contains(t, logs[0].Error, "no active email settings")
+		assert.Nil(t, logs[0].SentAt)
+
+		// A failed attempt doesn't count towards the duplicate check
+		require.Error(t, es.SendLicenseKey(licenseKey))
+	})
+}
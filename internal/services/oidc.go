@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"matcha/internal/config"
+)
+
+// OIDCIdentity is the subset of the provider's user info used to find an admin
+type OIDCIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// OIDCProvider performs the authorization-code flow against an identity
+// provider. The flow uses PKCE: AuthCodeURL sends the challenge for a verifier
+// that only this browser's cookie holds, and Exchange must present it, so a
+// stolen or injected code is useless on its own.
+type OIDCProvider interface {
+	AuthCodeURL(ctx context.Context, state, codeVerifier string) (string, error)
+	Exchange(ctx context.Context, code, codeVerifier string) (*OIDCIdentity, error)
+}
+
+// PKCEChallenge derives the S256 code challenge sent for codeVerifier
+func PKCEChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+type oidcEndpoints struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// OIDCService is an OIDCProvider backed by the issuer's discovery document
+type OIDCService struct {
+	config *config.Config
+	client *http.Client
+
+	mu        sync.Mutex
+	endpoints *oidcEndpoints
+}
+
+func NewOIDCService(cfg *config.Config) *OIDCService {
+	return &OIDCService{
+		config: cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *OIDCService) AuthCodeURL(ctx context.Context, state, codeVerifier string) (string, error) {
+	endpoints, err := s.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {s.config.OIDCClientID},
+		"redirect_uri":          {s.config.OIDCRedirectURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {state},
+		"code_challenge":        {PKCEChallenge(codeVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+	return endpoints.AuthorizationEndpoint + "?" + params.Encode(), nil
+}
+
+func (s *OIDCService) Exchange(ctx context.Context, code, codeVerifier string) (*OIDCIdentity, error) {
+	endpoints, err := s.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {s.config.OIDCRedirectURL},
+		"client_id":     {s.config.OIDCClientID},
+		"client_secret": {s.config.OIDCClientSecret},
+		"code_verifier": {codeVerifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoints.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := s.doJSON(req, &token); err != nil {
+		return nil, fmt.Errorf("token exchange failed: %w", err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("token exchange returned no access token")
+	}
+
+	req, err = http.NewRequestWithContext(ctx, "GET", endpoints.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	var info struct {
+		Subject       string      `json:"sub"`
+		Email         string      `json:"email"`
+		EmailVerified interface{} `json:"email_verified"`
+		Name          string      `json:"name"`
+	}
+	if err := s.doJSON(req, &info); err != nil {
+		return nil, fmt.Errorf("userinfo request failed: %w", err)
+	}
+
+	// Some providers send email_verified as a string
+	verified := info.EmailVerified == true || info.EmailVerified == "true"
+
+	return &OIDCIdentity{
+		Subject:       info.Subject,
+		Email:         info.Email,
+		EmailVerified: verified,
+		Name:          info.Name,
+	}, nil
+}
+
+// discover fetches and caches the issuer's OpenID configuration
+func (s *OIDCService) discover(ctx context.Context) (*oidcEndpoints, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.endpoints != nil {
+		return s.endpoints, nil
+	}
+
+	discoveryURL := strings.TrimSuffix(s.config.OIDCIssuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, "GET", discoveryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints oidcEndpoints
+	if err := s.doJSON(req, &endpoints); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	if endpoints.AuthorizationEndpoint == "" || endpoints.TokenEndpoint == "" || endpoints.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("OIDC discovery document is missing required endpoints")
+	}
+
+	s.endpoints = &endpoints
+	return s.endpoints, nil
+}
+
+func (s *OIDCService) doJSON(req *http.Request, out interface{}) error {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, req.URL.Host)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,203 @@
+package services
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"matcha/internal/models"
+)
+
+// smtpsPort is the port where SMTP runs inside TLS from the first byte
+const smtpsPort = 465
+
+// smtpTLSMode reports how a connection for settings is secured
+type smtpTLSMode int
+
+const (
+	smtpPlaintext smtpTLSMode = iota
+	smtpSTARTTLS
+	smtpImplicitTLS
+)
+
+// tlsMode maps the stored encryption setting to a connection mode. Unknown
+// values are treated like the "tls" default rather than sent in plaintext.
+func tlsMode(settings *models.EmailSettings) smtpTLSMode {
+	switch strings.ToLower(settings.SMTPEncryption) {
+	case models.SMTPEncryptionNone:
+		return smtpPlaintext
+	case models.SMTPEncryptionSTARTTLS:
+		return smtpSTARTTLS
+	case models.SMTPEncryptionSSL:
+		return smtpImplicitTLS
+	}
+	if settings.SMTPPort == smtpsPort {
+		return smtpImplicitTLS
+	}
+	return smtpSTARTTLS
+}
+
+// smtpHost returns the configured host without the brackets an IPv6
+// address may have been entered with
+func smtpHost(settings *models.EmailSettings) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(settings.SMTPHost), "["), "]")
+}
+
+// smtpAddress joins host and port, bracketing IPv6 hosts
+func smtpAddress(settings *models.EmailSettings) string {
+	return net.JoinHostPort(smtpHost(settings), strconv.Itoa(settings.SMTPPort))
+}
+
+// smtpTLSConfig verifies the server against the system roots, or against
+// SMTPRootCA when one is configured
+func smtpTLSConfig(settings *models.EmailSettings) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         smtpHost(settings),
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: settings.SMTPSkipVerify,
+	}
+	if strings.TrimSpace(settings.SMTPRootCA) != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(settings.SMTPRootCA)) {
+			return nil, errors.New("SMTP root CA is not a valid PEM certificate")
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// deliverSMTP sends a built message through the server in settings. The
+// whole conversation, not just connecting, must finish within timeout, so a
+// server that accepts the connection and then stalls can't hang the sender.
+func deliverSMTP(settings *models.EmailSettings, to string, message []byte, timeout time.Duration) error {
+	err := converseSMTP(settings, to, message, timeout)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("SMTP server %s did not respond within %s: %w", smtpAddress(settings), timeout, err)
+	}
+	return err
+}
+
+// verifySMTP connects and signs in to the server in settings without sending
+// anything, to check the settings work before they are relied on
+func verifySMTP(settings *models.EmailSettings, timeout time.Duration) error {
+	client, err := openSMTP(settings, timeout)
+	if err == nil {
+		err = client.Quit()
+		_ = client.Close()
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("SMTP server %s did not respond within %s: %w", smtpAddress(settings), timeout, err)
+	}
+	return err
+}
+
+func converseSMTP(settings *models.EmailSettings, to string, message []byte, timeout time.Duration) error {
+	client, err := openSMTP(settings, timeout)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = client.Close() }()
+
+	if err := client.Mail(settings.FromEmail); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	// Closing the writer is when the server accepts or rejects the message
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	// The message is accepted at this point; failing here would only make a
+	// retry deliver it twice
+	_ = client.Quit()
+	return nil
+}
+
+// openSMTP connects to the server in settings, upgrades to TLS as configured
+// and signs in, all within timeout
+func openSMTP(settings *models.EmailSettings, timeout time.Duration) (*smtp.Client, error) {
+	mode := tlsMode(settings)
+	tlsConfig, err := smtpTLSConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	if mode == smtpImplicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", smtpAddress(settings), tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", smtpAddress(settings))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	client, err := smtp.NewClient(conn, smtpHost(settings))
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if mode == smtpSTARTTLS {
+		// Carrying on in plaintext would send the password in the clear
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			_ = client.Close()
+			return nil, fmt.Errorf("%s does not offer STARTTLS; choose ssl for port %d or none for a local relay", smtpAddress(settings), smtpsPort)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	}
+
+	if settings.SMTPUsername != "" {
+		auth := smtp.PlainAuth("", settings.SMTPUsername, settings.SMTPPassword, smtpHost(settings))
+		if err := client.Auth(auth); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+// transientSMTPError reports whether a failed delivery is worth retrying:
+// the server was unreachable, stalled or hung up, or answered with a 4xx
+// "try again later" reply. 5xx rejections and TLS or configuration errors
+// fail the same way every time.
+func transientSMTPError(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 400 && protoErr.Code < 500
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout() ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,202 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidWebhookSignature is returned when a webhook's signature doesn't
+// match the configured secret
+var ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+
+// StripeSignatureTolerance is how far a Stripe-Signature timestamp may be from
+// now, which bounds how long a captured request can be replayed
+const StripeSignatureTolerance = 5 * time.Minute
+
+// VerifyStripeSignature checks a Stripe-Signature header ("t=<unix>,v1=<hex>")
+// against the raw payload, signed with the endpoint's signing secret
+func VerifyStripeSignature(payload []byte, header, secret string, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return fmt.Errorf("%w: malformed Stripe-Signature header", ErrInvalidWebhookSignature)
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: malformed timestamp", ErrInvalidWebhookSignature)
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > StripeSignatureTolerance || age < -StripeSignatureTolerance {
+		return fmt.Errorf("%w: timestamp outside the tolerance", ErrInvalidWebhookSignature)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+
+	for _, signature := range signatures {
+		decoded, err := hex.DecodeString(signature)
+		if err == nil && hmac.Equal(decoded, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidWebhookSignature
+}
+
+// PayPalTransmission is the signature PayPal sends in its PAYPAL-* headers
+type PayPalTransmission struct {
+	ID        string // PAYPAL-TRANSMISSION-ID
+	Time      string // PAYPAL-TRANSMISSION-TIME
+	Signature string // PAYPAL-TRANSMISSION-SIG, base64
+	CertURL   string // PAYPAL-CERT-URL
+	AuthAlgo  string // PAYPAL-AUTH-ALGO
+}
+
+// PayPalVerifier checks PayPal's transmission signatures. PayPal signs
+// "<transmission id>|<time>|<webhook id>|<crc32 of the body>" with the key of
+// a certificate it links to, so the check needs the webhook ID from the
+// developer dashboard and the certificate, which is cached by URL.
+type PayPalVerifier struct {
+	// FetchCert downloads the signing certificate; tests swap it out
+	FetchCert func(ctx context.Context, certURL string) (*x509.Certificate, error)
+
+	mu    sync.Mutex
+	certs map[string]*x509.Certificate
+}
+
+func NewPayPalVerifier() *PayPalVerifier {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return &PayPalVerifier{
+		FetchCert: func(ctx context.Context, certURL string) (*x509.Certificate, error) {
+			return fetchCertificate(ctx, client, certURL)
+		},
+		certs: make(map[string]*x509.Certificate),
+	}
+}
+
+// Verify checks the transmission against the raw payload and webhookID
+func (v *PayPalVerifier) Verify(ctx context.Context, payload []byte, transmission PayPalTransmission, webhookID string) error {
+	if transmission.ID == "" || transmission.Time == "" || transmission.Signature == "" {
+		return fmt.Errorf("%w: missing PayPal transmission headers", ErrInvalidWebhookSignature)
+	}
+	if transmission.AuthAlgo != "" && transmission.AuthAlgo != "SHA256withRSA" {
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidWebhookSignature, transmission.AuthAlgo)
+	}
+	if err := checkPayPalCertURL(transmission.CertURL); err != nil {
+		return err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(transmission.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: malformed signature", ErrInvalidWebhookSignature)
+	}
+
+	cert, err := v.certificate(ctx, transmission.CertURL)
+	if err != nil {
+		return fmt.Errorf("failed to load PayPal certificate: %w", err)
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("%w: certificate has no RSA key", ErrInvalidWebhookSignature)
+	}
+
+	message := fmt.Sprintf("%s|%s|%s|%d", transmission.ID, transmission.Time, webhookID, crc32.ChecksumIEEE(payload))
+	digest := sha256.Sum256([]byte(message))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return ErrInvalidWebhookSignature
+	}
+	return nil
+}
+
+// certificate returns the cached certificate for certURL, fetching it on
+// first use and again once it has expired
+func (v *PayPalVerifier) certificate(ctx context.Context, certURL string) (*x509.Certificate, error) {
+	v.mu.Lock()
+	cert, ok := v.certs[certURL]
+	v.mu.Unlock()
+	if ok && time.Now().Before(cert.NotAfter) {
+		return cert, nil
+	}
+
+	cert, err := v.FetchCert(ctx, certURL)
+	if err != nil {
+		return nil, err
+	}
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, errors.New("certificate is not currently valid")
+	}
+
+	v.mu.Lock()
+	v.certs[certURL] = cert
+	v.mu.Unlock()
+	return cert, nil
+}
+
+// checkPayPalCertURL only lets certificates be fetched from PayPal itself, so
+// a forged request can't point the check at a key of its own
+func checkPayPalCertURL(certURL string) error {
+	parsed, err := url.Parse(certURL)
+	if err != nil || parsed.Scheme != "https" {
+		return fmt.Errorf("%w: certificate URL must be https", ErrInvalidWebhookSignature)
+	}
+	host := parsed.Hostname()
+	if host != "paypal.com" && !strings.HasSuffix(host, ".paypal.com") {
+		return fmt.Errorf("%w: certificate URL %q is not on paypal.com", ErrInvalidWebhookSignature, host)
+	}
+	return nil
+}
+
+func fetchCertificate(ctx context.Context, client *http.Client, certURL string) (*x509.Certificate, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", certURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, errors.New("no PEM certificate in response")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
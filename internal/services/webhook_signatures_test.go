@@ -0,0 +1,110 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func stripeSignature(payload []byte, secret string, at time.Time) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + string(payload)))
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyStripeSignature(t *testing.T) {
+	payload := []byte(`{"type":"checkout.session.completed"}`)
+	now := time.Now()
+
+	assert.NoError(t, VerifyStripeSignature(payload, stripeSignature(payload, "whsec_test", now), "whsec_test", now))
+
+	// Stripe sends one v1 entry per active secret during its own rotations
+	_, valid, _ := strings.Cut(stripeSignature(payload, "whsec_test", now), ",v1=")
+	header := stripeSignature(payload, "whsec_other", now) + ",v1=" + valid
+	assert.NoError(t, VerifyStripeSignature(payload, header, "whsec_test", now))
+
+	for name, header := range map[string]string{
+		"wrong secret":     stripeSignature(payload, "whsec_wrong", now),
+		"stale timestamp":  stripeSignature(payload, "whsec_test", now.Add(-StripeSignatureTolerance-time.Second)),
+		"missing header":   "",
+		"no v1 signature":  "t=" + strconv.FormatInt(now.Unix(), 10),
+		"malformed header": "garbage",
+	} {
+		assert.ErrorIs(t, VerifyStripeSignature(payload, header, "whsec_test", now), ErrInvalidWebhookSignature, name)
+	}
+
+	tampered := []byte(`{"type":"customer.subscription.deleted"}`)
+	assert.ErrorIs(t, VerifyStripeSignature(tampered, stripeSignature(payload, "whsec_test", now), "whsec_test", now), ErrInvalidWebhookSignature)
+}
+
+func TestPayPalVerifier(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "messageverificationcerts.paypal.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	const certURL = "https://api.paypal.com/v1/notifications/certs/CERT-360caa42"
+	fetches := 0
+	verifier := NewPayPalVerifier()
+	verifier.FetchCert = func(ctx context.Context, url string) (*x509.Certificate, error) {
+		fetches++
+		return cert, nil
+	}
+
+	payload := []byte(`{"event_type":"PAYMENT.SALE.COMPLETED"}`)
+	sign := func(body []byte, webhookID string) PayPalTransmission {
+		message := fmt.Sprintf("%s|%s|%s|%d", "tx-1", "2024-03-01T12:00:00Z", webhookID, crc32.ChecksumIEEE(body))
+		digest := sha256.Sum256([]byte(message))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+		return PayPalTransmission{
+			ID:        "tx-1",
+			Time:      "2024-03-01T12:00:00Z",
+			Signature: base64.StdEncoding.EncodeToString(signature),
+			CertURL:   certURL,
+			AuthAlgo:  "SHA256withRSA",
+		}
+	}
+
+	ctx := context.Background()
+	assert.NoError(t, verifier.Verify(ctx, payload, sign(payload, "WH-1"), "WH-1"))
+	assert.NoError(t, verifier.Verify(ctx, payload, sign(payload, "WH-1"), "WH-1"))
+	assert.Equal(t, 1, fetches, "the certificate is cached")
+
+	assert.ErrorIs(t, verifier.Verify(ctx, payload, sign(payload, "WH-1"), "WH-2"), ErrInvalidWebhookSignature, "signed for another webhook")
+	assert.ErrorIs(t, verifier.Verify(ctx, []byte(`{"event_type":"BILLING.SUBSCRIPTION.CANCELLED"}`), sign(payload, "WH-1"), "WH-1"), ErrInvalidWebhookSignature, "tampered body")
+	assert.ErrorIs(t, verifier.Verify(ctx, payload, PayPalTransmission{}, "WH-1"), ErrInvalidWebhookSignature, "missing headers")
+
+	forged := sign(payload, "WH-1")
+	for _, url := range []string{"https://evil.example.com/cert.pem", "http://api.paypal.com/cert.pem", "https://paypal.com.evil.example/cert.pem"} {
+		forged.CertURL = url
+		assert.ErrorIs(t, verifier.Verify(ctx, payload, forged, "WH-1"), ErrInvalidWebhookSignature, url)
+	}
+	assert.Equal(t, 1, fetches, "certificates are only fetched from paypal.com")
+}
@@ -0,0 +1,234 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"matcha/internal/clock"
+	"matcha/internal/database"
+	"matcha/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// WebhookProcessFunc handles a single stored webhook event
+type WebhookProcessFunc func(event *models.WebhookEvent) error
+
+// WebhookProcessor runs stored webhook events through a process function,
+// retrying failures with exponential backoff until they are marked dead.
+type WebhookProcessor struct {
+	db          *gorm.DB
+	process     WebhookProcessFunc
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// StaleAfter is how long a pending event may wait for its Enqueue, or a
+	// processing event for its attempt, before RetryDue takes it over
+	StaleAfter time.Duration
+	Clock      clock.Clock // Schedules retries; tests swap in a clock.Fake
+
+	inflight sync.WaitGroup
+}
+
+func NewWebhookProcessor(db *gorm.DB, process WebhookProcessFunc) *WebhookProcessor {
+	return &WebhookProcessor{
+		db:          db,
+		process:     process,
+		MaxAttempts: 5,
+		BaseDelay:   30 * time.Second,
+		MaxDelay:    1 * time.Hour,
+		StaleAfter:  5 * time.Minute,
+		Clock:       clock.Real{},
+	}
+}
+
+// Enqueue processes the event in the background so the HTTP handler can ack quickly
+func (p *WebhookProcessor) Enqueue(event *models.WebhookEvent) {
+	p.inflight.Add(1)
+	go func() {
+		defer p.inflight.Done()
+		if err := p.Process(event.ID); err != nil {
+			log.Printf("Webhook event %d failed: %v", event.ID, err)
+		}
+	}()
+}
+
+// Wait blocks until every event handed to Enqueue has been processed, so
+// shutdown doesn't close the database under them
+func (p *WebhookProcessor) Wait() {
+	p.inflight.Wait()
+}
+
+// Process makes one attempt at a pending or failed event and records the
+// outcome. Failed events are scheduled for retry or marked dead after
+// MaxAttempts. An event another worker has claimed is left alone.
+func (p *WebhookProcessor) Process(id uint) error {
+	claimed, err := p.claim(id, nil, "status IN ?", []string{models.WebhookStatusPending, models.WebhookStatusFailed})
+	if err != nil || !claimed {
+		return err
+	}
+	return p.attempt(id)
+}
+
+// claim atomically moves the event to processing if it still matches the
+// condition, applying any extra column updates. It reports false when
+// another worker got there first or the event has moved on.
+func (p *WebhookProcessor) claim(id uint, updates map[string]interface{}, condition string, args ...interface{}) (bool, error) {
+	values := map[string]interface{}{
+		"status":     models.WebhookStatusProcessing,
+		"updated_at": p.Clock.Now(),
+	}
+	for column, value := range updates {
+		values[column] = value
+	}
+
+	var claimed bool
+	err := database.PerformWrite(p.db, func(db *gorm.DB) error {
+		result := db.Model(&models.WebhookEvent{}).Where("id = ?", id).Where(condition, args...).Updates(values)
+		claimed = result.RowsAffected == 1
+		return result.Error
+	})
+	return claimed, err
+}
+
+// attempt runs an event this worker has claimed and records the outcome
+func (p *WebhookProcessor) attempt(id uint) error {
+	var event models.WebhookEvent
+	if err := p.db.First(&event, id).Error; err != nil {
+		return err
+	}
+
+	processErr := p.process(&event)
+
+	now := p.Clock.Now()
+	event.Attempts++
+	if processErr == nil {
+		event.Status = models.WebhookStatusProcessed
+		event.LastError = ""
+		event.NextAttemptAt = nil
+		event.ProcessedAt = &now
+	} else if event.Attempts >= p.MaxAttempts {
+		event.Status = models.WebhookStatusDead
+		event.LastError = processErr.Error()
+		event.NextAttemptAt = nil
+	} else {
+		next := now.Add(p.backoff(event.Attempts))
+		event.Status = models.WebhookStatusFailed
+		event.LastError = processErr.Error()
+		event.NextAttemptAt = &next
+	}
+
+	if err := database.PerformWrite(p.db, func(db *gorm.DB) error {
+		return db.Save(&event).Error
+	}); err != nil {
+		return fmt.Errorf("failed to record webhook attempt: %w", err)
+	}
+
+	return processErr
+}
+
+// ErrNotRedrivable is returned by Redrive for an event that is pending or
+// already processed
+var ErrNotRedrivable = errors.New("only failed or dead webhook events can be redriven")
+
+// ErrWebhookInProgress is returned by Replay for an event that is being
+// processed right now
+var ErrWebhookInProgress = errors.New("webhook event is already being processed")
+
+// Redrive resets a failed or dead event and processes it immediately
+func (p *WebhookProcessor) Redrive(id uint) error {
+	claimed, err := p.claim(id, resetAttempts(), "status IN ?", []string{models.WebhookStatusFailed, models.WebhookStatusDead})
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		if err := p.db.First(&models.WebhookEvent{}, id).Error; err != nil {
+			return err
+		}
+		return ErrNotRedrivable
+	}
+	return p.attempt(id)
+}
+
+// Replay resets an event whatever its status, even processed, and processes
+// it again. Only an event that is mid-attempt is refused.
+func (p *WebhookProcessor) Replay(id uint) error {
+	claimed, err := p.claim(id, resetAttempts(), "status <> ?", models.WebhookStatusProcessing)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		if err := p.db.First(&models.WebhookEvent{}, id).Error; err != nil {
+			return err
+		}
+		return ErrWebhookInProgress
+	}
+	return p.attempt(id)
+}
+
+// resetAttempts clears an event's attempts so it runs as if freshly received
+func resetAttempts() map[string]interface{} {
+	return map[string]interface{}{
+		"attempts":        0,
+		"next_attempt_at": nil,
+	}
+}
+
+// RetryDue processes every failed event whose backoff has elapsed. Pending
+// events whose Enqueue never ran, and processing events whose attempt was cut
+// short by a crash, are taken over once they are older than StaleAfter.
+func (p *WebhookProcessor) RetryDue() {
+	now := p.Clock.Now()
+	stale := now.Add(-p.StaleAfter)
+
+	var events []models.WebhookEvent
+	p.db.Where("status = ? AND next_attempt_at <= ?", models.WebhookStatusFailed, now).
+		Or("status IN ? AND updated_at <= ?", []string{models.WebhookStatusPending, models.WebhookStatusProcessing}, stale).
+		Order("id ASC").
+		Find(&events)
+
+	for _, event := range events {
+		// Re-check the same condition in the claim, so an event another
+		// worker picked up since the query is skipped
+		var claimed bool
+		var err error
+		if event.Status == models.WebhookStatusFailed {
+			claimed, err = p.claim(event.ID, nil, "status = ? AND next_attempt_at <= ?", event.Status, now)
+		} else {
+			claimed, err = p.claim(event.ID, nil, "status = ? AND updated_at <= ?", event.Status, stale)
+		}
+		if err == nil && claimed {
+			err = p.attempt(event.ID)
+		}
+		if err != nil {
+			log.Printf("Webhook event %d retry %d failed: %v", event.ID, event.Attempts+1, err)
+		}
+	}
+}
+
+// Run retries due events every interval until ctx is cancelled
+func (p *WebhookProcessor) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.RetryDue()
+		}
+	}
+}
+
+func (p *WebhookProcessor) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << (attempt - 1)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
@@ -0,0 +1,219 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"matcha/internal/clock"
+	"matcha/internal/models"
+	"matcha/internal/testutils"
+)
+
+func TestWebhookProcessor(t *testing.T) {
+	t.Run("Failing Event Ends In Dead Letter State", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+
+		calls := 0
+		processor := NewWebhookProcessor(db, func(event *models.WebhookEvent) error {
+			calls++
+			return errors.New("email provider unavailable")
+		})
+		processor.MaxAttempts = 3
+
+		event := models.WebhookEvent{Provider: "stripe", Payload: "{}", Status: models.WebhookStatusPending}
+		require.NoError(t, db.Create(&event).Error)
+
+		for i := 0; i < 5; i++ {
+			_ = processor.Process(event.ID)
+		}
+
+		require.NoError(t, db.First(&event, event.ID).Error)
+		assert.Equal(t, models.WebhookStatusDead, event.Status)
+		assert.Equal(t, 3, event.Attempts)
+		assert.Equal(t, 3, calls, "dead events must not be processed again")
+		assert.Equal(t, "email provider unavailable", event.LastError)
+		assert.Nil(t, event.NextAttemptAt)
+	})
+
+	t.Run("Failed Event Is Scheduled For Retry", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+
+		processor := NewWebhookProcessor(db, func(event *models.WebhookEvent) error {
+			return errors.New("temporary failure")
+		})
+
+		event := models.WebhookEvent{Provider: "paypal", Payload: "{}", Status: models.WebhookStatusPending}
+		require.NoError(t, db.Create(&event).Error)
+
+		assert.Error(t, processor.Process(event.ID))
+
+		require.NoError(t, db.First(&event, event.ID).Error)
+		assert.Equal(t, models.WebhookStatusFailed, event.Status)
+		assert.NotNil(t, event.NextAttemptAt)
+	})
+
+	t.Run("Retry Waits For Backoff", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+
+		calls := 0
+		processor := NewWebhookProcessor(db, func(event *models.WebhookEvent) error {
+			calls++
+			if calls == 1 {
+				return errors.New("temporary failure")
+			}
+			return nil
+		})
+		fake := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+		processor.Clock = fake
+
+		event := models.WebhookEvent{Provider: "stripe", Payload: "{}", Status: models.WebhookStatusPending}
+		require.NoError(t, db.Create(&event).Error)
+		assert.Error(t, processor.Process(event.ID))
+
+		fake.Advance(processor.BaseDelay - time.Second)
+		processor.RetryDue()
+		assert.Equal(t, 1, calls, "an event is not retried before its backoff elapses")
+
+		fake.Advance(time.Second)
+		processor.RetryDue()
+		assert.Equal(t, 2, calls)
+
+		require.NoError(t, db.First(&event, event.ID).Error)
+		assert.Equal(t, models.WebhookStatusProcessed, event.Status)
+	})
+
+	t.Run("Manual Redrive Of Dead Event Succeeds", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+
+		healthy := false
+		processor := NewWebhookProcessor(db, func(event *models.WebhookEvent) error {
+			if !healthy {
+				return errors.New("email provider unavailable")
+			}
+			return nil
+		})
+		processor.MaxAttempts = 1
+
+		event := models.WebhookEvent{Provider: "gumroad", Payload: "{}", Status: models.WebhookStatusPending}
+		require.NoError(t, db.Create(&event).Error)
+
+		_ = processor.Process(event.ID)
+		require.NoError(t, db.First(&event, event.ID).Error)
+		require.Equal(t, models.WebhookStatusDead, event.Status)
+
+		healthy = true
+		require.NoError(t, processor.Redrive(event.ID))
+
+		require.NoError(t, db.First(&event, event.ID).Error)
+		assert.Equal(t, models.WebhookStatusProcessed, event.Status)
+		assert.Equal(t, 1, event.Attempts)
+		assert.Empty(t, event.LastError)
+		assert.NotNil(t, event.ProcessedAt)
+	})
+
+	t.Run("Redrive Refuses Pending And Processed Events", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+
+		calls := 0
+		processor := NewWebhookProcessor(db, func(event *models.WebhookEvent) error {
+			calls++
+			return nil
+		})
+
+		for _, status := range []string{models.WebhookStatusPending, models.WebhookStatusProcessed} {
+			event := models.WebhookEvent{Provider: "gumroad", Payload: "{}", Status: status, Attempts: 1}
+			require.NoError(t, db.Create(&event).Error)
+
+			assert.ErrorIs(t, processor.Redrive(event.ID), ErrNotRedrivable, status)
+
+			require.NoError(t, db.First(&event, event.ID).Error)
+			assert.Equal(t, status, event.Status)
+			assert.Equal(t, 1, event.Attempts)
+		}
+		assert.Zero(t, calls)
+	})
+
+	t.Run("Stale Pending Event Is Picked Up By RetryDue", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+
+		calls := 0
+		processor := NewWebhookProcessor(db, func(event *models.WebhookEvent) error {
+			calls++
+			return nil
+		})
+		fake := clock.NewFake(time.Now())
+		processor.Clock = fake
+
+		// Stored, but the process stopped before its Enqueue ran
+		event := models.WebhookEvent{Provider: "stripe", Payload: "{}", Status: models.WebhookStatusPending}
+		require.NoError(t, db.Create(&event).Error)
+
+		processor.RetryDue()
+		assert.Zero(t, calls, "a fresh pending event is left to its Enqueue")
+
+		fake.Advance(processor.StaleAfter + time.Second)
+		processor.RetryDue()
+		assert.Equal(t, 1, calls)
+
+		require.NoError(t, db.First(&event, event.ID).Error)
+		assert.Equal(t, models.WebhookStatusProcessed, event.Status)
+	})
+
+	t.Run("Claimed Event Is Not Processed Twice", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+
+		calls := 0
+		processor := NewWebhookProcessor(db, func(event *models.WebhookEvent) error {
+			calls++
+			return nil
+		})
+
+		event := models.WebhookEvent{Provider: "stripe", Payload: "{}", Status: models.WebhookStatusProcessing}
+		require.NoError(t, db.Create(&event).Error)
+
+		assert.NoError(t, processor.Process(event.ID))
+		assert.ErrorIs(t, processor.Redrive(event.ID), ErrNotRedrivable)
+		assert.ErrorIs(t, processor.Replay(event.ID), ErrWebhookInProgress)
+		processor.RetryDue()
+		assert.Zero(t, calls)
+
+		require.NoError(t, db.First(&event, event.ID).Error)
+		assert.Equal(t, models.WebhookStatusProcessing, event.Status)
+	})
+
+	t.Run("Wait Blocks Until Enqueued Events Finish", func(t *testing.T) {
+		db := testutils.SetupTestDB(t)
+
+		release := make(chan struct{})
+		processor := NewWebhookProcessor(db, func(event *models.WebhookEvent) error {
+			<-release
+			return nil
+		})
+
+		event := models.WebhookEvent{Provider: "stripe", Payload: "{}", Status: models.WebhookStatusPending}
+		require.NoError(t, db.Create(&event).Error)
+		processor.Enqueue(&event)
+
+		waited := make(chan struct{})
+		go func() {
+			processor.Wait()
+			close(waited)
+		}()
+
+		select {
+		case <-waited:
+			t.Fatal("Wait returned while an event was still processing")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(release)
+		<-waited
+
+		require.NoError(t, db.First(&event, event.ID).Error)
+		assert.Equal(t, models.WebhookStatusProcessed, event.Status)
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	htmlEngine "github.com/gofiber/template/html/v2"
@@ -11,14 +12,18 @@ import (
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 
+	"matcha/internal/config"
 	"matcha/internal/models"
+	"matcha/internal/views"
 )
 
 func SetupTestDB(t *testing.T) *gorm.DB {
+	models.SetEncryptionKey("test-secret-key")
+
 	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
 	require.NoError(t, err)
 
-	err = db.AutoMigrate(&models.Product{}, &models.Customer{}, &models.LicenseKey{}, &models.AdminUser{}, &models.EmailSettings{})
+	err = db.AutoMigrate(&models.Product{}, &models.Customer{}, &models.LicenseKey{}, &models.AdminUser{}, &models.EmailSettings{}, &models.WebhookEvent{}, &models.EmailTemplate{}, &models.VerificationStat{}, &models.SeatCheckout{}, &models.WebhookSettings{}, &models.ProductMapping{}, &models.EmailLog{}, &models.LoginThrottle{}, &models.LicenseKeyNote{}, &models.LicenseKeyRotation{})
 	require.NoError(t, err)
 
 	// Add cleanup function to ensure database is cleaned up after test
@@ -31,23 +36,17 @@ func SetupTestDB(t *testing.T) *gorm.DB {
 
 // SetupTestAppWithDB creates a minimal Fiber app with database context for handler testing
 func SetupTestAppWithDB(t *testing.T, db *gorm.DB) *fiber.App {
+	return SetupTestAppInZone(t, db, time.UTC)
+}
+
+// SetupTestAppInZone is SetupTestAppWithDB with templates rendering times in loc
+func SetupTestAppInZone(t *testing.T, db *gorm.DB, loc *time.Location) *fiber.App {
 	// Set up template engine for tests - use absolute path from project root
 	engine := htmlEngine.New("../../templates", ".gohtml")
 	engine.Reload(true)
 
 	// Add template functions
-	engine.AddFunc("dict", func(values ...interface{}) map[string]interface{} {
-		dict := make(map[string]interface{})
-		for i := 0; i < len(values); i += 2 {
-			if i+1 < len(values) {
-				key, ok := values[i].(string)
-				if ok {
-					dict[key] = values[i+1]
-				}
-			}
-		}
-		return dict
-	})
+	engine.AddFuncMap(views.Funcs(loc, config.DefaultAdminPath, nil))
 
 	app := fiber.New(fiber.Config{
 		Views: engine, // Use template engine for tests
@@ -84,6 +83,14 @@ func CleanupTestDB(db *gorm.DB) {
 	db.Unscoped().Where("1 = 1").Delete(&models.Product{})
 	db.Unscoped().Where("1 = 1").Delete(&models.AdminUser{})
 	db.Unscoped().Where("1 = 1").Delete(&models.EmailSettings{})
+	db.Unscoped().Where("1 = 1").Delete(&models.WebhookEvent{})
+	db.Unscoped().Where("1 = 1").Delete(&models.EmailTemplate{})
+	db.Unscoped().Where("1 = 1").Delete(&models.VerificationStat{})
+	db.Unscoped().Where("1 = 1").Delete(&models.SeatCheckout{})
+	db.Unscoped().Where("1 = 1").Delete(&models.WebhookSettings{})
+	db.Unscoped().Where("1 = 1").Delete(&models.ProductMapping{})
+	db.Unscoped().Where("1 = 1").Delete(&models.EmailLog{})
+	db.Unscoped().Where("1 = 1").Delete(&models.LoginThrottle{}, &models.LicenseKeyNote{}, &models.LicenseKeyRotation{})
 }
 
 // SetupTestApp creates a basic Fiber app for unit testing handlers
@@ -93,18 +100,7 @@ func SetupTestApp() *fiber.App {
 	engine.Reload(true)
 
 	// Add template functions
-	engine.AddFunc("dict", func(values ...interface{}) map[string]interface{} {
-		dict := make(map[string]interface{})
-		for i := 0; i < len(values); i += 2 {
-			if i+1 < len(values) {
-				key, ok := values[i].(string)
-				if ok {
-					dict[key] = values[i+1]
-				}
-			}
-		}
-		return dict
-	})
+	engine.AddFuncMap(views.Funcs(time.UTC, config.DefaultAdminPath, nil))
 
 	app := fiber.New(fiber.Config{
 		Views: engine, // Use template engine for tests
@@ -121,18 +117,7 @@ func SetupIntegrationApp(t *testing.T) (*fiber.App, *gorm.DB) {
 	engine.Reload(true)
 
 	// Add template functions
-	engine.AddFunc("dict", func(values ...interface{}) map[string]interface{} {
-		dict := make(map[string]interface{})
-		for i := 0; i < len(values); i += 2 {
-			if i+1 < len(values) {
-				key, ok := values[i].(string)
-				if ok {
-					dict[key] = values[i+1]
-				}
-			}
-		}
-		return dict
-	})
+	engine.AddFuncMap(views.Funcs(time.UTC, config.DefaultAdminPath, nil))
 
 	app := fiber.New(fiber.Config{
 		Views: engine, // Use template engine for tests
@@ -196,8 +181,9 @@ func TestRequestJSON(t *testing.T, app *fiber.App, method, url string, body stri
 	}
 	require.NoError(t, err)
 
-	// Set content type for JSON requests
+	// Send and accept JSON, as API clients of the admin handlers do
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
 
 	resp, err := app.Test(req)
 	require.NoError(t, err)
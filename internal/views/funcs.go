@@ -0,0 +1,51 @@
+package views
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Funcs returns the helpers registered on every template engine. Times are
+// rendered in loc so the admin UI shows a single, consistent timezone,
+// adminPath gives links the prefix the admin panel is mounted under, and
+// enabled reports which optional features have pages to link to; nil means
+// all of them.
+func Funcs(loc *time.Location, adminPath string, enabled func(feature string) bool) map[string]interface{} {
+	return map[string]interface{}{
+		"dict": func(values ...interface{}) map[string]interface{} {
+			dict := make(map[string]interface{})
+			for i := 0; i < len(values); i += 2 {
+				if i+1 < len(values) {
+					key, ok := values[i].(string)
+					if ok {
+						dict[key] = values[i+1]
+					}
+				}
+			}
+			return dict
+		},
+		"formatTime": func(t time.Time, layout string) string {
+			return t.In(loc).Format(layout)
+		},
+		"adminPath": func() string {
+			return adminPath
+		},
+		"featureEnabled": func(feature string) bool {
+			return enabled == nil || enabled(feature)
+		},
+		// fieldError looks up a field's message in a form's validation
+		// errors, a map of field to message. They are missing when the form
+		// is first shown, so anything that isn't such a map has no errors.
+		"fieldError": func(errors interface{}, field string) string {
+			v := reflect.ValueOf(errors)
+			if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+				return ""
+			}
+			if message := v.MapIndex(reflect.ValueOf(field).Convert(v.Type().Key())); message.IsValid() {
+				return fmt.Sprint(message.Interface())
+			}
+			return ""
+		},
+	}
+}
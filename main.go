@@ -3,10 +3,16 @@ package main
 import (
 	"embed"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"matcha/internal/app"
+	"matcha/internal/cli"
 	"matcha/internal/config"
 	"matcha/internal/database"
+	"matcha/internal/migrations"
 	"matcha/internal/models"
 
 	"github.com/joho/godotenv"
@@ -28,28 +34,71 @@ func main() {
 
 	// Initialize configuration
 	cfg := config.New()
-	log.Printf("Configuration loaded - Environment: %s, SecretKey: %s, Debug: %v", cfg.Environment, cfg.SecretKey, cfg.Debug)
+	log.Printf("Configuration loaded - %s", cfg.Redacted())
+	if err := cfg.Validate(); err != nil {
+		log.Fatal("Invalid configuration:", err)
+	}
+	// Checked here rather than in Validate, as the roles live in models
+	if !models.IsAdminRole(cfg.OIDCDefaultRole) {
+		log.Fatalf("Invalid configuration: OIDC_DEFAULT_ROLE must be one of %s, got %q", strings.Join(models.AdminRoles, ", "), cfg.OIDCDefaultRole)
+	}
+
+	// Secrets stored in the database are encrypted with a key derived from SecretKey
+	models.SetEncryptionKey(cfg.SecretKey)
 
 	// Initialize database
-	db, err := database.New(cfg.DatabaseURL)
+	db, err := database.New(cfg.DatabaseURL, database.Pragmas{
+		JournalMode: cfg.SQLiteJournalMode,
+		Synchronous: cfg.SQLiteSynchronous,
+		CacheSize:   cfg.SQLiteCacheSize,
+	}, database.Pool{
+		MaxOpenConns:    cfg.DBMaxOpenConns,
+		MaxIdleConns:    cfg.DBMaxIdleConns,
+		ConnMaxLifetime: cfg.DBConnMaxLifetime,
+	})
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
 
-	// Auto-migrate database
-	if err := db.AutoMigrate(&models.Product{}, &models.Customer{}, &models.LicenseKey{}, &models.AdminUser{}, &models.EmailSettings{}); err != nil {
+	// Bring the schema up to date: auto-migrate, then pending versioned migrations
+	if err := migrations.Run(db, migrations.All); err != nil {
 		log.Fatal("Failed to migrate database:", err)
 	}
 
+	// Maintenance commands, e.g. `matcha admin reset-password`, run instead of the server
+	if len(os.Args) > 1 {
+		if err := cli.Run(db, os.Args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Create default admin user
-	if err := models.CreateDefaultAdmin(db, "admin", "admin123"); err != nil {
+	if generated, err := models.CreateDefaultAdmin(db, cfg.AdminUsername, cfg.AdminPassword); err != nil {
 		log.Println("Warning: Could not create default admin user:", err)
+	} else if generated != "" {
+		log.Printf("Created admin user %q with generated password: %s (you will be asked to change it on first login)", cfg.AdminUsername, generated)
 	}
 
 	// Create and configure the Fiber app
 	fiberApp := app.NewApp(cfg, db, templateFS, staticFS)
 
 	// Start server
-	log.Printf("Server starting on port %s in %s environment", cfg.Port, cfg.Environment)
-	log.Fatal(fiberApp.Listen(":" + cfg.Port))
+	go func() {
+		log.Printf("Server starting on port %s in %s environment", cfg.Port, cfg.Environment)
+		if err := fiberApp.Listen(":" + cfg.Port); err != nil {
+			log.Fatal("Server stopped:", err)
+		}
+	}()
+
+	// Wait for a termination signal, then drain in-flight requests before exiting
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+
+	log.Printf("Shutting down, waiting up to %s for in-flight requests", cfg.ShutdownTimeout)
+	if err := app.Shutdown(fiberApp, db, cfg.ShutdownTimeout); err != nil {
+		log.Println("Warning: Unclean shutdown:", err)
+	}
+	log.Println("Server stopped")
 }